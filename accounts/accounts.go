@@ -39,7 +39,8 @@ const (
 	MimetypeDataWithValidator = "data/validator"
 	MimetypeTypedData         = "data/typed"
 	MimetypeClique            = "application/x-clique-header"
-	MimetypeDpos            = "application/x-dpos-header"
+	MimetypeDpos              = "application/x-dpos-header"
+	MimetypeDposPrecommit     = "application/x-dpos-vote"
 	MimetypeTextPlain         = "text/plain"
 )
 
@@ -172,7 +172,7 @@ func (api *ExternalSigner) SignData(account accounts.Account, mimeType string, d
 	}
 	
 	// If V is on 27/28-form, convert to 0/1 for dpos
-	if mimeType == accounts.MimetypeDpos && (res[64] == 27 || res[64] == 28) {
+	if (mimeType == accounts.MimetypeDpos || mimeType == accounts.MimetypeDposPrecommit) && (res[64] == 27 || res[64] == 28) {
 		res[64] -= 27 // Transform V from 27/28 to 0/1 for dpos use
 	}
 	return res, nil
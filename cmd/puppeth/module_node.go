@@ -30,9 +30,13 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 )
 
+// defaultNodeImage is the docker image nodes are built from unless the network
+// needs a custom geth build, such as a dpos enabled one.
+const defaultNodeImage = "ethereum/client-go:latest"
+
 // nodeDockerfile is the Dockerfile required to run an Ethereum node.
 var nodeDockerfile = `
-FROM ethereum/client-go:latest
+FROM {{.Image}}
 
 ADD genesis.json /genesis.json
 {{if .Unlock}}
@@ -71,6 +75,7 @@ services:
       - GAS_TARGET={{.GasTarget}}
       - GAS_LIMIT={{.GasLimit}}
       - GAS_PRICE={{.GasPrice}}
+      - GETH_IMAGE={{.Image}}
     logging:
       driver: "json-file"
       options:
@@ -96,8 +101,13 @@ func deployNode(client *sshClient, network string, bootnodes []string, config *n
 	if config.peersLight > 0 {
 		lightFlag = fmt.Sprintf("--lightpeers=%d --lightserv=50", config.peersLight)
 	}
+	image := config.image
+	if image == "" {
+		image = defaultNodeImage
+	}
 	dockerfile := new(bytes.Buffer)
 	template.Must(template.New("").Parse(nodeDockerfile)).Execute(dockerfile, map[string]interface{}{
+		"Image":     image,
 		"NetworkID": config.network,
 		"Port":      config.port,
 		"IP":        client.address,
@@ -128,6 +138,7 @@ func deployNode(client *sshClient, network string, bootnodes []string, config *n
 		"GasTarget":  config.gasTarget,
 		"GasLimit":   config.gasLimit,
 		"GasPrice":   config.gasPrice,
+		"Image":      image,
 	})
 	files[filepath.Join(workdir, "docker-compose.yaml")] = composefile.Bytes()
 
@@ -152,6 +163,7 @@ func deployNode(client *sshClient, network string, bootnodes []string, config *n
 // nodeInfos is returned from a boot or seal node status check to allow reporting
 // various configuration parameters.
 type nodeInfos struct {
+	image      string
 	genesis    []byte
 	network    int64
 	datadir    string
@@ -179,6 +191,9 @@ func (info *nodeInfos) Report() map[string]string {
 		"Peer count (light nodes)": strconv.Itoa(info.peersLight),
 		"Ethstats username":        info.ethstats,
 	}
+	if info.image != "" {
+		report["Docker image"] = info.image
+	}
 	if info.gasTarget > 0 {
 		// Miner or signer node
 		report["Gas price (minimum accepted)"] = fmt.Sprintf("%0.3f GWei", info.gasPrice)
@@ -191,7 +206,7 @@ func (info *nodeInfos) Report() map[string]string {
 			report["Miner account"] = info.etherbase
 		}
 		if info.keyJSON != "" {
-			// Clique proof-of-authority signer
+			// Clique proof-of-authority or dpos signer
 			var key struct {
 				Address string `json:"address"`
 			}
@@ -253,6 +268,7 @@ func checkNode(client *sshClient, network string, boot bool) (*nodeInfos, error)
 	}
 	// Assemble and return the useful infos
 	stats := &nodeInfos{
+		image:      infos.envvars["GETH_IMAGE"],
 		genesis:    genesis,
 		datadir:    infos.volumes["/root/.ethereum"],
 		ethashdir:  infos.volumes["/root/.ethash"],
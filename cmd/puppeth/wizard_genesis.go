@@ -30,6 +30,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
@@ -59,6 +60,7 @@ func (w *wizard) makeGenesis() {
 	fmt.Println("Which consensus engine to use? (default = clique)")
 	fmt.Println(" 1. Ethash - proof-of-work")
 	fmt.Println(" 2. Clique - proof-of-authority")
+	fmt.Println(" 3. Dpos   - delegated proof-of-stake")
 
 	choice := w.read()
 	switch {
@@ -105,6 +107,84 @@ func (w *wizard) makeGenesis() {
 			copy(genesis.ExtraData[32+i*common.AddressLength:], signer[:])
 		}
 
+	case choice == "3":
+		// In the case of dpos, configure the consensus parameters
+		genesis.Difficulty = big.NewInt(1)
+		genesis.Config.Dpos = &params.DposConfig{
+			SlotInterval:  10,
+			EpochInterval: 30000,
+			RandaoBlock:   big.NewInt(0),
+			ScheduleBlock: big.NewInt(0),
+		}
+		fmt.Println()
+		fmt.Println("How many seconds should blocks take? (default = 10)")
+		genesis.Config.Dpos.SlotInterval = uint64(w.readDefaultInt(10))
+
+		fmt.Println()
+		fmt.Println("How many blocks should an epoch last? (default = 30000)")
+		genesis.Config.Dpos.EpochInterval = uint64(w.readDefaultInt(30000))
+
+		// We also need the initial list of signers
+		fmt.Println()
+		fmt.Println("Which accounts are the initial signers? (mandatory at least one)")
+
+		var signers []common.Address
+		for {
+			if address := w.readAddress(); address != nil {
+				signers = append(signers, *address)
+				continue
+			}
+			if len(signers) > 0 {
+				break
+			}
+		}
+		// Each signer shares its delegator rewards among its initial delegators
+		delegators := make(map[common.Address][]dpos.ElectedDelegator)
+		delegating := make(map[common.Address]bool)
+
+		for _, signer := range signers {
+			fmt.Println()
+			fmt.Printf("Which accounts delegate to %s? (optional)\n", signer.Hex())
+
+			var accounts []common.Address
+			for {
+				address := w.readAddress()
+				if address == nil {
+					break
+				}
+				if delegating[*address] {
+					log.Error("Account already delegates to another signer", "address", address.Hex())
+					continue
+				}
+				delegating[*address] = true
+				accounts = append(accounts, *address)
+			}
+			for len(accounts) > 0 {
+				var (
+					portions []dpos.ElectedDelegator
+					total    uint64
+				)
+				for _, account := range accounts {
+					fmt.Println()
+					fmt.Printf("What percentage of the delegator rewards should %s get? (default = %0.3f)\n", account.Hex(), 100/float64(len(accounts)))
+					portion := uint64(w.readDefaultFloat(100/float64(len(accounts))) / 100 * float64(dpos.PortionBase))
+
+					portions = append(portions, dpos.ElectedDelegator{Delegator: account, Portion: uint32(portion)})
+					total += portion
+				}
+				if total <= dpos.PortionBase {
+					delegators[signer] = portions
+					break
+				}
+				log.Error("Delegator portions exceed 100%, please try again")
+			}
+		}
+		extra, err := dpos.EncodeGenesisExtra(signers, delegators)
+		if err != nil {
+			log.Crit("Failed to encode dpos genesis extra-data", "err", err)
+		}
+		genesis.ExtraData = extra
+
 	default:
 		log.Crit("Invalid consensus engine choice", "choice", choice)
 	}
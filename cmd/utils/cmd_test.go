@@ -0,0 +1,135 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/params"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Tests that a DPOS chain export can be imported into a datadir opened through
+// MakeChain, rebuilding the epoch snapshots along the way.
+func TestImportDposChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geth-import-dpos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Seal a short chain spanning a few epochs and export it
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	extra, err := dpos.EncodeGenesisExtra([]common.Address{signer}, nil)
+	if err != nil {
+		t.Fatalf("failed to encode genesis extra: %v", err)
+	}
+	config := *params.AllDposProtocolChanges
+	config.Dpos = &params.DposConfig{SlotInterval: 1, EpochInterval: 3, MaxSigners: 2}
+	genesis := &core.Genesis{Config: &config, ExtraData: extra, GasLimit: params.GenesisGasLimit, Difficulty: big.NewInt(1)}
+
+	db := rawdb.NewMemoryDatabase()
+	genesis.MustCommit(db)
+	engine := dpos.New(config.Dpos, db)
+	engine.Authorize(signer, nil)
+
+	source, err := core.NewBlockChain(db, nil, &config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create source chain: %v", err)
+	}
+	defer source.Stop()
+
+	for i := 0; i < 8; i++ {
+		parent := source.CurrentBlock()
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number(), common.Big1), GasLimit: parent.GasLimit()}
+		if err := engine.Prepare(source, header); err != nil {
+			t.Fatalf("failed to prepare block #%d: %v", header.Number, err)
+		}
+		header.Time = parent.Time() + config.Dpos.SlotInterval
+
+		statedb, _ := source.StateAt(parent.Root())
+		block, err := engine.FinalizeAndAssemble(source, header, statedb, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to assemble block #%d: %v", header.Number, err)
+		}
+		header = block.Header()
+		sig, _ := crypto.Sign(dpos.SealHash(header).Bytes(), key)
+		copy(header.Extra[1:], sig)
+
+		if _, err := source.InsertChain(types.Blocks{block.WithSeal(header)}); err != nil {
+			t.Fatalf("failed to insert block #%d: %v", header.Number, err)
+		}
+	}
+	file := filepath.Join(dir, "chain.rlp")
+	if err := ExportChain(source, file); err != nil {
+		t.Fatalf("failed to export chain: %v", err)
+	}
+
+	// Initialize a fresh datadir with the same genesis and import the export
+	stack, err := node.New(&node.Config{DataDir: filepath.Join(dir, "datadir"), Name: "geth"})
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	defer stack.Close()
+
+	chaindb, err := stack.OpenDatabaseWithFreezer("chaindata", 0, 0, "", "")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	genesis.MustCommit(chaindb)
+	chaindb.Close()
+
+	set := flag.NewFlagSet("test", 0)
+	GCModeFlag.Apply(set)
+	ctx := cli.NewContext(cli.NewApp(), set, nil)
+
+	chain, chaindb := MakeChain(ctx, stack, false)
+	defer chaindb.Close()
+	defer chain.Stop()
+
+	if _, ok := chain.Engine().(*dpos.Dpos); !ok {
+		t.Fatalf("engine mismatch: have %T, want *dpos.Dpos", chain.Engine())
+	}
+	if err := ImportChain(chain, file); err != nil {
+		t.Fatalf("failed to import chain: %v", err)
+	}
+	if have, want := chain.CurrentBlock().Hash(), source.CurrentBlock().Hash(); have != want {
+		t.Fatalf("head mismatch: have %x, want %x", have, want)
+	}
+	// The snapshot before every epoch block is persisted during the replay
+	for _, number := range []uint64{2, 5} {
+		hash := chain.GetHeaderByNumber(number).Hash()
+		if ok, _ := chaindb.Has(append([]byte("dpos-"), hash[:]...)); !ok {
+			t.Errorf("snapshot #%d missing", number)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rpc"
 )
@@ -89,9 +90,10 @@ type Engine interface {
 	// but does not assemble the block.
 	//
 	// Note: The block header and state database might be updated to reflect any
-	// consensus rules that happen at finalization (e.g. block rewards).
+	// consensus rules that happen at finalization (e.g. block rewards). An error
+	// means the modifications could not be completed and the block is invalid.
 	Finalize(chain ChainHeaderReader, header *types.Header, state *state.StateDB, txs []*types.Transaction,
-		uncles []*types.Header)
+		uncles []*types.Header) error
 
 	// FinalizeAndAssemble runs any post-transaction state modifications (e.g. block
 	// rewards) and assembles the final block.
@@ -129,3 +131,57 @@ type PoW interface {
 	// Hashrate returns the current mining hashrate of a PoW consensus engine.
 	Hashrate() float64
 }
+
+// Finality is a consensus engine which can tell when blocks become irreversible.
+type Finality interface {
+	Engine
+
+	// Finalized returns the last irreversible block of the chain ending at the
+	// given head, or nil if none is known.
+	Finalized(chain ChainHeaderReader, head *types.Header) *types.Header
+}
+
+// InstantSealer is a consensus engine which may only seal blocks when there are
+// transactions to include, e.g. a zero slot DPOS developer chain.
+type InstantSealer interface {
+	Engine
+
+	// InstantSealing returns whether the block after parent is only sealed once
+	// new transactions arrive.
+	InstantSealing(chain ChainHeaderReader, parent *types.Header) bool
+}
+
+// RandomnessBeacon is a consensus engine which provides on-chain randomness.
+// Like the PREVRANDAO of EIP-4399, it replaces the block difficulty in the EVM.
+type RandomnessBeacon interface {
+	Engine
+
+	// Randomness returns the randomness available to the transactions of the
+	// given header, settled by its ancestors, or nil if the header is before the
+	// fork replacing the difficulty. A header after the fork whose randomness
+	// is unavailable can not be processed.
+	Randomness(chain ChainHeaderReader, header *types.Header) (*common.Hash, error)
+}
+
+// SystemContractProvider is a consensus engine which serves native contracts at
+// engine-defined addresses, e.g. the DPOS registry.
+type SystemContractProvider interface {
+	Engine
+
+	// SystemContracts returns the native contracts to run while executing the
+	// transactions of the given header. The chain may be nil if the caller can
+	// not provide one.
+	SystemContracts(chain ChainHeaderReader, header *types.Header) map[common.Address]vm.SystemContract
+}
+
+// ReceiptEmitter is a consensus engine which emits logs of its own for a block
+// on top of the transaction logs, e.g. the result of an election. The logs are
+// carried by a system receipt following the transaction receipts, so they are
+// covered by the receipt root and the bloom of the block.
+type ReceiptEmitter interface {
+	Engine
+
+	// SystemReceipt returns the system receipt of a block given the receipts
+	// of its transactions, or nil if the engine emits no logs for the block.
+	SystemReceipt(header *types.Header, receipts types.Receipts) *types.Receipt
+}
@@ -2,9 +2,10 @@ package dpos
 
 import(
 	"github.com/ethereum/go-ethereum/common"
-	"encoding/binary"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
 	"errors"
-	"bytes"
+	"math/big"
 	_ "fmt"
 )
 
@@ -14,11 +15,36 @@ const (
 	becomeDelegator
 	quitCandidate
 	quitDelegator
+	stake
+	unstake
+	reportDoubleSign
+	unjail
+	voteProposal
+	reportDoublePrecommit
 )
 
+//导出给外部包(如dposclient)用的action id
+const (
+	ActionBecomeCandidate  = becomeCandidate
+	ActionBecomeDelegator  = becomeDelegator
+	ActionQuitCandidate    = quitCandidate
+	ActionQuitDelegator    = quitDelegator
+	ActionStake            = stake
+	ActionUnstake          = unstake
+	ActionReportDoubleSign = reportDoubleSign
+	ActionUnjail           = unjail
+	ActionVoteProposal     = voteProposal
+	ActionReportDoublePrecommit = reportDoublePrecommit
+)
+
+// DefaultSystemAddress is the system address used when the chain config
+// doesn't set one.
+var DefaultSystemAddress = defaultSystemAddress
+
 //dpos常量
 var (
-	contractAddress = common.HexToAddress("0x0000000000000000000000000000000000000001")
+	//默认的系统地址,同时也是抵押金的托管账户(escrow), 不能和预编译合约的地址重叠
+	defaultSystemAddress = common.HexToAddress("0x0000000000000000000000000000000000001000")
 )
 
 type Action struct {
@@ -49,12 +75,7 @@ var Actions map[uint8]*Action = map[uint8]*Action{
 		},
 		
 		ToBytesFn : func(values []interface{}) ([]byte) {
-			value := values[0].(uint8)
-			
-			buf := new(bytes.Buffer)
-			binary.Write(buf, binary.BigEndian, value)
-	
-			return buf.Bytes()
+			return []byte{}
 		},
 		
 		FromBytesFn: func(bytes []byte) ([]interface{}) {
@@ -70,9 +91,11 @@ var Actions map[uint8]*Action = map[uint8]*Action{
 		
 		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
 			
-			address := values[0].([]byte)
+			if len(values) != 1 {
+				return errors.New("Invalid action#" + string(id))
+			}
 			
-			if len(address) != common.AddressLength {
+			if _, ok := values[0].(common.Address); !ok {
 				return errors.New("Invalid action#" + string(id))
 			}
 			
@@ -89,12 +112,7 @@ var Actions map[uint8]*Action = map[uint8]*Action{
 		},
 		
 		ToBytesFn : func(values []interface{}) ([]byte) {
-			value := values[0].(uint8)
-			
-			buf := new(bytes.Buffer)
-			binary.Write(buf, binary.BigEndian, value)
-	
-			return buf.Bytes()
+			return values[0].(common.Address).Bytes()
 		},
 		
 		FromBytesFn: func(bytes []byte) ([]interface{}) {
@@ -120,12 +138,7 @@ var Actions map[uint8]*Action = map[uint8]*Action{
 		},
 		
 		ToBytesFn : func(values []interface{}) ([]byte) {
-			value := values[0].(uint8)
-			
-			buf := new(bytes.Buffer)
-			binary.Write(buf, binary.BigEndian, value)
-	
-			return buf.Bytes()
+			return []byte{}
 		},
 		
 		FromBytesFn: func(bytes []byte) ([]interface{}) {
@@ -135,9 +148,38 @@ var Actions map[uint8]*Action = map[uint8]*Action{
 	},
 	
 	quitDelegator: &Action{
-		Id          : quitCandidate,
+		Id          : quitDelegator,
 		Values      : make([]interface{},0),
-		Description : "To quit as candidate",
+		Description : "To quit as delegator",
+		
+		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
+			return nil
+		},
+		
+		ValidateBytesFn: func(_bytes []byte) (error) {
+			if len(_bytes) != 1 {
+				return errors.New("Invalid action#" + string(_bytes[0]))
+			}
+			return nil
+		},
+		
+		ToBytesFn : func(values []interface{}) ([]byte) {
+			return []byte{}
+		},
+		
+		FromBytesFn: func(bytes []byte) ([]interface{}) {
+			return []interface{}{}
+		},
+
+	},
+	
+	/*
+	抵押金额就是tx.value, 资金转入托管账户(系统地址)
+	*/
+	stake: &Action{
+		Id          : stake,
+		Values      : make([]interface{},0),
+		Description : "Bond tx value as stake",
 		
 		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
 			return nil
@@ -151,12 +193,130 @@ var Actions map[uint8]*Action = map[uint8]*Action{
 		},
 		
 		ToBytesFn : func(values []interface{}) ([]byte) {
-			value := values[0].(uint8)
+			return []byte{}
+		},
+		
+		FromBytesFn: func(bytes []byte) ([]interface{}) {
+			return []interface{}{}
+		},
+
+	},
+	
+	/*
+	解押金额以32 bytes记录在action里，解押的资金将在解押等待期过后的epoch区块退回
+	*/
+	unstake: &Action{
+		Id          : unstake,
+		Values      : make([]interface{},0),
+		Description : "Unbond stake, released after unbonding period",
+		
+		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
+			
+			if len(values) != 1 {
+				return errors.New("Invalid action#" + string(id))
+			}
+			
+			amount, ok := values[0].(*big.Int)
+			
+			if !ok || amount.Sign() <= 0 || amount.BitLen() > 256 {
+				return errors.New("Invalid action#" + string(id))
+			}
+			
+			return nil
+		},
+		
+		ValidateBytesFn: func(_bytes []byte) (error) {
+			
+			if len(_bytes) != common.HashLength + 1 {
+				return errors.New("Invalid action#" + string(_bytes[0]))
+			}
+			
+			if new(big.Int).SetBytes(_bytes[1:]).Sign() <= 0 {
+				return errors.New("Invalid action#" + string(_bytes[0]))
+			}
 			
-			buf := new(bytes.Buffer)
-			binary.Write(buf, binary.BigEndian, value)
+			return nil
+		},
+		
+		ToBytesFn : func(values []interface{}) ([]byte) {
+			return common.LeftPadBytes(values[0].(*big.Int).Bytes(), common.HashLength)
+		},
+		
+		FromBytesFn: func(bytes []byte) ([]interface{}) {
+			return []interface{}{new(big.Int).SetBytes(bytes[1:])}
+		},
+
+	},
 	
-			return buf.Bytes()
+	/*
+	举报双签, 证据是同一高度的两个不同块头，以rlp([header1, header2])记录在action里
+	*/
+	reportDoubleSign: &Action{
+		Id          : reportDoubleSign,
+		Values      : make([]interface{},0),
+		Description : "Submit two conflicting headers signed at the same height",
+		
+		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
+			
+			if len(values) != 2 {
+				return errors.New("Invalid action#" + string(id))
+			}
+			
+			for _, value := range values {
+				if header, ok := value.(*types.Header); !ok || header == nil || header.Number == nil {
+					return errors.New("Invalid action#" + string(id))
+				}
+			}
+			
+			return nil
+		},
+		
+		ValidateBytesFn: func(_bytes []byte) (error) {
+			
+			var headers []*types.Header
+			if err := rlp.DecodeBytes(_bytes[1:], &headers); err != nil || len(headers) != 2 {
+				return errors.New("Invalid action#" + string(_bytes[0]))
+			}
+			
+			return nil
+		},
+		
+		ToBytesFn : func(values []interface{}) ([]byte) {
+			encoded, _ := rlp.EncodeToBytes([]*types.Header{values[0].(*types.Header), values[1].(*types.Header)})
+			
+			return encoded
+		},
+		
+		FromBytesFn: func(bytes []byte) ([]interface{}) {
+			var headers []*types.Header
+			rlp.DecodeBytes(bytes[1:], &headers)
+			
+			return []interface{}{headers[0], headers[1]}
+		},
+
+	},
+	
+	/*
+	因出块不达标而被关的签名者, 在刑满后通过unjail恢复参选资格
+	*/
+	unjail: &Action{
+		Id          : unjail,
+		Values      : make([]interface{},0),
+		Description : "Leave jail after the jail period",
+		
+		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
+			return nil
+		},
+		
+		ValidateBytesFn: func(_bytes []byte) (error) {
+			if len(_bytes) != 1 {
+				return errors.New("Invalid action#" + string(_bytes[0]))
+			}
+			return nil
+		},
+		
+		ToBytesFn : func(values []interface{}) ([]byte) {
+			return []byte{}
 		},
 		
 		FromBytesFn: func(bytes []byte) ([]interface{}) {
@@ -164,6 +324,107 @@ var Actions map[uint8]*Action = map[uint8]*Action{
 		},
 
 	},
+	
+	/*
+	抵押者按抵押金对提案投票, 提案值(32 bytes)之后的1 byte是赞成(1)或反对(0)
+	*/
+	voteProposal: &Action{
+		Id          : voteProposal,
+		Values      : make([]interface{},0),
+		Description : "Vote on a proposal with bonded stake",
+		
+		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
+			
+			if len(values) != 2 {
+				return errors.New("Invalid action#" + string(id))
+			}
+			
+			proposalBytes, ok := values[0].(common.Hash)
+			if !ok {
+				return errors.New("Invalid action#" + string(id))
+			}
+			
+			if err := new(Proposal).fromBytes(proposalBytes); err != nil {
+				return err
+			}
+			
+			if _, ok := values[1].(bool); !ok {
+				return errors.New("Invalid action#" + string(id))
+			}
+			
+			return nil
+		},
+		
+		ValidateBytesFn: func(_bytes []byte) (error) {
+			
+			if len(_bytes) != common.HashLength + 2 || _bytes[common.HashLength+1] > 1 {
+				return errors.New("Invalid action#" + string(_bytes[0]))
+			}
+			
+			return new(Proposal).fromBytes(common.BytesToHash(_bytes[1:common.HashLength+1]))
+		},
+		
+		ToBytesFn : func(values []interface{}) ([]byte) {
+			result := values[0].(common.Hash).Bytes()
+			if values[1].(bool) {
+				return append(result, 1)
+			}
+			return append(result, 0)
+		},
+		
+		FromBytesFn: func(bytes []byte) ([]interface{}) {
+			return []interface{}{common.BytesToHash(bytes[1:common.HashLength+1]), bytes[common.HashLength+1] == 1}
+		},
+
+	},
+	
+	/*
+	举报重复的预提交投票, 证据是同一签名者在同一高度对不同块的两张投票，以rlp([vote1, vote2])记录在action里
+	*/
+	reportDoublePrecommit: &Action{
+		Id          : reportDoublePrecommit,
+		Values      : make([]interface{},0),
+		Description : "Submit two conflicting precommit votes cast at the same height",
+		
+		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
+			
+			if len(values) != 2 {
+				return errors.New("Invalid action#" + string(id))
+			}
+			
+			for _, value := range values {
+				if vote, ok := value.(*Precommit); !ok || vote == nil {
+					return errors.New("Invalid action#" + string(id))
+				}
+			}
+			
+			return nil
+		},
+		
+		ValidateBytesFn: func(_bytes []byte) (error) {
+			
+			var votes []*Precommit
+			if err := rlp.DecodeBytes(_bytes[1:], &votes); err != nil || len(votes) != 2 {
+				return errors.New("Invalid action#" + string(_bytes[0]))
+			}
+			
+			return nil
+		},
+		
+		ToBytesFn : func(values []interface{}) ([]byte) {
+			encoded, _ := rlp.EncodeToBytes([]*Precommit{values[0].(*Precommit), values[1].(*Precommit)})
+			
+			return encoded
+		},
+		
+		FromBytesFn: func(bytes []byte) ([]interface{}) {
+			var votes []*Precommit
+			rlp.DecodeBytes(bytes[1:], &votes)
+			
+			return []interface{}{votes[0], votes[1]}
+		},
+
+	},
 }
 
 
@@ -171,12 +432,26 @@ func getAction(id uint8) (*Action,error) {
 	action, ok := Actions[id]
 	
 	if ok {
-		return &(*action),nil //new
+		cpy := *action
+		return &cpy,nil //new
 	} else {
 		return &Action{}, errors.New("Action not found")
 	}
 }
 
+// EncodeAction encodes an action with the given values into the data of a
+// transaction sent to the system address. The values are those decoded by the
+// action itself, e.g. the candidate address of becomeDelegator.
+func EncodeAction(id uint8, values ...interface{}) ([]byte, error) {
+	action, err := getAction(id)
+	if err != nil {
+		return nil, err
+	}
+	action.Values = values
+	
+	return action.toBytes()
+}
+
 func(self *Action) toBytes() ([]byte,error) {
 	
 	if err:=self.ValidateValuesFn(self.Id, self.Values);err!=nil {
@@ -191,6 +466,11 @@ func(self *Action) toBytes() ([]byte,error) {
 
 func(self *Action) fromBytes(actionBytes []byte) error {
 	
+	//普通转账到系统地址是没有data的
+	if len(actionBytes) == 0 {
+		return errors.New("Action not found")
+	}
+	
 	id := actionBytes[0]	
 	
 	action, err := getAction(id)
@@ -17,13 +17,24 @@
 package dpos
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"math/big"
+	"sort"
+
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
+const (
+	apiVersion  = "1.0" // version of the dpos RPC namespace
+	maxPageSize = 100   // maximum number of entries returned by a paginated query
+)
+
 // API is a user facing RPC API to allow controlling the signer and voting
 // mechanisms of the DPOS scheme.
 type API struct {
@@ -31,9 +42,15 @@ type API struct {
 	dpos *Dpos
 }
 
-// GetSnapshot retrieves the state snapshot at a given block.
-func (api *API) GetSnapshot(number *rpc.BlockNumber) (*Snapshot, error) {
-	fmt.Println("")
+// NewAPI creates the DPOS API over the given chain, for services other than the
+// RPC server to use, such as GraphQL.
+func NewAPI(chain consensus.ChainHeaderReader, dpos *Dpos) *API {
+	return &API{chain: chain, dpos: dpos}
+}
+
+// GetSnapshot retrieves the state snapshot at a given block. On light clients
+// the snapshot is retrieved from the server, see SetEpochRetriever.
+func (api *API) GetSnapshot(ctx context.Context, number *rpc.BlockNumber) (*Snapshot, error) {
 	// Retrieve the requested block number (or current if none requested)
 	var header *types.Header
 	if number == nil || *number == rpc.LatestBlockNumber {
@@ -45,20 +62,271 @@ func (api *API) GetSnapshot(number *rpc.BlockNumber) (*Snapshot, error) {
 	if header == nil {
 		return nil, errUnknownBlock
 	}
-	return api.dpos.snapshot(api.chain, header.Number.Uint64(), header.Hash(), nil)
+	return api.dpos.snapshotOf(ctx, api.chain, header)
 }
 
 // GetSnapshotAtHash retrieves the state snapshot at a given block.
-func (api *API) GetSnapshotAtHash(hash common.Hash) (*Snapshot, error) {
+func (api *API) GetSnapshotAtHash(ctx context.Context, hash common.Hash) (*Snapshot, error) {
 	header := api.chain.GetHeaderByHash(hash)
 	if header == nil {
 		return nil, errUnknownBlock
 	}
-	return api.dpos.snapshot(api.chain, header.Number.Uint64(), header.Hash(), nil)
+	return api.dpos.snapshotOf(ctx, api.chain, header)
+}
+
+// GetSigners retrieves the signers elected for the epoch of the given block,
+// along with the ones pre-elected for the next epoch.
+func (api *API) GetSigners(ctx context.Context, number *rpc.BlockNumber) (*Signers, error) {
+	snap, err := api.GetSnapshot(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	return &Signers{Elected: snap.electedSigners(), PreElected: snap.preElectedSigners()}, nil
+}
+
+// GetSignersAtHash retrieves the signers elected for the epoch of the given
+// block, along with the ones pre-elected for the next epoch.
+func (api *API) GetSignersAtHash(ctx context.Context, hash common.Hash) (*Signers, error) {
+	snap, err := api.GetSnapshotAtHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &Signers{Elected: snap.electedSigners(), PreElected: snap.preElectedSigners()}, nil
+}
+
+// Schedule is the order in which the elected signers seal the blocks of an
+// epoch: the block of slot s, its timestamp divided by the slot interval, is
+// sealed in turn by Signers[s % len(Signers)].
+type Schedule struct {
+	Epoch    uint64           `json:"epoch"`    // Epoch block which elected the signers
+	Seed     common.Hash      `json:"seed"`     // Seed the signers are shuffled with
+	Signers  []common.Address `json:"signers"`  // Signers in the order they seal
+	NextSlot uint64           `json:"nextSlot"` // First slot after the given block
+	Next     common.Address   `json:"next"`     // Signer in turn for the next slot
+}
+
+// GetSchedule retrieves the sealing order of the signers elected for the epoch
+// of the given block.
+func (api *API) GetSchedule(ctx context.Context, number *rpc.BlockNumber) (*Schedule, error) {
+	snap, err := api.GetSnapshot(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	next := snap.lastSlot() + 1
+	return &Schedule{
+		Epoch:    snap.Number - snap.Number%api.dpos.config.EpochInterval,
+		Seed:     snap.Seed,
+		Signers:  schedule(snap.electedSigners(), snap.Seed),
+		NextSlot: next,
+		Next:     snap.inturnSigner(next),
+	}, nil
+}
+
+// GetMix retrieves the RANDAO mix after the given block, which the transactions
+// of the next block read through the DIFFICULTY opcode. Light clients don't
+// have the mix.
+func (api *API) GetMix(ctx context.Context, number *rpc.BlockNumber) (common.Hash, error) {
+	snap, err := api.GetSnapshot(ctx, number)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if snap.Light {
+		return common.Hash{}, errNoMix
+	}
+	return snap.Mix, nil
+}
+
+// GetCandidates retrieves a page of the candidates at the given block, ordered
+// by the stake delegated to them, highest first. A zero limit returns the
+// maximum page size.
+func (api *API) GetCandidates(ctx context.Context, offset, limit uint64, number *rpc.BlockNumber) (*CandidatePage, error) {
+	snap, err := api.GetSnapshot(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	//轻节点的快照没有抵押金额, 排不出名次
+	if snap.Light {
+		return nil, errLightSnapshot
+	}
+	var (
+		weights = make(map[common.Address]*big.Int)
+		counts  = make(map[common.Address]uint64)
+	)
+	for candidate := range snap.Candidates {
+		weights[candidate] = new(big.Int)
+	}
+	for delegator, candidate := range snap.Delegators {
+		if weight, ok := weights[candidate]; ok {
+			weight.Add(weight, snap.stakeOf(delegator))
+			counts[candidate]++
+		}
+	}
+	sorted := addressBigIntDescSorter(weights)
+
+	from, to := pageBounds(offset, limit, len(sorted))
+
+	page := &CandidatePage{Total: uint64(len(sorted)), Candidates: []*CandidateInfo{}}
+	for _, kv := range sorted[from:to] {
+		_, elected := snap.ElectedSigners[kv.Key]
+		_, jailed := snap.Jailed[kv.Key]
+
+		page.Candidates = append(page.Candidates, &CandidateInfo{
+			Address:    kv.Key,
+			SelfStake:  (*hexutil.Big)(snap.stakeOf(kv.Key)),
+			Weight:     (*hexutil.Big)(kv.Value),
+			Delegators: counts[kv.Key],
+			Elected:    elected,
+			Jailed:     jailed,
+		})
+	}
+	return page, nil
+}
+
+// GetDelegators retrieves a page of the delegators of a candidate at the given
+// block, ordered by their stake, highest first. A zero limit returns the
+// maximum page size.
+func (api *API) GetDelegators(ctx context.Context, candidate common.Address, offset, limit uint64, number *rpc.BlockNumber) (*DelegatorPage, error) {
+	snap, err := api.GetSnapshot(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	//轻节点的快照没有抵押金额, 排不出名次
+	if snap.Light {
+		return nil, errLightSnapshot
+	}
+	stakes := make(map[common.Address]*big.Int)
+	for delegator, delegatee := range snap.Delegators {
+		if delegatee == candidate {
+			stakes[delegator] = snap.stakeOf(delegator)
+		}
+	}
+	sorted := addressBigIntDescSorter(stakes)
+
+	from, to := pageBounds(offset, limit, len(sorted))
+
+	page := &DelegatorPage{Total: uint64(len(sorted)), Delegators: []*DelegatorInfo{}}
+	for _, kv := range sorted[from:to] {
+		page.Delegators = append(page.Delegators, &DelegatorInfo{Address: kv.Key, Stake: (*hexutil.Big)(kv.Value)})
+	}
+	return page, nil
+}
+
+// GetDelegation retrieves the candidate the given address delegates to at the
+// given block, or nil if it doesn't delegate.
+func (api *API) GetDelegation(ctx context.Context, delegator common.Address, number *rpc.BlockNumber) (*common.Address, error) {
+	snap, err := api.GetSnapshot(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	if candidate, ok := snap.Delegators[delegator]; ok {
+		return &candidate, nil
+	}
+	return nil, nil
+}
+
+// PreviewElection runs the election on the current head as if the epoch
+// closed there, returning who would be elected in the next epoch block.
+// Downtime is judged on the blocks sealed so far in the epoch.
+func (api *API) PreviewElection(ctx context.Context) (*ElectionPreview, error) {
+	header := api.chain.CurrentHeader()
+
+	snap, err := api.dpos.snapshotOf(ctx, api.chain, header)
+	if err != nil {
+		return nil, err
+	}
+	//轻节点的快照没有抵押金额, 无法选举
+	if snap.Light {
+		return nil, errLightSnapshot
+	}
+	//epoch区块的前一块已经选出, 不用再选
+	if preview := snap.copy(); (preview.Number+1)%api.dpos.config.EpochInterval != 0 {
+		preview.closeEpoch()
+		snap = preview
+	}
+	result := &ElectionPreview{
+		Number:     snap.Number,
+		Epoch:      snap.Number - snap.Number%api.dpos.config.EpochInterval + api.dpos.config.EpochInterval,
+		Signers:    snap.preElectedSigners(),
+		Delegators: snap.PreElectedDelegators,
+		Proposals:  snap.unconfirmedProposals(),
+		Jailed:     []common.Address{},
+	}
+	for address, jail := range snap.Jailed {
+		if jail.Number == snap.Number && jail.Reason == jailDowntime {
+			result.Jailed = append(result.Jailed, address)
+		}
+	}
+	sort.Sort(signersAscending(result.Jailed))
+	return result, nil
+}
+
+// GetJailed retrieves the jailed candidates at a given block, along with why
+// and when each of them was jailed.
+func (api *API) GetJailed(ctx context.Context, number *rpc.BlockNumber) (map[common.Address]*Jail, error) {
+	snap, err := api.GetSnapshot(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	return snap.Jailed, nil
+}
+
+// GetPrecommitEvidences retrieves the conflicting precommit votes seen by the
+// node, each encoded as the data of a reportDoublePrecommit transaction to the
+// system address.
+func (api *API) GetPrecommitEvidences() ([]hexutil.Bytes, error) {
+	evidences := api.dpos.precommitEvidences()
+
+	result := make([]hexutil.Bytes, 0, len(evidences))
+	for _, votes := range evidences {
+		data, err := EncodeAction(reportDoublePrecommit, votes[0], votes[1])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, data)
+	}
+	return result, nil
+}
+
+// GetTally retrieves the stake-weighted tally of the proposals voted on so far
+// in the epoch of the given block. The votes themselves are in the snapshot.
+func (api *API) GetTally(ctx context.Context, number *rpc.BlockNumber) (map[common.Hash]*Tally, error) {
+	snap, err := api.GetSnapshot(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	return snap.tally(), nil
 }
 
-func (api *API) Test(hash common.Hash) *types.Header {
-	return api.chain.GetHeaderByHash(hash)	
+// GetRewards retrieves the block reward paid out for sealing the given block,
+// split between the signer and its elected delegators. Transaction fees, which
+// go to the signer as well, are not included.
+func (api *API) GetRewards(number *rpc.BlockNumber) (*Rewards, error) {
+	var header *types.Header
+	if number == nil || *number == rpc.LatestBlockNumber {
+		header = api.chain.CurrentHeader()
+	} else {
+		header = api.chain.GetHeaderByNumber(uint64(number.Int64()))
+	}
+	//创世块没有奖励
+	if header == nil || header.Number.Uint64() == 0 {
+		return nil, errUnknownBlock
+	}
+	signer, err := api.dpos.Author(header)
+	if err != nil {
+		return nil, err
+	}
+	toSigner, delegators, rewards := api.dpos.blockRewards(api.chain, header, signer)
+
+	result := &Rewards{
+		Number:       header.Number.Uint64(),
+		Signer:       signer,
+		SignerReward: (*hexutil.Big)(toSigner),
+		Delegators:   make(map[common.Address]*hexutil.Big),
+	}
+	for i, delegator := range delegators {
+		result.Delegators[delegator.Delegator] = (*hexutil.Big)(rewards[i])
+	}
+	return result, nil
 }
 
 // Proposals returns the current proposals the node tries to uphold and vote on.
@@ -97,3 +365,228 @@ func (api *API) Discard(proposalBytes common.Hash) {
 	delete(api.dpos.myProposals, proposalBytes)
 }
 
+// Signers are the elected and pre-elected signers at a given block. Signers
+// are pre-elected in the block before an epoch block, the list is empty in
+// the rest of the epoch and on light clients.
+type Signers struct {
+	Elected    []common.Address `json:"elected"`
+	PreElected []common.Address `json:"preElected"`
+}
+
+type status struct {
+	InturnPercent float64                `json:"inturnPercent"`
+	SigningStatus map[common.Address]int `json:"sealerActivity"`
+	MissedSlots   map[common.Address]int `json:"missedSlots"`
+	NumBlocks     uint64                 `json:"numBlocks"`
+}
+
+// Status returns the status of the last N blocks,
+// - the number of blocks sealed by each signer,
+// - the number of in-turn slots each signer missed, either skipped or sealed
+//   out-of-turn by another signer,
+// - the percentage of in-turn blocks
+//
+// The in-turn signer of every slot is taken from the extra-data and the hash of
+// its epoch block, so the status only needs headers and works on light clients
+// too.
+func (api *API) Status() (*status, error) {
+	var (
+		numBlocks = uint64(64)
+		header    = api.chain.CurrentHeader()
+		end       = header.Number.Uint64()
+		optimals  = 0
+	)
+	if numBlocks > end {
+		numBlocks = end
+	}
+	var (
+		start        = end - numBlocks + 1
+		signStatus   = make(map[common.Address]int)
+		missed       = make(map[common.Address]int)
+		epochs       = make(map[uint64][]common.Address)
+		epochHeaders = make(map[uint64]*types.Header)
+		interval     = api.dpos.config.EpochInterval
+		parent       = api.chain.GetHeaderByNumber(start - 1)
+	)
+	if parent == nil {
+		return nil, fmt.Errorf("missing block %d", start-1)
+	}
+	for n := start; n <= end; n++ {
+		h := api.chain.GetHeaderByNumber(n)
+		if h == nil {
+			return nil, fmt.Errorf("missing block %d", n)
+		}
+		//epoch区块按上一个epoch的顺序出块, 参考epochOfHeader
+		epoch := (n - 1) - (n-1)%interval
+		if _, ok := epochs[epoch]; !ok {
+			epochHeader := api.chain.GetHeaderByNumber(epoch)
+			extra, err := parseEpochExtra(epochHeader)
+			if err != nil {
+				return nil, fmt.Errorf("epoch block %d: %v", epoch, err)
+			}
+			epochs[epoch], epochHeaders[epoch] = schedule(extra.Signers, epochSeed(api.dpos.config, epochHeader, extra)), epochHeader
+		}
+		sealer, err := api.dpos.Author(h)
+		if err != nil {
+			return nil, err
+		}
+		signStatus[sealer]++
+
+		//按时间截所在的slot轮流出块, 父块之后跳过的slot也算错过, 参考schedule.go
+		var (
+			order        = epochs[epoch]
+			slotInterval = slotIntervalAt(api.dpos.config, api.dpos.rulesOfEpoch(epochHeaders[epoch], n).SlotInterval, n)
+			parentSlot   = slotOf(parent.Time, n-1, slotInterval)
+			slot         = slotOf(h.Time, n, slotInterval)
+		)
+		if order[slot%uint64(len(order))] == sealer {
+			optimals++
+		}
+		for signer, count := range missedSlots(order, parentSlot, slot, sealer) {
+			missed[signer] += int(count)
+		}
+		parent = h
+	}
+	//当前epoch的签名者即使没有出块也要列出
+	if signers, ok := epochs[(end-1)-(end-1)%interval]; ok {
+		for _, signer := range signers {
+			if _, ok := signStatus[signer]; !ok {
+				signStatus[signer] = 0
+			}
+			if _, ok := missed[signer]; !ok {
+				missed[signer] = 0
+			}
+		}
+	}
+	var inturnPercent float64
+	if numBlocks > 0 {
+		inturnPercent = float64(100*optimals) / float64(numBlocks)
+	}
+	return &status{
+		InturnPercent: inturnPercent,
+		SigningStatus: signStatus,
+		MissedSlots:   missed,
+		NumBlocks:     numBlocks,
+	}, nil
+}
+
+type version struct {
+	API          string `json:"api"`
+	ExtraVersion uint8  `json:"extraVersion"`
+}
+
+// Version returns the version of the dpos RPC API and of the header
+// extra-data format.
+func (api *API) Version() *version {
+	return &version{API: apiVersion, ExtraVersion: extraVersion}
+}
+
+// CandidateInfo is a candidate along with the stake delegated to it.
+type CandidateInfo struct {
+	Address    common.Address `json:"address"`
+	SelfStake  *hexutil.Big   `json:"selfStake"`
+	Weight     *hexutil.Big   `json:"weight"` //委托人的抵押金总和, 即选票
+	Delegators uint64         `json:"delegators"`
+	Elected    bool           `json:"elected"`
+	Jailed     bool           `json:"jailed"`
+}
+
+// CandidatePage is a page of candidates out of the total number.
+type CandidatePage struct {
+	Total      uint64           `json:"total"`
+	Candidates []*CandidateInfo `json:"candidates"`
+}
+
+// DelegatorInfo is a delegator along with its stake.
+type DelegatorInfo struct {
+	Address common.Address `json:"address"`
+	Stake   *hexutil.Big   `json:"stake"`
+}
+
+// DelegatorPage is a page of delegators out of the total number.
+type DelegatorPage struct {
+	Total      uint64           `json:"total"`
+	Delegators []*DelegatorInfo `json:"delegators"`
+}
+
+// ElectionPreview is the outcome of an election held on a given block.
+type ElectionPreview struct {
+	Number     uint64                                `json:"number"` //选举所依据的块高度
+	Epoch      uint64                                `json:"epoch"`  //新签名者生效的epoch区块
+	Signers    []common.Address                      `json:"signers"`
+	Delegators map[common.Address][]ElectedDelegator `json:"delegators"`
+	Proposals  []common.Hash                         `json:"proposals"`
+	Jailed     []common.Address                      `json:"jailed"` //因出块不达标将入狱的签名者
+}
+
+// Rewards is the block reward of a block, split between its signer and the
+// delegators elected for the signer.
+type Rewards struct {
+	Number       uint64                          `json:"number"`
+	Signer       common.Address                  `json:"signer"`
+	SignerReward *hexutil.Big                    `json:"signerReward"` //包括委托人分剩的余数
+	Delegators   map[common.Address]*hexutil.Big `json:"delegators"`
+}
+
+// BlockInfo is the DPOS consensus data carried by a header.
+type BlockInfo struct {
+	Signer   common.Address // 从签名恢复, 创世块为空
+	InTurn   bool
+	Proposal common.Hash // 签名者投的子提案, 没有投票时为空
+	Yes      bool
+	Epoch    *EpochExtra // 只有epoch区块和创世块才有
+}
+
+// BlockInfo decodes the signer, its vote and, on epoch blocks, the election
+// results from a header. It only needs the header itself.
+func (self *Dpos) BlockInfo(header *types.Header) (*BlockInfo, error) {
+	info := &BlockInfo{
+		InTurn:   header.Difficulty != nil && header.Difficulty.Cmp(diffInTurn) == 0,
+		Proposal: header.MixDigest,
+		Yes:      bytes.Equal(header.Nonce[:], nonceYesVote),
+	}
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err != nil {
+		return nil, err
+	}
+	if extra.Epoch {
+		info.Epoch = extra
+	}
+	if header.Number.Uint64() > 0 {
+		signer, err := self.Author(header)
+		if err != nil {
+			return nil, err
+		}
+		info.Signer = signer
+	}
+	return info, nil
+}
+
+// ProposalHashes returns the proposals of the extra-data in their 32 byte form,
+// as voted on in headers.
+func (e *EpochExtra) ProposalHashes() []common.Hash {
+	hashes := make([]common.Hash, 0, len(e.Proposals))
+	for _, proposal := range e.Proposals {
+		if hash, err := proposal.toBytes(); err == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+/*
+分页的范围, limit为0或超过maxPageSize时取maxPageSize
+*/
+func pageBounds(offset, limit uint64, total int) (int, int) {
+	if limit == 0 || limit > maxPageSize {
+		limit = maxPageSize
+	}
+	if offset > uint64(total) {
+		offset = uint64(total)
+	}
+	end := offset + limit
+	if end > uint64(total) {
+		end = uint64(total)
+	}
+	return int(offset), int(end)
+}
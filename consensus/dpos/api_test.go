@@ -0,0 +1,349 @@
+package dpos
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// 用keys做创世块的签名者, 第i块由keys[sealers[i-1]]出块
+func newTestChain(t *testing.T, keys []*ecdsa.PrivateKey, delegators map[common.Address][]ElectedDelegator, epochInterval uint64, sealers []int) (*core.BlockChain, *Dpos) {
+	signers := make([]common.Address, len(keys))
+	for i, key := range keys {
+		signers[i] = crypto.PubkeyToAddress(key.PublicKey)
+	}
+	extra, err := EncodeGenesisExtra(signers, delegators)
+	if err != nil {
+		t.Fatalf("failed to encode genesis extra: %v", err)
+	}
+	config := *params.AllDposProtocolChanges
+	config.Dpos = &params.DposConfig{SlotInterval: 1, EpochInterval: epochInterval, MaxSigners: uint64(len(keys)), ScheduleBlock: big.NewInt(0)}
+	genesis := &core.Genesis{Config: &config, ExtraData: extra, GasLimit: params.GenesisGasLimit, Difficulty: big.NewInt(1)}
+
+	db := rawdb.NewMemoryDatabase()
+	genesis.MustCommit(db)
+	engine := New(config.Dpos, db)
+
+	chain, err := core.NewBlockChain(db, nil, &config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	for _, sealer := range sealers {
+		insertTestBlock(t, chain, engine, keys[sealer])
+	}
+	return chain, engine
+}
+
+// 由key出块并接到链头
+func insertTestBlock(t *testing.T, chain *core.BlockChain, engine *Dpos, key *ecdsa.PrivateKey) *types.Block {
+	engine.Authorize(crypto.PubkeyToAddress(key.PublicKey), nil)
+
+	parent := chain.CurrentBlock()
+	header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number(), common.Big1), GasLimit: parent.GasLimit()}
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare block #%d: %v", header.Number, err)
+	}
+	header.Time = slotTestTime(t, chain, engine, key)
+
+	statedb, _ := chain.StateAt(parent.Root())
+	block, err := engine.FinalizeAndAssemble(chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to assemble block #%d: %v", header.Number, err)
+	}
+	header = block.Header()
+	sig, _ := crypto.Sign(SealHash(header).Bytes(), key)
+	copy(header.Extra[1:], sig)
+
+	block = block.WithSeal(header)
+	if _, err := chain.InsertChain(types.Blocks{block}); err != nil {
+		t.Fatalf("failed to insert block #%d: %v", header.Number, err)
+	}
+	return block
+}
+
+// key在链头之后最早可以出块的时间截: 轮到他时是下一个slot, 否则要等一个超时slot
+func slotTestTime(t *testing.T, chain *core.BlockChain, engine *Dpos, key *ecdsa.PrivateKey) uint64 {
+	parent := chain.CurrentHeader()
+	snap, err := engine.snapshot(chain, parent.Number.Uint64(), parent.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	interval := engine.config.SlotInterval
+	slot := parent.Time/interval + 1
+	if snap.inturnSigner(slot) != crypto.PubkeyToAddress(key.PublicKey) {
+		slot += timeoutSlots
+	}
+	return slot * interval
+}
+
+// 按地址从小到大排序的keys, 和epoch区块extra里的签名者顺序一样
+func sortedTestKeys(n int) []*ecdsa.PrivateKey {
+	keys := make([]*ecdsa.PrivateKey, n)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := crypto.PubkeyToAddress(keys[i].PublicKey), crypto.PubkeyToAddress(keys[j].PublicKey)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+	return keys
+}
+
+// 按seed洗牌后的出块顺序排列的keys, 第number块轮到order[number%n]
+func scheduledTestKeys(keys []*ecdsa.PrivateKey, seed common.Hash) []*ecdsa.PrivateKey {
+	byAddress := make(map[common.Address]*ecdsa.PrivateKey, len(keys))
+	signers := make([]common.Address, len(keys))
+	for i, key := range keys {
+		signers[i] = crypto.PubkeyToAddress(key.PublicKey)
+		byAddress[signers[i]] = key
+	}
+	order := make([]*ecdsa.PrivateKey, len(keys))
+	for i, signer := range schedule(signers, seed) {
+		order[i] = byAddress[signer]
+	}
+	return order
+}
+
+func TestAPISigners(t *testing.T) {
+	keys := sortedTestKeys(3)
+	chain, engine := newTestChain(t, keys, nil, 10, []int{1, 2, 0, 1, 2, 0, 1, 2, 0})
+	defer chain.Stop()
+
+	api := &API{chain: chain, dpos: engine}
+
+	want := make([]common.Address, len(keys))
+	for i, key := range keys {
+		want[i] = crypto.PubkeyToAddress(key.PublicKey)
+	}
+	//第9块是epoch区块的前一块, 已经选出下个epoch的签名者
+	for _, number := range []uint64{5, 9} {
+		bn := rpc.BlockNumber(number)
+		signers, err := api.GetSigners(context.Background(), &bn)
+		if err != nil {
+			t.Fatalf("block #%d: failed to get signers: %v", number, err)
+		}
+		if !reflect.DeepEqual(signers.Elected, want) {
+			t.Errorf("block #%d: elected signers mismatch: have %v, want %v", number, signers.Elected, want)
+		}
+		if number == 9 && len(signers.PreElected) == 0 {
+			t.Errorf("block #%d: pre-elected signers missing", number)
+		}
+		if number == 5 && len(signers.PreElected) != 0 {
+			t.Errorf("block #%d: unexpected pre-elected signers: %v", number, signers.PreElected)
+		}
+		atHash, err := api.GetSignersAtHash(context.Background(), chain.GetHeaderByNumber(number).Hash())
+		if err != nil || !reflect.DeepEqual(atHash, signers) {
+			t.Errorf("block #%d: signers by hash mismatch: have %v, want %v (err %v)", number, atHash, signers, err)
+		}
+	}
+	if _, err := api.GetSignersAtHash(context.Background(), common.Hash{}); err != errUnknownBlock {
+		t.Errorf("unknown block: have %v, want %v", err, errUnknownBlock)
+	}
+}
+
+func TestAPIStatus(t *testing.T) {
+	keys := sortedTestKeys(4)
+	chain, engine := newTestChain(t, keys, nil, 10, nil)
+	defer chain.Stop()
+
+	/*
+		按出块顺序排列, 第k个slot轮到keys[k%4]:
+		第1块由keys[1]在slot 1出块; 第2块由keys[0]在超时slot 3补发, 跳过slot 2;
+		第3块由keys[2]在超时slot 5补发, 跳过slot 4; 第4块由keys[3]在自己的slot 7出块, 跳过slot 6
+	*/
+	keys = scheduledTestKeys(keys, chain.Genesis().Hash())
+	for _, sealer := range []int{1, 0, 2, 3} {
+		insertTestBlock(t, chain, engine, keys[sealer])
+	}
+	if time := chain.CurrentHeader().Time; time != 7 {
+		t.Fatalf("head slot mismatch: have %d, want 7", time)
+	}
+	status, err := (&API{chain: chain, dpos: engine}).Status()
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	if status.NumBlocks != 4 {
+		t.Errorf("block count mismatch: have %d, want 4", status.NumBlocks)
+	}
+	if status.InturnPercent != 50 {
+		t.Errorf("in-turn percentage mismatch: have %v, want 50", status.InturnPercent)
+	}
+	var (
+		a = crypto.PubkeyToAddress(keys[0].PublicKey)
+		b = crypto.PubkeyToAddress(keys[1].PublicKey)
+		c = crypto.PubkeyToAddress(keys[2].PublicKey)
+		d = crypto.PubkeyToAddress(keys[3].PublicKey)
+	)
+	if want := map[common.Address]int{a: 1, b: 1, c: 1, d: 1}; !reflect.DeepEqual(status.SigningStatus, want) {
+		t.Errorf("sealer activity mismatch: have %v, want %v", status.SigningStatus, want)
+	}
+	if want := map[common.Address]int{a: 1, b: 1, c: 2, d: 1}; !reflect.DeepEqual(status.MissedSlots, want) {
+		t.Errorf("missed slots mismatch: have %v, want %v", status.MissedSlots, want)
+	}
+}
+
+func TestAPICandidates(t *testing.T) {
+	keys := sortedTestKeys(1)
+	chain, engine := newTestChain(t, keys, nil, 10, []int{0, 0, 0})
+	defer chain.Stop()
+
+	var (
+		a  = crypto.PubkeyToAddress(keys[0].PublicKey)
+		b  = common.HexToAddress("0x00000000000000000000000000000000000000b0")
+		c  = common.HexToAddress("0x00000000000000000000000000000000000000c0")
+		d1 = common.HexToAddress("0x00000000000000000000000000000000000000d1")
+		d2 = common.HexToAddress("0x00000000000000000000000000000000000000d2")
+		d3 = common.HexToAddress("0x00000000000000000000000000000000000000d3")
+	)
+	//直接改缓存里的快照, 省去发送action的tx
+	head := chain.CurrentHeader()
+	snap, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	snap = snap.copy()
+	snap.Candidates[b] = struct{}{}
+	snap.Candidates[c] = struct{}{}
+	snap.Delegators[d1] = b
+	snap.Delegators[d2] = c
+	snap.Delegators[d3] = c
+	snap.Stakes[c] = big.NewInt(7)
+	snap.Stakes[d1] = big.NewInt(5)
+	snap.Stakes[d2] = big.NewInt(10)
+	snap.Stakes[d3] = big.NewInt(1)
+	snap.Missed[a] = 4
+	engine.recents.Add(head.Hash(), snap)
+
+	var (
+		api    = &API{chain: chain, dpos: engine}
+		ctx    = context.Background()
+		latest = rpc.LatestBlockNumber
+	)
+	page, err := api.GetCandidates(ctx, 0, 2, &latest)
+	if err != nil {
+		t.Fatalf("failed to get candidates: %v", err)
+	}
+	if page.Total != 3 || len(page.Candidates) != 2 {
+		t.Fatalf("candidate page mismatch: total %d, have %d", page.Total, len(page.Candidates))
+	}
+	if first := page.Candidates[0]; first.Address != c || first.Weight.ToInt().Int64() != 11 || first.SelfStake.ToInt().Int64() != 7 || first.Delegators != 2 {
+		t.Errorf("first candidate mismatch: %+v", first)
+	}
+	if page, _ = api.GetCandidates(ctx, 2, 2, &latest); len(page.Candidates) != 1 || page.Candidates[0].Address != a || !page.Candidates[0].Elected {
+		t.Errorf("last candidate page mismatch: %+v", page.Candidates)
+	}
+	if page, _ = api.GetCandidates(ctx, 5, 0, &latest); page.Total != 3 || len(page.Candidates) != 0 {
+		t.Errorf("page past the end mismatch: %+v", page)
+	}
+	delegators, err := api.GetDelegators(ctx, c, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to get delegators: %v", err)
+	}
+	if delegators.Total != 2 || delegators.Delegators[0].Address != d2 || delegators.Delegators[1].Address != d3 {
+		t.Errorf("delegators mismatch: %+v", delegators.Delegators)
+	}
+	if candidate, err := api.GetDelegation(ctx, d1, nil); err != nil || candidate == nil || *candidate != b {
+		t.Errorf("delegation mismatch: have %v, want %x (err %v)", candidate, b, err)
+	}
+	if candidate, err := api.GetDelegation(ctx, a, nil); err != nil || candidate != nil {
+		t.Errorf("unexpected delegation: %v (err %v)", candidate, err)
+	}
+	//a错过的slot(4)多过出块数(3), 有候选人补上时入狱
+	preview, err := api.PreviewElection(ctx)
+	if err != nil {
+		t.Fatalf("failed to preview election: %v", err)
+	}
+	if preview.Number != 3 || preview.Epoch != 10 {
+		t.Errorf("preview position mismatch: number %d, epoch %d", preview.Number, preview.Epoch)
+	}
+	if want := []common.Address{c}; !reflect.DeepEqual(preview.Signers, want) {
+		t.Errorf("preview signers mismatch: have %v, want %v", preview.Signers, want)
+	}
+	if want := []common.Address{a}; !reflect.DeepEqual(preview.Jailed, want) {
+		t.Errorf("preview jailed mismatch: have %v, want %v", preview.Jailed, want)
+	}
+	if len(preview.Delegators[c]) != 2 || preview.Delegators[c][0].Delegator != d2 {
+		t.Errorf("preview delegators mismatch: %v", preview.Delegators[c])
+	}
+	//预览不能改动快照
+	if len(snap.PreElectedSigners) != 0 || len(snap.Jailed) != 0 {
+		t.Errorf("preview modified the snapshot")
+	}
+}
+
+// 查询到的奖励要和Finalize实际发到state里的一样
+// 轻节点的快照没有抵押金额, 按抵押金排名的查询都不可用
+func TestAPILightSnapshot(t *testing.T) {
+	keys := sortedTestKeys(1)
+	chain, engine := newTestChain(t, keys, nil, 10, []int{0})
+	defer chain.Stop()
+
+	head := chain.CurrentHeader()
+	snap, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	snap.Light = true
+
+	api := &API{chain: chain, dpos: engine}
+	if _, err := api.GetCandidates(context.Background(), 0, 10, nil); err != errLightSnapshot {
+		t.Errorf("candidates error mismatch: have %v, want %v", err, errLightSnapshot)
+	}
+	if _, err := api.GetDelegators(context.Background(), crypto.PubkeyToAddress(keys[0].PublicKey), 0, 10, nil); err != errLightSnapshot {
+		t.Errorf("delegators error mismatch: have %v, want %v", err, errLightSnapshot)
+	}
+	if _, err := api.PreviewElection(context.Background()); err != errLightSnapshot {
+		t.Errorf("election preview error mismatch: have %v, want %v", err, errLightSnapshot)
+	}
+}
+
+func TestAPIRewards(t *testing.T) {
+	keys := sortedTestKeys(1)
+	signer := crypto.PubkeyToAddress(keys[0].PublicKey)
+
+	var (
+		d1 = common.HexToAddress("0x00000000000000000000000000000000000000d1")
+		d2 = common.HexToAddress("0x00000000000000000000000000000000000000d2")
+	)
+	chain, engine := newTestChain(t, keys, map[common.Address][]ElectedDelegator{
+		signer: {{Delegator: d1, Portion: uint32(portionBase / 3)}, {Delegator: d2, Portion: uint32(portionBase / 3)}},
+	}, 10, []int{0, 0})
+	defer chain.Stop()
+
+	bn := rpc.BlockNumber(2)
+	rewards, err := (&API{chain: chain, dpos: engine}).GetRewards(&bn)
+	if err != nil {
+		t.Fatalf("failed to get rewards: %v", err)
+	}
+	parent, _ := chain.StateAt(chain.GetHeaderByNumber(1).Root)
+	statedb, _ := chain.StateAt(chain.GetHeaderByNumber(2).Root)
+
+	paid := func(address common.Address) *big.Int {
+		return new(big.Int).Sub(statedb.GetBalance(address), parent.GetBalance(address))
+	}
+	if rewards.Signer != signer || rewards.SignerReward.ToInt().Cmp(paid(signer)) != 0 {
+		t.Errorf("signer reward mismatch: have %x %v, want %x %v", rewards.Signer, rewards.SignerReward, signer, paid(signer))
+	}
+	for _, delegator := range []common.Address{d1, d2} {
+		if have := rewards.Delegators[delegator]; have == nil || have.ToInt().Cmp(paid(delegator)) != 0 {
+			t.Errorf("delegator %x reward mismatch: have %v, want %v", delegator, have, paid(delegator))
+		}
+	}
+	bn = 0
+	if _, err := (&API{chain: chain, dpos: engine}).GetRewards(&bn); err != errUnknownBlock {
+		t.Errorf("genesis rewards: have %v, want %v", err, errUnknownBlock)
+	}
+}
@@ -23,23 +23,20 @@ package dpos
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"math"
 	"math/big"
 	"math/rand"
 	"sync"
 	"time"
-	"fmt"
 	
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/consensus"
-	_ "github.com/ethereum/go-ethereum/consensus/misc"
+	"github.com/ethereum/go-ethereum/consensus/misc"
 	"github.com/ethereum/go-ethereum/core/state"
-	_ "github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
@@ -51,13 +48,12 @@ import (
 
 //dpos常量
 const (
-	signerReward    = 50     //签名者的奖励%份额, 必须是int
-	maxSignerSize  = 2		  //最多多少个signer在一个epoch世代
 	storeSnapInterval = 1024  //块高度%storeSnapInterval==0时，快照将存入DB
 	inmemorySnapshots  = 128  //缓存存入多少个最近的快照
 	inmemorySignatures = 4096 //缓存存入多少个ecrecover的结果
-
-	wiggleTime = 500 * time.Millisecond //如果出块轮不到我，多等待一会，减少链脏（不必要的侧链插入)
+	inmemoryFinalities = 128  //缓存存入多少个最近链头的finality状态
+	
+	portionBase uint64 = 1e9 //委托人份额的单位(十亿分之一)，份额是100%时等于portionBase
 )
 
 var (
@@ -67,6 +63,12 @@ var (
 	ConstantinopleBlockReward = big.NewInt(2e+18) 
 	
 	epochLength = uint64(30000) //块高度%epochlength==0时，这块便是创世块
+	unbondingEpochs = uint64(7) //默认的解押等待期(epoch个数)
+	slashPercent = uint64(10) //默认罚没双签者抵押金的百分比
+	jailEpochs = uint64(2) //默认出块不达标的入狱期(epoch个数)
+	signerReward = uint64(50) //默认签名者的奖励%份额
+	maxSigners = uint64(2) //默认最多多少个signer在一个epoch世代
+	wiggleTime = uint64(500) //默认的wiggle时间单位(毫秒)，如果出块轮不到我，多等待一会，减少链脏（不必要的侧链插入)
 
 	//填充block.header.nonce值
 	nonceYesVote = hexutil.MustDecode("0xffffffffffffffff") //投赞成票
@@ -93,6 +95,18 @@ var (
 	
 	//epoch区块的extra的signers不符合条件
 	errInvalidEpochExtraProposal = errors.New("Invalid proposals contain in epoch block's extra")
+	
+	//epoch区块的extra里委托人的份额加起来超过100%
+	errInvalidEpochExtraPortion = errors.New("Invalid delegator portions contain in epoch block's extra")
+	
+	//epoch区块的extra里委托人的列表和签名者对不上
+	errInvalidEpochExtraDelegator = errors.New("Invalid delegators contain in epoch block's extra")
+	
+	//extra的varint长度越界或不是最短写法
+	errInvalidExtra = errors.New("Malformed extra-data")
+	
+	//extra的版本不认识
+	errUnknownExtraVersion = errors.New("Unknown extra-data version")
 
 	//nonces值只能是0x00..0或0xff..f
 	errInvalidVote = errors.New("Vote nonce not 0x00..0 or 0xff..f")
@@ -108,6 +122,21 @@ var (
 
 	//本地与入参的签名者不配对
 	errMismatchingEpochSigners = errors.New("Mismatching signer list on epoch block")
+	
+	//本地与入参的提案结果不配对
+	errMismatchingEpochProposals = errors.New("Mismatching proposal list on epoch block")
+	
+	//本地与入参的中选委托人不配对
+	errMismatchingEpochDelegators = errors.New("Mismatching delegator list on epoch block")
+	
+	//epoch区块没有记录出块顺序的种子
+	errMissingEpochSeed = errors.New("Missing schedule seed on epoch block")
+	
+	//epoch区块的种子不是出块之前的RANDAO mix
+	errMismatchingEpochSeed = errors.New("Mismatching schedule seed on epoch block")
+	
+	//schedule分叉之前的epoch区块不能记录种子
+	errUnexpectedEpochSeed = errors.New("Unexpected schedule seed before schedule fork")
 
 	//叔块不是空
 	errInvalidUncleHash = errors.New("Non empty uncle hash")
@@ -122,6 +151,15 @@ var (
 
 	//新区块的时间截不能大过父区块 + slotinterval
 	errInvalidTimestamp = errors.New("Invalid timestamp")
+	
+	//时间截不是slotinterval的整数倍
+	errUnalignedTimestamp = errors.New("Timestamp not aligned to slot")
+	
+	//轮不到出块的签名者在超时slot之前出块
+	errEarlyOutOfTurn = errors.New("Out-of-turn block before timeout slot")
+	
+	//提案设置了gas limit目标时，新区块的gas limit没有向目标调整
+	errInvalidGasLimit = errors.New("Gas limit does not follow the target")
 
 	// 用在snapshot, 检查入参的headers(多祖先块）是否合格
 	errInvalidVotingChain = errors.New("Invalid voting chain")
@@ -137,11 +175,62 @@ var (
 	//块体还没有同步
 	errMissingBody = errors.New("Missing body")
 	
+	//块体已同步但收据还没有
+	errMissingReceipts = errors.New("Missing receipts")
+	
+	//块的state里没有写入快照, 不能用来组装快照
+	errMissingRegistry = errors.New("Missing registry snapshot")
+	
+	//轻节点取得的registry数量不对
+	errInvalidRegistryProof = errors.New("invalid registry proof")
+	
+	//轻节点的快照没有抵押金额等数据
+	errLightSnapshot = errors.New("not available on light clients")
+	
 	//epoch块高度不对
 	errWrongEpochNumber = errors.New("Wrong epoch number")
 	
 	//epoch块还没有来临
 	errMissingEpochBlock = errors.New("Missing epoch block during stateless situation")
+	
+	//action不存在
+	errUnknownAction = errors.New("Unknown action")
+	
+	//被委托的地址不是候选人
+	errUnknownCandidate = errors.New("Unknown candidate")
+	
+	//抵押金额必须大于0
+	errInvalidStake = errors.New("Invalid stake amount")
+	
+	//解押金额超过已抵押金额
+	errInsufficientStake = errors.New("Insufficient bonded stake")
+	
+	//action格式不对
+	errInvalidAction = errors.New("Invalid action")
+	
+	//只有外部账户可以直接调用系统合约
+	errIndirectAction = errors.New("Action must be sent by transaction")
+	
+	//只有stake可以附带value, 否则资金会滞留在托管账户
+	errUnexpectedValue = errors.New("Unexpected value for action")
+	
+	//双签证据不成立
+	errInvalidEvidence = errors.New("Invalid double sign evidence")
+	
+	//双签证据已被受理
+	errDuplicateEvidence = errors.New("Duplicate double sign evidence")
+	
+	//双签证据超出举报期限
+	errStaleEvidence = errors.New("Stale double sign evidence")
+	
+	//签名者仍在狱中
+	errJailed = errors.New("Signer is jailed")
+	
+	//签名者不在狱中
+	errNotJailed = errors.New("Signer is not jailed")
+	
+	//没有抵押金也不是候选人，不能对提案投票
+	errNoVotingPower = errors.New("No voting power")
 )
 
 // SignerFn hashes and signs the data to be signed by a backing account.
@@ -154,18 +243,20 @@ type Dpos struct {
 
 	recents    *lru.ARCCache    // 快速读取最近的Snapshots，以达到加速处理reorg的目的
 	signatures *lru.ARCCache    // 快速读取最近的Signatures，以达到加速处理mining的目的
+	finalities *lru.ARCCache    // 最近链头的finality状态, 新链头从父块的状态递推, 参考finality.go
 
 	myProposals map[common.Hash]bool //键值为proposal bytes
 
 	signer common.Address       // signer的以太坊地址
 	signFn SignerFn             // signer的签名函数
 	lock   sync.RWMutex         // 加锁保护signer字段
+	
+	retriever EpochRetriever    // 轻节点取epoch区块和registry的函数, 参考light.go
+	
+	precommits *precommitPool   // 预提交投票池, 参考precommits.go
 
 	//以下测试用途
 	fakeDiff bool //跳过难度验证
-	
-	state *state.StateDB 
-	
 }
 
 func New(config *params.DposConfig, db ethdb.Database) *Dpos {
@@ -175,9 +266,31 @@ func New(config *params.DposConfig, db ethdb.Database) *Dpos {
 		//如果链配置是空，那就使用默认值
 		conf.EpochInterval = epochLength
 	}
+	if conf.SystemAddress == (common.Address{}) {
+		conf.SystemAddress = defaultSystemAddress
+	}
+	if conf.UnbondingEpochs == 0 {
+		conf.UnbondingEpochs = unbondingEpochs
+	}
+	if conf.SlashPercent == 0 {
+		conf.SlashPercent = slashPercent
+	}
+	if conf.JailEpochs == 0 {
+		conf.JailEpochs = jailEpochs
+	}
+	if conf.SignerReward == 0 {
+		conf.SignerReward = signerReward
+	}
+	if conf.MaxSigners == 0 {
+		conf.MaxSigners = maxSigners
+	}
+	if conf.WiggleTime == 0 {
+		conf.WiggleTime = wiggleTime
+	}
 	// Allocate the snapshot caches and create the engine
 	recents,    _ := lru.NewARC(inmemorySnapshots) //最近的Snapshots
 	signatures, _ := lru.NewARC(inmemorySignatures)//最近的Signatures
+	finalities, _ := lru.NewARC(inmemoryFinalities)//最近链头的finality状态
 	
 	//返回一个新的Dpos对象
 	return &Dpos{
@@ -185,7 +298,9 @@ func New(config *params.DposConfig, db ethdb.Database) *Dpos {
 		db:         db,
 		recents:    recents,
 		signatures: signatures,
+		finalities: finalities,
 		myProposals:  make(map[common.Hash]bool),
+		precommits: newPrecommitPool(),
 	}
 }
 
@@ -287,45 +402,27 @@ func (self *Dpos) verifyHeader(chain consensus.ChainHeaderReader, header *types.
 		return errInvalidEpochVote
 	}
 	
-	//验证extra值
-	
-	//全部区块的extra的开头都必定是0x41
-	var extras [][]byte
-	
-	if header.Extra[0] != 0x41 {
-		return errMissingSignature
-	} 
+	//验证extra值, 格式不对时返回错误而不是panic
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err != nil {
+		return err
+	}
 	
-	//找出入参的块头属于哪个epoch块
-	if !epochBlock {
-		//非epoch区块的extra只能是签名
-		if len(header.Extra) != crypto.SignatureLength + 1 {
-			return errInvalidNonEpochExtra
-		}
-		
-	} else  {
-		extras = unserialize(header.Extra)
+	//epoch区块必须带有签名者、提案和委托人, 非epoch区块的extra只能是签名
+	if epochBlock && !extra.Epoch {
+		return errInvalidEpochExtraSigner
+	}
+	if !epochBlock && extra.Epoch {
+		return errInvalidNonEpochExtra
+	}
 	
-		//至少需要一个signer,注意这里还未深入验证
-		if !(len(extras[1])%common.AddressLength ==0 && len(extras[1])/common.AddressLength > 0) {
-			return errInvalidEpochExtraSigner
-		}
-		
-		//必须和Proposals的数量对等
-		if !(len(extras[2])%common.HashLength ==0 && len(extras[2])/common.HashLength == len(Proposals)) {
-			return errInvalidEpochExtraProposal
-		} else {
-						
-			proposalCnt := len(extras[2])/common.HashLength
-			
-			//检查每个提案的值
-			for i := 0; i < proposalCnt; i++ {
-				proposal := &Proposal{}
-				if err := proposal.fromBytes(common.BytesToHash(extras[2][i*common.HashLength:(i+1)*common.HashLength])); err != nil {
-					return err
-				}
-			}
-		}
+	//schedule分叉之后epoch区块必须记录下个epoch出块顺序的种子, 之前不能记录, 参考schedule.go
+	scheduled := self.config.IsSchedule(header.Number)
+	if epochBlock && number > 0 && scheduled && extra.Seed == (common.Hash{}) {
+		return errMissingEpochSeed
+	}
+	if !scheduled && extra.Seed != (common.Hash{}) {
+		return errUnexpectedEpochSeed
 	}
 	
 	//叔块必需是空
@@ -353,12 +450,33 @@ func (self *Dpos) verifyHeader(chain consensus.ChainHeaderReader, header *types.
 		return consensus.ErrUnknownAncestor
 	}
 	
+	//验证最终确定证书, 参考finality.go
+	if extra.Certificate != nil {
+		if err := self.verifyCertificate(chain, header, parents, extra.Certificate); err != nil {
+			return err
+		}
+	}
+	
+	epochHeader := self.epochOfHeader(chain, header, parents)
+	
+	//以提案修改过的参数为准
+	rules := self.rulesOfEpoch(epochHeader, number)
+	
 	//新区块的时间截不能大过父区块 + slotinterval
-	if parent.Time+self.config.SlotInterval > header.Time {
+	if parent.Time+rules.SlotInterval > header.Time {
 		return errInvalidTimestamp
 	}
-
-	epochHeader := self.epochOfHeader(chain, header, parents)
+	
+	//schedule分叉之后时间截必须对齐slot, 参考schedule.go
+	interval := slotIntervalAt(self.config, rules.SlotInterval, number)
+	if interval > 0 && header.Time%interval != 0 {
+		return errUnalignedTimestamp
+	}
+	
+	//设置了gas limit目标时，gas limit必须按规则向目标调整
+	if rules.GasLimitTarget > 0 && header.GasLimit != misc.CalcGasLimit(parent, rules.GasLimitTarget, rules.GasLimitTarget) {
+		return errInvalidGasLimit
+	}
 	
 	if epochHeader != nil {
 		
@@ -370,17 +488,17 @@ func (self *Dpos) verifyHeader(chain consensus.ChainHeaderReader, header *types.
 			return err
 		}
 
-		signers, _, _ := parseEpochExtra(epochHeader)
-		totalSigners := len(signers)
+		epochExtra, err := parseEpochExtra(epochHeader)
+		if err != nil {
+			return err
+		}
+		signers := epochExtra.Signers
 		
 		validSigner := false
-		offset := 0
 		
 		for _, _signer := range signers {
 			if _signer == signer {
 				validSigner = true
-			} else if !validSigner {
-				offset++
 			}
 		}	
 
@@ -388,8 +506,9 @@ func (self *Dpos) verifyHeader(chain consensus.ChainHeaderReader, header *types.
 			return errUnauthorizedSignerAgainstExtra
 		}
 		
-		//这里取inturn的逻辑和snapshot.inturn()里的逻辑是一样的
-		inturn := (number % uint64(totalSigners)) == uint64(offset)
+		//这里取inturn的逻辑和snapshot.inturn()里的逻辑是一样的, 种子记录在epoch区块里, 按时间截所在的slot(分叉之前按块高度)轮流出块
+		parentSlot, slot := slotOf(parent.Time, number-1, interval), slotOf(header.Time, number, interval)
+		inturn := scheduledSigner(signers, epochSeed(self.config, epochHeader, epochExtra), slot) == signer
 		
 		//属inturn的signer必须给对应的难度#2
 		if inturn && header.Difficulty.Cmp(diffInTurn) != 0 {
@@ -400,6 +519,11 @@ func (self *Dpos) verifyHeader(chain consensus.ChainHeaderReader, header *types.
 		if !inturn && header.Difficulty.Cmp(diffNoTurn) != 0 {
 			return errWrongDifficultyAgainstExtra
 		} 
+		
+		//轮不到的signer要等父块之后有超时slot没有出块才能补发, slot为0时没有超时
+		if !inturn && interval > 0 && !timedOut(parentSlot, slot) {
+			return errEarlyOutOfTurn
+		}
 	} else if !epochBlock {
 		/*
 		主要针对轻节点，如果欲验证的块是普通块，那么self.epochOfHeader(...)一定会在parents里找到epoch
@@ -413,6 +537,19 @@ func (self *Dpos) verifyHeader(chain consensus.ChainHeaderReader, header *types.
 	return nil
 }
 
+/*
+从块头所属epoch块的extra读取在该块生效的参数，只需要块头，所以同步块头时也可以用
+
+找不到epoch块时只用链配置
+*/
+func (self *Dpos) rulesOfEpoch(epochHeader *types.Header, number uint64) *Rules {
+	epochExtra, err := parseEpochExtra(epochHeader)
+	if err != nil {
+		return newRules(self.config, number, nil)
+	}
+	return newRules(self.config, number, epochExtra.Proposals)
+}
+
 /*
 实现 consensus.Engine 接口
 */
@@ -422,8 +559,6 @@ func(self *Dpos) VerifySeal(chain consensus.ChainHeaderReader, header *types.Hea
 
 func (self *Dpos) verifySeal(chain consensus.ChainHeaderReader, header *types.Header, parents []*types.Header) error {
 	
-	extras := unserialize(header.Extra)
-	
 	//不接受创世块
 	number := header.Number.Uint64()
 	if number == 0 {
@@ -432,22 +567,74 @@ func (self *Dpos) verifySeal(chain consensus.ChainHeaderReader, header *types.He
 	epochBlock := (number % self.config.EpochInterval) == 0
 	
 	//取快照做二度检查
-	snap, err := self.snapshot(chain, number-1, header.ParentHash, parents)
+	var (
+		snap *Snapshot
+		err  error
+	)
+	if parent := chain.GetHeader(header.ParentHash, number-1); parent != nil && len(parents) == 0 {
+		//轻节点没有区块体, snapshotOf(...)改由EpochRetriever取得快照
+		ctx, cancel := context.WithTimeout(context.Background(), lightRetrieveTimeout)
+		snap, err = self.snapshotOf(ctx, chain, parent)
+		cancel()
+	} else {
+		snap, err = self.snapshot(chain, number-1, header.ParentHash, parents)
+	}
 	if err != nil {
 		return err
 	}
 	
-	if epochBlock {
-		//把本地签名者生成bytes (list)
-		signers := make([]byte, len(snap.PreElectedSigners)*common.AddressLength)
-		for i, signer := range snap.preElectedSigners() {
-			copy(signers[i*common.AddressLength:], signer[:])
+	//轻节点的快照没有抵押金额, 无法重新选举, epoch区块的签名者只能以块头链为准
+	if epochBlock && !snap.Light {
+		epochExtra, err := parseEpochExtra(header)
+		if err != nil {
+			return err
 		}
 		
 		//比较本地与入参的签名者是否一样
-		if !bytes.Equal(signers, extras[1]) {
+		signers := snap.preElectedSigners()
+		if len(signers) != len(epochExtra.Signers) {
 			return errMismatchingEpochSigners
 		}
+		for i, signer := range signers {
+			if signer != epochExtra.Signers[i] {
+				return errMismatchingEpochSigners
+			}
+		}
+		
+		//比较本地与入参的委托人和份额是否一样, 份额决定了下个epoch的分红
+		for i, signer := range signers {
+			delegators := snap.PreElectedDelegators[signer]
+			if len(delegators) != len(epochExtra.Delegators[i]) {
+				return errMismatchingEpochDelegators
+			}
+			for j, delegator := range delegators {
+				if delegator != epochExtra.Delegators[i][j] {
+					return errMismatchingEpochDelegators
+				}
+			}
+		}
+		
+		//提案结果决定了下个epoch的奖励和出块间隔等规则, 必须和本地的完全一样(相同的ID和值)
+		proposals := snap.unconfirmedProposals()
+		if len(proposals) != len(epochExtra.Proposals) {
+			return errMismatchingEpochProposals
+		}
+		for i, proposalBytes := range proposals {
+			if extraBytes, err := epochExtra.Proposals[i].toBytes(); err != nil || extraBytes != proposalBytes {
+				return errMismatchingEpochProposals
+			}
+		}
+	}
+	
+	//种子必须是出块之前的RANDAO mix, 轻快照没有mix时以块头链为准
+	if epochBlock && snap.Mix != (common.Hash{}) && self.config.IsSchedule(header.Number) {
+		epochExtra, err := parseEpochExtra(header)
+		if err != nil {
+			return err
+		}
+		if epochExtra.Seed != snap.Mix {
+			return errMismatchingEpochSeed
+		}
 	}
 	
 	//检查签名者是否合格
@@ -470,9 +657,14 @@ func (self *Dpos) verifySeal(chain consensus.ChainHeaderReader, header *types.He
 		}
 	}
 	
+	//公开的RANDAO秘密必须符合承诺
+	if err := snap.verifyRandao(signer, header); err != nil {
+		return err
+	}
+	
 	//正式检查难度
 	if !self.fakeDiff {
-		inturn := snap.inturn(header.Number.Uint64(), signer)
+		inturn := snap.inturn(snap.slot(header.Time), signer)
 		//属inturn的signer必须给对应的难度#2
 		if inturn && header.Difficulty.Cmp(diffInTurn) != 0 {
 			return errWrongDifficultyAgainstSnap
@@ -519,12 +711,46 @@ func(self *Dpos) Prepare(chain consensus.ChainHeaderReader, header *types.Header
 		return consensus.ErrUnknownAncestor
 	}
 	
-	//header.Time 等于 max(parent.Time + Period, now) 
-	header.Time = parent.Time + self.config.SlotInterval
-	if header.Time < uint64(time.Now().Unix()) {
-		header.Time = uint64(time.Now().Unix())
+	snap, err := self.snapshot(chain, number-1, header.ParentHash, nil)
+	if err != nil {
+		return err
+	}
+	rules := snap.rules()
+	
+	//提案设置了gas limit目标时，取代矿工自己的目标
+	if rules.GasLimitTarget > 0 {
+		header.GasLimit = misc.CalcGasLimit(parent, rules.GasLimitTarget, rules.GasLimitTarget)
 	}
 	
+	//slot为0时(包括schedule分叉之前), header.Time 等于 max(parent.Time + slotinterval, now)
+	interval := slotIntervalAt(self.config, rules.SlotInterval, number)
+	if interval == 0 {
+		header.Time = parent.Time + rules.SlotInterval
+		if header.Time < uint64(time.Now().Unix()) {
+			header.Time = uint64(time.Now().Unix())
+		}
+		return nil
+	}
+	
+	/*
+	否则header.Time对齐到slot, 取父块之后、不早于现在的第一个slot
+	
+	轮不到自己出块时, 要等父块之后有timeoutSlots个slot没有出块, 在这之前轮到自己的slot就用那个slot, 参考schedule.go
+	*/
+	self.lock.RLock()
+	signer := self.signer
+	self.lock.RUnlock()
+	
+	parentSlot := parent.Time / interval
+	slot := parentSlot + 1
+	if now := (uint64(time.Now().Unix()) + interval - 1) / interval; now > slot {
+		slot = now
+	}
+	for !timedOut(parentSlot, slot) && snap.inturnSigner(slot) != signer {
+		slot++
+	}
+	header.Time = slot * interval
+	
 	return nil
 }
 
@@ -539,64 +765,67 @@ func(self *Dpos) Prepare(chain consensus.ChainHeaderReader, header *types.Header
 
 */
 func(self *Dpos) Finalize(chain consensus.ChainHeaderReader, header *types.Header, _state *state.StateDB, txs []*types.Transaction,
-		uncles []*types.Header) {
-	
-	self.state = _state
-	//读取应得的奖励
-	blockReward := FrontierBlockReward
-	
-	if chain.Config().IsByzantium(header.Number) {
-		blockReward = ByzantiumBlockReward
-	}
-	if chain.Config().IsConstantinople(header.Number) {
-		blockReward = ConstantinopleBlockReward
-	}
+		uncles []*types.Header) error {
 	
 	//如果是下载的块，signer一定会有值
 	signer, _ := ecrecover(header, self.signatures); 
+	signed := signer != (common.Address{})
 	
-	if signer == (common.Address{}) {
+	if !signed {
 		//否则这是miner正想打造的新区块
 		signer = self.signer 
 	} 
 	
-	//把奖励发给签名者
-	toSigner := new(big.Int).Set(blockReward)
-	toSigner.Mul(toSigner, big.NewInt(signerReward))
-	toSigner.Div(toSigner, big.NewInt(100))
+	//把奖励发给签名者和委托人
+	toSigner, delegators, rewards := self.blockRewards(chain, header, signer)
 	
 	_state.AddBalance(signer, toSigner)
+	for i, delegator := range delegators {
+		_state.AddBalance(delegator.Delegator, rewards[i])
+	}
 	
-	//把奖励发给委托人
-	toDelegators :=  new(big.Int).Set(blockReward)
-	toDelegators.Sub(toDelegators, toSigner)
+	/*
+	epoch区块时，把到期的解押金从托管账户退回给委托人，并销毁双签者被罚没的抵押金
 	
-	//找出入参的块头属于哪个epoch块
-	epochHeader := self.epochOfHeader(chain, header, nil)
-
-	signers, _, delegatorss := parseEpochExtra(epochHeader)
+	只依赖父块的快照，所以本块的txs不会影响结算的结果
 	
-	electedDelegators :=  make(map[common.Address][]ElectedDelegator)
-	for k, delegators := range delegatorss {
-		for _, delegator := range delegators {
-			electedDelegators[signers[k]]= append(electedDelegators[signers[k]], delegator)
+	取不到快照时结算不了, 各节点的state会不同, 所以这个块无效
+	*/
+	number := header.Number.Uint64()
+	epochBlock := number%self.config.EpochInterval == 0
+	if epochBlock {
+		snap, err := self.snapshot(chain, number-1, header.ParentHash, nil)
+		if err != nil {
+			return err
 		}
+		released, slashed := snap.copy().settle(number)
+		
+		for _, unbonding := range released {
+			_state.SubBalance(self.config.SystemAddress, unbonding.Amount)
+			_state.AddBalance(unbonding.Delegator, unbonding.Amount)
+		}
+		_state.SubBalance(self.config.SystemAddress, slashed)
 	}
 	
-	totalDelegators := len(electedDelegators[signer])
-	
-	if totalDelegators > 0 {
-		//取中选的Delegators，他们是获利者 
-		for _, delegator := range electedDelegators[signer] {
-				
-			portionAmt := new(big.Float).Mul(new(big.Float).SetInt(toDelegators), big.NewFloat(float64(delegator.Portion))) 
-			
-			delegatorReward := new(big.Int)
-			portionAmt.Int(delegatorReward)
+	/*
+	把执行完本块后的快照写入系统账户的storage, 参考registry.go, 快速同步的节点从pivot块的state取得完整的快照
 	
-			_state.AddBalance(delegator.Delegator, delegatorReward)
+	本块已接受的action都记录在state的log里, 和系统合约读到的快照一样。
+	只有action和epoch区块的结算会改变候选人、委托关系和抵押金, 其他块不用比较; 创世块的state里没有registry, 写入之前每块都要检查
+	*/
+	logs := _state.Logs()
+	snap, err := self.finalSnapshot(chain, header, signer, logs)
+	if err != nil {
+		//本地不是合格的签名者时出不了这个块, 只是组装pending state, 不记块头
+		if signed {
+			return err
+		}
+		if snap, err = self.pendingSnapshot(chain, header, logs); err != nil {
+			return err
 		}
 	}
+	registry := epochBlock || hasAcceptedAction(logs, self.config.SystemAddress) || !registryWritten(_state, self.config.SystemAddress)
+	writeRegistry(_state, self.config.SystemAddress, snap, registry)
 	
 	/*
 	到这里，取总TX费用的奖励怎么没看到？其实这个已发生在
@@ -608,6 +837,58 @@ func(self *Dpos) Finalize(chain consensus.ChainHeaderReader, header *types.Heade
 	
 	/*uncle不存在于Dpos*/
 	header.UncleHash = types.CalcUncleHash(nil)
+	
+	return nil
+}
+
+/*
+计算签名者出块的奖励, 返回签名者的奖励(包括委托人分剩的余数)、签名者的中选委托人和他们各自的奖励
+
+只需要块头, dpos.getRewards也用它查询旧块的奖励
+*/
+func (self *Dpos) blockRewards(chain consensus.ChainHeaderReader, header *types.Header, signer common.Address) (*big.Int, []ElectedDelegator, []*big.Int) {
+	
+	//找出入参的块头属于哪个epoch块
+	epochHeader := self.epochOfHeader(chain, header, nil)
+	
+	//读取本块生效的经济参数, 提案优先于链配置
+	rules := self.rulesOfEpoch(epochHeader, header.Number.Uint64())
+	
+	//读取应得的奖励, 链配置没有设置则按硬分叉
+	blockReward := rules.BlockReward
+	
+	if blockReward == nil {
+		blockReward = FrontierBlockReward
+		
+		if chain.Config().IsByzantium(header.Number) {
+			blockReward = ByzantiumBlockReward
+		}
+		if chain.Config().IsConstantinople(header.Number) {
+			blockReward = ConstantinopleBlockReward
+		}
+	}
+	
+	//签名者的份额
+	toSigner := new(big.Int).Set(blockReward)
+	toSigner.Mul(toSigner, new(big.Int).SetUint64(rules.SignerReward))
+	toSigner.Div(toSigner, big.NewInt(100))
+	
+	//委托人的份额
+	toDelegators :=  new(big.Int).Set(blockReward)
+	toDelegators.Sub(toDelegators, toSigner)
+	
+	//块头已经验证过, 读不到epoch块时没有委托人, 奖励全归签名者
+	electedDelegators :=  make(map[common.Address][]ElectedDelegator)
+	if epochExtra, err := parseEpochExtra(epochHeader); err == nil {
+		for k, delegators := range epochExtra.Delegators {
+			electedDelegators[epochExtra.Signers[k]] = delegators
+		}
+	}
+	
+	//取中选的Delegators，他们是获利者，除不尽的余数归签名者
+	rewards, remainder := delegatorRewards(toDelegators, electedDelegators[signer])
+	
+	return toSigner.Add(toSigner, remainder), electedDelegators[signer], rewards
 }
 
 /*
@@ -615,14 +896,10 @@ func(self *Dpos) Finalize(chain consensus.ChainHeaderReader, header *types.Heade
 */
 func(self *Dpos) FinalizeAndAssemble(chain consensus.ChainHeaderReader, header *types.Header, _state *state.StateDB, txs []*types.Transaction, uncles []*types.Header, receipts []*types.Receipt) (*types.Block, error) {
 
-	self.state = _state
-	
-	self.Finalize(chain, header, _state, txs, uncles)
-	
 	number := header.Number.Uint64()
 	/*
-	snapshot必须摆在finalize后面
-	因为计算preElected时是取epochinterval-1块的最终state,所以颁发奖励后的state才是最终的state
+	先组装好块头(投票、难度和extra), 再Finalize(...):
+	Finalize把执行完本块后的快照写入state, 和其他节点导入这个块时一样要用到整个块头
 	*/
 	snap, err := self.snapshot(chain, number-1, header.ParentHash, nil)
 	if err != nil {
@@ -664,63 +941,70 @@ func(self *Dpos) FinalizeAndAssemble(chain consensus.ChainHeaderReader, header *
 	/*
 	计算难度
 	*/
-	header.Difficulty = calcDifficulty(snap, self.signer) 
+	header.Difficulty = calcDifficulty(snap, self.signer, header.Time) 
 
 	/*
 	处理 block.header.extra
 	*/
-	header.Extra = make([]byte,0)
-
-	//初始化签名值为0x00...0
-	item := bytes.Repeat([]byte{0x00}, crypto.SignatureLength)
-
-	header.Extra = append(header.Extra, VarIntToBytes(item)...)
-	header.Extra = append(header.Extra, item...)
-
+	//签名值先是0x00...0, 等待Seal(...)填入
+	extra := &EpochExtra{}
+	
 	//epoch区块
 	if number%self.config.EpochInterval == 0 {
-		
-		item = make([]byte,0)
+		extra.Epoch = true
 		
 		//添加中选多签名者的信息, 按地址排序
-		for _, signer := range snap.preElectedSigners() {
-			item = append(item, signer[:]...)
-		}
-		
-		header.Extra = append(header.Extra, VarIntToBytes(item)...)
-		header.Extra = append(header.Extra, item...)
+		extra.Signers = snap.preElectedSigners()
 		
-		item = make([]byte,0)
-		
-		//添加提案结果的信息
+		//添加提案结果的信息, 按提案ID排序
 		for _, proposalBytes := range snap.unconfirmedProposals() {
-			item = append(item, proposalBytes.Bytes()...)
+			proposal := &Proposal{}
+			if err := proposal.fromBytes(proposalBytes); err != nil {
+				return nil, err
+			}
+			extra.Proposals = append(extra.Proposals, proposal)
 		}
 		
-		header.Extra = append(header.Extra, VarIntToBytes(item)...)
-		header.Extra = append(header.Extra, item...)
-		
-		item = make([]byte,0)
-		
 		//添加中选委员人
-		for _, signer := range snap.preElectedSigners() {
-			delegators := snap.PreElectedDelegators[signer]
-			
-			subitem := []byte{}
-			for _, delegator:= range delegators {
-				subitem = append(subitem, delegator.Delegator.Bytes()...)
-				subitem = append(subitem, common.FromHex(fmt.Sprintf("%x", math.Float32bits(delegator.Portion)))...)
-			}
-			
-			item = append(item, VarIntToBytes(subitem)...)
-			item = append(item, subitem...)
+		for _, signer := range extra.Signers {
+			extra.Delegators = append(extra.Delegators, snap.PreElectedDelegators[signer])
 		}
 		
-		header.Extra = append(header.Extra, VarIntToBytes(item)...)
-		header.Extra = append(header.Extra, item...)
-		
+		//schedule分叉之后记录下个epoch出块顺序的种子, 轻节点的快照没有mix, 出不了epoch区块
+		if self.config.IsSchedule(header.Number) {
+			if snap.Light {
+				return nil, errNoMix
+			}
+			extra.Seed = snap.Mix
+		}
+	}
+	
+	//聚合最终确定证书, 参考precommits.go
+	if parent := chain.GetHeader(header.ParentHash, number-1); parent != nil {
+		extra.Certificate = self.certificate(chain, parent)
+	}
+	
+	//RANDAO的承诺和公开, 参考randao.go
+	self.lock.RLock()
+	signer := self.signer
+	self.lock.RUnlock()
+	
+	if signer != (common.Address{}) {
+		extra.Randao = self.makeRandao(snap, signer, number)
 	}
 	
+	if header.Extra, err = extra.Encode(); err != nil {
+		return nil, err
+	}
+	
+	if err := self.Finalize(chain, header, _state, txs, uncles); err != nil {
+		return nil, err
+	}
+	
+	//epoch区块的系统收据也计入收据根和bloom, 参考system.go
+	if receipt := self.SystemReceipt(header, receipts); receipt != nil {
+		receipts = append(receipts[:len(receipts):len(receipts)], receipt)
+	}
 	
 	//返回一个未完成的区块，等待sealing(签名)
 	newBlock := types.NewBlock(header, txs, nil, receipts, new(trie.Trie))
@@ -752,6 +1036,12 @@ func(self *Dpos) Seal(chain consensus.ChainHeaderReader, block *types.Block, res
 		return err
 	}
 	
+	//slot为0时只在有tx时出块, 避免空块刷屏, 和clique一样不当作出块失败
+	if snap.rules().SlotInterval == 0 && len(block.Transactions()) == 0 {
+		log.Info("Sealing paused, waiting for transactions")
+		return nil
+	}
+	
 	//再确定自己是否是合格的签名者
 	if _, authorized := snap.ElectedSigners[signer]; !authorized {
 		return errUnauthorizedSignerAgainstSnap
@@ -773,9 +1063,10 @@ func(self *Dpos) Seal(chain consensus.ChainHeaderReader, block *types.Block, res
 		/*
 		如果自己没有出块优先权，多等待点时间，这就优先给出块人出块权：
 		
-		所以如果拥有出块权的签名者掉线，其他签名者还是可以签发的
+		所以如果拥有出块权的签名者掉线，其他签名者还是可以签发的。这样的块已经在超时slot之后(参考Prepare(...)),
+		要让的是这个slot轮到的签名者
 		*/
-		wiggle := time.Duration(len(snap.ElectedSigners)/2+1) * wiggleTime
+		wiggle := time.Duration(len(snap.ElectedSigners)/2+1) * time.Duration(self.config.Rules(number).WiggleTime) * time.Millisecond
 		delay += time.Duration(rand.Int63n(int64(wiggle)))
 
 		log.Trace("Out-of-turn signing requested", "wiggle", common.PrettyDuration(wiggle))
@@ -793,13 +1084,8 @@ func(self *Dpos) Seal(chain consensus.ChainHeaderReader, block *types.Block, res
 	/*
 	把签名写入extra字段
 	*/
-	extras := unserialize(header.Extra)
-	header.Extra = make([]byte,0)
-	
-	copy(extras[0][:], sighash)
-	for _, extra := range extras {
-		header.Extra = append(header.Extra, VarIntToBytes(extra)...)
-		header.Extra = append(header.Extra, extra...)
+	if header.Extra, err = withSignature(header.Extra, sighash); err != nil {
+		return err
 	}
 
 	//最后，等待seal程序被终止或触发delay超时
@@ -833,19 +1119,21 @@ func(self *Dpos) SealHash(header *types.Header) common.Hash {
 /*
 实现 consensus.Engine 接口
 
-DIFF_NOTURN(2) if BLOCK_NUMBER % SIGNER_COUNT != SIGNER_INDEX
-DIFF_INTURN(1) if BLOCK_NUMBER % SIGNER_COUNT == SIGNER_INDEX
+DIFF_NOTURN(1) if SLOT % SIGNER_COUNT != SIGNER_INDEX
+DIFF_INTURN(2) if SLOT % SIGNER_COUNT == SIGNER_INDEX
+
+SLOT是时间截除以slotinterval, SIGNER_INDEX是签名者在本epoch出块顺序里的位置, 参考schedule.go
 */
 func(self *Dpos) CalcDifficulty(chain consensus.ChainHeaderReader, time uint64, parent *types.Header) *big.Int {
 	snap, err := self.snapshot(chain, parent.Number.Uint64(), parent.Hash(), nil)
 	if err != nil {
 		return nil
 	}
-	return calcDifficulty(snap, self.signer)
+	return calcDifficulty(snap, self.signer, time)
 }
 
-func calcDifficulty(snap *Snapshot, signer common.Address) *big.Int {
-	if snap.inturn(snap.Number+1, signer) {
+func calcDifficulty(snap *Snapshot, signer common.Address, time uint64) *big.Int {
+	if snap.inturn(snap.slot(time), signer) {
 		return new(big.Int).Set(diffInTurn)
 	}
 	return new(big.Int).Set(diffNoTurn)
@@ -865,8 +1153,8 @@ func(self *Dpos) APIs(chain consensus.ChainHeaderReader) []rpc.API {
 
 	return []rpc.API{{
 		Namespace: "dpos",
-		Version:   "1.0",
-		Service:   &API{chain: chain, dpos: self},
+		Version:   apiVersion,
+		Service:   NewAPI(chain, self),
 		Public:    false,
 	}}
 	
@@ -881,8 +1169,8 @@ func(self *Dpos) Close() error {
 
 func (self *Dpos) epochOfHeader(chain consensus.ChainHeaderReader, header *types.Header, _parents []*types.Header) (*types.Header) {
 	
-	var parents []*types.Header
-	copy(parents, _parents)
+	//只截取切片，不会改动调用者的parents
+	parents := _parents
 	
 	number := header.Number.Uint64()
 	
@@ -945,7 +1233,7 @@ func (self *Dpos) snapshot(chain consensus.ChainHeaderReader, number uint64, has
 		//试试在磁盘里找
 		if number%storeSnapInterval == 0 || (number+1)%self.config.EpochInterval == 0 {
 			
-			if s, err := loadSnapshot(self.config, self.signatures, self.db, hash); err == nil {
+			if s, err := loadSnapshot(self.config, self.signatures, self.db, hash); err == nil && self.upgradeSnapshot(chain, s, parents) {
 				log.Trace("Loaded voting snapshot from disk", "number", number, "hash", hash)
 				snap = s
 				break
@@ -971,9 +1259,13 @@ func (self *Dpos) snapshot(chain consensus.ChainHeaderReader, number uint64, has
 			
 			if thisHeader != nil {
 				
-				signers, proposals, delegatorss := parseEpochExtra(thisHeader)
-				
-				snap = newSnapshot(self.config, self.signatures, number, hash, signers,proposals, delegatorss)
+				genesisExtra, err := parseEpochExtra(thisHeader)
+				if err != nil {
+					return nil, err
+				}
+				snap = newSnapshot(self.config, self.signatures, number, hash, genesisExtra.Signers, genesisExtra.Proposals, genesisExtra.Delegators)
+				snap.Seed = epochSeed(self.config, thisHeader, genesisExtra)
+				snap.Time = thisHeader.Time
 				if err := snap.store(self.db); err != nil {
 					return nil, err
 				}
@@ -996,6 +1288,15 @@ func (self *Dpos) snapshot(chain consensus.ChainHeaderReader, number uint64, has
 			if header == nil {
 				return nil, consensus.ErrUnknownAncestor
 			}
+			
+			//父块没有区块体或收据(例如快速同步的pivot块之前)时无法重放, 改从本块state里的registry组装, 参考registry.go
+			if number > 0 && !self.replayable(header.ParentHash, number-1) {
+				if s, err := self.stateSnapshot(chain, header); err == nil {
+					log.Info("Seeded snapshot from registry", "number", number, "hash", hash)
+					snap = s
+					break
+				}
+			}
 		}
 		
 		//把全部走过的区块都存在于headers,之后要给snap.apply做统计用的
@@ -1008,8 +1309,14 @@ func (self *Dpos) snapshot(chain consensus.ChainHeaderReader, number uint64, has
 		headers[i], headers[len(headers)-1-i] = headers[len(headers)-1-i], headers[i]
 	}
 	
+	//apply需要读取块体, 只有头的链(例如HeaderChain)只能用缓存的快照
+	reader, ok := chain.(consensus.ChainReader)
+	if !ok && len(headers) > 0 {
+		return nil, errMissingBody
+	}
+	
 	//处理投票
-	snap, err := snap.apply(chain.(consensus.ChainReader), headers, self.db, self.state) 
+	snap, err := snap.apply(reader, headers, self.db) 
 	if err != nil {
 		
 		return nil, err
@@ -1027,3 +1334,44 @@ func (self *Dpos) snapshot(chain consensus.ChainHeaderReader, number uint64, has
 	
 	return snap, err
 }
+
+/*
+补全旧版本存盘的快照, 补不上时返回false, 调用者不能用这个快照:
+ 1. 没有出块顺序的种子, 从链上取选出当前签名者的epoch区块的种子
+ 2. 没有RANDAO的mix, 旧版本不接受带RANDAO元素的块, 所以mix一定还是创世块的哈希
+ 3. 没有快照所在块的时间截, 从块头补回
+
+parents的用法和snapshot(...)一样, 最后一个可能就是快照的块
+*/
+func (self *Dpos) upgradeSnapshot(chain consensus.ChainHeaderReader, snap *Snapshot, parents []*types.Header) bool {
+	if snap.Mix == (common.Hash{}) {
+		genesis := chain.GetHeaderByNumber(0)
+		if genesis == nil {
+			return false
+		}
+		snap.Mix = genesis.Hash()
+	}
+	if snap.Seed != (common.Hash{}) && snap.Time != 0 {
+		return true
+	}
+	var header *types.Header
+	if len(parents) > 0 && parents[len(parents)-1].Hash() == snap.Hash {
+		header, parents = parents[len(parents)-1], parents[:len(parents)-1]
+	} else {
+		header, parents = chain.GetHeader(snap.Hash, snap.Number), nil
+	}
+	if header == nil {
+		return false
+	}
+	snap.Time = header.Time
+	if snap.Seed != (common.Hash{}) {
+		return true
+	}
+	epochHeader, _ := ancestorOf(chain, header, parents, snap.Number-snap.Number%self.config.EpochInterval)
+	epochExtra, err := parseEpochExtra(epochHeader)
+	if err != nil {
+		return false
+	}
+	snap.Seed = epochSeed(self.config, epochHeader, epochExtra)
+	return true
+}
@@ -0,0 +1,137 @@
+package dpos
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// 由key组装链头之后的下一块, forge可以在重新签名之前修改extra
+func forgeTestHeader(t *testing.T, chain *core.BlockChain, engine *Dpos, key *ecdsa.PrivateKey, forge func(*EpochExtra)) *types.Header {
+	engine.Authorize(crypto.PubkeyToAddress(key.PublicKey), nil)
+
+	parent := chain.CurrentBlock()
+	header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number(), big.NewInt(1)), GasLimit: parent.GasLimit()}
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare block #%d: %v", header.Number, err)
+	}
+	header.Time = slotTestTime(t, chain, engine, key)
+
+	statedb, _ := chain.StateAt(parent.Root())
+	block, err := engine.FinalizeAndAssemble(chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to assemble block #%d: %v", header.Number, err)
+	}
+	header = block.Header()
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err != nil {
+		t.Fatalf("failed to decode extra: %v", err)
+	}
+	forge(extra)
+	if err := resealTestHeader(header, extra, key); err != nil {
+		t.Fatalf("failed to reseal: %v", err)
+	}
+	return header
+}
+
+// epoch区块只改提案结果也要被拒绝, 否则出块者可以自行决定下个epoch的奖励和出块间隔
+func TestForgedEpochProposals(t *testing.T) {
+	keys := sortedTestKeys(1)
+	chain, engine := newTestChain(t, keys, nil, 3, []int{0, 0})
+	defer chain.Stop()
+
+	honest := forgeTestHeader(t, chain, engine, keys[0], func(*EpochExtra) {})
+	if err := engine.VerifySeal(chain, honest); err != nil {
+		t.Fatalf("honest epoch block rejected: %v", err)
+	}
+	forged := forgeTestHeader(t, chain, engine, keys[0], func(extra *EpochExtra) {
+		proposal, _ := getProposal(BlockRewardProposal)
+		proposal.Values = []interface{}{new(big.Int).Mul(big.NewInt(1000), big.NewInt(1e18))}
+		extra.Proposals = append(extra.Proposals, proposal)
+	})
+	if err := engine.VerifySeal(chain, forged); err != errMismatchingEpochProposals {
+		t.Errorf("forged proposal error mismatch: have %v, want %v", err, errMismatchingEpochProposals)
+	}
+}
+
+// epoch区块的委托人和份额必须和本地选出的一样, 只检查份额总和不超过portionBase是不够的
+func TestForgedEpochDelegators(t *testing.T) {
+	keys := sortedTestKeys(1)
+	chain, engine := newTestChain(t, keys, nil, 3, []int{0, 0})
+	defer chain.Stop()
+
+	var (
+		signer    = crypto.PubkeyToAddress(keys[0].PublicKey)
+		delegator = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+	)
+	//在缓存的父块快照上放一个预选的委托人
+	parent := chain.CurrentHeader()
+	snap, err := engine.snapshot(chain, parent.Number.Uint64(), parent.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	snap.PreElectedDelegators[signer] = []ElectedDelegator{{Delegator: delegator, Portion: uint32(portionBase)}}
+
+	honest := forgeTestHeader(t, chain, engine, keys[0], func(*EpochExtra) {})
+	if err := engine.VerifySeal(chain, honest); err != nil {
+		t.Fatalf("honest epoch block rejected: %v", err)
+	}
+	forgeries := []func(*EpochExtra){
+		func(extra *EpochExtra) { extra.Delegators[0][0].Portion = uint32(portionBase / 2) },
+		func(extra *EpochExtra) { extra.Delegators[0][0].Delegator = common.Address{0xf2} },
+		func(extra *EpochExtra) { extra.Delegators[0] = nil },
+	}
+	for i, forge := range forgeries {
+		forged := forgeTestHeader(t, chain, engine, keys[0], forge)
+		if err := engine.VerifySeal(chain, forged); err != errMismatchingEpochDelegators {
+			t.Errorf("forgery %d: error mismatch: have %v, want %v", i, err, errMismatchingEpochDelegators)
+		}
+	}
+}
+
+// epoch区块的种子必须是出块之前的RANDAO mix, 否则出块者可以挑选下个epoch的出块顺序
+func TestForgedEpochSeed(t *testing.T) {
+	keys := sortedTestKeys(1)
+	chain, engine := newTestChain(t, keys, nil, 3, []int{0, 0})
+	defer chain.Stop()
+
+	parent := chain.CurrentHeader()
+	snap, err := engine.snapshot(chain, parent.Number.Uint64(), parent.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	honest := forgeTestHeader(t, chain, engine, keys[0], func(*EpochExtra) {})
+	if extra, err := parseEpochExtra(honest); err != nil || extra.Seed != snap.Mix {
+		t.Fatalf("epoch seed mismatch: have %v, want %x", extra, snap.Mix)
+	}
+	if err := engine.VerifySeal(chain, honest); err != nil {
+		t.Fatalf("honest epoch block rejected: %v", err)
+	}
+	forged := forgeTestHeader(t, chain, engine, keys[0], func(extra *EpochExtra) { extra.Seed = common.Hash{0x01} })
+	if err := engine.VerifySeal(chain, forged); err != errMismatchingEpochSeed {
+		t.Errorf("forged seed error mismatch: have %v, want %v", err, errMismatchingEpochSeed)
+	}
+	missing := forgeTestHeader(t, chain, engine, keys[0], func(extra *EpochExtra) { extra.Seed = common.Hash{} })
+	if err := engine.VerifyHeader(chain, missing, false); err != errMissingEpochSeed {
+		t.Errorf("missing seed error mismatch: have %v, want %v", err, errMissingEpochSeed)
+	}
+}
+
+// 取不到快照时Finalize要返回错误, 不能跳过结算和registry
+func TestFinalizeMissingSnapshot(t *testing.T) {
+	keys := sortedTestKeys(1)
+	chain, engine := newTestChain(t, keys, nil, 3, []int{0, 0})
+	defer chain.Stop()
+
+	parent := chain.CurrentBlock()
+	statedb, _ := chain.StateAt(parent.Root())
+	header := &types.Header{ParentHash: common.Hash{0xff}, Number: big.NewInt(3), Time: parent.Time() + 1, Extra: parent.Extra()}
+	if err := engine.Finalize(chain, header, statedb, nil, nil); err == nil {
+		t.Errorf("epoch block finalized without a snapshot")
+	}
+}
@@ -0,0 +1,423 @@
+/*
+dpos区块头extra的编解码
+
+格式:
+ 1. 版本(1 byte), 目前只有extraVersion
+ 2. 签名(65 bytes), 封块前全是0x00
+ 3. 只有epoch区块和创世块才有以下三项, 每项前面是varint长度(<=0xfc时1 byte, 否则0xfd加2 bytes大端):
+    签名者(按地址从小到大), 提案(按提案ID从小到大), 委托人(每位签名者一个varint子项, 子项里每位委托人是地址加4 bytes份额)
+ 4. 可选的扩展项, 任何区块都可以有, 也是varint长度的一项, 里面每个扩展是1 byte标签加一个varint子项, 标签从小到大且不能重复:
+    extFinality: 最终确定证书, 块高度(8 bytes大端)、块哈希和签名者的预提交签名(按签名者地址从小到大), 参考finality.go
+    extRandao: RANDAO承诺(32 bytes), 可以再接公开的秘密(32 bytes), 参考randao.go
+    extSeed: 出块顺序的种子(32 bytes), 即出epoch区块之前的RANDAO mix, 只有epoch区块才有, 参考schedule.go
+
+所以签名后面有0项或1项的是普通区块, 有3项或4项的是epoch区块
+
+解码会检查所有长度, 格式不对的extra返回错误而不是panic, 所以可以直接用在来自网络的块头
+*/
+package dpos
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	//第一个格式的版本, 它本来是签名的varint长度(65), 沿用它当版本, 已有的链和创世块不用改
+	extraVersion byte = 0x41
+
+	extraSealLength = 1 + crypto.SignatureLength //版本加签名, 非epoch区块的extra只有这部分
+
+	maxExtraSigners  = 255    //epoch区块最多记录多少位签名者
+	maxExtraItemSize = 0xffff //varint最多可以表示的长度
+
+	portionLength   = 4 //委托人份额是uint32
+	delegatorLength = common.AddressLength + portionLength
+
+	extFinality byte = 0x01 //扩展项里最终确定证书的标签
+	extRandao   byte = 0x02 //扩展项里RANDAO承诺和公开的标签
+	extSeed     byte = 0x03 //扩展项里出块顺序种子的标签
+)
+
+// EpochExtra is the decoded extra-data of a DPOS header. Only epoch blocks and
+// the genesis carry the signers, proposals and delegators after the signature.
+type EpochExtra struct {
+	Signature  [crypto.SignatureLength]byte
+	Epoch      bool                 //是否带有签名者、提案和委托人
+	Signers    []common.Address     //按地址从小到大
+	Proposals  []*Proposal          //按提案ID从小到大
+	Delegators [][]ElectedDelegator //和Signers一一对应
+
+	Certificate *Certificate //可选的最终确定证书, 任何区块都可以有
+	Randao      *Randao      //可选的RANDAO承诺和公开, 任何区块都可以有
+	Seed        common.Hash  //下个epoch出块顺序的种子, 只有epoch区块才有, 全0表示没有
+}
+
+// Encode validates the extra-data and serializes it.
+func (e *EpochExtra) Encode() ([]byte, error) {
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	extra := append([]byte{extraVersion}, e.Signature[:]...)
+	if !e.Epoch {
+		return e.appendExtensions(extra)
+	}
+	signers := make([]byte, 0, len(e.Signers)*common.AddressLength)
+	for _, signer := range e.Signers {
+		signers = append(signers, signer[:]...)
+	}
+	proposals := make([]byte, 0, len(e.Proposals)*common.HashLength)
+	for _, proposal := range e.Proposals {
+		//按已登记的提案编码, 不依赖调用者填好的函数
+		registered, err := getProposal(proposal.Id)
+		if err != nil {
+			return nil, errInvalidEpochExtraProposal
+		}
+		registered.Values = proposal.Values
+
+		hash, err := registered.toBytes()
+		if err != nil {
+			return nil, err
+		}
+		proposals = append(proposals, hash[:]...)
+	}
+	var (
+		delegators []byte
+		err        error
+	)
+	for _, list := range e.Delegators {
+		segment := make([]byte, 0, len(list)*delegatorLength)
+		for _, delegator := range list {
+			portion := make([]byte, portionLength)
+			binary.BigEndian.PutUint32(portion, delegator.Portion)
+
+			segment = append(segment, delegator.Delegator[:]...)
+			segment = append(segment, portion...)
+		}
+		if delegators, err = appendItem(delegators, segment); err != nil {
+			return nil, errInvalidEpochExtraDelegator
+		}
+	}
+	for _, item := range [][]byte{signers, proposals, delegators} {
+		if extra, err = appendItem(extra, item); err != nil {
+			return nil, err
+		}
+	}
+	return e.appendExtensions(extra)
+}
+
+/*
+有扩展时把扩展项接到extra后面
+*/
+func (e *EpochExtra) appendExtensions(extra []byte) ([]byte, error) {
+	var (
+		extensions []byte
+		err        error
+	)
+	//按标签从小到大
+	if e.Certificate != nil {
+		if extensions, err = appendItem(append(extensions, extFinality), e.Certificate.encode()); err != nil {
+			return nil, errInvalidCertificate
+		}
+	}
+	if e.Randao != nil {
+		if extensions, err = appendItem(append(extensions, extRandao), e.Randao.encode()); err != nil {
+			return nil, errInvalidRandao
+		}
+	}
+	if e.Seed != (common.Hash{}) {
+		if extensions, err = appendItem(append(extensions, extSeed), e.Seed[:]); err != nil {
+			return nil, err
+		}
+	}
+	if len(extensions) == 0 {
+		return extra, nil
+	}
+	return appendItem(extra, extensions)
+}
+
+/*
+解码扩展项, 标签必须从小到大, 不认识的标签返回错误
+*/
+func (e *EpochExtra) decodeExtensions(data []byte) error {
+	//没有扩展时不写扩展项, 空的扩展项不是最短的写法
+	if len(data) == 0 {
+		return errInvalidExtra
+	}
+	var last byte
+	for len(data) > 0 {
+		tag := data[0]
+		if tag <= last {
+			return errInvalidExtra
+		}
+		last = tag
+
+		//每个扩展只有一个子项, 先切出这一项再看后面
+		item, rest, err := splitItem(data[1:])
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case extFinality:
+			certificate := new(Certificate)
+			if err := certificate.decode(item); err != nil {
+				return err
+			}
+			e.Certificate = certificate
+		case extRandao:
+			randao := new(Randao)
+			if err := randao.decode(item); err != nil {
+				return err
+			}
+			e.Randao = randao
+		case extSeed:
+			//全0的种子等于没有, 不是最短的写法
+			if len(item) != common.HashLength || common.BytesToHash(item) == (common.Hash{}) {
+				return errInvalidExtra
+			}
+			e.Seed = common.BytesToHash(item)
+		default:
+			return errInvalidExtra
+		}
+		data = rest
+	}
+	return nil
+}
+
+// Decode parses and validates the extra-data, returning an error instead of
+// panicking on malformed input.
+func (e *EpochExtra) Decode(extra []byte) error {
+	*e = EpochExtra{}
+
+	if len(extra) < extraSealLength {
+		return errMissingSignature
+	}
+	if extra[0] != extraVersion {
+		return errUnknownExtraVersion
+	}
+	copy(e.Signature[:], extra[1:extraSealLength])
+
+	if len(extra) == extraSealLength {
+		return nil
+	}
+	items, err := splitItems(extra[extraSealLength:])
+	if err != nil {
+		return err
+	}
+	//最后一项是扩展项
+	if len(items) == 1 || len(items) == 4 {
+		if err := e.decodeExtensions(items[len(items)-1]); err != nil {
+			return err
+		}
+		items = items[:len(items)-1]
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	if len(items) != 3 {
+		return errInvalidExtra
+	}
+	e.Epoch = true
+
+	//签名者
+	if len(items[0])%common.AddressLength != 0 {
+		return errInvalidEpochExtraSigner
+	}
+	for i := 0; i < len(items[0]); i += common.AddressLength {
+		e.Signers = append(e.Signers, common.BytesToAddress(items[0][i:i+common.AddressLength]))
+	}
+	//提案
+	if len(items[1])%common.HashLength != 0 {
+		return errInvalidEpochExtraProposal
+	}
+	for i := 0; i < len(items[1]); i += common.HashLength {
+		proposal := new(Proposal)
+		if err := proposal.fromBytes(common.BytesToHash(items[1][i : i+common.HashLength])); err != nil {
+			return err
+		}
+		e.Proposals = append(e.Proposals, proposal)
+	}
+	//委托人
+	segments, err := splitItems(items[2])
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if len(segment)%delegatorLength != 0 {
+			return errInvalidEpochExtraDelegator
+		}
+		list := make([]ElectedDelegator, 0, len(segment)/delegatorLength)
+		for i := 0; i < len(segment); i += delegatorLength {
+			list = append(list, ElectedDelegator{
+				Delegator: common.BytesToAddress(segment[i : i+common.AddressLength]),
+				Portion:   binary.BigEndian.Uint32(segment[i+common.AddressLength : i+delegatorLength]),
+			})
+		}
+		e.Delegators = append(e.Delegators, list)
+	}
+	return e.validate()
+}
+
+// validate checks the invariants shared by encoding and decoding.
+func (e *EpochExtra) validate() error {
+	if !e.Epoch {
+		if len(e.Signers) > 0 || len(e.Proposals) > 0 || len(e.Delegators) > 0 || e.Seed != (common.Hash{}) {
+			return errInvalidNonEpochExtra
+		}
+		return nil
+	}
+	//至少需要一个签名者, 按地址从小到大且不能重复
+	if len(e.Signers) == 0 || len(e.Signers) > maxExtraSigners {
+		return errInvalidEpochExtraSigner
+	}
+	for i := 1; i < len(e.Signers); i++ {
+		if bytes.Compare(e.Signers[i-1][:], e.Signers[i][:]) >= 0 {
+			return errInvalidEpochExtraSigner
+		}
+	}
+	//只记录曾经定案的提案, 按提案ID从小到大且不能重复
+	if len(e.Proposals) > len(Proposals) {
+		return errInvalidEpochExtraProposal
+	}
+	for i, proposal := range e.Proposals {
+		if proposal == nil || (i > 0 && proposal.Id <= e.Proposals[i-1].Id) {
+			return errInvalidEpochExtraProposal
+		}
+	}
+	//每位签名者的委托人份额加起来不能超过100%
+	if len(e.Delegators) != len(e.Signers) {
+		return errInvalidEpochExtraDelegator
+	}
+	for _, list := range e.Delegators {
+		sum := uint64(0)
+		for _, delegator := range list {
+			sum += uint64(delegator.Portion)
+		}
+		if sum > portionBase {
+			return errInvalidEpochExtraPortion
+		}
+	}
+	return nil
+}
+
+/*
+读取块头的extra, 必须是epoch区块或创世块的格式
+*/
+func parseEpochExtra(header *types.Header) (*EpochExtra, error) {
+	if header == nil {
+		return nil, errMissingEpochBlock
+	}
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err != nil {
+		return nil, err
+	}
+	if !extra.Epoch {
+		return nil, errInvalidEpochExtraSigner
+	}
+	return extra, nil
+}
+
+/*
+取出签名, 只检查版本和长度, 不解码后面的部分
+*/
+func extraSignature(extra []byte) ([]byte, error) {
+	if len(extra) < extraSealLength {
+		return nil, errMissingSignature
+	}
+	if extra[0] != extraVersion {
+		return nil, errUnknownExtraVersion
+	}
+	return extra[1:extraSealLength], nil
+}
+
+/*
+返回把签名填入后的extra副本
+*/
+func withSignature(extra []byte, signature []byte) ([]byte, error) {
+	if _, err := extraSignature(extra); err != nil {
+		return nil, err
+	}
+	if len(signature) != crypto.SignatureLength {
+		return nil, errInvalidExtra
+	}
+	sealed := common.CopyBytes(extra)
+	copy(sealed[1:extraSealLength], signature)
+
+	return sealed, nil
+}
+
+/*
+返回签名清零后的extra副本, 用来计算SealHash
+
+格式不对的extra原样返回, 这样的块头在verifyHeader就会被拒绝
+*/
+func unsealedExtra(extra []byte) []byte {
+	unsealed := common.CopyBytes(extra)
+	if _, err := extraSignature(extra); err == nil {
+		copy(unsealed[1:extraSealLength], make([]byte, crypto.SignatureLength))
+	}
+	return unsealed
+}
+
+/*
+加上varint长度后接到dst后面
+*/
+func appendItem(dst []byte, item []byte) ([]byte, error) {
+	switch {
+	case len(item) <= 0xfc:
+		dst = append(dst, byte(len(item)))
+	case len(item) <= maxExtraItemSize:
+		dst = append(dst, 0xfd, byte(len(item)>>8), byte(len(item)))
+	default:
+		return nil, errInvalidExtra
+	}
+	return append(dst, item...), nil
+}
+
+/*
+按varint长度切分, 长度必须是最短的写法, 不能越界也不能有多余的bytes
+*/
+func splitItems(data []byte) ([][]byte, error) {
+	var items [][]byte
+
+	for len(data) > 0 {
+		item, rest, err := splitItem(data)
+		if err != nil {
+			return nil, err
+		}
+		items, data = append(items, item), rest
+	}
+	return items, nil
+}
+
+/*
+切出开头的一项, 返回这一项和剩下的bytes
+*/
+func splitItem(data []byte) ([]byte, []byte, error) {
+	var size int
+
+	switch {
+	case len(data) == 0:
+		return nil, nil, errInvalidExtra
+	case data[0] <= 0xfc:
+		size, data = int(data[0]), data[1:]
+	case data[0] == 0xfd:
+		if len(data) < 3 {
+			return nil, nil, errInvalidExtra
+		}
+		size, data = int(binary.BigEndian.Uint16(data[1:3])), data[3:]
+		if size <= 0xfc {
+			return nil, nil, errInvalidExtra
+		}
+	default:
+		return nil, nil, errInvalidExtra
+	}
+	if size > len(data) {
+		return nil, nil, errInvalidExtra
+	}
+	return data[:size], data[size:], nil
+}
@@ -0,0 +1,378 @@
+/*
+不可逆区块(finality)
+
+一个区块在超过2/3的当选签名者在它之上(包括它本身)出过块之后就不可逆了: 要分叉到它之前, 需要超过1/3的签名者在两条链上都签名。
+从链头往回走, 记下出过块的当选签名者, 人数刚好超过2/3时所在的区块就是最后的不可逆区块。
+
+签名者以链头所属epoch的选举结果为准, 不在其中的签名者不算数。超过1/3的签名者离线时, finality会停在原处,
+所以最多只往回找一个epoch的长度。
+
+除了数后代块, 签名者还会对新的链头签预提交投票(参考precommits.go), 投票通过dposv子协议传播(参考protocol.go)。
+某块的投票超过2/3当选签名者时, 之后出块的签名者把这些签名聚合成最终确定证书放进extra(参考extra.go),
+证书所证明的块马上不可逆, 不用等2/3的签名者轮流出块。证书只需要块头和epoch区块就能验证, 跨链桥也可以用。
+*/
+package dpos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const certificateHeaderLength = 8 + common.HashLength //证书的块高度和块哈希
+
+var (
+	//预提交投票签名的数据前缀, 避免和其他签名混淆
+	precommitPrefix = []byte("dpos precommit vote")
+
+	//投票的签名格式不对
+	errInvalidPrecommit = errors.New("Invalid precommit vote signature")
+
+	//投票者不是该块所属epoch的当选签名者
+	errUnauthorizedPrecommit = errors.New("Unauthorized precommit voter")
+
+	//投票的块太旧
+	errStalePrecommit = errors.New("Stale precommit vote")
+
+	//投票者在同一高度已经投过另一个块
+	errDoublePrecommit = errors.New("Conflicting precommit vote")
+
+	//最终确定证书格式不对、不是祖先块或签名不足
+	errInvalidCertificate = errors.New("Invalid finality certificate")
+)
+
+// Precommit is a precommit vote of an elected signer for a block.
+type Precommit struct {
+	Number    uint64
+	Hash      common.Hash
+	Signature []byte
+}
+
+/*
+签名者签的数据: 前缀、块高度(8 bytes大端)和块哈希, 签名的是它的keccak256
+*/
+func precommitData(number uint64, hash common.Hash) []byte {
+	data := make([]byte, len(precommitPrefix)+8+common.HashLength)
+	copy(data, precommitPrefix)
+	binary.BigEndian.PutUint64(data[len(precommitPrefix):], number)
+	copy(data[len(precommitPrefix)+8:], hash[:])
+	return data
+}
+
+// DecodePrecommitData parses the data a signer signs for a precommit vote.
+func DecodePrecommitData(data []byte) (uint64, common.Hash, error) {
+	if len(data) != len(precommitPrefix)+8+common.HashLength || !bytes.HasPrefix(data, precommitPrefix) {
+		return 0, common.Hash{}, errInvalidPrecommit
+	}
+	number := binary.BigEndian.Uint64(data[len(precommitPrefix):])
+	return number, common.BytesToHash(data[len(precommitPrefix)+8:]), nil
+}
+
+// Signer recovers the address of the signer who cast the vote.
+func (p *Precommit) Signer() (common.Address, error) {
+	return recoverPrecommitter(p.Number, p.Hash, p.Signature)
+}
+
+/*
+投票的唯一标识, 用来记录节点已经知道哪些投票
+*/
+func (p *Precommit) id() common.Hash {
+	return crypto.Keccak256Hash(precommitData(p.Number, p.Hash), p.Signature)
+}
+
+func recoverPrecommitter(number uint64, hash common.Hash, signature []byte) (common.Address, error) {
+	if len(signature) != crypto.SignatureLength {
+		return common.Address{}, errInvalidPrecommit
+	}
+	pubkey, err := crypto.Ecrecover(crypto.Keccak256(precommitData(number, hash)), signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	var signer common.Address
+	copy(signer[:], crypto.Keccak256(pubkey[1:])[12:])
+	return signer, nil
+}
+
+/*
+验证重复投票的证据: 两张投票必须同高度、投的块不同、且由同一个签名者签名
+
+返回投票者和证据哈希, 证据哈希取自两张投票签的数据而不是签名, 与先后次序无关, 用作防止重复举报
+*/
+func verifyPrecommitEvidence(first, second *Precommit) (common.Address, common.Hash, error) {
+	if first.Number != second.Number || first.Hash == second.Hash {
+		return common.Address{}, common.Hash{}, errInvalidEvidence
+	}
+	firstSigner, err := first.Signer()
+	if err != nil {
+		return common.Address{}, common.Hash{}, err
+	}
+	secondSigner, err := second.Signer()
+	if err != nil {
+		return common.Address{}, common.Hash{}, err
+	}
+	if firstSigner != secondSigner {
+		return common.Address{}, common.Hash{}, errInvalidEvidence
+	}
+	firstData, secondData := precommitData(first.Number, first.Hash), precommitData(second.Number, second.Hash)
+	if bytes.Compare(firstData, secondData) > 0 {
+		firstData, secondData = secondData, firstData
+	}
+	return firstSigner, crypto.Keccak256Hash(firstData, secondData), nil
+}
+
+// Certificate is a finality certificate: the precommit votes of more than 2/3 of
+// the signers elected for a block, aggregated into the extra of a later block.
+type Certificate struct {
+	Number     uint64
+	Hash       common.Hash
+	Signatures [][]byte //按签名者地址从小到大
+}
+
+func (c *Certificate) encode() []byte {
+	data := make([]byte, certificateHeaderLength, certificateHeaderLength+len(c.Signatures)*crypto.SignatureLength)
+	binary.BigEndian.PutUint64(data, c.Number)
+	copy(data[8:], c.Hash[:])
+	for _, signature := range c.Signatures {
+		data = append(data, signature...)
+	}
+	return data
+}
+
+func (c *Certificate) decode(data []byte) error {
+	//至少要有一个签名
+	if len(data) <= certificateHeaderLength || (len(data)-certificateHeaderLength)%crypto.SignatureLength != 0 {
+		return errInvalidCertificate
+	}
+	c.Number = binary.BigEndian.Uint64(data)
+	c.Hash = common.BytesToHash(data[8:certificateHeaderLength])
+	c.Signatures = nil
+	for i := certificateHeaderLength; i < len(data); i += crypto.SignatureLength {
+		c.Signatures = append(c.Signatures, common.CopyBytes(data[i:i+crypto.SignatureLength]))
+	}
+	return nil
+}
+
+// Signers recovers the signers who voted for the certified block. They must be
+// in ascending order without duplicates.
+func (c *Certificate) Signers() ([]common.Address, error) {
+	signers := make([]common.Address, 0, len(c.Signatures))
+	for _, signature := range c.Signatures {
+		signer, err := recoverPrecommitter(c.Number, c.Hash, signature)
+		if err != nil {
+			return nil, err
+		}
+		if len(signers) > 0 && bytes.Compare(signers[len(signers)-1][:], signer[:]) >= 0 {
+			return nil, errInvalidCertificate
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+/*
+超过2/3的签名者需要多少人
+*/
+func finalityThreshold(signers int) int {
+	return signers*2/3 + 1
+}
+
+/*
+块头所属epoch的当选签名者
+*/
+func (self *Dpos) electedSignersOf(chain consensus.ChainHeaderReader, header *types.Header, parents []*types.Header) ([]common.Address, error) {
+	epochExtra, err := parseEpochExtra(self.epochOfHeader(chain, header, parents))
+	if err != nil {
+		return nil, err
+	}
+	return epochExtra.Signers, nil
+}
+
+/*
+从header往回找高度为number的祖先块, 同时返回它前面的parents, parents的用法和verifyHeader一样
+*/
+func ancestorOf(chain consensus.ChainHeaderReader, header *types.Header, parents []*types.Header, number uint64) (*types.Header, []*types.Header) {
+	for header != nil && header.Number.Uint64() > number {
+		if len(parents) > 0 && parents[len(parents)-1].Hash() == header.ParentHash {
+			header, parents = parents[len(parents)-1], parents[:len(parents)-1]
+		} else {
+			header, parents = chain.GetHeader(header.ParentHash, header.Number.Uint64()-1), nil
+		}
+	}
+	return header, parents
+}
+
+/*
+验证块头带的最终确定证书:
+ 1. 证明的是一个epoch长度内的祖先块, 不能是创世块
+ 2. 签名者按地址从小到大, 都是被证明的块所属epoch的当选签名者, 而且超过2/3
+*/
+func (self *Dpos) verifyCertificate(chain consensus.ChainHeaderReader, header *types.Header, parents []*types.Header, certificate *Certificate) error {
+	number := header.Number.Uint64()
+	if certificate.Number == 0 || certificate.Number >= number || number-certificate.Number > self.config.EpochInterval {
+		return errInvalidCertificate
+	}
+	certified, certifiedParents := ancestorOf(chain, header, parents, certificate.Number)
+	if certified == nil {
+		//轻节点从checkpoint开始同步, 之前的块头不在本地, 和epoch区块的签名者一样跳过验证
+		return nil
+	}
+	if certified.Hash() != certificate.Hash {
+		return errInvalidCertificate
+	}
+	elected, err := self.electedSignersOf(chain, certified, certifiedParents)
+	if err == errMissingEpochBlock {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	signers, err := certificate.Signers()
+	if err != nil {
+		return errInvalidCertificate
+	}
+	voted := 0
+	for _, signer := range signers {
+		for _, electedSigner := range elected {
+			if signer == electedSigner {
+				voted++
+				break
+			}
+		}
+	}
+	if voted != len(signers) || voted < finalityThreshold(len(elected)) {
+		return errInvalidCertificate
+	}
+	return nil
+}
+
+// Finalized returns the last irreversible block of the chain ending at head: the
+// highest block more than 2/3 of the elected signers have sealed blocks on top
+// of, or sealed themselves, unless a block carries a finality certificate for a
+// higher one. It returns nil if no such block is found within an epoch from the
+// head.
+func (self *Dpos) Finalized(chain consensus.ChainHeaderReader, head *types.Header) *types.Header {
+	if head.Number.Uint64() == 0 {
+		return head
+	}
+	epochExtra, err := parseEpochExtra(self.epochOfHeader(chain, head, nil))
+	if err != nil {
+		return nil
+	}
+	state := self.finalityOf(chain, head)
+	if state == nil {
+		return nil
+	}
+	//当选签名者最近出的块按块高度从高到低排, 第threshold个块之上有超过2/3的签名者出过块
+	var sealed []*types.Header
+	for _, signer := range epochExtra.Signers {
+		if header, ok := state.sealed[signer]; ok {
+			sealed = append(sealed, header)
+		}
+	}
+	sort.Slice(sealed, func(i, j int) bool {
+		return sealed[i].Number.Cmp(sealed[j].Number) > 0
+	})
+	threshold := finalityThreshold(len(epochExtra.Signers))
+	switch {
+	case len(sealed) >= threshold:
+		return highestHeader(sealed[threshold-1], state.certified)
+	case head.Number.Uint64() < self.config.EpochInterval:
+		//创世块总是不可逆的
+		if genesis := chain.GetHeaderByNumber(0); genesis != nil {
+			return highestHeader(genesis, state.certified)
+		}
+	}
+	return state.certified
+}
+
+/*
+链头往回一个epoch长度内, 每个签名者最近出的块, 以及带证书的块里证明的最高的块
+*/
+type finalityState struct {
+	sealed    map[common.Address]*types.Header
+	certified *types.Header
+}
+
+/*
+链头的finality状态: 从缓存里找最近的祖先块的状态, 再逐块递推到链头。
+新链头通常只需要从父块的状态递推一块, 缓存里没有时最多往回找一个epoch的长度
+*/
+func (self *Dpos) finalityOf(chain consensus.ChainHeaderReader, head *types.Header) *finalityState {
+	var (
+		state   *finalityState
+		headers []*types.Header
+	)
+	for header := head; ; {
+		if cached, ok := self.finalities.Get(header.Hash()); ok {
+			state = cached.(*finalityState)
+			break
+		}
+		headers = append(headers, header)
+		number := header.Number.Uint64()
+		if number <= 1 || uint64(len(headers)) >= self.config.EpochInterval {
+			state = &finalityState{}
+			break
+		}
+		if header = chain.GetHeader(header.ParentHash, number-1); header == nil {
+			state = &finalityState{}
+			break
+		}
+	}
+	for i := len(headers) - 1; i >= 0; i-- {
+		next, err := self.advanceFinality(chain, state, headers[i])
+		if err != nil {
+			return nil
+		}
+		state = next
+	}
+	self.finalities.Add(head.Hash(), state)
+	return state
+}
+
+/*
+在state上加入header, 返回新的状态, state不变。出块超过一个epoch长度的签名者移出
+*/
+func (self *Dpos) advanceFinality(chain consensus.ChainHeaderReader, state *finalityState, header *types.Header) (*finalityState, error) {
+	signer, err := ecrecover(header, self.signatures)
+	if err != nil {
+		return nil, err
+	}
+	number := header.Number.Uint64()
+	next := &finalityState{
+		sealed:    make(map[common.Address]*types.Header, len(state.sealed)+1),
+		certified: state.certified,
+	}
+	for address, sealed := range state.sealed {
+		if sealed.Number.Uint64()+self.config.EpochInterval > number {
+			next.sealed[address] = sealed
+		}
+	}
+	next.sealed[signer] = header
+
+	//证书已经在verifyHeader验证过
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err == nil && extra.Certificate != nil {
+		if next.certified == nil || extra.Certificate.Number > next.certified.Number.Uint64() {
+			if certified := chain.GetHeader(extra.Certificate.Hash, extra.Certificate.Number); certified != nil {
+				next.certified = certified
+			}
+		}
+	}
+	return next, nil
+}
+
+/*
+返回块高度较高的一个, b可以是nil
+*/
+func highestHeader(a, b *types.Header) *types.Header {
+	if b != nil && b.Number.Cmp(a.Number) > 0 {
+		return b
+	}
+	return a
+}
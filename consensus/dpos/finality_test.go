@@ -0,0 +1,384 @@
+package dpos
+
+import (
+	"crypto/ecdsa"
+	"encoding/binary"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// 超过2/3的签名者在其上出过块的区块不可逆
+func TestFinalized(t *testing.T) {
+	keys := sortedTestKeys(4)
+
+	//轮流出块, 第k块由keys[k%4]出, 需要3个签名者
+	var sealers []int
+	for number := 1; number <= 12; number++ {
+		sealers = append(sealers, number%len(keys))
+	}
+	chain, engine := newTestChain(t, keys, nil, 20, sealers)
+	defer chain.Stop()
+
+	tests := []struct {
+		head      uint64
+		finalized uint64
+	}{
+		{12, 10},
+		{5, 3},
+		{3, 1},
+		{2, 0}, //只有两个签名者出过块, 只有创世块不可逆
+		{0, 0},
+	}
+	//没有缓存的引擎往回找一个epoch的长度, 结果和逐块递推的一样
+	fresh := New(engine.config, rawdb.NewMemoryDatabase())
+	for _, tt := range tests {
+		for _, engine := range []*Dpos{engine, fresh} {
+			finalized := engine.Finalized(chain, chain.GetHeaderByNumber(tt.head))
+			if finalized == nil || finalized.Hash() != chain.GetHeaderByNumber(tt.finalized).Hash() {
+				t.Errorf("head #%d: finalized mismatch: have %v, want #%d", tt.head, finalized, tt.finalized)
+			}
+		}
+	}
+	//链头的状态从父块的状态递推后缓存起来
+	if _, ok := engine.finalities.Get(chain.CurrentHeader().Hash()); !ok {
+		t.Errorf("head finality state not cached")
+	}
+	//区块链跟着链头更新不可逆区块
+	if finalized := chain.CurrentFinalizedHeader(); finalized == nil || finalized.Number.Uint64() != 10 {
+		t.Errorf("chain finalized mismatch: have %v, want #10", finalized)
+	}
+	//单个签名者出的块自身就不可逆
+	single, singleEngine := newTestChain(t, sortedTestKeys(1), nil, 20, []int{0, 0, 0})
+	defer single.Stop()
+
+	if finalized := singleEngine.Finalized(single, single.CurrentHeader()); finalized == nil || finalized.Hash() != single.CurrentHeader().Hash() {
+		t.Errorf("single signer finalized mismatch: have %v, want head", finalized)
+	}
+}
+
+// 由key对header签预提交投票
+func signTestPrecommit(key *ecdsa.PrivateKey, header *types.Header) *Precommit {
+	sig, _ := crypto.Sign(crypto.Keccak256(precommitData(header.Number.Uint64(), header.Hash())), key)
+	return &Precommit{Number: header.Number.Uint64(), Hash: header.Hash(), Signature: sig}
+}
+
+// 超过2/3签名者的投票聚合成证书放进下一块, 证书证明的块马上不可逆
+func TestCertificate(t *testing.T) {
+	keys := sortedTestKeys(4)
+	chain, engine := newTestChain(t, keys, nil, 20, []int{1, 2, 3, 0, 1, 2})
+	defer chain.Stop()
+
+	voted := chain.CurrentHeader()
+	for i, key := range keys[:3] {
+		if added, err := engine.AddPrecommit(chain, signTestPrecommit(key, voted)); !added || err != nil {
+			t.Fatalf("vote %d not added: %v", i, err)
+		}
+	}
+	if added, err := engine.AddPrecommit(chain, signTestPrecommit(keys[0], voted)); added || err != nil {
+		t.Errorf("duplicate vote added: %v", err)
+	}
+	outsider, _ := crypto.GenerateKey()
+	if _, err := engine.AddPrecommit(chain, signTestPrecommit(outsider, voted)); err != errUnauthorizedPrecommit {
+		t.Errorf("outsider vote error mismatch: have %v, want %v", err, errUnauthorizedPrecommit)
+	}
+	unknown := &types.Header{Number: big.NewInt(3), Extra: voted.Extra}
+	if _, err := engine.AddPrecommit(chain, signTestPrecommit(keys[0], unknown)); err != errUnknownBlock {
+		t.Errorf("unknown block vote error mismatch: have %v, want %v", err, errUnknownBlock)
+	}
+	//第7块带上第6块的证书
+	block := insertTestBlock(t, chain, engine, keys[3])
+
+	extra := new(EpochExtra)
+	if err := extra.Decode(block.Extra()); err != nil {
+		t.Fatalf("failed to decode extra: %v", err)
+	}
+	certificate := extra.Certificate
+	if certificate == nil || certificate.Number != 6 || certificate.Hash != voted.Hash() || len(certificate.Signatures) != 3 {
+		t.Fatalf("certificate mismatch: have %+v", certificate)
+	}
+	if finalized := chain.CurrentFinalizedHeader(); finalized == nil || finalized.Hash() != voted.Hash() {
+		t.Errorf("finalized mismatch: have %v, want #6", finalized)
+	}
+	//已经有证书的块不再重复放
+	if err := extra.Decode(insertTestBlock(t, chain, engine, keys[0]).Extra()); err != nil || extra.Certificate != nil {
+		t.Errorf("certificate repeated: %v", extra.Certificate)
+	}
+	//证书不对时块头验证失败
+	header := block.Header()
+	invalid := []*Certificate{
+		{Number: 6, Hash: voted.Hash(), Signatures: certificate.Signatures[:2]},                                                         //签名不足
+		{Number: 6, Hash: voted.ParentHash, Signatures: certificate.Signatures},                                                         //不是祖先块
+		{Number: 6, Hash: voted.Hash(), Signatures: append(certificate.Signatures[1:], certificate.Signatures[0])},                      //顺序不对
+		{Number: 7, Hash: header.Hash(), Signatures: certificate.Signatures},                                                            //不是祖先块
+		{Number: 0, Hash: chain.Genesis().Hash(), Signatures: [][]byte{signTestPrecommit(keys[0], chain.Genesis().Header()).Signature}}, //创世块
+	}
+	for i, certificate := range invalid {
+		if err := engine.verifyCertificate(chain, header, nil, certificate); err != errInvalidCertificate {
+			t.Errorf("invalid certificate %d: have %v, want %v", i, err, errInvalidCertificate)
+		}
+	}
+	if err := engine.verifyCertificate(chain, header, nil, certificate); err != nil {
+		t.Errorf("failed to verify certificate: %v", err)
+	}
+}
+
+func TestCertificateCodec(t *testing.T) {
+	certificate := &Certificate{Number: 6, Hash: common.Hash{1}, Signatures: [][]byte{make([]byte, crypto.SignatureLength)}}
+	for _, extra := range []*EpochExtra{
+		{Certificate: certificate},
+		{Epoch: true, Signers: []common.Address{{1}}, Delegators: make([][]ElectedDelegator, 1), Certificate: certificate},
+	} {
+		encoded, err := extra.Encode()
+		if err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+		decoded := new(EpochExtra)
+		if err := decoded.Decode(encoded); err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+		if decoded.Epoch != extra.Epoch || !reflect.DeepEqual(decoded.Certificate, certificate) {
+			t.Errorf("round trip mismatch: have %+v", decoded)
+		}
+	}
+	plain := make([]byte, extraSealLength)
+	plain[0] = extraVersion
+
+	invalid := [][]byte{
+		append(common.CopyBytes(plain), 0x00),                          //空的扩展项
+		append(common.CopyBytes(plain), 0x02, 0x03, 0x00),              //不认识的标签
+		append(common.CopyBytes(plain), 0x03, extFinality, 0x01, 0x00), //证书太短
+	}
+	for i, extra := range invalid {
+		if err := new(EpochExtra).Decode(extra); err == nil {
+			t.Errorf("invalid extra %d accepted", i)
+		}
+	}
+}
+
+// 投票通过dposv子协议传播, 新连上的peer会收到已有的投票
+func TestPrecommitGossip(t *testing.T) {
+	keys := sortedTestKeys(2)
+	chain, engine := newTestChain(t, keys, nil, 20, []int{1, 0})
+	defer chain.Stop()
+
+	//两个节点共用一条链, 只有a是签名者
+	a, b := New(engine.config, rawdb.NewMemoryDatabase()), New(engine.config, rawdb.NewMemoryDatabase())
+	a.Authorize(crypto.PubkeyToAddress(keys[0].PublicKey), func(signer accounts.Account, mimeType string, message []byte) ([]byte, error) {
+		return crypto.Sign(crypto.Keccak256(message), keys[0])
+	})
+	handlerA, handlerB := NewPrecommitHandler(a, chain), NewPrecommitHandler(b, chain)
+	handlerA.Start()
+	defer handlerA.Stop()
+	handlerB.Start()
+	defer handlerB.Stop()
+
+	waitVotes := func(engine *Dpos, want int) {
+		for i := 0; i < 100 && len(engine.recentPrecommits()) < want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if have := len(engine.recentPrecommits()); have != want {
+			t.Fatalf("vote count mismatch: have %d, want %d", have, want)
+		}
+	}
+	//还没有peer时a投第3块
+	insertTestBlock(t, chain, engine, keys[1])
+	waitVotes(a, 1)
+
+	rwA, rwB := p2p.MsgPipe()
+	defer rwA.Close()
+	go handlerA.runPeer(p2p.NewPeer(enode.ID{2}, "b", nil), rwA)
+	go handlerB.runPeer(p2p.NewPeer(enode.ID{1}, "a", nil), rwB)
+
+	waitVotes(b, 1)
+
+	//连上后a投第4块, 广播给b
+	insertTestBlock(t, chain, engine, keys[0])
+	waitVotes(b, 2)
+
+	if _, err := b.AddPrecommit(chain, signTestPrecommit(keys[0], chain.CurrentHeader())); err != nil {
+		t.Errorf("gossiped vote invalid: %v", err)
+	}
+	//非当选签名者的投票只丢弃, peer可能在另一条分叉上; 签名不对的投票才断开peer
+	rwC, rwD := p2p.MsgPipe()
+	defer rwC.Close()
+	defer rwD.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- handlerB.runPeer(p2p.NewPeer(enode.ID{3}, "c", nil), rwD) }()
+
+	outsider, _ := crypto.GenerateKey()
+	if err := p2p.Send(rwC, votesMsg, []*Precommit{signTestPrecommit(outsider, chain.CurrentHeader())}); err != nil {
+		t.Fatalf("failed to send vote: %v", err)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("peer sending an unauthorized vote disconnected: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if have := len(b.recentPrecommits()); have != 2 {
+		t.Errorf("unauthorized vote added: have %d votes, want 2", have)
+	}
+	invalid := signTestPrecommit(outsider, chain.CurrentHeader())
+	invalid.Signature = invalid.Signature[1:]
+	if err := p2p.Send(rwC, votesMsg, []*Precommit{invalid}); err != nil {
+		t.Fatalf("failed to send vote: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("peer not disconnected")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("peer sending an invalid signature not disconnected")
+	}
+}
+
+// 投过的块高度存入数据库, 重启后不再投; 已知有证书的块之后只给它的后代块投票
+func TestPrecommitSafety(t *testing.T) {
+	keys := sortedTestKeys(4)
+	chain, engine := newTestChain(t, keys, nil, 20, []int{1, 2, 3, 0, 1, 2})
+	defer chain.Stop()
+
+	signFn := func(signer accounts.Account, mimeType string, message []byte) ([]byte, error) {
+		return crypto.Sign(crypto.Keccak256(message), keys[0])
+	}
+	signer := crypto.PubkeyToAddress(keys[0].PublicKey)
+
+	voter := New(engine.config, engine.db)
+	voter.Authorize(signer, signFn)
+	head := chain.CurrentHeader()
+	if vote, err := voter.signPrecommit(chain, head); vote == nil || err != nil {
+		t.Fatalf("failed to vote for head: %v", err)
+	}
+	reopened := New(engine.config, engine.db)
+	reopened.Authorize(signer, signFn)
+	if vote, err := reopened.signPrecommit(chain, head); vote != nil || err != nil {
+		t.Errorf("voted for #%d again after restart: %v", head.Number, err)
+	}
+	//第6块的投票超过2/3后有了证书
+	for _, key := range keys[1:] {
+		if _, err := reopened.AddPrecommit(chain, signTestPrecommit(key, head)); err != nil {
+			t.Fatalf("failed to add vote: %v", err)
+		}
+	}
+	if certified := reopened.precommits.certified; certified == nil || certified.Hash() != head.Hash() {
+		t.Fatalf("certified block mismatch: have %v, want #6", certified)
+	}
+	block := insertTestBlock(t, chain, engine, keys[3])
+
+	//另一条分叉上的第6块有证书时不投第7块
+	fork := types.CopyHeader(head)
+	fork.Time++
+	reopened.precommits.certified = fork
+	if vote, err := reopened.signPrecommit(chain, block.Header()); vote != nil || err != nil {
+		t.Errorf("voted for a block conflicting with the certified one: %v", err)
+	}
+	reopened.precommits.certified = head
+	if vote, err := reopened.signPrecommit(chain, block.Header()); vote == nil || err != nil {
+		t.Errorf("failed to vote for a descendant of the certified block: %v", err)
+	}
+}
+
+// 签名者锁定在投过的块上, 只有更高的证书才能改投另一条分叉
+func TestPrecommitLock(t *testing.T) {
+	keys := sortedTestKeys(4)
+	chain, engine := newTestChain(t, keys, nil, 20, []int{1, 2, 3, 0, 1, 2})
+	defer chain.Stop()
+
+	signer := crypto.PubkeyToAddress(keys[0].PublicKey)
+	voter := New(engine.config, engine.db)
+	voter.Authorize(signer, func(signer accounts.Account, mimeType string, message []byte) ([]byte, error) {
+		return crypto.Sign(crypto.Keccak256(message), keys[0])
+	})
+	//上一次投的是另一条分叉上的第6块
+	head := chain.CurrentHeader()
+	fork := types.CopyHeader(head)
+	fork.Time++
+	lock := make([]byte, 8+common.HashLength)
+	binary.BigEndian.PutUint64(lock, 6)
+	copy(lock[8:], fork.Hash().Bytes())
+	if err := engine.db.Put(append([]byte(dbPrecommitPrefix), signer[:]...), lock); err != nil {
+		t.Fatalf("failed to store lock: %v", err)
+	}
+	seventh := insertTestBlock(t, chain, engine, keys[3]).Header()
+	if vote, err := voter.signPrecommit(chain, seventh); vote != nil || err != nil {
+		t.Errorf("voted off the locked fork: %v", err)
+	}
+	//同高度的证书不够改投
+	voter.precommits.certified = head
+	if vote, err := voter.signPrecommit(chain, seventh); vote != nil || err != nil {
+		t.Errorf("switched on a certificate no higher than the lock: %v", err)
+	}
+	voter.precommits.certified = seventh
+	eighth := insertTestBlock(t, chain, engine, keys[0]).Header()
+	if vote, err := voter.signPrecommit(chain, eighth); vote == nil || err != nil {
+		t.Fatalf("failed to switch on a higher certificate: %v", err)
+	}
+	//改投后锁定在新的块上
+	voter.precommits.certified = nil
+	ninth := insertTestBlock(t, chain, engine, keys[1]).Header()
+	if vote, err := voter.signPrecommit(chain, ninth); vote == nil || err != nil {
+		t.Errorf("failed to vote for a descendant of the new lock: %v", err)
+	}
+}
+
+// 同一签名者在同一高度投两个块是重复投票, 证据可以举报并罚没
+func TestDoublePrecommit(t *testing.T) {
+	keys := sortedTestKeys(4)
+	chain, engine := newTestChain(t, keys, nil, 20, []int{1, 2, 3, 0, 1, 2})
+	defer chain.Stop()
+
+	head := chain.CurrentHeader()
+	fork := types.CopyHeader(head)
+	fork.Time++
+	rawdb.WriteHeader(engine.db, fork)
+
+	if _, err := engine.AddPrecommit(chain, signTestPrecommit(keys[0], head)); err != nil {
+		t.Fatalf("failed to add vote: %v", err)
+	}
+	if added, err := engine.AddPrecommit(chain, signTestPrecommit(keys[0], fork)); added || err != errDoublePrecommit {
+		t.Errorf("conflicting vote mismatch: added %v, err %v, want %v", added, err, errDoublePrecommit)
+	}
+	evidences, err := (&API{chain: chain, dpos: engine}).GetPrecommitEvidences()
+	if err != nil || len(evidences) != 1 {
+		t.Fatalf("evidence count mismatch: have %d, want 1 (%v)", len(evidences), err)
+	}
+	report := &Action{}
+	if err := report.fromBytes(evidences[0]); err != nil || report.Id != reportDoublePrecommit {
+		t.Fatalf("failed to decode evidence: %v", err)
+	}
+	snap, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	snap = snap.copy()
+	offender := crypto.PubkeyToAddress(keys[0].PublicKey)
+	reporter := common.HexToAddress("0x00000000000000000000000000000000000000f1")
+	if err := snap.applyAction(reporter, report, new(big.Int), 7); err != nil {
+		t.Fatalf("valid evidence rejected: %v", err)
+	}
+	if _, ok := snap.Offenders[offender]; !ok {
+		t.Errorf("double voter not recorded as offender")
+	}
+	//同一份证据, 即使先后次序相反, 也不能被重复受理
+	swapped := &Action{Id: reportDoublePrecommit, Values: []interface{}{report.Values[1], report.Values[0]}}
+	if err := snap.applyAction(reporter, swapped, new(big.Int), 8); err != errDuplicateEvidence {
+		t.Errorf("replayed evidence error mismatch: have %v, want %v", err, errDuplicateEvidence)
+	}
+	//同一个块的投票不算重复投票
+	vote := signTestPrecommit(keys[1], head)
+	same := &Action{Id: reportDoublePrecommit, Values: []interface{}{vote, vote}}
+	if err := snap.applyAction(reporter, same, new(big.Int), 8); err != errInvalidEvidence {
+		t.Errorf("identical votes error mismatch: have %v, want %v", err, errInvalidEvidence)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+dpos的创世块
+
+创世块的extra和epoch区块同一格式, 参考extra.go。EncodeGenesisExtra(...)给puppeth等工具生成extra, 不用再手写varint的hex
+
+开发者创世块供geth --dev --dev.dpos使用, 开发者账号同时是唯一的候选人、签名者和委托人(份额100%), slot为0时只在有新tx时出块
+*/
+package dpos
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const (
+	// PortionBase is the portion of a delegator entitled to all delegator rewards.
+	PortionBase = portionBase
+
+	developerEpochInterval = uint64(10) //开发链的epoch短一点, 方便观察选举结果
+)
+
+// EncodeGenesisExtra encodes the initial signers and their delegators into the
+// genesis extra-data. Signers are sorted, the signature is left empty.
+func EncodeGenesisExtra(signers []common.Address, delegators map[common.Address][]ElectedDelegator) ([]byte, error) {
+	extra := &EpochExtra{Epoch: true, Signers: make([]common.Address, len(signers))}
+
+	copy(extra.Signers, signers)
+	sort.Sort(signersAscending(extra.Signers))
+
+	for _, signer := range extra.Signers {
+		extra.Delegators = append(extra.Delegators, delegators[signer])
+	}
+	return extra.Encode()
+}
+
+// DeveloperGenesisBlock returns the 'geth --dev --dev.dpos' genesis block.
+func DeveloperGenesisBlock(period uint64, developer common.Address) *core.Genesis {
+	genesis := core.DeveloperGenesisBlock(period, developer)
+
+	//沿用clique开发链的分叉设置和预分配, 只换共识引擎
+	config := *params.AllDposProtocolChanges
+	config.Dpos = &params.DposConfig{SlotInterval: period, EpochInterval: developerEpochInterval, RandaoBlock: big.NewInt(0), ScheduleBlock: big.NewInt(0)}
+	genesis.Config = &config
+
+	extra, err := EncodeGenesisExtra([]common.Address{developer}, map[common.Address][]ElectedDelegator{
+		developer: {{Delegator: developer, Portion: uint32(portionBase)}},
+	})
+	if err != nil {
+		panic(err) //只有一位签名者和委托人, 不会出错
+	}
+	genesis.ExtraData = extra
+	return genesis
+}
@@ -0,0 +1,164 @@
+/*
+轻节点的dpos快照
+
+轻节点没有区块体, snapshot(...)重放区块时会返回errMissingBody。轻节点改为通过EpochRetriever(LES的GetDposProofsMsg)取得:
+ 1. 块头所属的epoch区块, 由本地的规范链哈希验证, extra里有签名者、提案和委托人
+ 2. 系统账户storage里的registry(参考registry.go), 由块头的state root验证
+
+这样取得的快照只有Candidates、Delegators、ElectedSigners、ElectedDelegators、ConfirmedProposals和Recents,
+Stakes、Jailed、Votes等只在区块体里的数据, 以及下个epoch的预选结果(PreElected...)都是空的
+*/
+package dpos
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	maxRetrieveKeys      = 256              //每次最多取多少个slot, 和LES服务端的限制一样
+	lightRetrieveTimeout = 10 * time.Second //VerifySeal没有ctx, 取数据的时限
+)
+
+// EpochRetriever retrieves the epoch block numbered epoch and the given storage
+// slots of the DPOS system account, both proven against the given header.
+type EpochRetriever func(ctx context.Context, header *types.Header, epoch uint64, account common.Address, keys []common.Hash) (*types.Header, []common.Hash, error)
+
+// SetEpochRetriever sets the retriever used to build snapshots on nodes which
+// don't have the block bodies, such as light clients.
+func (self *Dpos) SetEpochRetriever(retriever EpochRetriever) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.retriever = retriever
+}
+
+// SystemAddress returns the address of the DPOS system contract, which also
+// holds the registry of candidates and delegations in its storage.
+func (self *Dpos) SystemAddress() common.Address {
+	return self.config.SystemAddress
+}
+
+/*
+取块头的快照, 设置了EpochRetriever(轻节点)时不重放区块, 改为向服务端取
+*/
+func (self *Dpos) snapshotOf(ctx context.Context, chain consensus.ChainHeaderReader, header *types.Header) (*Snapshot, error) {
+	self.lock.RLock()
+	retriever := self.retriever
+	self.lock.RUnlock()
+
+	if retriever == nil || header.Number.Uint64() == 0 {
+		return self.snapshot(chain, header.Number.Uint64(), header.Hash(), nil)
+	}
+	return self.lightSnapshot(ctx, chain, header, retriever)
+}
+
+/*
+用EpochRetriever组装块头的快照, 共三轮请求:
+ 1. 候选人和委托人的数量, 同时取得epoch区块
+ 2. 候选人和委托人的地址
+ 3. 每位委托人投的候选人
+*/
+func (self *Dpos) lightSnapshot(ctx context.Context, chain consensus.ChainHeaderReader, header *types.Header, retriever EpochRetriever) (*Snapshot, error) {
+	var (
+		number     = header.Number.Uint64()
+		epoch      = number - number%self.config.EpochInterval
+		system     = self.config.SystemAddress
+		candidates = addressSet{system, candidatesSlot}
+		delegators = addressSet{system, delegatorsSlot}
+	)
+	retrieve := func(keys []common.Hash) (*types.Header, []common.Hash, error) {
+		var (
+			epochHeader *types.Header
+			values      = make([]common.Hash, 0, len(keys))
+		)
+		for len(keys) > 0 {
+			chunk := keys
+			if len(chunk) > maxRetrieveKeys {
+				chunk = chunk[:maxRetrieveKeys]
+			}
+			h, vals, err := retriever(ctx, header, epoch, system, chunk)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(vals) != len(chunk) {
+				return nil, nil, errInvalidRegistryProof
+			}
+			epochHeader, values, keys = h, append(values, vals...), keys[len(chunk):]
+		}
+		return epochHeader, values, nil
+	}
+	//第一轮: 数量和epoch区块
+	epochHeader, counts, err := retrieve([]common.Hash{candidates.slot, delegators.slot})
+	if err != nil {
+		return nil, err
+	}
+	extra, err := parseEpochExtra(epochHeader)
+	if err != nil {
+		return nil, err
+	}
+	//第二轮: 地址
+	var (
+		numCandidates = counts[0].Big().Uint64()
+		numDelegators = counts[1].Big().Uint64()
+		keys          = make([]common.Hash, 0, numCandidates+numDelegators)
+	)
+	for i := uint64(0); i < numCandidates; i++ {
+		keys = append(keys, candidates.elementSlot(i))
+	}
+	for i := uint64(0); i < numDelegators; i++ {
+		keys = append(keys, delegators.elementSlot(i))
+	}
+	_, members, err := retrieve(keys)
+	if err != nil {
+		return nil, err
+	}
+	//第三轮: 委托关系
+	keys = keys[:0]
+	for _, delegator := range members[numCandidates:] {
+		keys = append(keys, mappingSlot(common.BytesToAddress(delegator.Bytes()), delegationsSlot))
+	}
+	_, delegations, err := retrieve(keys)
+	if err != nil {
+		return nil, err
+	}
+	snap := newSnapshot(self.config, self.signatures, number, header.Hash(), extra.Signers, extra.Proposals, extra.Delegators)
+	snap.Light = true
+	snap.Seed = epochSeed(self.config, epochHeader, extra)
+	snap.Time = header.Time
+	snap.Mix = common.Hash{} //mix要重放所有区块, 轻节点没有
+
+	for _, candidate := range members[:numCandidates] {
+		snap.Candidates[common.BytesToAddress(candidate.Bytes())] = struct{}{}
+	}
+	for i, delegator := range members[numCandidates:] {
+		snap.Delegators[common.BytesToAddress(delegator.Bytes())] = common.BytesToAddress(delegations[i].Bytes())
+	}
+	if err := self.fillRecents(chain, header, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+/*
+最近出块的签名者只需要块头
+*/
+func (self *Dpos) fillRecents(chain consensus.ChainHeaderReader, header *types.Header, snap *Snapshot) error {
+	var (
+		number = header.Number.Uint64()
+		limit  = uint64(len(snap.ElectedSigners)/2 + 1)
+	)
+	for current := header; current != nil && current.Number.Uint64() > 0 && number-current.Number.Uint64() < limit; {
+		signer, err := ecrecover(current, self.signatures)
+		if err != nil {
+			return err
+		}
+		snap.Recents[current.Number.Uint64()] = signer
+		current = chain.GetHeader(current.ParentHash, current.Number.Uint64()-1)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package dpos
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// 轻节点的快照要和重放区块得到的快照一致(只比较轻节点有的部分)
+func TestLightSnapshot(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	//委托人多过maxRetrieveKeys, 需要分批取
+	var delegators []ElectedDelegator
+	for i := 0; i < maxRetrieveKeys+44; i++ {
+		delegators = append(delegators, ElectedDelegator{Delegator: common.BigToAddress(big.NewInt(int64(i + 1))), Portion: 1})
+	}
+	chain, engine := newTestChain(t, []*ecdsa.PrivateKey{key}, map[common.Address][]ElectedDelegator{signer: delegators}, 3, []int{0, 0, 0, 0, 0})
+	defer chain.Stop()
+
+	//由本地的链和state充当LES服务端
+	requests := 0
+	retriever := func(ctx context.Context, header *types.Header, epoch uint64, account common.Address, keys []common.Hash) (*types.Header, []common.Hash, error) {
+		requests++
+		if len(keys) > maxRetrieveKeys {
+			t.Fatalf("too many keys requested: %d", len(keys))
+		}
+		statedb, err := chain.StateAt(header.Root)
+		if err != nil {
+			return nil, nil, err
+		}
+		values := make([]common.Hash, len(keys))
+		for i, key := range keys {
+			values[i] = statedb.GetState(account, key)
+		}
+		return chain.GetHeaderByNumber(epoch), values, nil
+	}
+	for _, number := range []uint64{1, 3, 5} {
+		header := chain.GetHeaderByNumber(number)
+
+		want, err := engine.snapshot(chain, number, header.Hash(), nil)
+		if err != nil {
+			t.Fatalf("block #%d: failed to replay snapshot: %v", number, err)
+		}
+		have, err := engine.lightSnapshot(context.Background(), chain, header, retriever)
+		if err != nil {
+			t.Fatalf("block #%d: failed to retrieve snapshot: %v", number, err)
+		}
+		if !have.Light || have.Number != number || have.Hash != header.Hash() {
+			t.Errorf("block #%d: snapshot header mismatch: have #%d %x", number, have.Number, have.Hash)
+		}
+		if !reflect.DeepEqual(have.Candidates, want.Candidates) {
+			t.Errorf("block #%d: candidates mismatch: have %v, want %v", number, have.Candidates, want.Candidates)
+		}
+		if !reflect.DeepEqual(have.Delegators, want.Delegators) {
+			t.Errorf("block #%d: delegators mismatch: have %d, want %d", number, len(have.Delegators), len(want.Delegators))
+		}
+		if !reflect.DeepEqual(have.electedSigners(), want.electedSigners()) {
+			t.Errorf("block #%d: signers mismatch: have %v, want %v", number, have.electedSigners(), want.electedSigners())
+		}
+		if !reflect.DeepEqual(have.ElectedDelegators, want.ElectedDelegators) {
+			t.Errorf("block #%d: elected delegators mismatch", number)
+		}
+		if !reflect.DeepEqual(have.Recents, want.Recents) {
+			t.Errorf("block #%d: recents mismatch: have %v, want %v", number, have.Recents, want.Recents)
+		}
+	}
+	//数量, 两批地址, 两批委托关系
+	if requests != 3*5 {
+		t.Errorf("retrieval count mismatch: have %d, want %d", requests, 3*5)
+	}
+	//设置了EpochRetriever后API改由它取快照
+	engine.SetEpochRetriever(retriever)
+	api := &API{chain: chain, dpos: engine}
+
+	snap, err := api.GetSnapshotAtHash(context.Background(), chain.CurrentHeader().Hash())
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	if !snap.Light {
+		t.Errorf("snapshot not retrieved")
+	}
+	//存盘后仍是轻快照, 不能当成完整的快照检查RANDAO和epoch区块
+	if err := snap.store(engine.db); err != nil {
+		t.Fatalf("failed to store snapshot: %v", err)
+	}
+	if loaded, err := loadSnapshot(engine.config, engine.signatures, engine.db, snap.Hash); err != nil || !loaded.Light {
+		t.Errorf("stored light snapshot loaded as full: %v", err)
+	}
+	if err := engine.VerifySeal(chain, chain.CurrentHeader()); err != nil {
+		t.Errorf("failed to verify seal with retrieved snapshot: %v", err)
+	}
+}
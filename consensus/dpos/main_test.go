@@ -4,7 +4,13 @@ import(
 	"testing"
 	"encoding/hex"
 	"bytes"
+	"crypto/ecdsa"
+	"math/big"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 func toBytes(hexStr string) []byte {
@@ -20,7 +26,7 @@ func TestSortConfirmedSignersAsc(t *testing.T) {
 	ConfirmedSigners[common.HexToAddress("0x0000000000000000000000000000000000000002")] = uint16(2)
 	ConfirmedSigners[common.HexToAddress("0x0000000000000000000000000000000000000003")] = uint16(1)
 	
-	sorted:= confirmedSignersSorter(ConfirmedSigners)
+	sorted:= addressIntAscSorter(ConfirmedSigners)
 	
 	t.Log("check sorting", sorted)
 	
@@ -39,13 +45,13 @@ func TestSelectedProposals(t *testing.T) {
 	for proposalId, proposalVotes := range groupProposals {
 				
 		if len(proposalVotes) > 1 {
-			sorted := tallySorter(proposalVotes)
+			sorted := hashIntDescSorter(proposalVotes)
 					
 			if sorted[0].Value == sorted[1].Value {
 				continue
 			}
 			
-			selectedProposals[proposalId] = sorted[0].Key.(common.Hash)
+			selectedProposals[proposalId] = sorted[0].Key
 		} else {
 			for proposalBytes := range proposalVotes {
 						
@@ -57,32 +63,667 @@ func TestSelectedProposals(t *testing.T) {
 	t.Log(selectedProposals)
 }
 
-func TestUnserialize(t *testing.T) {
+func TestSplitItems(t *testing.T) {
 	var tests =[]struct {
-		extra []byte
+		data []byte
 		want [][]byte
+		err error
 	}{
 		{
-			toBytes("40000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000003C0D4A5c97AACe5D2B60Bf0859366450a1A46BC68092050446bfeFD2D821b6d6D5f31ECe1E1B3958c266B7A2015d74a431D8fcE7cEc738D286D8606FCb2001FF000000000000000000000000000000000000000000000000000000000000"),
-			
+			toBytes("3C0D4A5c97AACe5D2B60Bf0859366450a1A46BC68092050446bfeFD2D821b6d6D5f31ECe1E1B3958c266B7A2015d74a431D8fcE7cEc738D286D8606FCb2001FF000000000000000000000000000000000000000000000000000000000000"),
 			[][]byte{
-				toBytes("00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"),
 				toBytes("0D4A5c97AACe5D2B60Bf0859366450a1A46BC68092050446bfeFD2D821b6d6D5f31ECe1E1B3958c266B7A2015d74a431D8fcE7cEc738D286D8606FCb"),
 				toBytes("01FF000000000000000000000000000000000000000000000000000000000000"),
-				
 			},
+			nil,
 		},
+		{toBytes("00"), [][]byte{{}}, nil},
+		{toBytes("0201"), nil, errInvalidExtra},     //越界
+		{toBytes("fd00"), nil, errInvalidExtra},     //长度不完整
+		{toBytes("fd000100"), nil, errInvalidExtra}, //不是最短的写法
+		{toBytes("fe00000000"), nil, errInvalidExtra},
+	}
+	
+	for i, test := range tests {
+		items, err := splitItems(test.data)
+		if err != test.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, test.err)
+			continue
+		}
+		if len(items) != len(test.want) {
+			t.Errorf("test %d: item count mismatch: have %d, want %d", i, len(items), len(test.want))
+			continue
+		}
+		for j, item := range items {
+			if !bytes.Equal(item, test.want[j]) {
+				t.Errorf("test %d: item %d mismatch: have %x, want %x", i, j, item, test.want[j])
+			}
+		}
+	}
+}
+
+func TestEpochExtraCodec(t *testing.T) {
+	var (
+		a = common.HexToAddress("0x000000000000000000000000000000000000000a")
+		b = common.HexToAddress("0x000000000000000000000000000000000000000b")
+		d = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+	)
+	proposal := &Proposal{Id: TestProposal, Values: []interface{}{uint8(1)}}
+	extra := &EpochExtra{
+		Epoch:      true,
+		Signers:    []common.Address{a, b},
+		Proposals:  []*Proposal{proposal},
+		Delegators: [][]ElectedDelegator{{{Delegator: d, Portion: uint32(portionBase)}}, nil},
+	}
+	extra.Signature[0] = 0x01
+	
+	encoded, err := extra.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if encoded[0] != extraVersion {
+		t.Errorf("version mismatch: have %x, want %x", encoded[0], extraVersion)
+	}
+	decoded := new(EpochExtra)
+	if err := decoded.Decode(encoded); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	reencoded, _ := decoded.Encode()
+	if !bytes.Equal(encoded, reencoded) {
+		t.Errorf("round trip mismatch: have %x, want %x", reencoded, encoded)
+	}
+	
+	//非epoch区块只有版本和签名
+	plain, err := (&EpochExtra{}).Encode()
+	if err != nil || len(plain) != extraSealLength {
+		t.Errorf("plain extra mismatch: %x %v", plain, err)
 	}
 	
-	for _, test := range tests {
-		datas := unserialize(test.extra)
+	//格式不对的extra必须返回错误, 不能panic
+	for i := 0; i < len(encoded); i++ {
+		if i == extraSealLength {
+			continue //刚好是非epoch区块的extra
+		}
+		if err := new(EpochExtra).Decode(encoded[:i]); err == nil {
+			t.Errorf("truncated extra (%d bytes) accepted", i)
+		}
+	}
+	unknown := append([]byte{0x40}, encoded[1:]...)
+	if err := new(EpochExtra).Decode(unknown); err != errUnknownExtraVersion {
+		t.Errorf("unknown version error mismatch: have %v, want %v", err, errUnknownExtraVersion)
+	}
+	
+	//epoch区块的种子放在扩展项里
+	seeded := *extra
+	seeded.Seed = common.Hash{0x05}
+	if encoded, err := seeded.Encode(); err != nil || decoded.Decode(encoded) != nil || decoded.Seed != seeded.Seed {
+		t.Errorf("seed round trip mismatch: have %x, want %x (%v)", decoded.Seed, seeded.Seed, err)
+	}
+	
+	invalid := []*EpochExtra{
+		{Signers: []common.Address{a}},                                                       //非epoch区块带签名者
+		{Seed: common.Hash{0x05}},                                                            //非epoch区块带种子
+		{Epoch: true},                                                                        //没有签名者
+		{Epoch: true, Signers: []common.Address{b, a}, Delegators: make([][]ElectedDelegator, 2)}, //顺序不对
+		{Epoch: true, Signers: []common.Address{a, a}, Delegators: make([][]ElectedDelegator, 2)}, //重复
+		{Epoch: true, Signers: []common.Address{a}},                                          //委托人和签名者对不上
+		{Epoch: true, Signers: []common.Address{a}, Delegators: [][]ElectedDelegator{{{Delegator: d, Portion: uint32(portionBase)}, {Delegator: a, Portion: 1}}}}, //超过100%
+		{Epoch: true, Signers: []common.Address{a}, Delegators: make([][]ElectedDelegator, 1), Proposals: []*Proposal{proposal, proposal}}, //提案重复
+	}
+	for i, extra := range invalid {
+		if _, err := extra.Encode(); err == nil {
+			t.Errorf("invalid extra %d encoded", i)
+		}
+	}
+}
+func TestStakeAndUnbonding(t *testing.T) {
+	var (
+		config    = &params.DposConfig{SlotInterval: 1, EpochInterval: 10, UnbondingEpochs: 2}
+		signer    = common.HexToAddress("0x0000000000000000000000000000000000000001")
+		delegator = common.HexToAddress("0x0000000000000000000000000000000000000002")
+	)
+	snap := newSnapshot(config, nil, 0, common.Hash{}, []common.Address{signer}, nil, nil)
+	
+	stakeAction, _ := getAction(stake)
+	if err := snap.applyAction(delegator, stakeAction, big.NewInt(100), 3); err != nil {
+		t.Fatalf("stake failed: %v", err)
+	}
+	
+	unstakeBytes := append([]byte{unstake}, common.LeftPadBytes(big.NewInt(40).Bytes(), common.HashLength)...)
+	unstakeAction := &Action{}
+	if err := unstakeAction.fromBytes(unstakeBytes); err != nil {
+		t.Fatalf("failed to decode unstake: %v", err)
+	}
+	if err := snap.applyAction(delegator, unstakeAction, new(big.Int), 12); err != nil {
+		t.Fatalf("unstake failed: %v", err)
+	}
+	if bonded := snap.stakeOf(delegator); bonded.Cmp(big.NewInt(60)) != 0 {
+		t.Errorf("bonded stake mismatch: have %v, want 60", bonded)
+	}
+	
+	//解押超过已抵押的金额必须被拒绝
+	tooMuch := &Action{Id: unstake, Values: []interface{}{big.NewInt(61)}}
+	if err := snap.applyAction(delegator, tooMuch, new(big.Int), 13); err != errInsufficientStake {
+		t.Errorf("over-unstake error mismatch: have %v, want %v", err, errInsufficientStake)
+	}
+	
+	//在12高度解押，要到(1+1+2)*10 = 40才退回
+	if release := snap.Unbondings[0].Release; release != 40 {
+		t.Errorf("release number mismatch: have %d, want 40", release)
+	}
+	if matured := snap.maturedUnbondings(30); len(matured) != 0 {
+		t.Errorf("unbonding released too early: %v", matured)
+	}
+	if matured := snap.maturedUnbondings(40); len(matured) != 1 || matured[0].Amount.Cmp(big.NewInt(40)) != 0 {
+		t.Errorf("unbonding not released: %v", matured)
+	}
+}
+
+func TestElectByStake(t *testing.T) {
+	var (
+		config = &params.DposConfig{SlotInterval: 1, EpochInterval: 10, MaxSigners: 2}
+		a      = common.HexToAddress("0x000000000000000000000000000000000000000a")
+		b      = common.HexToAddress("0x000000000000000000000000000000000000000b")
+		c      = common.HexToAddress("0x000000000000000000000000000000000000000c")
+		rich   = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		poor   = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+	)
+	snap := newSnapshot(config, nil, 0, common.Hash{}, []common.Address{a, b}, nil, nil)
+	snap.Candidates[c] = struct{}{}
+	
+	//每个签名者都出够块，不会被踢
+	snap.ElectedSigners[a], snap.ElectedSigners[b] = 5, 5
+	
+	snap.Delegators[rich] = c
+	snap.Delegators[poor] = a
+	snap.Stakes[rich] = big.NewInt(1000)
+	snap.Stakes[poor] = big.NewInt(10)
+	
+	snap.elect()
+	
+	if _, ok := snap.PreElectedSigners[c]; !ok {
+		t.Errorf("candidate with most bonded stake not elected: %v", snap.PreElectedSigners)
+	}
+	if _, ok := snap.PreElectedSigners[a]; !ok {
+		t.Errorf("candidate with bonded stake not elected: %v", snap.PreElectedSigners)
+	}
+	if _, ok := snap.PreElectedSigners[b]; ok {
+		t.Errorf("candidate without stake elected: %v", snap.PreElectedSigners)
+	}
+	if delegators := snap.PreElectedDelegators[c]; len(delegators) != 1 || delegators[0].Portion != uint32(portionBase) {
+		t.Errorf("delegator portion mismatch: %v", delegators)
+	}
+}
+
+func TestElectMaxSignersFork(t *testing.T) {
+	one := uint64(1)
+	var (
+		config = &params.DposConfig{SlotInterval: 1, EpochInterval: 10, MaxSigners: 2, Forks: []params.DposFork{{Block: big.NewInt(20), MaxSigners: &one}}}
+		a      = common.HexToAddress("0x000000000000000000000000000000000000000a")
+		b      = common.HexToAddress("0x000000000000000000000000000000000000000b")
+		rich   = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		poor   = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+	)
+	//在9和19高度预选，新签名者分别在10和20生效
+	for _, tt := range []struct {
+		number uint64
+		want   int
+	}{{9, 2}, {19, 1}} {
+		snap := newSnapshot(config, nil, tt.number, common.Hash{}, []common.Address{a, b}, nil, nil)
+		snap.ElectedSigners[a], snap.ElectedSigners[b] = 5, 5
+		snap.Delegators[rich], snap.Delegators[poor] = a, b
+		snap.Stakes[rich], snap.Stakes[poor] = big.NewInt(1000), big.NewInt(10)
 		
-		for i, data := range datas {
-			if !bytes.Equal(data, test.want[i]) {
-				t.Error("given", data, "expected", test.want[i])
-			} else {
-				t.Log("yes")
+		snap.elect()
+		
+		if len(snap.PreElectedSigners) != tt.want {
+			t.Errorf("number %d: signer count mismatch: have %d, want %d", tt.number, len(snap.PreElectedSigners), tt.want)
+		}
+		if _, ok := snap.PreElectedSigners[a]; !ok {
+			t.Errorf("number %d: candidate with most bonded stake not elected: %v", tt.number, snap.PreElectedSigners)
+		}
+	}
+}
+
+func TestProposalRules(t *testing.T) {
+	encode := func(id uint8, value int64) common.Hash {
+		proposal, err := getProposal(id)
+		if err != nil {
+			t.Fatalf("proposal %d not found: %v", id, err)
+		}
+		proposal.Values = []interface{}{big.NewInt(value)}
+		
+		proposalBytes, err := proposal.toBytes()
+		if err != nil {
+			t.Fatalf("failed to encode proposal %d: %v", id, err)
+		}
+		return proposalBytes
+	}
+	
+	//超出范围的值不能成为提案
+	invalid, _ := getProposal(SignerRewardProposal)
+	invalid.Values = []interface{}{big.NewInt(101)}
+	if _, err := invalid.toBytes(); err == nil {
+		t.Errorf("signer reward above 100%% accepted")
+	}
+	if err := new(Proposal).fromBytes(common.Hash{MaxSignersProposal}); err == nil {
+		t.Errorf("zero max signers accepted")
+	}
+	
+	var (
+		config = &params.DposConfig{SlotInterval: 1, EpochInterval: 10, MaxSigners: 3}
+		a      = common.HexToAddress("0x000000000000000000000000000000000000000a")
+		b      = common.HexToAddress("0x000000000000000000000000000000000000000b")
+		c      = common.HexToAddress("0x000000000000000000000000000000000000000c")
+	)
+	snap := newSnapshot(config, nil, 9, common.Hash{}, []common.Address{a, b}, nil, nil)
+	snap.ElectedSigners[a], snap.ElectedSigners[b] = 5, 5
+	snap.Candidates[c] = struct{}{}
+	
+	//候选人投给自己, a和b自己的抵押不足
+	for i, candidate := range []common.Address{a, b, c} {
+		snap.Delegators[candidate] = candidate
+		snap.Stakes[candidate] = big.NewInt(int64(100 * (i + 1)))
+	}
+	snap.UnconfirmedProposals[MaxSignersProposal] = encode(MaxSignersProposal, 1)
+	snap.UnconfirmedProposals[MinSelfStakeProposal] = encode(MinSelfStakeProposal, 250)
+	snap.UnconfirmedProposals[SlotIntervalProposal] = encode(SlotIntervalProposal, 5)
+	
+	//刚选出的提案还未定案, 当前仍按链配置
+	if rules := snap.rules(); rules.MaxSigners != 3 || rules.SlotInterval != 1 {
+		t.Errorf("unconfirmed proposals in effect: %+v", rules)
+	}
+	
+	snap.elect()
+	
+	if len(snap.PreElectedSigners) != 1 {
+		t.Fatalf("signer count mismatch: have %d, want 1", len(snap.PreElectedSigners))
+	}
+	if _, ok := snap.PreElectedSigners[c]; !ok {
+		t.Errorf("candidate with enough self-stake not elected: %v", snap.PreElectedSigners)
+	}
+	
+	//在epoch块定案后生效
+	snap.Number++
+	snap.newEpoch(snap.Number, snap.Mix)
+	if rules := snap.rules(); rules.MaxSigners != 1 || rules.SlotInterval != 5 || rules.MinSelfStake.Cmp(big.NewInt(250)) != 0 {
+		t.Errorf("confirmed proposals not in effect: %+v", rules)
+	}
+}
+
+func TestStakeWeightedTally(t *testing.T) {
+	var (
+		config = &params.DposConfig{SlotInterval: 1, EpochInterval: 10, MaxSigners: 3}
+		signer = common.HexToAddress("0x000000000000000000000000000000000000000a")
+		loyal  = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		rebel  = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+		holder = common.HexToAddress("0x00000000000000000000000000000000000000f3")
+		nobody = common.HexToAddress("0x00000000000000000000000000000000000000f4")
+	)
+	snap := newSnapshot(config, nil, 0, common.Hash{}, []common.Address{signer}, nil, nil)
+	snap.Candidates[signer] = struct{}{}
+	snap.Delegators[loyal], snap.Delegators[rebel] = signer, signer
+	snap.Stakes[signer] = big.NewInt(10)
+	snap.Stakes[loyal] = big.NewInt(20)
+	snap.Stakes[rebel] = big.NewInt(30)
+	snap.Stakes[holder] = big.NewInt(40)
+	
+	proposal, _ := getProposal(MaxSignersProposal)
+	proposal.Values = []interface{}{big.NewInt(1)}
+	proposalBytes, _ := proposal.toBytes()
+	
+	vote := func(voter common.Address, yesNo bool) error {
+		action, _ := getAction(voteProposal)
+		action.Values = []interface{}{proposalBytes, yesNo}
+		actionBytes, err := action.toBytes()
+		if err != nil {
+			t.Fatalf("failed to encode vote: %v", err)
+		}
+		decoded := &Action{}
+		if err := decoded.fromBytes(actionBytes); err != nil {
+			t.Fatalf("failed to decode vote: %v", err)
+		}
+		return snap.applyAction(voter, decoded, new(big.Int), 1)
+	}
+	
+	//签名者通过出块投赞成票, 代表没有亲自投票的委托人
+	if !snap.cast(signer, proposalBytes, true) {
+		t.Fatalf("signer vote rejected")
+	}
+	snap.Votes = append(snap.Votes, &Vote{Voter: signer, Block: 1, Proposal: proposalBytes, YesNo: true})
+	
+	if err := vote(rebel, false); err != nil {
+		t.Fatalf("delegator vote rejected: %v", err)
+	}
+	if err := vote(holder, true); err != nil {
+		t.Fatalf("staker vote rejected: %v", err)
+	}
+	if err := vote(nobody, true); err != errNoVotingPower {
+		t.Errorf("vote without stake error mismatch: have %v, want %v", err, errNoVotingPower)
+	}
+	
+	tally := snap.tally()[proposalBytes]
+	if tally == nil || tally.Yes.Cmp(big.NewInt(70)) != 0 || tally.No.Cmp(big.NewInt(30)) != 0 {
+		t.Fatalf("tally mismatch: have %+v, want yes 70 no 30", tally)
+	}
+	
+	//投了100/100, 赞成70% >= 67%
+	if passed := snap.passedProposals(snap.tally()); passed[MaxSignersProposal] != proposalBytes {
+		t.Errorf("proposal not passed: %v", passed)
+	}
+	
+	//持有者改投反对, 赞成30% < 67%
+	if err := vote(holder, false); err != nil {
+		t.Fatalf("changed vote rejected: %v", err)
+	}
+	if passed := snap.passedProposals(snap.tally()); len(passed) != 0 {
+		t.Errorf("proposal passed below threshold: %v", passed)
+	}
+	
+	//投票的抵押金不足法定人数
+	snap.Stakes[nobody] = big.NewInt(1000)
+	snap.Votes = snap.Votes[:1]
+	if passed := snap.passedProposals(snap.tally()); len(passed) != 0 {
+		t.Errorf("proposal passed below quorum: %v", passed)
+	}
+}
+
+func TestDelegatorRewards(t *testing.T) {
+	var (
+		a = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		b = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+		c = common.HexToAddress("0x00000000000000000000000000000000000000f3")
+	)
+	tests := []struct {
+		amount     int64
+		portions   []uint32
+		rewards    []int64
+		remainder  int64
+	}{
+		//三等分除不尽, 余数归签名者
+		{100, []uint32{333333333, 333333333, 333333333}, []int64{33, 33, 33}, 1},
+		{1e18, []uint32{500000000, 250000000, 250000000}, []int64{5e17, 2.5e17, 2.5e17}, 0},
+		//没有委托人, 全部归签名者
+		{100, nil, nil, 100},
+		//份额超过100%时, 总数不超过amount
+		{100, []uint32{1065353216, 1065353216}, []int64{100, 0}, 0},
+	}
+	for i, tt := range tests {
+		var delegators []ElectedDelegator
+		for j, portion := range tt.portions {
+			delegators = append(delegators, ElectedDelegator{[]common.Address{a, b, c}[j], portion})
+		}
+		rewards, remainder := delegatorRewards(big.NewInt(tt.amount), delegators)
+		
+		for j, reward := range rewards {
+			if reward.Int64() != tt.rewards[j] {
+				t.Errorf("test %d: reward %d mismatch: have %v, want %d", i, j, reward, tt.rewards[j])
 			}
 		}
+		if remainder.Int64() != tt.remainder {
+			t.Errorf("test %d: remainder mismatch: have %v, want %d", i, remainder, tt.remainder)
+		}
+	}
+}
+
+//按dpos的extra格式签名块头
+func signHeader(t *testing.T, header *types.Header, key *ecdsa.PrivateKey) {
+	header.Extra = append([]byte{crypto.SignatureLength}, make([]byte, crypto.SignatureLength)...)
+	
+	sig, err := crypto.Sign(SealHash(header).Bytes(), key)
+	if err != nil {
+		t.Fatalf("failed to sign header: %v", err)
+	}
+	copy(header.Extra[1:], sig)
+}
+
+func TestReportDoubleSign(t *testing.T) {
+	var (
+		config    = &params.DposConfig{SlotInterval: 1, EpochInterval: 10, UnbondingEpochs: 2, SlashPercent: 10}
+		key, _    = crypto.GenerateKey()
+		offender  = crypto.PubkeyToAddress(key.PublicKey)
+		reporter  = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		other     = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+		sigcache, _ = lru.NewARC(16)
+	)
+	snap := newSnapshot(config, sigcache, 0, common.Hash{}, []common.Address{offender, other}, nil, nil)
+	snap.Stakes[offender] = big.NewInt(1000)
+	snap.Unbondings = append(snap.Unbondings, &Unbonding{offender, big.NewInt(500), 30})
+	
+	first := &types.Header{Number: big.NewInt(5), Time: 100, Difficulty: big.NewInt(2)}
+	second := &types.Header{Number: big.NewInt(5), Time: 101, Difficulty: big.NewInt(2)}
+	signHeader(t, first, key)
+	signHeader(t, second, key)
+	
+	report, _ := getAction(reportDoubleSign)
+	report.Values = []interface{}{first, second}
+	reportBytes, err := report.toBytes()
+	if err != nil {
+		t.Fatalf("failed to encode evidence: %v", err)
+	}
+	decoded := &Action{}
+	if err := decoded.fromBytes(reportBytes); err != nil {
+		t.Fatalf("failed to decode evidence: %v", err)
+	}
+	if err := snap.applyAction(reporter, decoded, new(big.Int), 7); err != nil {
+		t.Fatalf("valid evidence rejected: %v", err)
+	}
+	
+	//同一份证据, 即使先后次序相反, 也不能被重复受理
+	swapped := &Action{Id: reportDoubleSign, Values: []interface{}{second, first}}
+	if err := snap.applyAction(reporter, swapped, new(big.Int), 8); err != errDuplicateEvidence {
+		t.Errorf("replayed evidence error mismatch: have %v, want %v", err, errDuplicateEvidence)
+	}
+	
+	//同一个块头不算双签
+	same := &Action{Id: reportDoubleSign, Values: []interface{}{first, first}}
+	if err := snap.applyAction(reporter, same, new(big.Int), 8); err != errInvalidEvidence {
+		t.Errorf("identical headers error mismatch: have %v, want %v", err, errInvalidEvidence)
+	}
+	
+	//不是那个高度的签名者, 即使是有抵押金的候选人也不受理
+	outsiderKey, _ := crypto.GenerateKey()
+	outsider := crypto.PubkeyToAddress(outsiderKey.PublicKey)
+	snap.Candidates[outsider] = struct{}{}
+	snap.Stakes[outsider] = big.NewInt(1000)
+	forged := []*types.Header{{Number: big.NewInt(6), Time: 100, Difficulty: big.NewInt(2)}, {Number: big.NewInt(6), Time: 101, Difficulty: big.NewInt(2)}}
+	signHeader(t, forged[0], outsiderKey)
+	signHeader(t, forged[1], outsiderKey)
+	if err := snap.applyAction(reporter, &Action{Id: reportDoubleSign, Values: []interface{}{forged[0], forged[1]}}, new(big.Int), 8); err != errInvalidEvidence {
+		t.Errorf("unelected offender error mismatch: have %v, want %v", err, errInvalidEvidence)
+	}
+	if _, ok := snap.Offenders[outsider]; ok {
+		t.Errorf("unelected offender accepted")
+	}
+	
+		snap.elect()
+	if _, ok := snap.PreElectedSigners[offender]; ok {
+		t.Errorf("double signer pre-elected: %v", snap.PreElectedSigners)
+	}
+	
+	snap.ElectedSigners[offender] = 3
+	_, slashed := snap.settle(10)
+	if slashed.Cmp(big.NewInt(150)) != 0 {
+		t.Errorf("slashed amount mismatch: have %v, want 150", slashed)
+	}
+	if bonded := snap.stakeOf(offender); bonded.Cmp(big.NewInt(900)) != 0 {
+		t.Errorf("bonded stake mismatch: have %v, want 900", bonded)
+	}
+	if _, ok := snap.Candidates[offender]; ok {
+		t.Errorf("double signer still a candidate")
+	}
+	if len(snap.Offenders) != 0 {
+		t.Errorf("offender not settled: %v", snap.Offenders)
+	}
+	if jail := snap.Jailed[offender]; jail == nil || jail.Minted != 3 {
+		t.Errorf("jail record mismatch: have %+v, want 3 minted", jail)
+	}
+}
+
+func TestJailForDowntime(t *testing.T) {
+	var (
+		config    = &params.DposConfig{SlotInterval: 1, EpochInterval: 10, JailEpochs: 2}
+		active    = common.HexToAddress("0x000000000000000000000000000000000000000a")
+		offline   = common.HexToAddress("0x000000000000000000000000000000000000000b")
+		candidate = common.HexToAddress("0x000000000000000000000000000000000000000c")
+		delegator = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+	)
+	snap := newSnapshot(config, nil, 9, common.Hash{}, []common.Address{active, offline}, nil, nil)
+	snap.Candidates[active] = struct{}{}
+	snap.Candidates[offline] = struct{}{}
+	snap.Candidates[candidate] = struct{}{}
+	
+	snap.ElectedSigners[active], snap.ElectedSigners[offline] = 9, 0
+	snap.Missed[offline] = 4
+	
+	snap.Delegators[delegator] = offline
+	snap.Stakes[delegator] = big.NewInt(1000)
+	
+	snap.elect()
+	
+	jail, ok := snap.Jailed[offline]
+	if !ok {
+		t.Fatalf("offline signer not jailed")
+	}
+	if jail.Reason != jailDowntime || jail.Number != 9 || jail.Release != 30 || jail.Missed != 4 {
+		t.Errorf("jail record mismatch: %+v", jail)
+	}
+	if _, ok := snap.PreElectedSigners[offline]; ok {
+		t.Errorf("jailed signer pre-elected: %v", snap.PreElectedSigners)
+	}
+	
+	//入狱者仍然是候选人, 委托也保留
+	if _, ok := snap.Candidates[offline]; !ok {
+		t.Errorf("jailed signer lost candidacy")
+	}
+	if snap.Delegators[delegator] != offline {
+		t.Errorf("delegation to jailed signer dropped")
+	}
+	
+	unjailAction, _ := getAction(unjail)
+	if err := snap.applyAction(offline, unjailAction, new(big.Int), 29); err != errJailed {
+		t.Errorf("early unjail error mismatch: have %v, want %v", err, errJailed)
+	}
+	if err := snap.applyAction(active, unjailAction, new(big.Int), 30); err != errNotJailed {
+		t.Errorf("unjail of free signer error mismatch: have %v, want %v", err, errNotJailed)
+	}
+	if err := snap.applyAction(offline, unjailAction, new(big.Int), 30); err != nil {
+		t.Errorf("unjail after release failed: %v", err)
+	}
+	if _, ok := snap.Jailed[offline]; ok {
+		t.Errorf("signer still jailed after unjail")
+	}
+}
+
+func TestDeveloperGenesis(t *testing.T) {
+	developer := common.HexToAddress("0x000000000000000000000000000000000000000d")
+	
+	genesis := DeveloperGenesisBlock(0, developer)
+	header := genesis.ToBlock(nil).Header()
+	
+	extra, err := parseEpochExtra(header)
+	if err != nil {
+		t.Fatalf("failed to parse genesis extra: %v", err)
+	}
+	if len(extra.Signers) != 1 || extra.Signers[0] != developer || len(extra.Proposals) != 0 {
+		t.Fatalf("genesis extra mismatch: %v %v", extra.Signers, extra.Proposals)
+	}
+	
+	//开发者同时是候选人、签名者和委托人
+	snap := newSnapshot(genesis.Config.Dpos, nil, 0, header.Hash(), extra.Signers, extra.Proposals, extra.Delegators)
+	if _, ok := snap.Candidates[developer]; !ok {
+		t.Errorf("developer not a candidate")
+	}
+	if snap.Delegators[developer] != developer {
+		t.Errorf("developer not delegating to itself: %v", snap.Delegators)
+	}
+	if delegators := snap.ElectedDelegators[developer]; len(delegators) != 1 || delegators[0].Portion != uint32(portionBase) {
+		t.Errorf("delegator portion mismatch: %v", delegators)
+	}
+	
+	//slot为0时不出空块
+	engine := New(genesis.Config.Dpos, nil)
+	engine.Authorize(developer, nil)
+	engine.recents.Add(snap.Hash, snap)
+	
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), ParentHash: snap.Hash, Difficulty: diffInTurn})
+	results := make(chan *types.Block, 1)
+	if err := engine.Seal(nil, block, results, nil); err != nil || len(results) != 0 {
+		t.Errorf("empty block sealed: err %v, results %d", err, len(results))
+	}
+	if !engine.InstantSealing(nil, header) {
+		t.Errorf("zero slot chain not instant sealing")
+	}
+}
+
+func TestEncodeGenesisExtra(t *testing.T) {
+	var (
+		a = common.HexToAddress("0x000000000000000000000000000000000000000a")
+		b = common.HexToAddress("0x000000000000000000000000000000000000000b")
+		d = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+	)
+	//签名者顺序不影响结果
+	encoded, err := EncodeGenesisExtra([]common.Address{b, a}, map[common.Address][]ElectedDelegator{
+		b: {{Delegator: d, Portion: uint32(portionBase / 4)}},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode genesis extra: %v", err)
+	}
+	extra, err := parseEpochExtra(&types.Header{Extra: encoded})
+	if err != nil {
+		t.Fatalf("failed to parse genesis extra: %v", err)
+	}
+	signers, proposals, delegatorss := extra.Signers, extra.Proposals, extra.Delegators
+	
+	if len(signers) != 2 || signers[0] != a || signers[1] != b || len(proposals) != 0 {
+		t.Fatalf("signers mismatch: %v %v", signers, proposals)
+	}
+	if len(delegatorss) != 2 || len(delegatorss[0]) != 0 || len(delegatorss[1]) != 1 {
+		t.Fatalf("delegators mismatch: %v", delegatorss)
+	}
+	if delegator := delegatorss[1][0]; delegator.Delegator != d || delegator.Portion != uint32(portionBase/4) {
+		t.Errorf("delegator mismatch: %v", delegator)
+	}
+}
+
+//EncodeAction编出的bytes要能被fromBytes解回同样的值
+func TestEncodeAction(t *testing.T) {
+	candidate := common.HexToAddress("0x000000000000000000000000000000000000000a")
+	
+	tests := []struct {
+		id     uint8
+		values []interface{}
+		want   []byte
+	}{
+		{becomeCandidate, nil, []byte{becomeCandidate}},
+		{becomeDelegator, []interface{}{candidate}, append([]byte{becomeDelegator}, candidate.Bytes()...)},
+		{quitCandidate, nil, []byte{quitCandidate}},
+		{quitDelegator, nil, []byte{quitDelegator}},
+		{unstake, []interface{}{big.NewInt(40)}, append([]byte{unstake}, common.LeftPadBytes([]byte{40}, common.HashLength)...)},
+	}
+	for i, tt := range tests {
+		encoded, err := EncodeAction(tt.id, tt.values...)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode: %v", i, err)
+		}
+		if !bytes.Equal(encoded, tt.want) {
+			t.Errorf("test %d: encoding mismatch: have %x, want %x", i, encoded, tt.want)
+		}
+		action := &Action{}
+		if err := action.fromBytes(encoded); err != nil {
+			t.Fatalf("test %d: failed to decode: %v", i, err)
+		}
+		if action.Id != tt.id || len(action.Values) != len(tt.values) {
+			t.Errorf("test %d: decoded action mismatch: %d %v", i, action.Id, action.Values)
+		}
+	}
+	//缺少或类型不对的值必须返回错误, 不能panic
+	for i, values := range [][]interface{}{nil, {candidate.Bytes()}} {
+		if _, err := EncodeAction(becomeDelegator, values...); err == nil {
+			t.Errorf("invalid delegation %d encoded", i)
+		}
 	}
-}
\ No newline at end of file
+	if _, err := EncodeAction(unstake); err == nil {
+		t.Errorf("unstake without amount encoded")
+	}
+}
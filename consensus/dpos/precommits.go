@@ -0,0 +1,308 @@
+/*
+预提交投票池
+
+签名者每看到一个更高的链头就签一票(同一高度只投一次), 投票连同收到的其他签名者的投票一起放在投票池里。
+投过的最高的块存入数据库, 重启后也不会在同一高度再投一次。签名者锁定在自己投过的块上, 之后只给它的后代块投票,
+除非另一条分叉上有比它更高的块有了证书(投票超过2/3), 这时才改投那个块的后代; 已知有证书的块之后也只给它的后代块投票,
+不会帮另一条分叉凑出冲突的证书。
+
+同一签名者在同一高度对不同块的两张投票是重复投票的证据, 投票池记下来, 可以通过reportDoublePrecommit action举报,
+和双签一样罚没抵押金, 参考dpos.getPrecommitEvidences。
+出块时从父块往回找, 第一个投票超过2/3当选签名者、而且比链上已有证书更高的块, 它的投票会聚合成证书放进新块的extra。
+
+投票池只保留一个epoch长度内的投票, 链头前进时清理。
+*/
+package dpos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const dbPrecommitPrefix = "dpos-precommit-" //签名者投过的最高块高度的数据库键前缀, 后接签名者地址
+
+// precommitPool collects the precommit votes of elected signers for recent blocks.
+type precommitPool struct {
+	votes     map[common.Hash]map[common.Address]*Precommit //块哈希 -> 签名者 -> 投票
+	heights   map[uint64]map[common.Address]*Precommit      //块高度 -> 签名者 -> 投票, 用来发现重复投票
+	evidences map[common.Hash][2]*Precommit                 //证据哈希 -> 重复投票的两张票
+	certified *types.Header                                 //投票池里投票超过2/3的最高的块
+	lock      sync.RWMutex
+}
+
+func newPrecommitPool() *precommitPool {
+	return &precommitPool{
+		votes:     make(map[common.Hash]map[common.Address]*Precommit),
+		heights:   make(map[uint64]map[common.Address]*Precommit),
+		evidences: make(map[common.Hash][2]*Precommit),
+	}
+}
+
+// AddPrecommit validates a precommit vote against the epoch of the voted block and
+// adds it to the vote pool. It reports whether the vote was new. A vote for
+// another block at the height the signer already voted on is kept as evidence
+// instead, and errDoublePrecommit is returned.
+func (self *Dpos) AddPrecommit(chain consensus.ChainHeaderReader, vote *Precommit) (bool, error) {
+	header := chain.GetHeader(vote.Hash, vote.Number)
+	if header == nil || vote.Number == 0 {
+		return false, errUnknownBlock
+	}
+	if head := chain.CurrentHeader(); head != nil && vote.Number+self.config.EpochInterval < head.Number.Uint64() {
+		return false, errStalePrecommit
+	}
+	signer, err := vote.Signer()
+	if err != nil {
+		return false, err
+	}
+	elected, err := self.electedSignersOf(chain, header, nil)
+	if err != nil {
+		return false, err
+	}
+	authorized := false
+	for _, electedSigner := range elected {
+		if electedSigner == signer {
+			authorized = true
+			break
+		}
+	}
+	if !authorized {
+		return false, errUnauthorizedPrecommit
+	}
+	self.precommits.lock.Lock()
+	defer self.precommits.lock.Unlock()
+
+	votes := self.precommits.votes[vote.Hash]
+	if votes == nil {
+		votes = make(map[common.Address]*Precommit)
+		self.precommits.votes[vote.Hash] = votes
+	}
+	if _, ok := votes[signer]; ok {
+		return false, nil
+	}
+	heights := self.precommits.heights[vote.Number]
+	if heights == nil {
+		heights = make(map[common.Address]*Precommit)
+		self.precommits.heights[vote.Number] = heights
+	}
+	if other, ok := heights[signer]; ok {
+		if _, evidence, err := verifyPrecommitEvidence(other, vote); err == nil {
+			if _, known := self.precommits.evidences[evidence]; !known {
+				log.Warn("Conflicting precommit votes", "signer", signer, "number", vote.Number, "first", other.Hash, "second", vote.Hash)
+				self.precommits.evidences[evidence] = [2]*Precommit{other, vote}
+			}
+		}
+		return false, errDoublePrecommit
+	}
+	heights[signer] = vote
+	votes[signer] = vote
+
+	if len(votes) >= finalityThreshold(len(elected)) {
+		if certified := self.precommits.certified; certified == nil || certified.Number.Uint64() < vote.Number {
+			self.precommits.certified = header
+		}
+	}
+	return true, nil
+}
+
+/*
+清理一个epoch长度以外的投票, 以及过了举报期限的重复投票证据
+*/
+func (self *Dpos) prunePrecommits(head uint64) {
+	self.precommits.lock.Lock()
+	defer self.precommits.lock.Unlock()
+
+	for number := range self.precommits.heights {
+		if number+self.config.EpochInterval < head {
+			delete(self.precommits.heights, number)
+		}
+	}
+	for evidence, votes := range self.precommits.evidences {
+		if votes[0].Number+self.config.UnbondingEpochs*self.config.EpochInterval < head {
+			delete(self.precommits.evidences, evidence)
+		}
+	}
+
+	for hash, votes := range self.precommits.votes {
+		//同一块的投票高度都一样, 看一票就够了
+		for _, vote := range votes {
+			if vote.Number+self.config.EpochInterval < head {
+				delete(self.precommits.votes, hash)
+			}
+			break
+		}
+	}
+}
+
+/*
+本地签名者对header签预提交投票, 以下情况返回nil:
+ 1. 没有授权签名或不是当选签名者
+ 2. 已经投过同高度或更高的块
+ 3. header不是上一次投的块的后代, 而且投票池里没有比上一次投的块更高的证书
+ 4. header不是投票池里有证书的最高的块的后代
+
+锁定在上一次投的块上: 签名者不会在两条分叉上都投票。证书超过2/3, 所以比锁定的块更高的证书说明别的签名者已经改投,
+这时改投才不会让两条分叉都凑出证书; 没有这样的证书时, 放弃了锁定分叉的签名者不能再投票, 直到锁定的分叉或新证书出现。
+*/
+func (self *Dpos) signPrecommit(chain consensus.ChainHeaderReader, header *types.Header) (*Precommit, error) {
+	self.lock.RLock()
+	signer, signFn := self.signer, self.signFn
+	self.lock.RUnlock()
+
+	number := header.Number.Uint64()
+	if signFn == nil || number == 0 {
+		return nil, nil
+	}
+	elected, err := self.electedSignersOf(chain, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	authorized := false
+	for _, electedSigner := range elected {
+		if electedSigner == signer {
+			authorized = true
+			break
+		}
+	}
+	if !authorized {
+		return nil, nil
+	}
+	self.precommits.lock.Lock()
+	defer self.precommits.lock.Unlock()
+
+	//同一高度只投一次, 也不回头投较低的块; 旧版本只存了块高度, 没有锁定的块
+	key := append([]byte(dbPrecommitPrefix), signer[:]...)
+	if blob, err := self.db.Get(key); err == nil && len(blob) >= 8 {
+		voted := binary.BigEndian.Uint64(blob)
+		if number <= voted {
+			return nil, nil
+		}
+		if len(blob) == 8+common.HashLength && !descendsFrom(chain, header, voted, common.BytesToHash(blob[8:])) {
+			if certified := self.precommits.certified; certified == nil || certified.Number.Uint64() <= voted {
+				return nil, nil
+			}
+		}
+	}
+	if certified := self.precommits.certified; certified != nil && !descendsFrom(chain, header, certified.Number.Uint64(), certified.Hash()) {
+		return nil, nil
+	}
+	//签名前先存入数据库, 签名后崩溃重启也不会再投
+	enc := make([]byte, 8+common.HashLength)
+	binary.BigEndian.PutUint64(enc, number)
+	copy(enc[8:], header.Hash().Bytes())
+	if err := self.db.Put(key, enc); err != nil {
+		return nil, err
+	}
+	signature, err := signFn(accounts.Account{Address: signer}, accounts.MimetypeDposPrecommit, precommitData(number, header.Hash()))
+	if err != nil {
+		return nil, err
+	}
+	return &Precommit{Number: number, Hash: header.Hash(), Signature: signature}, nil
+}
+
+/*
+header是否是number高度的块hash的后代
+*/
+func descendsFrom(chain consensus.ChainHeaderReader, header *types.Header, number uint64, hash common.Hash) bool {
+	ancestor, _ := ancestorOf(chain, header, nil, number)
+	return ancestor != nil && ancestor.Hash() == hash
+}
+
+/*
+为parent的子块聚合最终确定证书, 没有可以证明的块时返回nil
+
+从parent往回找, 遇到链上已有证书证明过的高度就停下, 所以证书只会越来越高
+*/
+func (self *Dpos) certificate(chain consensus.ChainHeaderReader, parent *types.Header) *Certificate {
+	var certified uint64
+
+	header := parent
+	for header != nil && header.Number.Uint64() > 0 && parent.Number.Uint64()+1-header.Number.Uint64() <= self.config.EpochInterval {
+		number := header.Number.Uint64()
+		if number <= certified {
+			return nil
+		}
+		if certificate := self.collectPrecommits(chain, header); certificate != nil {
+			return certificate
+		}
+		extra := new(EpochExtra)
+		if err := extra.Decode(header.Extra); err == nil && extra.Certificate != nil && extra.Certificate.Number > certified {
+			certified = extra.Certificate.Number
+		}
+		header = chain.GetHeader(header.ParentHash, number-1)
+	}
+	return nil
+}
+
+/*
+header的投票超过2/3当选签名者时返回证书, 签名按签名者地址从小到大
+*/
+func (self *Dpos) collectPrecommits(chain consensus.ChainHeaderReader, header *types.Header) *Certificate {
+	self.precommits.lock.RLock()
+	votes := self.precommits.votes[header.Hash()]
+	signers := make([]common.Address, 0, len(votes))
+	for signer := range votes {
+		signers = append(signers, signer)
+	}
+	self.precommits.lock.RUnlock()
+
+	elected, err := self.electedSignersOf(chain, header, nil)
+	if err != nil || len(signers) < finalityThreshold(len(elected)) {
+		return nil
+	}
+	sort.Slice(signers, func(i, j int) bool {
+		return bytes.Compare(signers[i][:], signers[j][:]) < 0
+	})
+	certificate := &Certificate{Number: header.Number.Uint64(), Hash: header.Hash()}
+
+	self.precommits.lock.RLock()
+	for _, signer := range signers {
+		certificate.Signatures = append(certificate.Signatures, votes[signer].Signature)
+	}
+	self.precommits.lock.RUnlock()
+
+	return certificate
+}
+
+/*
+投票池里的所有投票, 发给新连上的peer
+*/
+func (self *Dpos) recentPrecommits() []*Precommit {
+	self.precommits.lock.RLock()
+	defer self.precommits.lock.RUnlock()
+
+	var votes []*Precommit
+	for _, byBlock := range self.precommits.votes {
+		for _, vote := range byBlock {
+			votes = append(votes, vote)
+		}
+	}
+	return votes
+}
+
+/*
+投票池发现的重复投票证据, 按投票高度排序
+*/
+func (self *Dpos) precommitEvidences() [][2]*Precommit {
+	self.precommits.lock.RLock()
+	defer self.precommits.lock.RUnlock()
+
+	evidences := make([][2]*Precommit, 0, len(self.precommits.evidences))
+	for _, votes := range self.precommits.evidences {
+		evidences = append(evidences, votes)
+	}
+	sort.Slice(evidences, func(i, j int) bool {
+		if evidences[i][0].Number != evidences[j][0].Number {
+			return evidences[i][0].Number < evidences[j][0].Number
+		}
+		return bytes.Compare(evidences[i][0].Hash[:], evidences[j][0].Hash[:]) < 0
+	})
+	return evidences
+}
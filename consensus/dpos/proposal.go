@@ -1,5 +1,17 @@
 /*
-dpos自带的提案功能，目前只有一个提案，用作测试用途，名为TestProposal#1
+dpos自带的提案功能，TestProposal#1用作测试用途，其余的提案可以改变共识参数:
+
+MaxSignersProposal#2      每个epoch最多选出多少个签名者
+SignerRewardProposal#3    签名者分得的区块奖励%
+BlockRewardProposal#4     每块的奖励(wei)
+SlotIntervalProposal#5    出块间隔(秒)
+MinSelfStakeProposal#6    候选人自己最少要抵押多少才能参选(wei)
+GasLimitTargetProposal#7  区块gas limit的目标值
+
+提案值是32字节，第一个字节是提案ID，余下31字节是大端序的值。定案的值写在epoch块的extra，从下一个epoch开始生效，优先于链配置
+
+签名者通过出块(header.MixDigest/Nonce)投票，其他抵押者通过voteProposal action投票，票数按抵押金计算。
+每个提案有自己的法定人数(Quorum, 投票的抵押金占全部抵押金的%)和通过门槛(Threshold, 赞成票占已投票的%)
 
 在一个周期内(epoch)相同的提案不能被重复
 */
@@ -7,20 +19,32 @@ package dpos
 
 import(
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
 	"encoding/binary"
 	"errors"
 	"bytes"
-	_ "fmt"
+	"math/big"
+	"fmt"
 )
 
 const (
 	TestProposal uint8 = iota + 1	
+	MaxSignersProposal
+	SignerRewardProposal
+	BlockRewardProposal
+	SlotIntervalProposal
+	MinSelfStakeProposal
+	GasLimitTargetProposal
 )
 
+const maxProposalSigners = 255 //MaxSignersProposal的上限
+
 type Proposal struct {
 	Id          uint8
 	Values 		[]interface{}
 	Description string
+	Quorum      uint8 //投票的抵押金最少要占全部抵押金的%
+	Threshold   uint8 //赞成票最少要占已投票抵押金的%
 	ValidateValuesFn  func(uint8, []interface{}) (error)
 	ValidateBytesFn func(common.Hash) (error)
 	ToBytesFn func([]interface{}) ([]byte)
@@ -32,6 +56,8 @@ var Proposals map[uint8]*Proposal = map[uint8]*Proposal{
 		Id          : TestProposal,
 		Values      : make([]interface{},0),
 		Description : "This is test proposal by dpos",
+		Quorum      : 0,
+		Threshold   : 50,
 		
 		ValidateValuesFn	: func(id uint8, values []interface{}) (error) {
 			value := values[0].(uint8)
@@ -73,11 +99,76 @@ var Proposals map[uint8]*Proposal = map[uint8]*Proposal{
 	},
 }
 
+func init() {
+	Proposals[MaxSignersProposal] = newValueProposal(MaxSignersProposal, "Maximum number of signers elected for an epoch", 40, 67, func(value *big.Int) bool {
+		return value.Sign() > 0 && value.Cmp(big.NewInt(maxProposalSigners)) <= 0
+	})
+	Proposals[SignerRewardProposal] = newValueProposal(SignerRewardProposal, "Percentage of the block reward paid to the signer", 40, 67, func(value *big.Int) bool {
+		return value.Cmp(big.NewInt(100)) <= 0
+	})
+	Proposals[BlockRewardProposal] = newValueProposal(BlockRewardProposal, "Block reward in wei", 40, 67, func(value *big.Int) bool {
+		return true
+	})
+	Proposals[SlotIntervalProposal] = newValueProposal(SlotIntervalProposal, "Seconds between two blocks", 40, 67, func(value *big.Int) bool {
+		return value.Sign() > 0 && value.IsUint64()
+	})
+	Proposals[MinSelfStakeProposal] = newValueProposal(MinSelfStakeProposal, "Minimum stake bonded by a candidate itself to be elected, in wei", 33, 50, func(value *big.Int) bool {
+		return true
+	})
+	Proposals[GasLimitTargetProposal] = newValueProposal(GasLimitTargetProposal, "Target gas limit of blocks", 33, 50, func(value *big.Int) bool {
+		return value.IsUint64() && value.Uint64() >= params.MinGasLimit
+	})
+}
+
+/*
+值是一个非负整数的提案, Values[0]是*big.Int, 编码成31字节的大端序
+*/
+func newValueProposal(id uint8, description string, quorum uint8, threshold uint8, valid func(*big.Int) bool) *Proposal {
+	
+	invalid := fmt.Errorf("Invalid proposal#%d", id)
+	
+	return &Proposal{
+		Id          : id,
+		Values      : make([]interface{},0),
+		Description : description,
+		Quorum      : quorum,
+		Threshold   : threshold,
+		
+		ValidateValuesFn : func(id uint8, values []interface{}) (error) {
+			if len(values) != 1 {
+				return invalid
+			}
+			value, ok := values[0].(*big.Int)
+			
+			if !ok || value.Sign() < 0 || value.BitLen() > 8*(common.HashLength-1) || !valid(value) {
+				return invalid
+			}
+			return nil
+		},
+		
+		ValidateBytesFn: func(_bytes common.Hash) (error) {
+			if !valid(new(big.Int).SetBytes(_bytes[1:])) {
+				return invalid
+			}
+			return nil
+		},
+		
+		ToBytesFn : func(values []interface{}) ([]byte) {
+			return common.LeftPadBytes(values[0].(*big.Int).Bytes(), common.HashLength-1)
+		},
+		
+		FromBytesFn: func(_bytes common.Hash) ([]interface{}) {
+			return []interface{}{new(big.Int).SetBytes(_bytes[1:])}
+		},
+	}
+}
+
 func getProposal(id uint8) (*Proposal,error) {
 	proposal, ok := Proposals[id]
 	
 	if ok {
-		return &(*proposal),nil //new
+		cpy := *proposal
+		return &cpy,nil //new
 	} else {
 		return &Proposal{}, errors.New("Proposal not found")
 	}
@@ -118,6 +209,8 @@ func(self *Proposal) fromBytes(proposalBytes common.Hash) error {
 		
 		self.Id          = proposal.Id
 		self.Description = proposal.Description
+		self.Quorum      = proposal.Quorum
+		self.Threshold   = proposal.Threshold
 		self.ValidateValuesFn  = proposal.ValidateValuesFn
 		self.ToBytesFn   = proposal.ToBytesFn
 		self.FromBytesFn = proposal.FromBytesFn
@@ -130,3 +223,63 @@ func(self *Proposal) fromBytes(proposalBytes common.Hash) error {
 	return nil
 }
 
+
+/*
+在某块生效的共识参数: 链配置(含按块高度排定的分叉)加上已定案的提案, 提案优先
+*/
+type Rules struct {
+	params.DposRules
+	SlotInterval   uint64
+	MinSelfStake   *big.Int
+	GasLimitTarget uint64 //0表示没有目标，由矿工自己决定
+}
+
+func newRules(config *params.DposConfig, number uint64, proposals []*Proposal) *Rules {
+	
+	rules := &Rules{
+		DposRules    : config.Rules(number),
+		SlotInterval : config.SlotInterval,
+		MinSelfStake : new(big.Int),
+	}
+	
+	for _, proposal := range proposals {
+		if proposal.Id == TestProposal {
+			continue
+		}
+		value := proposal.Values[0].(*big.Int)
+		
+		switch proposal.Id {
+			case MaxSignersProposal:
+				rules.MaxSigners = value.Uint64()
+			case SignerRewardProposal:
+				rules.SignerReward = value.Uint64()
+			case BlockRewardProposal:
+				rules.BlockReward = new(big.Int).Set(value)
+			case SlotIntervalProposal:
+				rules.SlotInterval = value.Uint64()
+			case MinSelfStakeProposal:
+				rules.MinSelfStake = new(big.Int).Set(value)
+			case GasLimitTargetProposal:
+				rules.GasLimitTarget = value.Uint64()
+		}
+	}
+	
+	return rules
+}
+
+/*
+解码快照里按ID记录的提案
+*/
+func decodeProposals(proposals map[uint8]common.Hash) []*Proposal {
+	
+	result := make([]*Proposal, 0, len(proposals))
+	
+	for _, proposalBytes := range proposals {
+		proposal := &Proposal{}
+		if err := proposal.fromBytes(proposalBytes); err == nil {
+			result = append(result, proposal)
+		}
+	}
+	
+	return result
+}
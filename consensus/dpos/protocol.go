@@ -0,0 +1,282 @@
+/*
+dposv子协议
+
+签名者的预提交投票通过这个devp2p子协议传播, 只有一种消息votesMsg, 内容是一批投票(RLP列表)。
+ 1. 本地签名者在每个更高的链头签一票, 发给所有peer
+ 2. 收到的投票通过AddPrecommit验证, 新的投票再转发给还不知道它的peer
+ 3. 新连上的peer会先收到投票池里现有的投票
+
+投的块本地还没有时, 投票会被丢弃, 之后连上的peer会再收到。签名不对的投票会断开发送的peer;
+投票者不是本地所知的当选签名者时, peer可能只是在另一条分叉上, 和块本地还没有一样只丢弃投票。
+*/
+package dpos
+
+import (
+	"fmt"
+	"sync"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+const (
+	precommitProtocolName    = "dposv"
+	precommitProtocolVersion = 1
+	precommitProtocolLength  = 1 //只有votesMsg
+
+	votesMsg = 0x00
+
+	maxVotesMsgSize    = 128 * 1024 //一条消息的上限
+	maxVotesPerMsg     = 256        //每次发送最多多少票
+	maxKnownPrecommits = 4096       //每个peer最多记录多少张已知的投票
+	maxQueuedVotes     = 256        //每个peer的发送队列长度, 满了就丢弃
+	chainHeadChanSize  = 10
+)
+
+// PrecommitChain is the chain the precommit votes are cast for and checked
+// against.
+type PrecommitChain interface {
+	consensus.ChainHeaderReader
+
+	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
+}
+
+// PrecommitHandler casts the precommit votes of the local signer on new chain
+// heads, and gossips the votes of all signers over the dposv subprotocol.
+type PrecommitHandler struct {
+	engine *Dpos
+	chain  PrecommitChain
+
+	peers map[*precommitPeer]struct{}
+	lock  sync.RWMutex
+
+	headCh  chan core.ChainHeadEvent
+	headSub event.Subscription
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewPrecommitHandler creates the precommit handler of a DPOS chain.
+func NewPrecommitHandler(engine *Dpos, chain PrecommitChain) *PrecommitHandler {
+	return &PrecommitHandler{
+		engine: engine,
+		chain:  chain,
+		peers:  make(map[*precommitPeer]struct{}),
+		headCh: make(chan core.ChainHeadEvent, chainHeadChanSize),
+		quit:   make(chan struct{}),
+	}
+}
+
+// Protocols returns the dposv subprotocol to run alongside the eth protocol.
+func (h *PrecommitHandler) Protocols() []p2p.Protocol {
+	return []p2p.Protocol{{
+		Name:    precommitProtocolName,
+		Version: precommitProtocolVersion,
+		Length:  precommitProtocolLength,
+		Run:     h.runPeer,
+	}}
+}
+
+// Start starts voting on new chain heads.
+func (h *PrecommitHandler) Start() {
+	h.headSub = h.chain.SubscribeChainHeadEvent(h.headCh)
+
+	h.wg.Add(1)
+	go h.loop()
+}
+
+// Stop stops voting and waits for the voting loop to exit.
+func (h *PrecommitHandler) Stop() {
+	if h.headSub != nil {
+		h.headSub.Unsubscribe()
+	}
+	close(h.quit)
+	h.wg.Wait()
+}
+
+/*
+链头前进时清理投票池, 本地签名者签一票并广播
+*/
+func (h *PrecommitHandler) loop() {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case ev := <-h.headCh:
+			header := ev.Block.Header()
+			h.engine.prunePrecommits(header.Number.Uint64())
+
+			vote, err := h.engine.signPrecommit(h.chain, header)
+			if err != nil {
+				log.Warn("Failed to sign precommit vote", "number", header.Number, "hash", header.Hash(), "err", err)
+				continue
+			}
+			if vote == nil {
+				continue
+			}
+			if _, err := h.engine.AddPrecommit(h.chain, vote); err != nil {
+				log.Warn("Failed to add own precommit vote", "number", vote.Number, "hash", vote.Hash, "err", err)
+				continue
+			}
+			h.broadcast([]*Precommit{vote})
+
+		case <-h.headSub.Err():
+			return
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+/*
+把投票发给还不知道它们的peer
+*/
+func (h *PrecommitHandler) broadcast(votes []*Precommit) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for peer := range h.peers {
+		peer.sendVotes(votes)
+	}
+}
+
+func (h *PrecommitHandler) runPeer(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+	peer := newPrecommitPeer(p, rw)
+	defer peer.close()
+
+	h.lock.Lock()
+	h.peers[peer] = struct{}{}
+	h.lock.Unlock()
+
+	defer func() {
+		h.lock.Lock()
+		delete(h.peers, peer)
+		h.lock.Unlock()
+	}()
+	go peer.broadcastLoop()
+
+	//先把投票池里的投票发给新peer
+	peer.sendVotes(h.engine.recentPrecommits())
+
+	for {
+		if err := h.handleMsg(peer); err != nil {
+			peer.Log().Debug("Precommit message handling failed", "err", err)
+			return err
+		}
+	}
+}
+
+func (h *PrecommitHandler) handleMsg(peer *precommitPeer) error {
+	msg, err := peer.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer msg.Discard()
+
+	if msg.Size > maxVotesMsgSize {
+		return fmt.Errorf("message too large: %v > %v", msg.Size, maxVotesMsgSize)
+	}
+	if msg.Code != votesMsg {
+		return fmt.Errorf("invalid message code: %v", msg.Code)
+	}
+	var votes []*Precommit
+	if err := msg.Decode(&votes); err != nil {
+		return fmt.Errorf("invalid votes message: %v", err)
+	}
+	var added []*Precommit
+	for _, vote := range votes {
+		peer.markKnown(vote.id())
+
+		//签名不对的投票是peer的错, 断开连接
+		if _, err := vote.Signer(); err != nil {
+			return fmt.Errorf("invalid precommit vote: %v", err)
+		}
+		//投票的块本地可能还没有, 或者peer在另一条分叉上, 不算peer的错
+		ok, err := h.engine.AddPrecommit(h.chain, vote)
+		if err != nil {
+			peer.Log().Trace("Dropped precommit vote", "number", vote.Number, "hash", vote.Hash, "err", err)
+			continue
+		}
+		if ok {
+			added = append(added, vote)
+		}
+	}
+	if len(added) > 0 {
+		h.broadcast(added)
+	}
+	return nil
+}
+
+// precommitPeer is a peer running the dposv subprotocol.
+type precommitPeer struct {
+	*p2p.Peer
+	rw p2p.MsgReadWriter
+
+	known mapset.Set        //peer已经知道的投票
+	queue chan []*Precommit //等待发送的投票
+	term  chan struct{}
+}
+
+func newPrecommitPeer(p *p2p.Peer, rw p2p.MsgReadWriter) *precommitPeer {
+	return &precommitPeer{
+		Peer:  p,
+		rw:    rw,
+		known: mapset.NewSet(),
+		queue: make(chan []*Precommit, maxQueuedVotes),
+		term:  make(chan struct{}),
+	}
+}
+
+func (p *precommitPeer) close() {
+	close(p.term)
+}
+
+func (p *precommitPeer) markKnown(id interface{}) {
+	for p.known.Cardinality() >= maxKnownPrecommits {
+		p.known.Pop()
+	}
+	p.known.Add(id)
+}
+
+/*
+排队发送peer还不知道的投票, 队列满了就丢弃
+*/
+func (p *precommitPeer) sendVotes(votes []*Precommit) {
+	var unknown []*Precommit
+	for _, vote := range votes {
+		if id := vote.id(); !p.known.Contains(id) {
+			p.markKnown(id)
+			unknown = append(unknown, vote)
+		}
+	}
+	for len(unknown) > 0 {
+		batch := unknown
+		if len(batch) > maxVotesPerMsg {
+			batch = batch[:maxVotesPerMsg]
+		}
+		unknown = unknown[len(batch):]
+
+		select {
+		case p.queue <- batch:
+		default:
+			p.Log().Debug("Dropping precommit vote propagation", "count", len(batch))
+		}
+	}
+}
+
+func (p *precommitPeer) broadcastLoop() {
+	for {
+		select {
+		case votes := <-p.queue:
+			if err := p2p.Send(p.rw, votesMsg, votes); err != nil {
+				return
+			}
+		case <-p.term:
+			return
+		}
+	}
+}
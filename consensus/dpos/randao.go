@@ -0,0 +1,193 @@
+/*
+RANDAO随机数信标
+
+签名者出块时在extra的扩展项(标签extRandao, 参考extra.go)里对一个秘密做出承诺(keccak256(秘密)), 在自己的下一块公开它:
+ 1. 公开的秘密必须和快照里该签名者的承诺相符, 否则块无效(verifySeal检查)
+ 2. 相符的秘密并入快照的mix: mix = keccak256(mix, 秘密), 创世块的mix是创世块的哈希
+ 3. 有承诺却没有公开(扩展项缺少秘密或整个缺少)算一次错过公开, 承诺作废, 记在snapshot.Unrevealed,
+    选举时从出块数里扣除, 参考elect(...)
+ 4. 签名者只能决定公开或不公开, 不能改变公开的值, 所以出块的签名者最多只能放弃一次公开来影响mix, 代价是记一次错过
+
+秘密由签名者本地的随机种子(存在数据库里)和做出承诺的块高度算出, 重启后仍然能公开; 换了机器的签名者公开不了,
+只会记一次错过。
+
+从链配置的RandaoBlock起, 块里的交易通过DIFFICULTY指令读取父块之后的mix(和EIP-4399的PREVRANDAO一样), 参考Randomness(...);
+取不到mix时块无法执行, 不会退回难度。mix和承诺随快照写入系统账户的storage(参考registry.go), 快速同步的节点
+从pivot块的state取得, 和重放得到的一样; 只有轻节点的快照没有mix。RPC可以用dpos.getMix查询。
+*/
+package dpos
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const dbRandaoPrefix = "dpos-randao-" //签名者本地随机种子的数据库键前缀, 后接签名者地址
+
+var (
+	//扩展项里的承诺和秘密格式不对
+	errInvalidRandao = errors.New("Invalid randao commitment")
+
+	//公开的秘密和签名者的承诺不符
+	errInvalidReveal = errors.New("Randao reveal does not match commitment")
+
+	//轻节点的快照没有mix
+	errNoMix = errors.New("Randao mix unavailable")
+)
+
+// Randao is the RANDAO element of a header: the signer commits to a new secret
+// and reveals the one it committed to in its previous block, if any.
+type Randao struct {
+	Commitment common.Hash  //keccak256(秘密), 在签名者的下一块公开
+	Reveal     *common.Hash //签名者上一次承诺的秘密, 没有时为nil
+}
+
+/*
+承诺(32 bytes), 有公开的秘密时再接秘密(32 bytes)
+*/
+func (r *Randao) encode() []byte {
+	data := common.CopyBytes(r.Commitment[:])
+	if r.Reveal != nil {
+		data = append(data, r.Reveal[:]...)
+	}
+	return data
+}
+
+func (r *Randao) decode(data []byte) error {
+	switch len(data) {
+	case common.HashLength:
+		r.Commitment, r.Reveal = common.BytesToHash(data), nil
+	case 2 * common.HashLength:
+		reveal := common.BytesToHash(data[common.HashLength:])
+		r.Commitment, r.Reveal = common.BytesToHash(data[:common.HashLength]), &reveal
+	default:
+		return errInvalidRandao
+	}
+	return nil
+}
+
+// Commitment is a RANDAO commitment of a signer waiting to be revealed.
+type Commitment struct {
+	Number uint64      `json:"number"` //做出承诺的块高度
+	Hash   common.Hash `json:"hash"`   //keccak256(秘密)
+}
+
+/*
+检查块头公开的秘密是否符合签名者的承诺, 轻节点的快照没有承诺, 跳过检查
+*/
+func (s *Snapshot) verifyRandao(signer common.Address, header *types.Header) error {
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err != nil {
+		return err
+	}
+	if s.Light || extra.Randao == nil || extra.Randao.Reveal == nil {
+		return nil
+	}
+	commitment, ok := s.Commitments[signer]
+	if !ok || crypto.Keccak256Hash(extra.Randao.Reveal[:]) != commitment.Hash {
+		return errInvalidReveal
+	}
+	return nil
+}
+
+/*
+把number高度签名者的RANDAO元素记入快照: 并入公开的秘密或记一次错过公开, 再换上新的承诺
+*/
+func (s *Snapshot) applyRandao(signer common.Address, randao *Randao, number uint64) error {
+	commitment, committed := s.Commitments[signer]
+	switch {
+	case s.Light:
+		//轻快照没有之前的承诺和mix, 只记录新的承诺
+	case randao == nil || randao.Reveal == nil:
+		if committed {
+			s.Unrevealed[signer]++
+		}
+	case !committed || crypto.Keccak256Hash(randao.Reveal[:]) != commitment.Hash:
+		return errInvalidReveal
+	default:
+		s.Mix = crypto.Keccak256Hash(s.Mix[:], randao.Reveal[:])
+	}
+	if randao == nil {
+		delete(s.Commitments, signer)
+	} else {
+		s.Commitments[signer] = &Commitment{Number: number, Hash: randao.Commitment}
+	}
+	return nil
+}
+
+/*
+签名者在number高度承诺的秘密
+*/
+func randaoSecret(seed common.Hash, number uint64) common.Hash {
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], number)
+	return crypto.Keccak256Hash(seed[:], enc[:])
+}
+
+/*
+签名者本地的随机种子, 第一次用时生成并存入数据库
+*/
+func (self *Dpos) randaoSeed(signer common.Address) (common.Hash, error) {
+	key := append([]byte(dbRandaoPrefix), signer[:]...)
+	if blob, err := self.db.Get(key); err == nil && len(blob) == common.HashLength {
+		return common.BytesToHash(blob), nil
+	}
+	var seed common.Hash
+	if _, err := crand.Read(seed[:]); err != nil {
+		return common.Hash{}, err
+	}
+	if err := self.db.Put(key, seed[:]); err != nil {
+		return common.Hash{}, err
+	}
+	return seed, nil
+}
+
+/*
+本地签名者在number高度出块时的RANDAO元素: 新的承诺, 以及上一次承诺的秘密(算得出来时)
+*/
+func (self *Dpos) makeRandao(snap *Snapshot, signer common.Address, number uint64) *Randao {
+	seed, err := self.randaoSeed(signer)
+	if err != nil {
+		log.Warn("Failed to load randao seed", "signer", signer, "err", err)
+		return nil
+	}
+	secret := randaoSecret(seed, number)
+	randao := &Randao{Commitment: crypto.Keccak256Hash(secret[:])}
+
+	if commitment, ok := snap.Commitments[signer]; ok {
+		if reveal := randaoSecret(seed, commitment.Number); crypto.Keccak256Hash(reveal[:]) == commitment.Hash {
+			randao.Reveal = &reveal
+		} else {
+			log.Warn("Randao commitment made with another seed, skipping reveal", "signer", signer, "number", commitment.Number)
+		}
+	}
+	return randao
+}
+
+// Randomness implements consensus.RandomnessBeacon, returning the RANDAO mix
+// after the parent of the given header. It replaces the difficulty in the EVM
+// from the RANDAO fork block of the config on.
+func (self *Dpos) Randomness(chain consensus.ChainHeaderReader, header *types.Header) (*common.Hash, error) {
+	if !self.config.IsRandao(header.Number) {
+		return nil, nil
+	}
+	if header.Number.Sign() == 0 {
+		return nil, errNoMix
+	}
+	snap, err := self.snapshot(chain, header.Number.Uint64()-1, header.ParentHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Light {
+		return nil, errNoMix
+	}
+	mix := snap.Mix
+	return &mix, nil
+}
@@ -0,0 +1,242 @@
+package dpos
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestRandaoCodec(t *testing.T) {
+	reveal := common.Hash{2}
+	for _, randao := range []*Randao{
+		{Commitment: common.Hash{1}},
+		{Commitment: common.Hash{1}, Reveal: &reveal},
+	} {
+		for _, extra := range []*EpochExtra{
+			{Randao: randao},
+			{Epoch: true, Signers: []common.Address{{1}}, Delegators: make([][]ElectedDelegator, 1), Randao: randao},
+			{Certificate: &Certificate{Number: 6, Hash: common.Hash{1}, Signatures: [][]byte{make([]byte, crypto.SignatureLength)}}, Randao: randao},
+		} {
+			encoded, err := extra.Encode()
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			decoded := new(EpochExtra)
+			if err := decoded.Decode(encoded); err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if decoded.Epoch != extra.Epoch || !reflect.DeepEqual(decoded.Randao, randao) || !reflect.DeepEqual(decoded.Certificate, extra.Certificate) {
+				t.Errorf("round trip mismatch: have %+v", decoded)
+			}
+		}
+	}
+	plain := make([]byte, extraSealLength)
+	plain[0] = extraVersion
+
+	commitment := append([]byte{extRandao, 0x20}, make([]byte, 0x20)...)
+	invalid := [][]byte{
+		append(common.CopyBytes(plain), 0x02, extRandao, 0x00),                                //空的承诺
+		append(append(common.CopyBytes(plain), 0x23, extRandao, 0x21), make([]byte, 0x21)...), //承诺长度不对
+		append(append(common.CopyBytes(plain), 0x43, extRandao, 0x41), make([]byte, 0x41)...), //秘密长度不对
+		append(append(common.CopyBytes(plain), 0x44), append(commitment, commitment...)...),   //重复的标签
+	}
+	for i, extra := range invalid {
+		if err := new(EpochExtra).Decode(extra); err == nil {
+			t.Errorf("invalid extra %d accepted", i)
+		}
+	}
+}
+
+// 每块带着签名者的新承诺和上一次承诺的秘密, mix随公开的秘密变化
+func TestRandaoChain(t *testing.T) {
+	keys := sortedTestKeys(3)
+	chain, engine := newTestChain(t, keys, nil, 20, nil)
+	defer chain.Stop()
+
+	//第2块起DIFFICULTY指令返回mix
+	engine.config.RandaoBlock = big.NewInt(2)
+
+	order := scheduledTestKeys(keys, chain.Genesis().Hash())
+	var (
+		mix         = chain.Genesis().Hash()
+		commitments = make(map[common.Address]common.Hash)
+	)
+	for number := 1; number <= 7; number++ {
+		block := insertTestBlock(t, chain, engine, order[number%len(order)])
+
+		//块里的交易读到的是父块之后的mix
+		want := mix.Big()
+		if number < 2 {
+			want = block.Difficulty()
+		}
+		if context, err := core.NewEVMBlockContext(block.Header(), chain, nil); err != nil || context.Difficulty.Cmp(want) != 0 {
+			t.Errorf("block #%d: EVM difficulty mismatch: have %x, want %x (%v)", number, context.Difficulty, want, err)
+		}
+		extra := new(EpochExtra)
+		if err := extra.Decode(block.Extra()); err != nil || extra.Randao == nil {
+			t.Fatalf("block #%d: missing randao: %v", number, err)
+		}
+		signer := crypto.PubkeyToAddress(order[number%len(order)].PublicKey)
+		if commitment, ok := commitments[signer]; ok {
+			if extra.Randao.Reveal == nil || crypto.Keccak256Hash(extra.Randao.Reveal[:]) != commitment {
+				t.Fatalf("block #%d: reveal mismatch: have %v, want preimage of %x", number, extra.Randao.Reveal, commitment)
+			}
+			mix = crypto.Keccak256Hash(mix[:], extra.Randao.Reveal[:])
+		} else if extra.Randao.Reveal != nil {
+			t.Fatalf("block #%d: unexpected reveal", number)
+		}
+		commitments[signer] = extra.Randao.Commitment
+	}
+	if have, err := (&API{chain: chain, dpos: engine}).GetMix(context.Background(), nil); err != nil || have != mix {
+		t.Errorf("mix mismatch: have %x, want %x (%v)", have, mix, err)
+	}
+	if random, err := engine.Randomness(chain, chain.Genesis().Header()); random != nil || err != nil {
+		t.Errorf("randomness before the fork: have %v, %v, want nil", random, err)
+	}
+	//取不到mix时块无法执行, 不能退回难度
+	parent := chain.CurrentHeader()
+	snap, err := engine.snapshot(chain, parent.Number.Uint64(), parent.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	snap.Light = true
+	next := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(8), Difficulty: diffInTurn, Extra: parent.Extra}
+	if _, err := core.NewEVMBlockContext(next, chain, nil); err != errNoMix {
+		t.Errorf("missing mix error mismatch: have %v, want %v", err, errNoMix)
+	}
+	snap.Light = false
+	//公开的秘密和承诺不符时块头验证失败
+	block := chain.CurrentBlock()
+	header := block.Header()
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err != nil {
+		t.Fatalf("failed to decode extra: %v", err)
+	}
+	extra.Randao.Reveal = &common.Hash{0xff}
+	if err := resealTestHeader(header, extra, order[7%len(order)]); err != nil {
+		t.Fatalf("failed to reseal: %v", err)
+	}
+	if err := engine.VerifySeal(chain, header); err != errInvalidReveal {
+		t.Errorf("invalid reveal error mismatch: have %v, want %v", err, errInvalidReveal)
+	}
+}
+
+// 有承诺却不公开记一次错过公开, 承诺作废
+func TestRandaoUnrevealed(t *testing.T) {
+	keys := sortedTestKeys(2)
+	chain, engine := newTestChain(t, keys, nil, 20, nil)
+	defer chain.Stop()
+
+	order := scheduledTestKeys(keys, chain.Genesis().Hash())
+	insertTestBlock(t, chain, engine, order[1])
+	insertTestBlock(t, chain, engine, order[0])
+
+	//第3块由order[1]出, 去掉秘密
+	engine.Authorize(crypto.PubkeyToAddress(order[1].PublicKey), nil)
+
+	parent := chain.CurrentBlock()
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(3), GasLimit: parent.GasLimit()}
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare block: %v", err)
+	}
+	header.Time = slotTestTime(t, chain, engine, order[1])
+
+	statedb, _ := chain.StateAt(parent.Root())
+	block, err := engine.FinalizeAndAssemble(chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to assemble block: %v", err)
+	}
+	header = block.Header()
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err != nil || extra.Randao == nil || extra.Randao.Reveal == nil {
+		t.Fatalf("missing reveal: %v", err)
+	}
+	extra.Randao.Reveal = nil
+	if err := resealTestHeader(header, extra, order[1]); err != nil {
+		t.Fatalf("failed to reseal: %v", err)
+	}
+	//写入state的快照跟着块头变, 要重新Finalize再签名
+	statedb, _ = chain.StateAt(parent.Root())
+	if err := engine.Finalize(chain, header, statedb, nil, nil); err != nil {
+		t.Fatalf("failed to finalize: %v", err)
+	}
+	if err := resealTestHeader(header, extra, order[1]); err != nil {
+		t.Fatalf("failed to reseal: %v", err)
+	}
+	if _, err := chain.InsertChain(types.Blocks{block.WithSeal(header)}); err != nil {
+		t.Fatalf("failed to insert block: %v", err)
+	}
+	snap, err := engine.snapshot(chain, 3, header.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	signer := crypto.PubkeyToAddress(order[1].PublicKey)
+	//第2块是order[0]的第一块, 没有秘密可公开, mix还是创世块的哈希
+	if snap.Unrevealed[signer] != 1 || snap.Unrevealed[crypto.PubkeyToAddress(order[0].PublicKey)] != 0 || snap.Mix != chain.Genesis().Hash() {
+		t.Errorf("unrevealed mismatch: have %d, mix %x", snap.Unrevealed[signer], snap.Mix)
+	}
+	if commitment := snap.Commitments[signer]; commitment == nil || commitment.Number != 3 || commitment.Hash != extra.Randao.Commitment {
+		t.Errorf("commitment mismatch: have %+v", commitment)
+	}
+}
+
+// 换上extra并由key重新签名
+func resealTestHeader(header *types.Header, extra *EpochExtra, key *ecdsa.PrivateKey) error {
+	encoded, err := extra.Encode()
+	if err != nil {
+		return err
+	}
+	header.Extra = encoded
+	sig, err := crypto.Sign(SealHash(header).Bytes(), key)
+	if err != nil {
+		return err
+	}
+	copy(header.Extra[1:], sig)
+	return nil
+}
+
+// 快速同步的节点从pivot块的state取得mix和承诺, 之后的块读到的mix和全节点一样
+func TestRandaoSeededSnapshot(t *testing.T) {
+	keys := sortedTestKeys(3)
+	chain, engine := newTestChain(t, keys, nil, 6, nil)
+	defer chain.Stop()
+
+	engine.config.RandaoBlock = big.NewInt(0)
+
+	order := scheduledTestKeys(keys, chain.Genesis().Hash())
+	for number := 1; number <= 5; number++ {
+		insertTestBlock(t, chain, engine, order[number%len(order)])
+	}
+	//像快速同步的pivot块之前一样去掉第3块的区块体和收据, 用没有缓存的引擎读取
+	block := chain.GetBlockByNumber(3)
+	rawdb.DeleteBody(engine.db, block.Hash(), 3)
+	rawdb.DeleteReceipts(engine.db, block.Hash(), 3)
+
+	fresh := New(engine.config, engine.db)
+	parent := chain.CurrentHeader()
+	next := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(6), Time: parent.Time + 1}
+
+	want, err := engine.Randomness(chain, next)
+	if err != nil || want == nil || *want == chain.Genesis().Hash() {
+		t.Fatalf("failed to get randomness: %v, %v", want, err)
+	}
+	if have, err := fresh.Randomness(chain, next); err != nil || have == nil || *have != *want {
+		t.Errorf("seeded randomness mismatch: have %v, want %x (%v)", have, *want, err)
+	}
+	//epoch区块开始的新epoch以父块的mix为种子
+	pending, err := fresh.pendingSnapshot(chain, next, nil)
+	if err != nil {
+		t.Fatalf("failed to get pending snapshot: %v", err)
+	}
+	if pending.Seed != *want {
+		t.Errorf("pending seed mismatch: have %x, want %x", pending.Seed, *want)
+	}
+}
@@ -0,0 +1,532 @@
+/*
+dpos的候选人和委托关系(registry), 记在系统账户的storage里
+
+这样registry跟着state root走, 可以用eth_getProof证明, fast sync下载state后就有, 不用从创世块重放tx
+
+storage的布局和solidity的mapping/数组一样, slot是32 bytes:
+ 1. candidatesSlot = keccak256("dpos.registry.candidates"), 值为候选人数量n
+    第i位候选人在 keccak256(candidatesSlot) + i, 值为候选人地址
+    候选人的序号在 keccak256(地址左补零到32 bytes ++ candidatesSlot), 值为i+1, 0表示不是候选人
+ 2. delegatorsSlot = keccak256("dpos.registry.delegators"), 委托人的集合, 布局同上
+ 3. 委托人投的候选人在 keccak256(委托人地址左补零到32 bytes ++ delegationsSlot), delegationsSlot = keccak256("dpos.registry.delegations")
+ 4. snapshotSlot = keccak256("dpos.registry.snapshot"), 快照其余的数据(抵押金、解押、狱中记录、双签者和证据、
+    出块和错过的计数、RANDAO的mix和承诺、投票等)的RLP编码, 布局同solidity的bytes: 值为长度,
+    第i个32 bytes在 keccak256(snapshotSlot) + i
+
+快照仍然是选举用的数据, Finalize(...)把执行完本块后的快照写入storage, 只写有变化的slot:
+候选人和委托关系只在有action或epoch区块时才比较, 其余的数据每块都会变(例如出块数和mix)。
+祖先没有区块体(例如快速同步的pivot块之前)无法重放时, snapshot(...)从本块state里的registry组装完整的快照, 参考stateSnapshot(...)
+*/
+package dpos
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	candidatesSlot  = crypto.Keccak256Hash([]byte("dpos.registry.candidates"))
+	delegatorsSlot  = crypto.Keccak256Hash([]byte("dpos.registry.delegators"))
+	delegationsSlot = crypto.Keccak256Hash([]byte("dpos.registry.delegations"))
+	snapshotSlot    = crypto.Keccak256Hash([]byte("dpos.registry.snapshot"))
+)
+
+// registryReader is the part of the state needed to read the registry.
+type registryReader interface {
+	GetState(common.Address, common.Hash) common.Hash
+}
+
+/*
+storage里的地址集合, 删除时把最后一个元素搬到被删的位置
+*/
+type addressSet struct {
+	system common.Address
+	slot   common.Hash
+}
+
+func (s addressSet) len(db registryReader) uint64 {
+	return db.GetState(s.system, s.slot).Big().Uint64()
+}
+
+func (s addressSet) elementSlot(i uint64) common.Hash {
+	base := crypto.Keccak256Hash(s.slot[:]).Big()
+	return common.BigToHash(base.Add(base, new(big.Int).SetUint64(i)))
+}
+
+func (s addressSet) indexSlot(address common.Address) common.Hash {
+	return mappingSlot(address, s.slot)
+}
+
+func (s addressSet) contains(db registryReader, address common.Address) bool {
+	return db.GetState(s.system, s.indexSlot(address)) != (common.Hash{})
+}
+
+func (s addressSet) members(db registryReader) []common.Address {
+	n := s.len(db)
+
+	members := make([]common.Address, 0, n)
+	for i := uint64(0); i < n; i++ {
+		members = append(members, common.BytesToAddress(db.GetState(s.system, s.elementSlot(i)).Bytes()))
+	}
+	return members
+}
+
+func (s addressSet) add(db vm.StateDB, address common.Address) {
+	if s.contains(db, address) {
+		return
+	}
+	n := s.len(db)
+
+	db.SetState(s.system, s.elementSlot(n), address.Hash())
+	db.SetState(s.system, s.indexSlot(address), uint64ToHash(n+1))
+	db.SetState(s.system, s.slot, uint64ToHash(n+1))
+}
+
+func (s addressSet) remove(db vm.StateDB, address common.Address) {
+	index := db.GetState(s.system, s.indexSlot(address)).Big().Uint64()
+	if index == 0 {
+		return
+	}
+	last := s.len(db) - 1
+
+	//最后一个元素搬到被删的位置
+	if index-1 != last {
+		moved := db.GetState(s.system, s.elementSlot(last))
+		db.SetState(s.system, s.elementSlot(index-1), moved)
+		db.SetState(s.system, s.indexSlot(common.BytesToAddress(moved.Bytes())), uint64ToHash(index))
+	}
+	db.SetState(s.system, s.elementSlot(last), common.Hash{})
+	db.SetState(s.system, s.indexSlot(address), common.Hash{})
+	db.SetState(s.system, s.slot, uint64ToHash(last))
+}
+
+/*
+storage里的bytes, 长度记在slot, 内容按32 bytes一段从keccak256(slot)开始存放
+*/
+type bytesSlot struct {
+	system common.Address
+	slot   common.Hash
+}
+
+func (s bytesSlot) chunkSlot(i uint64) common.Hash {
+	return addressSet(s).elementSlot(i)
+}
+
+func (s bytesSlot) get(db registryReader) []byte {
+	size := db.GetState(s.system, s.slot).Big().Uint64()
+
+	blob := make([]byte, 0, size+common.HashLength)
+	for i := uint64(0); uint64(len(blob)) < size; i++ {
+		chunk := db.GetState(s.system, s.chunkSlot(i))
+		blob = append(blob, chunk[:]...)
+	}
+	return blob[:size]
+}
+
+/*
+只改动有变化的段, 变短时清空多出来的段
+*/
+func (s bytesSlot) set(db vm.StateDB, blob []byte) {
+	chunks := func(size uint64) uint64 { return (size + common.HashLength - 1) / common.HashLength }
+
+	old := db.GetState(s.system, s.slot).Big().Uint64()
+	for i := uint64(0); i < chunks(uint64(len(blob))); i++ {
+		var chunk common.Hash
+		copy(chunk[:], blob[i*common.HashLength:])
+		if slot := s.chunkSlot(i); db.GetState(s.system, slot) != chunk {
+			db.SetState(s.system, slot, chunk)
+		}
+	}
+	for i := chunks(uint64(len(blob))); i < chunks(old); i++ {
+		db.SetState(s.system, s.chunkSlot(i), common.Hash{})
+	}
+	if old != uint64(len(blob)) {
+		db.SetState(s.system, s.slot, uint64ToHash(uint64(len(blob))))
+	}
+}
+
+/*
+solidity的mapping(address => ...)在slot的位置
+*/
+func mappingSlot(key common.Address, slot common.Hash) common.Hash {
+	return crypto.Keccak256Hash(common.LeftPadBytes(key[:], common.HashLength), slot[:])
+}
+
+func uint64ToHash(n uint64) common.Hash {
+	return common.BigToHash(new(big.Int).SetUint64(n))
+}
+
+/*
+从state读取registry, 结果和快照的Candidates, Delegators同一格式
+*/
+func readRegistry(db registryReader, system common.Address) (map[common.Address]struct{}, map[common.Address]common.Address) {
+	var (
+		candidates = make(map[common.Address]struct{})
+		delegators = make(map[common.Address]common.Address)
+	)
+	for _, candidate := range (addressSet{system, candidatesSlot}).members(db) {
+		candidates[candidate] = struct{}{}
+	}
+	for _, delegator := range (addressSet{system, delegatorsSlot}).members(db) {
+		delegators[delegator] = common.BytesToAddress(db.GetState(system, mappingSlot(delegator, delegationsSlot)).Bytes())
+	}
+	return candidates, delegators
+}
+
+// stateReader is a chain which can open the state of its blocks.
+type stateReader interface {
+	StateAt(root common.Hash) (*state.StateDB, error)
+}
+
+/*
+块头的父块能不能重放: snapshot.apply(...)需要区块体和收据
+*/
+func (self *Dpos) replayable(hash common.Hash, number uint64) bool {
+	return rawdb.HasBody(self.db, hash, number) && rawdb.HasReceipts(self.db, hash, number)
+}
+
+/*
+用块头的state组装完整的快照, 不用重放区块:
+ 1. 候选人和委托关系取自state里的registry
+ 2. 其余的数据取自snapshotSlot里的RLP编码, 参考encodeRegistrySnapshot(...)
+
+块头的高度、哈希和时间截不写入state(出块时签名之前块哈希还没确定), 取自块头本身
+*/
+func (self *Dpos) stateSnapshot(chain consensus.ChainHeaderReader, header *types.Header) (*Snapshot, error) {
+	reader, ok := chain.(stateReader)
+	if !ok {
+		return nil, errMissingBody
+	}
+	statedb, err := reader.StateAt(header.Root)
+	if err != nil {
+		return nil, err
+	}
+	blob := (bytesSlot{self.config.SystemAddress, snapshotSlot}).get(statedb)
+	if len(blob) == 0 {
+		return nil, errMissingRegistry
+	}
+	snap := newSnapshot(self.config, self.signatures, header.Number.Uint64(), header.Hash(), nil, nil, nil)
+	snap.Time = header.Time
+	if err := decodeRegistrySnapshot(blob, snap); err != nil {
+		return nil, err
+	}
+	snap.Candidates, snap.Delegators = readRegistry(statedb, self.config.SystemAddress)
+
+	return snap, nil
+}
+
+/*
+registry是否写入过: writeRegistry(...)第一次改动storage时把系统账户的nonce设为1
+*/
+func registryWritten(db vm.StateDB, system common.Address) bool {
+	return db.GetNonce(system) != 0
+}
+
+/*
+把快照写入state, 只改动有变化的slot: registry为true时比较Candidates和Delegators, 其余的数据每次都写
+
+先按state里的顺序删除, 再按地址顺序加入, 所有节点的结果一定相同
+*/
+func writeRegistry(db vm.StateDB, system common.Address, snap *Snapshot, registry bool) {
+	var (
+		candidates = addressSet{system, candidatesSlot}
+		delegators = addressSet{system, delegatorsSlot}
+		touched    = false
+	)
+	//只有storage的账户是空账户, nonce设为1, 避免被EIP-158删掉
+	touch := func() {
+		if !touched && db.GetNonce(system) == 0 {
+			db.SetNonce(system, 1)
+		}
+		touched = true
+	}
+	if blob := encodeRegistrySnapshot(snap); !bytes.Equal((bytesSlot{system, snapshotSlot}).get(db), blob) {
+		touch()
+		(bytesSlot{system, snapshotSlot}).set(db, blob)
+	}
+	if !registry {
+		return
+	}
+	for _, candidate := range candidates.members(db) {
+		if _, ok := snap.Candidates[candidate]; !ok {
+			touch()
+			candidates.remove(db, candidate)
+		}
+	}
+	for _, delegator := range delegators.members(db) {
+		if _, ok := snap.Delegators[delegator]; !ok {
+			touch()
+			delegators.remove(db, delegator)
+			db.SetState(system, mappingSlot(delegator, delegationsSlot), common.Hash{})
+		}
+	}
+	for _, candidate := range sortedAddresses(snap.Candidates) {
+		if !candidates.contains(db, candidate) {
+			touch()
+			candidates.add(db, candidate)
+		}
+	}
+	for _, delegator := range sortedDelegators(snap.Delegators) {
+		slot := mappingSlot(delegator, delegationsSlot)
+		if candidate := snap.Delegators[delegator].Hash(); db.GetState(system, slot) != candidate {
+			touch()
+			delegators.add(db, delegator)
+			db.SetState(system, slot, candidate)
+		}
+	}
+}
+
+func sortedAddresses(set map[common.Address]struct{}) []common.Address {
+	addresses := make([]common.Address, 0, len(set))
+	for address := range set {
+		addresses = append(addresses, address)
+	}
+	sort.Sort(signersAscending(addresses))
+	return addresses
+}
+
+func sortedDelegators(delegators map[common.Address]common.Address) []common.Address {
+	addresses := make([]common.Address, 0, len(delegators))
+	for delegator := range delegators {
+		addresses = append(addresses, delegator)
+	}
+	sort.Sort(signersAscending(addresses))
+	return addresses
+}
+
+// registryAccount is a per-address counter or height of the snapshot.
+type registryAccount struct {
+	Address common.Address
+	Value   uint64
+}
+
+// registryStake is the stake of a staker.
+type registryStake struct {
+	Address common.Address
+	Amount  *big.Int
+}
+
+// registryEvidence is an accepted double sign evidence.
+type registryEvidence struct {
+	Hash   common.Hash
+	Height uint64
+}
+
+// registryElection is the signers elected by an epoch block.
+type registryElection struct {
+	Epoch   uint64
+	Signers []common.Address
+}
+
+// registryJail is the jail record of a candidate.
+type registryJail struct {
+	Address common.Address
+	Jail    *Jail
+}
+
+// registryDelegators is the delegators elected with a signer.
+type registryDelegators struct {
+	Signer     common.Address
+	Delegators []ElectedDelegator
+}
+
+// registryProposal is a proposal result.
+type registryProposal struct {
+	Id       uint8
+	Proposal common.Hash
+}
+
+// registryCommitment is a pending RANDAO commitment.
+type registryCommitment struct {
+	Address    common.Address
+	Commitment *Commitment
+}
+
+// registrySnapshot is the part of the snapshot kept in snapshotSlot. Every map
+// is flattened into a slice sorted by key so that all nodes encode it the same.
+type registrySnapshot struct {
+	Seed common.Hash
+
+	ElectedSigners       []registryAccount
+	PreElectedSigners    []common.Address
+	ElectedDelegators    []registryDelegators
+	PreElectedDelegators []registryDelegators
+	ConfirmedProposals   []registryProposal
+	UnconfirmedProposals []registryProposal
+
+	Stakes     []registryStake
+	Unbondings []*Unbonding
+	Evidences  []registryEvidence
+	Offenders  []registryAccount
+	Elections  []registryElection
+	Missed     []registryAccount
+	Jailed     []registryJail
+
+	Mix         common.Hash
+	Commitments []registryCommitment
+	Unrevealed  []registryAccount
+
+	Recents []registryAccount
+	Votes   []*Vote
+}
+
+/*
+快照写入snapshotSlot的RLP编码, 不包括高度、哈希、时间截和registry里的候选人、委托关系
+*/
+func encodeRegistrySnapshot(snap *Snapshot) []byte {
+	accounts := func(values map[common.Address]uint64) []registryAccount {
+		list := make([]registryAccount, 0, len(values))
+		for address, value := range values {
+			list = append(list, registryAccount{address, value})
+		}
+		sort.Slice(list, func(i, j int) bool { return bytes.Compare(list[i].Address[:], list[j].Address[:]) < 0 })
+		return list
+	}
+	delegators := func(values map[common.Address][]ElectedDelegator) []registryDelegators {
+		list := make([]registryDelegators, 0, len(values))
+		for signer, delegators := range values {
+			list = append(list, registryDelegators{signer, delegators})
+		}
+		sort.Slice(list, func(i, j int) bool { return bytes.Compare(list[i].Signer[:], list[j].Signer[:]) < 0 })
+		return list
+	}
+	proposals := func(values map[uint8]common.Hash) []registryProposal {
+		list := make([]registryProposal, 0, len(values))
+		for id, proposal := range values {
+			list = append(list, registryProposal{id, proposal})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+		return list
+	}
+	minted := make(map[common.Address]uint64, len(snap.ElectedSigners))
+	for signer, count := range snap.ElectedSigners {
+		minted[signer] = uint64(count)
+	}
+	recents := make(map[common.Address]uint64, len(snap.Recents))
+	for number, signer := range snap.Recents {
+		recents[signer] = number
+	}
+	stored := &registrySnapshot{
+		Seed:                 snap.Seed,
+		ElectedSigners:       accounts(minted),
+		PreElectedSigners:    sortedAddresses(snap.PreElectedSigners),
+		ElectedDelegators:    delegators(snap.ElectedDelegators),
+		PreElectedDelegators: delegators(snap.PreElectedDelegators),
+		ConfirmedProposals:   proposals(snap.ConfirmedProposals),
+		UnconfirmedProposals: proposals(snap.UnconfirmedProposals),
+		Unbondings:           snap.Unbondings,
+		Offenders:            accounts(snap.Offenders),
+		Missed:               accounts(snap.Missed),
+		Mix:                  snap.Mix,
+		Unrevealed:           accounts(snap.Unrevealed),
+		Recents:              accounts(recents),
+		Votes:                snap.Votes,
+	}
+	for staker, amount := range snap.Stakes {
+		stored.Stakes = append(stored.Stakes, registryStake{staker, amount})
+	}
+	sort.Slice(stored.Stakes, func(i, j int) bool {
+		return bytes.Compare(stored.Stakes[i].Address[:], stored.Stakes[j].Address[:]) < 0
+	})
+	for hash, height := range snap.Evidences {
+		stored.Evidences = append(stored.Evidences, registryEvidence{hash, height})
+	}
+	sort.Slice(stored.Evidences, func(i, j int) bool {
+		return bytes.Compare(stored.Evidences[i].Hash[:], stored.Evidences[j].Hash[:]) < 0
+	})
+	for epoch, signers := range snap.Elections {
+		stored.Elections = append(stored.Elections, registryElection{epoch, signers})
+	}
+	sort.Slice(stored.Elections, func(i, j int) bool { return stored.Elections[i].Epoch < stored.Elections[j].Epoch })
+
+	for candidate, jail := range snap.Jailed {
+		stored.Jailed = append(stored.Jailed, registryJail{candidate, jail})
+	}
+	sort.Slice(stored.Jailed, func(i, j int) bool {
+		return bytes.Compare(stored.Jailed[i].Address[:], stored.Jailed[j].Address[:]) < 0
+	})
+	for signer, commitment := range snap.Commitments {
+		stored.Commitments = append(stored.Commitments, registryCommitment{signer, commitment})
+	}
+	sort.Slice(stored.Commitments, func(i, j int) bool {
+		return bytes.Compare(stored.Commitments[i].Address[:], stored.Commitments[j].Address[:]) < 0
+	})
+	blob, err := rlp.EncodeToBytes(stored)
+	if err != nil {
+		panic(err) //只有可编码的类型
+	}
+	return blob
+}
+
+/*
+把snapshotSlot的RLP编码还原进快照
+*/
+func decodeRegistrySnapshot(blob []byte, snap *Snapshot) error {
+	stored := new(registrySnapshot)
+	if err := rlp.DecodeBytes(blob, stored); err != nil {
+		return err
+	}
+	snap.Seed, snap.Mix = stored.Seed, stored.Mix
+
+	for _, signer := range stored.ElectedSigners {
+		snap.ElectedSigners[signer.Address] = uint16(signer.Value)
+	}
+	for _, signer := range stored.PreElectedSigners {
+		snap.PreElectedSigners[signer] = struct{}{}
+	}
+	for _, elected := range stored.ElectedDelegators {
+		snap.ElectedDelegators[elected.Signer] = elected.Delegators
+	}
+	for _, elected := range stored.PreElectedDelegators {
+		snap.PreElectedDelegators[elected.Signer] = elected.Delegators
+	}
+	for _, proposal := range stored.ConfirmedProposals {
+		snap.ConfirmedProposals[proposal.Id] = proposal.Proposal
+	}
+	for _, proposal := range stored.UnconfirmedProposals {
+		snap.UnconfirmedProposals[proposal.Id] = proposal.Proposal
+	}
+	for _, stake := range stored.Stakes {
+		snap.Stakes[stake.Address] = stake.Amount
+	}
+	snap.Unbondings = append(snap.Unbondings, stored.Unbondings...)
+
+	for _, evidence := range stored.Evidences {
+		snap.Evidences[evidence.Hash] = evidence.Height
+	}
+	for _, offender := range stored.Offenders {
+		snap.Offenders[offender.Address] = offender.Value
+	}
+	snap.Elections = make(map[uint64][]common.Address, len(stored.Elections))
+	for _, election := range stored.Elections {
+		snap.Elections[election.Epoch] = election.Signers
+	}
+	for _, missed := range stored.Missed {
+		snap.Missed[missed.Address] = missed.Value
+	}
+	for _, jailed := range stored.Jailed {
+		snap.Jailed[jailed.Address] = jailed.Jail
+	}
+	for _, commitment := range stored.Commitments {
+		snap.Commitments[commitment.Address] = commitment.Commitment
+	}
+	for _, unrevealed := range stored.Unrevealed {
+		snap.Unrevealed[unrevealed.Address] = unrevealed.Value
+	}
+	for _, recent := range stored.Recents {
+		snap.Recents[recent.Value] = recent.Address
+	}
+	snap.Votes = append(snap.Votes, stored.Votes...)
+
+	return nil
+}
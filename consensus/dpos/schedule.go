@@ -0,0 +1,156 @@
+/*
+出块顺序(schedule)
+
+每个epoch的签名者按地址排序后, 用种子做确定性的洗牌(Fisher-Yates), 时间截落在第slot个slot(时间截除以slotinterval)的块
+轮到schedule[slot%len]出块。种子是出epoch区块之前的RANDAO mix(参考randao.go), 记录在epoch区块的extra里, 只用块头就能算出顺序。
+mix在上一个epoch的最后一块之前谁也不知道, 所以签名者不能靠挑选地址排到相邻的位置, 出块顺序也只在本epoch内可以预测。
+不用epoch区块的哈希, 因为出块者可以改动时间截等字段反复试出对自己有利的哈希。
+
+epoch区块本身仍属于上一个epoch(参考epochOfHeader), 按上一个epoch的顺序出块, 创世块后的第一个epoch用创世块的哈希。
+verifyHeader(对照epoch区块的extra)、Snapshot.inturn(对照快照)和calcDifficulty都用schedule(...)算顺序。
+
+时间截必须对齐slot, 每个slot最多出一块:
+ 1. 轮到的签名者在自己的slot出块, 没有出块的slot(包括被别人补发的slot)记一次错过, 参考missedSlots(...)
+ 2. 轮不到的签名者只能在父块之后至少timeoutSlots个slot没有出块时补发, 而且会再多等wiggle时间, 优先让这个slot轮到的签名者出块
+ 3. slotinterval为0时只在有tx时出块, 没有slot, 按块高度轮流, 也没有超时限制
+
+slot对齐、按slot轮流和洗牌都从DposConfig.ScheduleBlock起生效(参考slotIntervalAt和epochSeed), 在这之前按块高度轮流,
+签名者按地址排序, epoch区块也不记录种子。
+*/
+package dpos
+
+import (
+	"encoding/binary"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+/*
+用种子打乱签名者, 返回新的切片, 不改动入参; 种子为空(schedule分叉之前)时只按地址排序
+
+第i轮(i从len-1到1)和位置j交换, j取keccak256(种子, i的8字节大端)的前8字节对i+1取余
+*/
+func schedule(signers []common.Address, seed common.Hash) []common.Address {
+	shuffled := make([]common.Address, len(signers))
+	copy(shuffled, signers)
+	sort.Sort(signersAscending(shuffled))
+	if seed == (common.Hash{}) {
+		return shuffled
+	}
+
+	var index [8]byte
+	for i := len(shuffled) - 1; i > 0; i-- {
+		binary.BigEndian.PutUint64(index[:], uint64(i))
+		j := binary.BigEndian.Uint64(crypto.Keccak256(seed[:], index[:])) % uint64(i+1)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return shuffled
+}
+
+/*
+epoch区块(或创世块)选出的签名者的出块顺序种子: extra里记录的种子, 创世块没有, 用它的哈希;
+schedule分叉之前的epoch区块没有种子, 返回空的种子, 签名者只按地址排序
+*/
+func epochSeed(config *params.DposConfig, header *types.Header, extra *EpochExtra) common.Hash {
+	if extra.Seed != (common.Hash{}) {
+		return extra.Seed
+	}
+	if header.Number.Sign() == 0 && config.IsSchedule(header.Number) {
+		return header.Hash()
+	}
+	return common.Hash{}
+}
+
+/*
+number高度的块的slotinterval: schedule分叉之前按块高度轮流, 时间截不对齐slot, 也没有超时, 和slotinterval为0一样
+*/
+func slotIntervalAt(config *params.DposConfig, interval, number uint64) uint64 {
+	if !config.IsSchedule(new(big.Int).SetUint64(number)) {
+		return 0
+	}
+	return interval
+}
+
+/*
+在slot轮到出块的签名者
+*/
+func scheduledSigner(signers []common.Address, seed common.Hash, slot uint64) common.Address {
+	order := schedule(signers, seed)
+	return order[slot%uint64(len(order))]
+}
+
+const timeoutSlots = 1 //父块之后要有多少个slot没有出块, 轮不到的签名者才可以补发
+
+/*
+number高度、时间截为time的块所在的slot, slotinterval为0时就是块高度
+*/
+func slotOf(time, number, interval uint64) uint64 {
+	if interval == 0 {
+		return number
+	}
+	return time / interval
+}
+
+/*
+父块之后是否已经有timeoutSlots个slot没有出块
+*/
+func timedOut(parentSlot, slot uint64) bool {
+	return slot > parentSlot+timeoutSlots
+}
+
+/*
+父块(parentSlot)和signer在slot出的块之间, 每位签名者错过了几个轮到自己的slot:
+中间跳过的slot各记一次, slot本身轮到的不是signer时也记一次
+
+停链很久之后跳过的slot可能很多, 完整的轮数一次记上, 只逐个数剩下的部分
+*/
+func missedSlots(order []common.Address, parentSlot, slot uint64, signer common.Address) map[common.Address]uint64 {
+	missed := make(map[common.Address]uint64)
+	if len(order) == 0 || slot <= parentSlot {
+		return missed
+	}
+	var (
+		n       = uint64(len(order))
+		skipped = slot - parentSlot - 1
+	)
+	if rounds := skipped / n; rounds > 0 {
+		for _, sealer := range order {
+			missed[sealer] += rounds
+		}
+	}
+	for s := parentSlot + 1 + skipped/n*n; s < slot; s++ {
+		missed[order[s%n]]++
+	}
+	if inturn := order[slot%n]; inturn != signer {
+		missed[inturn]++
+	}
+	return missed
+}
+
+// SlotInterval returns the slot interval of the block after parent, taking the
+// confirmed proposals into account like Seal does. Zero means blocks are only
+// sealed when there are transactions.
+func (self *Dpos) SlotInterval(chain consensus.ChainHeaderReader, parent *types.Header) (uint64, error) {
+	snap, err := self.snapshot(chain, parent.Number.Uint64(), parent.Hash(), nil)
+	if err != nil {
+		return 0, err
+	}
+	return snap.rules().SlotInterval, nil
+}
+
+// InstantSealing implements consensus.InstantSealer, returning whether the slot
+// interval of the block after parent is zero, so blocks are only sealed when
+// there are transactions.
+func (self *Dpos) InstantSealing(chain consensus.ChainHeaderReader, parent *types.Header) bool {
+	interval, err := self.SlotInterval(chain, parent)
+	if err != nil {
+		return self.config.SlotInterval == 0
+	}
+	return interval == 0
+}
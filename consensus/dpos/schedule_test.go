@@ -0,0 +1,366 @@
+package dpos
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// 洗牌是确定性的排列, 只由签名者集合和种子决定
+func TestSchedule(t *testing.T) {
+	signers := make([]common.Address, 21)
+	for i := range signers {
+		signers[i] = common.BytesToAddress(crypto.Keccak256([]byte{byte(i)}))
+	}
+	sorted := make([]common.Address, len(signers))
+	copy(sorted, signers)
+	sort.Sort(signersAscending(sorted))
+
+	order := schedule(signers, common.Hash{1})
+	if !reflect.DeepEqual(order, schedule(sorted, common.Hash{1})) {
+		t.Errorf("schedule depends on the input order")
+	}
+	shuffled := make([]common.Address, len(order))
+	copy(shuffled, order)
+	sort.Sort(signersAscending(shuffled))
+	if !reflect.DeepEqual(shuffled, sorted) {
+		t.Errorf("schedule is not a permutation: %v", order)
+	}
+	if reflect.DeepEqual(order, sorted) {
+		t.Errorf("schedule not shuffled")
+	}
+	if reflect.DeepEqual(order, schedule(signers, common.Hash{2})) {
+		t.Errorf("schedule independent of the seed")
+	}
+	if order := schedule(signers[:1], common.Hash{1}); len(order) != 1 || order[0] != signers[0] {
+		t.Errorf("single signer schedule mismatch: %v", order)
+	}
+}
+
+// 轮到出块的签名者由epoch区块记录的种子(出块之前的RANDAO mix)决定, epoch区块之后重新洗牌
+func TestScheduleChain(t *testing.T) {
+	keys := sortedTestKeys(3)
+	chain, engine := newTestChain(t, keys, nil, 4, nil)
+	defer chain.Stop()
+
+	//第1到4块按创世块的顺序出块, epoch区块(第4块)也属于上一个epoch
+	order := scheduledTestKeys(keys, chain.Genesis().Hash())
+	for number := 1; number <= 4; number++ {
+		if block := insertTestBlock(t, chain, engine, order[number%len(order)]); block.Difficulty().Cmp(diffInTurn) != 0 {
+			t.Fatalf("block #%d: difficulty mismatch: have %v, want %v", number, block.Difficulty(), diffInTurn)
+		}
+	}
+	epoch := chain.CurrentHeader()
+	mix, err := engine.snapshot(chain, 3, epoch.ParentHash, nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	seed := mix.Mix
+	if seed == epoch.Hash() {
+		t.Fatalf("epoch block seeded with its own hash")
+	}
+
+	schedule, err := (&API{chain: chain, dpos: engine}).GetSchedule(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("failed to get schedule: %v", err)
+	}
+	order = scheduledTestKeys(keys, seed)
+	want := make([]common.Address, len(order))
+	for i, key := range order {
+		want[i] = crypto.PubkeyToAddress(key.PublicKey)
+	}
+	if schedule.Epoch != 4 || schedule.Seed != seed || !reflect.DeepEqual(schedule.Signers, want) || schedule.Next != want[5%len(want)] {
+		t.Errorf("schedule mismatch: have %+v, want seed %x signers %v", schedule, seed, want)
+	}
+	//重新洗牌后轮到的签名者可能刚出过块, 由下一个slot的签名者出块, 这不算错过
+	for number := 5; number <= 6; number++ {
+		slot := chain.CurrentHeader().Time + 1
+		sealer := order[slot%uint64(len(order))]
+		if sealer == recentTestSigner(chain, engine, keys) {
+			sealer = order[(slot+1)%uint64(len(order))]
+		}
+		insertTestBlock(t, chain, engine, sealer)
+	}
+	snap, err := engine.snapshot(chain, 6, chain.CurrentHeader().Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	for signer, missed := range snap.Missed {
+		if missed != 0 {
+			t.Errorf("signer %x: unexpected missed slots: %d", signer, missed)
+		}
+	}
+	//不是轮到的签名者不能用in-turn的难度, 也不能在超时slot之前补发
+	parent := chain.CurrentBlock()
+	next := (parent.Time() + 1) % uint64(len(order))
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     big.NewInt(7),
+		GasLimit:   parent.GasLimit(),
+		Time:       parent.Time() + 1,
+		Difficulty: new(big.Int).Set(diffInTurn),
+		UncleHash:  types.EmptyUncleHash,
+		Extra:      make([]byte, extraSealLength),
+	}
+	header.Extra[0] = extraVersion
+
+	var outsider *ecdsa.PrivateKey
+	for _, key := range order {
+		if key != order[next] && key != recentTestSigner(chain, engine, keys) {
+			outsider = key
+		}
+	}
+	sign := func() {
+		sig, _ := crypto.Sign(SealHash(header).Bytes(), outsider)
+		copy(header.Extra[1:], sig)
+	}
+	sign()
+	if err := engine.VerifyHeader(chain, header, true); err != errWrongDifficultyAgainstExtra {
+		t.Errorf("out-of-turn header error mismatch: have %v, want %v", err, errWrongDifficultyAgainstExtra)
+	}
+	header.Difficulty = new(big.Int).Set(diffNoTurn)
+	sign()
+	if err := engine.VerifyHeader(chain, header, true); err != errEarlyOutOfTurn {
+		t.Errorf("early out-of-turn header error mismatch: have %v, want %v", err, errEarlyOutOfTurn)
+	}
+	bn := rpc.BlockNumber(6)
+	if schedule, err := (&API{chain: chain, dpos: engine}).GetSchedule(context.Background(), &bn); err != nil || schedule.NextSlot != parent.Time()+1 || schedule.Next != want[next] {
+		t.Errorf("next signer mismatch: have %v, want %x", schedule, want[next])
+	}
+}
+
+// 时间截对齐slot, 跳过的slot记为轮到的签名者错过
+func TestSlotTiming(t *testing.T) {
+	keys := sortedTestKeys(5)
+	chain, engine := newTestChain(t, keys, nil, 100, nil)
+	defer chain.Stop()
+
+	engine.config.SlotInterval = 2
+	order := scheduledTestKeys(keys, chain.Genesis().Hash())
+
+	//slot 1和2各出一块, 第3块由order[0]在超时slot 4补发, slot 3没有出块
+	insertTestBlock(t, chain, engine, order[1])
+	insertTestBlock(t, chain, engine, order[2])
+
+	parent := chain.CurrentBlock()
+	if parent.Time() != 4 {
+		t.Fatalf("timestamp mismatch: have %d, want 4", parent.Time())
+	}
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(3), GasLimit: parent.GasLimit(), Time: 11}
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare block: %v", err)
+	}
+	if header.Time%2 != 0 || header.Time <= parent.Time() {
+		t.Errorf("prepared timestamp not aligned: %d", header.Time)
+	}
+	statedb, _ := chain.StateAt(parent.Root())
+	header.Time = 11
+	block, err := engine.FinalizeAndAssemble(chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to assemble block: %v", err)
+	}
+	header = block.Header()
+	sig, _ := crypto.Sign(SealHash(header).Bytes(), order[0])
+	copy(header.Extra[1:], sig)
+	if err := engine.VerifyHeader(chain, header, true); err != errUnalignedTimestamp {
+		t.Errorf("unaligned header error mismatch: have %v, want %v", err, errUnalignedTimestamp)
+	}
+	if block := insertTestBlock(t, chain, engine, order[0]); block.Time() != 8 || block.Difficulty().Cmp(diffNoTurn) != 0 {
+		t.Errorf("out-of-turn block mismatch: time %d, difficulty %v", block.Time(), block.Difficulty())
+	}
+	snap, err := engine.snapshot(chain, 3, chain.CurrentHeader().Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	for i, key := range order {
+		want := uint64(0)
+		if i == 3 || i == 4 {
+			want = 1
+		}
+		if missed := snap.Missed[crypto.PubkeyToAddress(key.PublicKey)]; missed != want {
+			t.Errorf("signer %d: missed slots mismatch: have %d, want %d", i, missed, want)
+		}
+	}
+}
+
+// schedule分叉之前按块高度轮流出块, 签名者按地址排序, 没有超时; 分叉之后按slot轮流, epoch区块记录种子
+func TestScheduleFork(t *testing.T) {
+	keys := sortedTestKeys(3)
+	chain, engine := newTestChain(t, keys, nil, 4, nil)
+	defer chain.Stop()
+
+	engine.config.ScheduleBlock = big.NewInt(6)
+
+	//分叉之前的epoch区块不能记录种子
+	for number := 1; number <= 3; number++ {
+		if block := insertTestBlock(t, chain, engine, keys[number%len(keys)]); block.Difficulty().Cmp(diffInTurn) != 0 {
+			t.Fatalf("block #%d: difficulty mismatch: have %v, want %v", number, block.Difficulty(), diffInTurn)
+		}
+	}
+	forged := forgeTestHeader(t, chain, engine, keys[1], func(extra *EpochExtra) { extra.Seed = common.Hash{0x01} })
+	if err := engine.VerifyHeader(chain, forged, false); err != errUnexpectedEpochSeed {
+		t.Errorf("pre-fork seed error mismatch: have %v, want %v", err, errUnexpectedEpochSeed)
+	}
+	insertTestBlock(t, chain, engine, keys[1])
+	if extra, err := parseEpochExtra(chain.CurrentHeader()); err != nil || extra.Seed != (common.Hash{}) {
+		t.Fatalf("pre-fork epoch block seeded: %v", extra)
+	}
+	//轮不到的签名者紧接着父块出块
+	outOfTurn := func(key *ecdsa.PrivateKey) *types.Header {
+		parent := chain.CurrentBlock()
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     new(big.Int).Add(parent.Number(), common.Big1),
+			GasLimit:   parent.GasLimit(),
+			Time:       parent.Time() + 1,
+			Difficulty: new(big.Int).Set(diffNoTurn),
+			UncleHash:  types.EmptyUncleHash,
+			Extra:      make([]byte, extraSealLength),
+		}
+		header.Extra[0] = extraVersion
+		sig, _ := crypto.Sign(SealHash(header).Bytes(), key)
+		copy(header.Extra[1:], sig)
+		return header
+	}
+	if err := engine.VerifyHeader(chain, outOfTurn(keys[0]), false); err != nil {
+		t.Errorf("pre-fork out-of-turn header rejected: %v", err)
+	}
+	insertTestBlock(t, chain, engine, keys[2])
+
+	//分叉之后不能在超时slot之前补发
+	insertTestBlock(t, chain, engine, keys[0])
+	if err := engine.VerifyHeader(chain, outOfTurn(keys[2]), false); err != errEarlyOutOfTurn {
+		t.Errorf("post-fork out-of-turn header error mismatch: have %v, want %v", err, errEarlyOutOfTurn)
+	}
+	for number := 7; number <= 8; number++ {
+		insertTestBlock(t, chain, engine, keys[(chain.CurrentHeader().Time+1)%uint64(len(keys))])
+	}
+	epoch := chain.CurrentHeader()
+	snap, err := engine.snapshot(chain, 7, epoch.ParentHash, nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	if extra, err := parseEpochExtra(epoch); err != nil || extra.Seed != snap.Mix || extra.Seed == (common.Hash{}) {
+		t.Errorf("post-fork epoch seed mismatch: have %v, want %x", extra, snap.Mix)
+	}
+}
+
+// 出块间隔按链头快照的规则, 定案的提案优先于链配置
+func TestSlotIntervalRules(t *testing.T) {
+	keys := sortedTestKeys(1)
+	chain, engine := newTestChain(t, keys, nil, 100, []int{0})
+	defer chain.Stop()
+
+	head := chain.CurrentHeader()
+	if interval, err := engine.SlotInterval(chain, head); err != nil || interval != 1 {
+		t.Errorf("configured interval mismatch: have %d, want 1 (%v)", interval, err)
+	}
+	snap, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	proposal, _ := getProposal(SlotIntervalProposal)
+	proposal.Values = []interface{}{big.NewInt(3)}
+	snap.ConfirmedProposals[SlotIntervalProposal], _ = proposal.toBytes()
+	if interval, err := engine.SlotInterval(chain, head); err != nil || interval != 3 {
+		t.Errorf("proposed interval mismatch: have %d, want 3 (%v)", interval, err)
+	}
+}
+
+func TestMissedSlots(t *testing.T) {
+	order := []common.Address{{1}, {2}, {3}}
+	tests := []struct {
+		parentSlot, slot uint64
+		signer           common.Address
+		want             map[common.Address]uint64
+	}{
+		{3, 4, common.Address{2}, map[common.Address]uint64{}},                        //轮到的签名者出块
+		{3, 4, common.Address{1}, map[common.Address]uint64{{2}: 1}},                  //被别人补发
+		{3, 6, common.Address{1}, map[common.Address]uint64{{2}: 1, {3}: 1}},          //跳过两个slot
+		{3, 12, common.Address{1}, map[common.Address]uint64{{1}: 2, {2}: 3, {3}: 3}}, //跳过两轮多
+	}
+	for i, tt := range tests {
+		if missed := missedSlots(order, tt.parentSlot, tt.slot, tt.signer); !reflect.DeepEqual(missed, tt.want) {
+			t.Errorf("test %d: missed slots mismatch: have %v, want %v", i, missed, tt.want)
+		}
+	}
+}
+
+// 错过一半以上轮到自己的slot的签名者在epoch结束时入狱, 由候选人补上
+func TestJailMissedSlots(t *testing.T) {
+	keys := sortedTestKeys(3)
+	chain, engine := newTestChain(t, keys, nil, 10, nil)
+	defer chain.Stop()
+
+	order := scheduledTestKeys(keys, chain.Genesis().Hash())
+	offline := order[0]
+
+	//offline的slot总是由下一位签名者补发
+	seal := func() {
+		slot := chain.CurrentHeader().Time + 1
+		for i := uint64(0); ; i++ {
+			if sealer := order[(slot+i)%uint64(len(order))]; sealer != offline && sealer != recentTestSigner(chain, engine, keys) {
+				insertTestBlock(t, chain, engine, sealer)
+				return
+			}
+		}
+	}
+	for number := 1; number < 9; number++ {
+		seal()
+	}
+	//直接改缓存里的快照, 加一名候选人补上入狱的签名者
+	head := chain.CurrentHeader()
+	snap, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	var (
+		candidate = common.HexToAddress("0x00000000000000000000000000000000000000c0")
+		delegator = common.HexToAddress("0x00000000000000000000000000000000000000d1")
+	)
+	snap.Candidates[candidate] = struct{}{}
+	snap.Delegators[delegator] = candidate
+	snap.Stakes[delegator] = big.NewInt(1)
+
+	seal()
+
+	snap, err = engine.snapshot(chain, 9, chain.CurrentHeader().Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	address := crypto.PubkeyToAddress(offline.PublicKey)
+	if jail := snap.Jailed[address]; jail == nil || jail.Reason != jailDowntime || jail.Minted != 0 || jail.Missed == 0 {
+		t.Fatalf("offline signer jail mismatch: %+v", jail)
+	}
+	if _, ok := snap.PreElectedSigners[address]; ok {
+		t.Errorf("jailed signer pre-elected: %v", snap.PreElectedSigners)
+	}
+	if _, ok := snap.PreElectedSigners[candidate]; !ok {
+		t.Errorf("candidate not pre-elected: %v", snap.PreElectedSigners)
+	}
+	for _, key := range order[1:] {
+		if _, jailed := snap.Jailed[crypto.PubkeyToAddress(key.PublicKey)]; jailed {
+			t.Errorf("online signer %x jailed", crypto.PubkeyToAddress(key.PublicKey))
+		}
+	}
+}
+
+// 链头的签名者, 下一块不能再由他出
+func recentTestSigner(chain *core.BlockChain, engine *Dpos, keys []*ecdsa.PrivateKey) *ecdsa.PrivateKey {
+	signer, _ := engine.Author(chain.CurrentHeader())
+	for _, key := range keys {
+		if crypto.PubkeyToAddress(key.PublicKey) == signer {
+			return key
+		}
+	}
+	return nil
+}
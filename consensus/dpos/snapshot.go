@@ -21,17 +21,17 @@ import (
 	"encoding/json"
 	"sort"
 	"time"
-	"fmt"
+	"math"
 	"math/big"
 	_ "errors"
 	
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/consensus"
-	"github.com/ethereum/go-ethereum/core/state"
 	
 	lru "github.com/hashicorp/golang-lru"
 	
@@ -39,21 +39,54 @@ import (
 
 const (
 	dbSnapPrefix string = "dpos-"
+	
+	//入狱原因
+	jailDowntime   string = "downtime"    //错过的slot多过出块数
+	jailDoubleSign string = "double-sign" //双签被罚没, 永远不能unjail
 )
 
 /*
-每张票的信息
+每张票的信息, 投票者可以是签名者(通过出块投票)或抵押者(通过voteProposal action投票)
 */
 type Vote struct {
-	Signer   common.Address `json:"signer"`   // Authorized signer that cast this vote
+	Voter    common.Address `json:"voter"`    // Signer or staker that cast this vote
 	Block    uint64         `json:"block"`    // Block number the vote was cast in (expire old votes)
 	YesNo    bool           `json:"yesno"`
 	Proposal common.Hash    `json:"proposal"` // Proposal bytes
 }
 
+/*
+一个子提案的票数, 按抵押金计算
+*/
+type Tally struct {
+	Yes *big.Int `json:"yes"`
+	No  *big.Int `json:"no"`
+}
+
 type ElectedDelegator struct {
 	Delegator common.Address `json:"delegator"`
-	Portion float32          `json:"portion"`
+	Portion uint32           `json:"portion"` //占委托人奖励的份额，单位是portionBase分之一
+}
+
+/*
+签名者的入狱记录, 用来区分"因掉线被关"和"落选"
+*/
+type Jail struct {
+	Reason  string `json:"reason"`
+	Number  uint64 `json:"number"`  //入狱的区块高度
+	Release uint64 `json:"release"` //从这个高度起可以unjail
+	Minted  uint16 `json:"minted"`  //入狱前那个epoch的出块数
+	Missed  uint64 `json:"missed"`  //入狱前那个epoch错过的出块数
+	Unrevealed uint64 `json:"unrevealed"` //入狱前那个epoch错过公开RANDAO秘密的次数
+}
+
+/*
+解押中的抵押金, 到了Release高度(epoch区块)时才从托管账户退回给委托人
+*/
+type Unbonding struct {
+	Delegator common.Address `json:"delegator"`
+	Amount    *big.Int       `json:"amount"`
+	Release   uint64         `json:"release"`
 }
 
 // Snapshot is the state of the authorization voting at a given point in time.
@@ -63,6 +96,8 @@ type Snapshot struct {
 
 	Number  uint64                      `json:"number"`   //快照会一直更新区块高度
 	Hash    common.Hash                 `json:"hash"`     //快照会一直更新区块哈希
+	Seed    common.Hash                 `json:"seed"`     //本epoch出块顺序的种子, 即选出当前签名者的epoch区块记录的RANDAO mix, 参考schedule.go
+	Time    uint64                      `json:"time"`     //快照所在块的时间截, 用来算下一块之前跳过的slot
 	
 	ElectedSigners map[common.Address]uint16 `json:"elected_signers"`  //当前合格的签名者， 值为出块数
 	PreElectedSigners map[common.Address]struct{} `json:"pre_elected_signers"`  //即将成为合格签名者
@@ -76,10 +111,24 @@ type Snapshot struct {
 	Candidates map[common.Address]struct{} `json:"candidates"` //候选人
 	Delegators map[common.Address]common.Address `json:"delegators"` //委任人，键值为delegator地址，值为signer地址
 	
+	Stakes map[common.Address]*big.Int `json:"stakes"` //已抵押的金额，键值为抵押者地址，选举只看这个金额
+	Unbondings []*Unbonding `json:"unbondings"` //解押中的金额，按解押先后排序
+	
+	Evidences map[common.Hash]uint64 `json:"evidences"` //已受理的双签证据，键值为证据哈希，值为双签的高度，防止重复举报
+	Offenders map[common.Address]uint64 `json:"offenders"` //等待在下个epoch区块被罚没的双签者，值为受理证据的高度
+	Elections map[uint64][]common.Address `json:"elections"` //举报期限内每个epoch选出的签名者(按地址排序)，键值为epoch区块的高度，用来核对双签者
+	
+	Missed map[common.Address]uint64 `json:"missed"` //本epoch里每个签名者错过的出块数(轮到他的slot没有出块或由别人出块)
+	Jailed map[common.Address]*Jail `json:"jailed"` //狱中的候选人，不能参选
+	
+	Mix common.Hash `json:"mix"` //RANDAO的mix, 参考randao.go
+	Commitments map[common.Address]*Commitment `json:"commitments"` //每个签名者等待公开的RANDAO承诺
+	Unrevealed map[common.Address]uint64 `json:"unrevealed"` //本epoch里每个签名者错过公开秘密的次数
+	
 	Recents map[uint64]common.Address   `json:"recents"`  //Set of recent signers for spam protections
-	Votes   []*Vote                     `json:"votes"`    //记录每张投票*Vote
-	Tally   map[common.Hash]int         `json:"tally"`    //键值为proposal bytes, 值为获得的votes, 超过半数票提案就通过
+	Votes   []*Vote                     `json:"votes"`    //记录本epoch每张投票*Vote, 谁投了什么
 	
+	Light bool `json:"light,omitempty"` //由轻节点的EpochRetriever取得, 只有部分数据, 参考light.go; 要存盘, 否则重启后会被当成完整的快照
 }
 
 // newSnapshot creates a new snapshot with the specified startup parameters. This
@@ -92,6 +141,8 @@ func newSnapshot(config *params.DposConfig, sigcache *lru.ARCCache, number uint6
 		sigcache: sigcache,
 		Number:   number,
 		Hash:     hash,
+		Seed:     hash,
+		Mix:      hash,
 		
 		ElectedSigners:  make(map[common.Address]uint16),
 		PreElectedSigners:  make(map[common.Address]struct{}),
@@ -105,8 +156,20 @@ func newSnapshot(config *params.DposConfig, sigcache *lru.ARCCache, number uint6
 		Candidates:make(map[common.Address]struct{}),
 		Delegators:make(map[common.Address]common.Address),
 		
+		Stakes:make(map[common.Address]*big.Int),
+		Unbondings:make([]*Unbonding, 0),
+		
+		Evidences:make(map[common.Hash]uint64),
+		Offenders:make(map[common.Address]uint64),
+		Elections:make(map[uint64][]common.Address),
+		
+		Missed:make(map[common.Address]uint64),
+		Jailed:make(map[common.Address]*Jail),
+		
+		Commitments:make(map[common.Address]*Commitment),
+		Unrevealed:make(map[common.Address]uint64),
+		
 		Recents:  make(map[uint64]common.Address),
-		Tally:    make(map[common.Hash]int),
 	}
 	
 	for _, signer := range signers {
@@ -126,6 +189,8 @@ func newSnapshot(config *params.DposConfig, sigcache *lru.ARCCache, number uint6
 	}
 	
 	
+	snap.Elections[number-number%config.EpochInterval] = snap.electedSigners()
+	
 	for k, delegators := range delegatorss {
 		for _, delegator := range delegators {
 			snap.ElectedDelegators[signers[k]]= append(snap.ElectedDelegators[signers[k]], delegator)
@@ -153,6 +218,35 @@ func loadSnapshot(config *params.DposConfig, sigcache *lru.ARCCache, db ethdb.Da
 	
 	snap.config = config
 	snap.sigcache = sigcache
+	
+	//旧版本的快照没有抵押记录
+	if snap.Stakes == nil {
+		snap.Stakes = make(map[common.Address]*big.Int)
+	}
+	if snap.Unbondings == nil {
+		snap.Unbondings = make([]*Unbonding, 0)
+	}
+	if snap.Evidences == nil {
+		snap.Evidences = make(map[common.Hash]uint64)
+	}
+	if snap.Offenders == nil {
+		snap.Offenders = make(map[common.Address]uint64)
+	}
+	if snap.Elections == nil {
+		snap.Elections = make(map[uint64][]common.Address)
+	}
+	if snap.Missed == nil {
+		snap.Missed = make(map[common.Address]uint64)
+	}
+	if snap.Jailed == nil {
+		snap.Jailed = make(map[common.Address]*Jail)
+	}
+	if snap.Commitments == nil {
+		snap.Commitments = make(map[common.Address]*Commitment)
+	}
+	if snap.Unrevealed == nil {
+		snap.Unrevealed = make(map[common.Address]uint64)
+	}
 
 	return snap, nil
 }
@@ -175,6 +269,9 @@ func (s *Snapshot) copy() *Snapshot {
 		sigcache: s.sigcache,
 		Number:   s.Number,
 		Hash:     s.Hash,
+		Seed:     s.Seed,
+		Time:     s.Time,
+		Mix:      s.Mix,
 		
 		ElectedSigners:  make(map[common.Address]uint16),
 		PreElectedSigners: make(map[common.Address]struct{}),
@@ -188,9 +285,23 @@ func (s *Snapshot) copy() *Snapshot {
 		Candidates: make(map[common.Address]struct{}),
 		Delegators: make(map[common.Address]common.Address),
 		
+		Stakes:     make(map[common.Address]*big.Int),
+		Unbondings: make([]*Unbonding, 0, len(s.Unbondings)),
+		
+		Evidences:  make(map[common.Hash]uint64),
+		Offenders:  make(map[common.Address]uint64),
+		Elections:  make(map[uint64][]common.Address),
+		
+		Missed:     make(map[common.Address]uint64),
+		Jailed:     make(map[common.Address]*Jail),
+		
+		Commitments: make(map[common.Address]*Commitment),
+		Unrevealed:  make(map[common.Address]uint64),
+		
 		Recents:  make(map[uint64]common.Address),
 		Votes:    make([]*Vote, len(s.Votes)),
-		Tally:    make(map[common.Hash]int),
+		
+		Light: s.Light,
 	}
 	
 	for signer, mintCnt := range s.ElectedSigners {
@@ -229,6 +340,44 @@ func (s *Snapshot) copy() *Snapshot {
 		cpy.Delegators[delegator] = signer
 	}
 	
+	for staker, amount := range s.Stakes {
+		cpy.Stakes[staker] = new(big.Int).Set(amount)
+	}
+	
+	for _, unbonding := range s.Unbondings {
+		cpy.Unbondings = append(cpy.Unbondings, &Unbonding{unbonding.Delegator, new(big.Int).Set(unbonding.Amount), unbonding.Release})
+	}
+	
+	for evidence, number := range s.Evidences {
+		cpy.Evidences[evidence] = number
+	}
+	
+	for offender, number := range s.Offenders {
+		cpy.Offenders[offender] = number
+	}
+	
+	for epoch, signers := range s.Elections {
+		cpy.Elections[epoch] = signers
+	}
+	
+	for signer, missed := range s.Missed {
+		cpy.Missed[signer] = missed
+	}
+	
+	for signer, jail := range s.Jailed {
+		record := *jail
+		cpy.Jailed[signer] = &record
+	}
+	
+	for signer, commitment := range s.Commitments {
+		record := *commitment
+		cpy.Commitments[signer] = &record
+	}
+	
+	for signer, unrevealed := range s.Unrevealed {
+		cpy.Unrevealed[signer] = unrevealed
+	}
+	
 	for proposalId, proposalBytes := range s.ConfirmedProposals {
 		cpy.ConfirmedProposals[ proposalId ] = proposalBytes
 	}
@@ -241,9 +390,6 @@ func (s *Snapshot) copy() *Snapshot {
 		cpy.Recents[block] = signer
 	}
 	
-	for proposalBytes, votes := range s.Tally {
-		cpy.Tally[proposalBytes] = votes
-	}
 	copy(cpy.Votes, s.Votes)
 
 	return cpy
@@ -258,7 +404,7 @@ func (s *Snapshot) lastVote(signer common.Address, proposalBytes common.Hash) *V
 	proposal := &Proposal{}
 	if err :=proposal.fromBytes(proposalBytes);err == nil {
 		for _, vote := range s.Votes {
-			if vote.Signer == signer && vote.Proposal == proposalBytes {
+			if vote.Voter == signer && vote.Proposal == proposalBytes {
 				lastVote = vote
 			}
 		}
@@ -291,7 +437,7 @@ func (s *Snapshot) validVote(signer common.Address, proposalBytes common.Hash, y
 }
 
 /*
-执行投票
+检查签名者通过出块投的票是否有效, 票数在tally()里按抵押金统计
 */
 func (s *Snapshot) cast(signer common.Address, proposalBytes common.Hash, yesNo bool) bool {
 	
@@ -310,65 +456,119 @@ func (s *Snapshot) cast(signer common.Address, proposalBytes common.Hash, yesNo
 		return false
 	}
 	
-	if oldVotes, ok := s.Tally[proposalBytes]; ok {
-		if yesNo {
-			oldVotes++
-		} else {
-			oldVotes--
-		}
-		
-		if oldVotes <= 0 {
-			delete(s.Tally, proposalBytes)
-		} else {
-			s.Tally[proposalBytes] = oldVotes
-		}
-	} else {
-		//如果是新投票，那么第一张一定是赞成票
-		s.Tally[proposalBytes] = 1
-	}
 	return true
 }
 
 /*
-撤销执行投票
+按抵押金统计本epoch的投票, 每个投票者对每个子提案只算最后一张票
+
+票数是投票者自己的抵押金, 候选人还加上投给他、但没有亲自对同一提案(ID)投票的委托人的抵押金
 */
-func (s *Snapshot) uncast(signer common.Address, proposalBytes common.Hash) bool {
+func (s *Snapshot) tally() map[common.Hash]*Tally {
 	
-	proposal := &Proposal{}
-	if err :=proposal.fromBytes(proposalBytes);err!=nil {
-		return false
+	latest := make(map[common.Address]map[common.Hash]bool)
+	voted := make(map[common.Address]map[uint8]struct{})
+	
+	for _, vote := range s.Votes {
+		if _, exist := latest[vote.Voter]; !exist {
+			latest[vote.Voter] = make(map[common.Hash]bool)
+			voted[vote.Voter] = make(map[uint8]struct{})
+		}
+		latest[vote.Voter][vote.Proposal] = vote.YesNo
+		voted[vote.Voter][vote.Proposal[0]] = struct{}{}
 	}
 	
-	//检查提案是否存在
-	_, exist := getProposal(proposal.Id)
-	if exist!=nil {
-		return false
+	tally := make(map[common.Hash]*Tally)
+	
+	for voter, votes := range latest {
+		for proposalBytes, yesNo := range votes {
+			
+			weight := new(big.Int).Set(s.stakeOf(voter))
+			
+			if _, candidate := s.Candidates[voter]; candidate {
+				for delegator, candidate := range s.Delegators {
+					if candidate != voter || delegator == voter {
+						continue
+					}
+					if _, own := voted[delegator][proposalBytes[0]]; own {
+						continue
+					}
+					weight.Add(weight, s.stakeOf(delegator))
+				}
+			}
+			
+			if _, exist := tally[proposalBytes]; !exist {
+				tally[proposalBytes] = &Tally{Yes: new(big.Int), No: new(big.Int)}
+			}
+			
+			if yesNo {
+				tally[proposalBytes].Yes.Add(tally[proposalBytes].Yes, weight)
+			} else {
+				tally[proposalBytes].No.Add(tally[proposalBytes].No, weight)
+			}
+		}
 	}
 	
-	//还没开始投票的提案不算数
-	votes, ok := s.Tally[proposalBytes]
-	if !ok {
-		return false
-	} 
+	return tally
+}
+
+/*
+按提案ID选出通过的子提案:
+1) 投票的抵押金占全部抵押金的%不少于提案的Quorum
+2) 赞成票占已投票抵押金的%不少于提案的Threshold
+3) 同一提案有多个子提案通过时，赞成票最多的胜出；最多票相同则这个提案不做任何改变
+*/
+func (s *Snapshot) passedProposals(tally map[common.Hash]*Tally) map[uint8]common.Hash {
 	
-	//取最后一张票
-	var lastVote *Vote = s.lastVote(signer, proposalBytes)
+	total := new(big.Int)
+	for _, amount := range s.Stakes {
+		total.Add(total, amount)
+	}
 	
-	if !lastVote.YesNo {
-		return false
+	selected := make(map[uint8]common.Hash)
+	tied := make(map[uint8]bool)
+	
+	for proposalBytes, votes := range tally {
+		
+		proposal := &Proposal{}
+		if err := proposal.fromBytes(proposalBytes); err != nil {
+			continue
+		}
+		
+		cast := new(big.Int).Add(votes.Yes, votes.No)
+		
+		quorum := new(big.Int).Mul(total, big.NewInt(int64(proposal.Quorum)))
+		if new(big.Int).Mul(cast, big.NewInt(100)).Cmp(quorum) < 0 {
+			continue
+		}
+		
+		threshold := new(big.Int).Mul(cast, big.NewInt(int64(proposal.Threshold)))
+		if votes.Yes.Sign() == 0 || new(big.Int).Mul(votes.Yes, big.NewInt(100)).Cmp(threshold) < 0 {
+			continue
+		}
+		
+		best, exist := selected[proposal.Id]
+		if !exist {
+			selected[proposal.Id] = proposalBytes
+			continue
+		}
+		
+		switch votes.Yes.Cmp(tally[best].Yes) {
+			case 1:
+				selected[proposal.Id] = proposalBytes
+				tied[proposal.Id] = false
+			case 0:
+				tied[proposal.Id] = true
+		}
 	}
 	
-	// 取消票
-	if votes > 1 {
-		//减一，因为早前的票已无效
-		votes--
-		s.Tally[proposalBytes] = votes
-	} else {
-		//tally.Votes--， 表示tally.Votes变0,所以delete
-		delete(s.Tally, proposalBytes)
+	for id, tie := range tied {
+		if tie {
+			delete(selected, id)
+		}
 	}
 	
-	return true
+	return selected
 }
 
 //排序相关的函数和接口
@@ -410,7 +610,13 @@ type addressIntAsc struct {
 type manyAddressIntAsc []addressIntAsc
 func (p manyAddressIntAsc) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 func (p manyAddressIntAsc) Len() int { return len(p) }
-func (p manyAddressIntAsc) Less(i, j int) bool { return p[i].Value < p[j].Value }
+func (p manyAddressIntAsc) Less(i, j int) bool {
+	//出块数相同时按地址排序，保证每个节点排出的结果一样
+	if p[i].Value == p[j].Value {
+		return bytes.Compare(p[i].Key[:], p[j].Key[:]) < 0
+	}
+	return p[i].Value < p[j].Value
+}
 
 func addressIntAscSorter(m map[common.Address]uint16) manyAddressIntAsc {
 	p := make(manyAddressIntAsc, len(m))
@@ -456,7 +662,7 @@ func addressBigIntDescSorter(m map[common.Address]*big.Int) manyAddressBigIntDes
 
 // apply creates a new authorization snapshot by applying the given headers to
 // the original one.
-func (s *Snapshot) apply(chain consensus.ChainReader,headers []*types.Header, db ethdb.Database, _state *state.StateDB) (*Snapshot, error) {
+func (s *Snapshot) apply(chain consensus.ChainReader,headers []*types.Header, db ethdb.Database) (*Snapshot, error) {
 
 	// Allow passing in no headers for cleaner code
 	if len(headers) == 0 {
@@ -484,112 +690,25 @@ func (s *Snapshot) apply(chain consensus.ChainReader,headers []*types.Header, db
 	
 	for i, header := range headers {
 		
-		snap.Number += 1
-		snap.Hash = header.Hash()
-	
 		number := header.Number.Uint64()
 		
-		if number%s.config.EpochInterval == 0 {
-			//处理被踢者
-			for kickoutSigner := range snap.ElectedSigners {
-				_, exist := snap.PreElectedSigners[kickoutSigner]
-				
-				if !exist {
-					//被踢出者丧失候选人身份
-					delete(snap.Candidates, kickoutSigner)
-					
-					//移除被踢出者投他人的记录
-					delete(snap.Delegators, kickoutSigner)
-					
-					//移除他人投被踢出者的记录
-					for delegator, candidate := range snap.Delegators {
-						if candidate == kickoutSigner {
-							delete(snap.Delegators, delegator)
-						}
-					}
-				}
-			}
-			
-			for k, v := range snap.UnconfirmedProposals {
-				snap.ConfirmedProposals[k] = v
-			}
-			
-			snap.ElectedSigners = make(map[common.Address]uint16)
-			for k := range snap.PreElectedSigners {
-				snap.ElectedSigners[k] = 0
-			}
-			
-			snap.ElectedDelegators = make(map[common.Address][]ElectedDelegator)
-			for k, v := range snap.PreElectedDelegators {
-				snap.ElectedDelegators[k] = v
-			}
-			
-			snap.PreElectedDelegators = make(map[common.Address][]ElectedDelegator)
-			snap.PreElectedSigners = make(map[common.Address]struct{})
-			snap.UnconfirmedProposals = make(map[uint8]common.Hash)
-			
-			//在epoch区块时，清除投票信息
-			snap.Votes = nil
-			snap.Tally = make(map[common.Hash]int)
-			
-		} 
-
-		/*
-		limit这里是指SIGNER_LIMIT,表示一个signer在连续SIGNER_LIMIT个区块内只可以出块一次也等于投人一次
-		
-		snap.Recents保存最近出块的高度和签名者，所以新块的签名者不能存在于snap.Recents否则无效
-		
-		打个例子, 签名者列表(SIGNER_COUNT) = 7位人。新块高度=100， SIGNER_LIMIT = FLOOR(SIGNER_COUNT/2) + 1 = 4
-		
-		删除高度 = 100 - 4 = 96
-		删除snap.Recents[96],表示在96高度的这位签名者可以被解放了，他可以在97到100的新块间再签一次
-		*/
-		if limit := uint64(len(snap.ElectedSigners)/2 + 1); number >= limit {
-			delete(snap.Recents, number-limit)
-		}
-		
 		//从header signature通过ecrecover(...)取得签名者
 		signer, err := ecrecover(header, s.sigcache)
 		
 		if err != nil {
 			return nil, err
 		}
-
-		if _, ok := snap.ElectedSigners[signer]; !ok {
-			return nil, errUnauthorizedSignerAgainstSnap
-		} else {
-			snap.ElectedSigners[signer]++
-		}
-		
-		//snap.Recents保证在signer limit个区块间，一个signer只有一个签名
-		for _, recent := range snap.Recents {
-			if recent == signer {
-				return nil, errRecentlySigned
-			}
-		}
 		
-		//把签名者加入进snap.Recents里
-		snap.Recents[number] = signer
-		
-		//取是赞成票或是取消票
-		var yesNo bool
-		switch {
-			case bytes.Equal(header.Nonce[:], nonceYesVote):
-				yesNo = true
-			case bytes.Equal(header.Nonce[:], nonceNoVote):
-				yesNo = false
-			default:
-				return nil, errInvalidVote
+		if err := snap.applyHeader(header, signer); err != nil {
+			return nil, err
 		}
 		
-		//处理当前的票
-		if snap.cast(signer, header.MixDigest, yesNo) {
-			snap.Votes = append(snap.Votes, &Vote{
-				Signer:   signer,
-				Block:    number,
-				Proposal: header.MixDigest,
-				YesNo:    yesNo,
-			})
+		if number%s.config.EpochInterval == 0 {
+			for address, jail := range snap.Jailed {
+				if jail.Number == number && jail.Reason == jailDoubleSign {
+					log.Info("Dpos signer jailed", "number", number, "signer", address, "reason", jailDoubleSign)
+				}
+			}
 		}
 		
 		//由于eth是先同步块头后同步块体，返回错误是因为块体还未完成同步
@@ -600,45 +719,22 @@ func (s *Snapshot) apply(chain consensus.ChainReader,headers []*types.Header, db
 			return nil, errMissingBody
 		} else {
 			
-			
 			txs := block.Body().Transactions
 			
-			ethSigner := types.MakeSigner(chain.Config(), new(big.Int).SetUint64(number))
+			receipts := rawdb.ReadRawReceipts(db, header.Hash(), number)
+			if len(receipts) < len(txs) {
+				return nil, errMissingReceipts
+			}
 			
-			for i:=0; i < len(txs); i++ {
-				tx := txs[i]
-				
-				if *tx.To() == contractAddress {
-					action:= &Action{}
-					if err := action.fromBytes(tx.Data()); err == nil {
-						
-						if from, err := ethSigner.Sender(tx); err == nil {
-
-							switch action.Id {
-								case becomeCandidate:
-									snap.Candidates[from] = struct{}{}
-								
-								case becomeDelegator:
-									
-									candidate := action.Values[0].(common.Address)
-									
-									_, exist := snap.Candidates[candidate]
-									
-									if exist {
-										snap.Delegators[from] = candidate
-									}
-									
-								case quitCandidate:
-									delete(snap.Candidates,from)
-									
-									for delegator, candidate := range snap.Delegators {
-										if candidate == from {
-											delete(snap.Delegators, delegator)
-										}
-									}
-								case quitDelegator:
-									delete(snap.Delegators,from)
-							}
+			//只执行被系统合约接受的action, 被revert或被拒绝的action没有接受log, epoch区块的系统收据里也没有
+			for i, receipt := range receipts[:len(txs)] {
+				for _, l := range receipt.Logs {
+					if from, action, value, ok := acceptedAction(l, s.config.SystemAddress); ok {
+						if err := snap.applyAction(from, action, value, number); err != nil {
+							//系统合约已在相同的快照上检查过, 不应该发生
+							log.Warn("Failed to apply accepted dpos action", "number", number, "tx", txs[i].Hash(), "action", action.Id, "err", err)
+						} else if action.Id == unjail {
+							log.Info("Dpos signer unjailed", "number", number, "signer", from)
 						}
 					}
 				}
@@ -647,185 +743,571 @@ func (s *Snapshot) apply(chain consensus.ChainReader,headers []*types.Header, db
 		
 		if (number+1)%s.config.EpochInterval == 0 {
 			
+			snap.closeEpoch()
+			
+			for address, jail := range snap.Jailed {
+				if jail.Number == number && jail.Reason == jailDowntime {
+					log.Info("Dpos signer jailed", "number", number, "signer", address, "reason", jailDowntime, "minted", jail.Minted, "missed", jail.Missed)
+				}
+			}
+			
+			//快照epochblock-1的块，方便重启后快速恢复
+			if err := snap.store(db); err != nil {
+				return nil, err
+			} 
+		}
+		
+		//如果process时间过长就写入日志
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Reconstructing voting history", "processed", i, "total", len(headers), "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	
+	//如果process时间过长就写入日志
+	if time.Since(start) > 8*time.Second {
+		log.Info("Reconstructed voting history", "processed", len(headers), "elapsed", common.PrettyDuration(time.Since(start)))
+	}
+	
+	return snap, nil
+}
+
+/*
+把signer签名的块头记入快照: epoch区块先开始新的epoch, 再记出块数、错过的slot、最近的签名者、提案投票和RANDAO
+
+块里的action和epoch区块前一块的closeEpoch(...)由调用者随后执行, apply(...)和Finalize(...)都用它, 两者的结果必须相同
+*/
+func (s *Snapshot) applyHeader(header *types.Header, signer common.Address) error {
+	
+	number := header.Number.Uint64()
+	
+	//epoch区块仍按上一个epoch的顺序和出块间隔出块, 所以在newEpoch之前取, 参考schedule.go
+	interval := slotIntervalAt(s.config, s.rules().SlotInterval, number)
+	parentSlot, slot := slotOf(s.Time, s.Number, interval), slotOf(header.Time, number, interval)
+	order := schedule(s.electedSigners(), s.Seed)
+	
+	s.Number += 1
+	s.Hash = header.Hash()
+	s.Time = header.Time
+	
+	extra := new(EpochExtra)
+	if err := extra.Decode(header.Extra); err != nil {
+		return err
+	}
+	
+	if number%s.config.EpochInterval == 0 {
+		s.newEpoch(number, epochSeed(s.config, header, extra))
+	}
+
+	/*
+	limit这里是指SIGNER_LIMIT,表示一个signer在连续SIGNER_LIMIT个区块内只可以出块一次也等于投人一次
+	
+	s.Recents保存最近出块的高度和签名者，所以新块的签名者不能存在于s.Recents否则无效
+	
+	打个例子, 签名者列表(SIGNER_COUNT) = 7位人。新块高度=100， SIGNER_LIMIT = FLOOR(SIGNER_COUNT/2) + 1 = 4
+	
+	删除高度 = 100 - 4 = 96
+	删除s.Recents[96],表示在96高度的这位签名者可以被解放了，他可以在97到100的新块间再签一次
+	*/
+	if limit := uint64(len(s.ElectedSigners)/2 + 1); number >= limit {
+		delete(s.Recents, number-limit)
+	}
+	
+	if _, ok := s.ElectedSigners[signer]; !ok {
+		return errUnauthorizedSignerAgainstSnap
+	} else {
+		s.ElectedSigners[signer]++
+	}
+	
+	/*
+	轮到出块的签名者没有出块，记一次错过: 父块之后跳过的slot, 以及本块的slot由别人补发时
+	
+	新epoch重新洗牌后, 轮到的签名者可能刚在上一个epoch末尾出过块而不能出块, 这不算错过;
+	epoch区块轮到的签名者也可能已经落选, 不用记录
+	*/
+	for missed, count := range missedSlots(order, parentSlot, slot, signer) {
+		if _, elected := s.ElectedSigners[missed]; elected && !s.recentlySigned(number, missed) {
+			s.Missed[missed] += count
+		}
+	}
+	
+	//s.Recents保证在signer limit个区块间，一个signer只有一个签名
+	for _, recent := range s.Recents {
+		if recent == signer {
+			return errRecentlySigned
+		}
+	}
+	
+	//把签名者加入进s.Recents里
+	s.Recents[number] = signer
+	
+	//取是赞成票或是取消票
+	var yesNo bool
+	switch {
+		case bytes.Equal(header.Nonce[:], nonceYesVote):
+			yesNo = true
+		case bytes.Equal(header.Nonce[:], nonceNoVote):
+			yesNo = false
+		default:
+			return errInvalidVote
+	}
+	
+	//处理当前的票
+	if s.cast(signer, header.MixDigest, yesNo) {
+		s.Votes = append(s.Votes, &Vote{
+			Voter:    signer,
+			Block:    number,
+			Proposal: header.MixDigest,
+			YesNo:    yesNo,
+		})
+	}
+	
+	//RANDAO的承诺和公开, 参考randao.go
+	return s.applyRandao(signer, extra.Randao, number)
+}
+
+/*
+在epoch区块的前一块结束本epoch, 预选结果在下一块(epoch区块)由newEpoch(...)转正
+
+API的选举预览也用它, 所以这里不写日志
+*/
+func (s *Snapshot) closeEpoch() {
+	//按抵押金统计本epoch的投票，选出达到法定人数和门槛的子提案
+	selectedProposals := s.passedProposals(s.tally())
+	
+	//将当前已定案的值拷贝到UnconfirmedProposals
+	for k, v := range s.ConfirmedProposals {
+		s.UnconfirmedProposals[k] = v
+	}
+	
+	//将由投票产出的结果写入UnconfirmedProposals
+	for proposalId, proposalBytes := range selectedProposals {
+		s.UnconfirmedProposals[proposalId] = proposalBytes
+	}
+	
+	//这里预选新签名者，选票来自抵押金，所以不再需要读取state
+	//提案已选出, 新的签名者人数等参数在下个epoch生效
+	s.elect()
+}
+
+/*
+在epoch区块number开始新的epoch, 在处理该块的tx之前调用, seed是epoch区块记录的出块顺序种子
+*/
+func (s *Snapshot) newEpoch(number uint64, seed common.Hash) {
+	/*
+	落选的签名者仍然是候选人，他们的委托人也保留
+	出块不达标的签名者已在elect()里入狱，记录在s.Jailed
+	*/
+	for k, v := range s.UnconfirmedProposals {
+		s.ConfirmedProposals[k] = v
+	}
+	
+	s.ElectedSigners = make(map[common.Address]uint16)
+	for k := range s.PreElectedSigners {
+		s.ElectedSigners[k] = 0
+	}
+	
+	s.ElectedDelegators = make(map[common.Address][]ElectedDelegator)
+	for k, v := range s.PreElectedDelegators {
+		s.ElectedDelegators[k] = v
+	}
+	
+	s.PreElectedDelegators = make(map[common.Address][]ElectedDelegator)
+	s.PreElectedSigners = make(map[common.Address]struct{})
+	
+	//记下本epoch的签名者, 举报期限内的双签证据要对照它
+	s.Elections[number] = s.electedSigners()
+	
+	//新的签名者按epoch区块记录的种子(出块之前的RANDAO mix)洗牌
+	s.Seed = seed
+	s.UnconfirmedProposals = make(map[uint8]common.Hash)
+	
+	//在epoch区块时，清除投票信息
+	s.Votes = nil
+	
+	//新的epoch重新统计错过的出块数和错过公开的次数
+	s.Missed = make(map[common.Address]uint64)
+	s.Unrevealed = make(map[common.Address]uint64)
+	
+	//退回到期的解押金和罚没双签者，资金的转移已在Finalize(...)里完成
+	s.settle(number)
+}
+
+/*
+执行一个已解码的action, 返回错误表示该action被拒绝, 快照保持不变
+
+value是tx.value, 只有stake会用到, 资金已经随tx转入托管账户
+*/
+func (s *Snapshot) applyAction(from common.Address, action *Action, value *big.Int, number uint64) error {
+	
+	switch action.Id {
+		case becomeCandidate:
+			if _, jailed := s.Jailed[from]; jailed {
+				return errJailed
+			}
+			s.Candidates[from] = struct{}{}
+		
+		case becomeDelegator:
 			
-			statedb, err := state.New(header.Root, state.NewDatabase(db), nil)
+			candidate := action.Values[0].(common.Address)
 			
-			if statedb==nil {
-				statedb = _state
+			if _, exist := s.Candidates[candidate]; !exist {
+				return errUnknownCandidate
 			}
+			s.Delegators[from] = candidate
 			
-			if statedb == nil {
-				fmt.Println("chiew check apply", err)
-				
-				//这里针对before Pivot和Pivot之间没有state的区块 (fast-sync),虽然牵强，但为了连贯性只有为之
-				if len(headers)-1 < i + 1 {
-					return nil, errMissingEpochBlock
-				} else {
-					
-					electedSigners, _, delegatorss := parseEpochExtra(headers[i+1])
-					electedDelegators :=  make(map[common.Address][]ElectedDelegator)
-					for k, delegators := range delegatorss {
-						for _, delegator := range delegators {
-							electedDelegators[electedSigners[k]]= append(electedDelegators[electedSigners[k]], delegator)
-						}
-					}
-					
-					for _, signer := range electedSigners {
-						snap.PreElectedSigners[signer]  = struct{}{}
-					}
-					snap.PreElectedDelegators = electedDelegators
+		case quitCandidate:
+			delete(s.Candidates,from)
+			
+			for delegator, candidate := range s.Delegators {
+				if candidate == from {
+					delete(s.Delegators, delegator)
 				}
+			}
+		case quitDelegator:
+			delete(s.Delegators,from)
+		
+		case stake:
+			if value == nil || value.Sign() <= 0 {
+				return errInvalidStake
+			}
+			s.Stakes[from] = new(big.Int).Add(s.stakeOf(from), value)
+			
+		case reportDoubleSign, reportDoublePrecommit:
+			//重复的预提交投票和双签一样处罚
+			var (
+				offender common.Address
+				evidence common.Hash
+				height uint64
+				err error
+			)
+			if action.Id == reportDoubleSign {
+				offender, evidence, err = verifyEvidence(action.Values[0].(*types.Header), action.Values[1].(*types.Header), s.sigcache)
+				height = action.Values[0].(*types.Header).Number.Uint64()
 			} else {
-					
-				//这里预选新签名者
-				//每个出块人的最低出块数，低过这个值将被开除, -1 是不包括epoch块
-				minMintTarget := (int(snap.config.EpochInterval) - 1) / len(snap.ElectedSigners) / 2
-				candidateCnt := len(snap.Candidates) - len(snap.ElectedSigners)
-				//candidateCnt = 1
-				sorted := addressIntAscSorter(snap.ElectedSigners)
-				
-				//被踢出签名者,将丧失候选人身份
-				kickoutSigners := make(map[common.Address]struct{},0)
-				candidateVotes := make(map[common.Address]*big.Int)
-				
-				for _, kv := range sorted {
-					
-					address := kv.Key
-					mintCnt := kv.Value
-					
-					if len(kickoutSigners) < candidateCnt && mintCnt < minMintTarget {
-						kickoutSigners[address] = struct{}{}
-					} else {
-						candidateVotes[ address ] = big.NewInt(0)
-					}
-				}
-				
-				//如今 snap.Candidates都是合格的候选人， 开始竞争!
-				for delegator, candidate := range snap.Delegators {
-					
-					if _, exist := kickoutSigners[candidate]; exist {
-						continue
-					}
-					
-					if _, exist := kickoutSigners[delegator]; exist {
-						continue
-					}
-					
-					if _, exist := candidateVotes[candidate]; !exist {
-						candidateVotes[candidate] = big.NewInt(0)
-					}
-					
-					balance := statedb.GetBalance(delegator)
-					
-					if balance.Cmp(common.Big0) > 0 {
-						//计算每个候选人的支持率
-						candidateVotes[candidate].Add(candidateVotes[candidate],balance)
-					}
-				}
-				
-				newSigners := addressBigIntDescSorter(candidateVotes)
-				
-				if len(newSigners) > maxSignerSize {
-					newSigners = newSigners[:maxSignerSize]
-				}
-				
-				for _, newSigner := range newSigners {
-					preElectedSigner := newSigner.Key
-					snap.PreElectedSigners[preElectedSigner] = struct{}{}
-					
-					//处理pre elected delegator
-					snap.PreElectedDelegators[preElectedSigner] = []ElectedDelegator{}
-					
-					delegators := make(map[common.Address]*big.Int)
-					sum := new(big.Int)
-					for delegator, candidate := range snap.Delegators {
-						if candidate == preElectedSigner {
-							delegators[delegator] = statedb.GetBalance(delegator)
-							sum.Add(sum,delegators[delegator])
-						}
-					}
-					
-					sortedDelegators := addressBigIntDescSorter(delegators)
-					operand2 := new(big.Float).SetInt(sum)
-					for i := 0; i < len(sortedDelegators); i++ {
-						address := sortedDelegators[i].Key
-						operand1 := new(big.Float).SetInt(sortedDelegators[i].Value)
-						result := new(big.Float).Quo(operand1, operand2)
-						
-						portion, _ := result.Float32()
-						
-						snap.PreElectedDelegators[preElectedSigner] = append(snap.PreElectedDelegators[preElectedSigner], ElectedDelegator{address, portion})
-					}
-				}
+				offender, evidence, err = verifyPrecommitEvidence(action.Values[0].(*Precommit), action.Values[1].(*Precommit))
+				height = action.Values[0].(*Precommit).Number
+			}
+			if err != nil {
+				return err
 			}
 			
-			//由于相同的提案ID但不同的值（子提案）是可以做多，这里按ID把同类型的提案重新组合
-			groupProposals := make(map[uint8]map[common.Hash]int)
-			for proposalBytes, votes := range snap.Tally {
-				
-				proposal := &Proposal{}
-				if err:=proposal.fromBytes(proposalBytes);err!=nil {
-					return nil, err
-				}
-				
-				_, exist := groupProposals[proposal.Id]
-				
-				if !exist {
-					groupProposals[proposal.Id] = make(map[common.Hash]int)
-				} 
-				groupProposals[proposal.Id][proposalBytes] = votes
-				
+			//只受理在解押等待期内的证据，否则双签者的抵押金可能早已退回
+			if height > number || number - height > s.config.UnbondingEpochs*s.config.EpochInterval {
+				return errStaleEvidence
 			}
 			
-			//把获票最多的子提案，按提案ID存入 selectedProposals
-			selectedProposals := make(map[uint8]common.Hash)
-			for proposalId, proposalVotes := range groupProposals {
-				
-				if len(proposalVotes) > 1 {
-					sorted := hashIntDescSorter(proposalVotes)
-					
-					//如果同类的两个子提案的获得票是相同的，那么这个提案将无效
-					if sorted[0].Value == sorted[1].Value {
-						continue
-					}
+			//双签者必须是那个高度的签名者, 否则任何人拿到落选或已退出的候选人私钥都可以伪造证据罚没他的抵押金
+			if !s.electedAt(height, offender) {
+				return errInvalidEvidence
+			}
 			
-					selectedProposals[proposalId] = sorted[0].Key
-				} else {
-					for proposalBytes := range proposalVotes {
-						selectedProposals[proposalId] = proposalBytes
-					}
-				}
+			if _, exist := s.Evidences[evidence]; exist {
+				return errDuplicateEvidence
 			}
+			s.Evidences[evidence] = height
 			
-			//将当前已定案的值拷贝到UnconfirmedProposals
-			for k, v := range snap.ConfirmedProposals {
-				snap.UnconfirmedProposals[k] = v
+			if _, exist := s.Offenders[offender]; !exist {
+				s.Offenders[offender] = number
+			}
+		
+		case unjail:
+			jail, jailed := s.Jailed[from]
+			if !jailed {
+				return errNotJailed
 			}
+			if number < jail.Release {
+				return errJailed
+			}
+			delete(s.Jailed, from)
+		
+		case unstake:
+			amount := action.Values[0].(*big.Int)
 			
-			//将由投票产出的结果写入UnconfirmedProposals
-			for proposalId, proposalBytes := range selectedProposals {
-				snap.UnconfirmedProposals[proposalId] = proposalBytes
+			bonded := s.stakeOf(from)
+			if bonded.Cmp(amount) < 0 {
+				return errInsufficientStake
 			}
 			
-			//快照epochblock-1的块，因为旧state有可能被删除
-			if err := snap.store(db); err != nil {
-				return nil, err
-			} 
+			if remain := new(big.Int).Sub(bonded, amount); remain.Sign() > 0 {
+				s.Stakes[from] = remain
+			} else {
+				delete(s.Stakes, from)
+			}
+			
+			s.Unbondings = append(s.Unbondings, &Unbonding{from, new(big.Int).Set(amount), s.releaseNumber(number)})
+		
+		case voteProposal:
+			//自己有抵押金或是候选人(代表他的委托人)才有票
+			if _, candidate := s.Candidates[from]; !candidate && s.stakeOf(from).Sign() == 0 {
+				return errNoVotingPower
+			}
+			
+			s.Votes = append(s.Votes, &Vote{
+				Voter:    from,
+				Block:    number,
+				Proposal: action.Values[0].(common.Hash),
+				YesNo:    action.Values[1].(bool),
+			})
+		
+		default:
+			return errUnknownAction
+	}
+	
+	return nil
+}
+
+/*
+在epoch区块number结算:
+1) 移除到期的解押记录, 返回它们以便Finalize(...)退回资金
+2) 罚没双签者SlashPercent%的抵押金(包括解押中的), 并取消他的候选人身份, 返回罚没的总额以便Finalize(...)从托管账户销毁
+
+Finalize(...)在父块快照的副本上调用, apply(...)在快照本身调用, 两者结果一定相同
+*/
+func (s *Snapshot) settle(number uint64) ([]*Unbonding, *big.Int) {
+	
+	released := s.maturedUnbondings(number)
+	s.Unbondings = s.Unbondings[len(released):]
+	
+	slashed := new(big.Int)
+	
+	for _, offender := range s.offenders() {
+		
+		if amount := s.Stakes[offender]; amount != nil {
+			penalty := s.penalty(amount)
+			slashed.Add(slashed, penalty)
+			
+			if remain := new(big.Int).Sub(amount, penalty); remain.Sign() > 0 {
+				s.Stakes[offender] = remain
+			} else {
+				delete(s.Stakes, offender)
+			}
 		}
 		
-		//如果process时间过长就写入日志
-		if time.Since(logged) > 8*time.Second {
-			log.Info("Reconstructing voting history", "processed", i, "total", len(headers), "elapsed", common.PrettyDuration(time.Since(start)))
-			logged = time.Now()
+		for _, unbonding := range s.Unbondings {
+			if unbonding.Delegator == offender {
+				penalty := s.penalty(unbonding.Amount)
+				slashed.Add(slashed, penalty)
+				unbonding.Amount = new(big.Int).Sub(unbonding.Amount, penalty)
+			}
+		}
+		
+		//双签者丧失候选人身份, 投他的委托人也一并移除
+		delete(s.Candidates, offender)
+		delete(s.Delegators, offender)
+		
+		//出块数要在移出签名者之前取
+		minted := s.ElectedSigners[offender]
+		if len(s.ElectedSigners) > 1 {
+			delete(s.ElectedSigners, offender)
 		}
+		
+		for delegator, candidate := range s.Delegators {
+			if candidate == offender {
+				delete(s.Delegators, delegator)
+			}
+		}
+		
+		delete(s.Offenders, offender)
+		
+		//双签者永远不能unjail, 也不能再成为候选人
+		s.Jailed[offender] = &Jail{Reason: jailDoubleSign, Number: number, Release: math.MaxUint64, Minted: minted, Missed: s.Missed[offender]}
 	}
 	
-	//如果process时间过长就写入日志
-	if time.Since(start) > 8*time.Second {
-		log.Info("Reconstructed voting history", "processed", len(headers), "elapsed", common.PrettyDuration(time.Since(start)))
+	//超出举报期限的证据不会再被受理, 可以移除
+	for evidence, height := range s.Evidences {
+		if number - height > s.config.UnbondingEpochs*s.config.EpochInterval {
+			delete(s.Evidences, evidence)
+		}
 	}
 	
-	return snap, nil
+	//epoch的最后一块也超出举报期限时, 那个epoch的签名者不再需要
+	for epoch := range s.Elections {
+		if epoch + s.config.EpochInterval + s.config.UnbondingEpochs*s.config.EpochInterval < number {
+			delete(s.Elections, epoch)
+		}
+	}
+	
+	return released, slashed
+}
+
+/*
+signer是否是出height高度的块的签名者: 看选出那个epoch签名者的epoch区块, epoch区块本身仍属于上一个epoch, 参考epochOfHeader
+*/
+func (s *Snapshot) electedAt(height uint64, signer common.Address) bool {
+	if height == 0 {
+		return false
+	}
+	for _, elected := range s.Elections[(height-1)-(height-1)%s.config.EpochInterval] {
+		if elected == signer {
+			return true
+		}
+	}
+	return false
+}
+
+//按地址排序的双签者
+func (s *Snapshot) offenders() []common.Address {
+	offenders := make([]common.Address, 0, len(s.Offenders))
+	for offender := range s.Offenders {
+		offenders = append(offenders, offender)
+	}
+	sort.Sort(signersAscending(offenders))
+	return offenders
+}
+
+//计算罚没金额
+func (s *Snapshot) penalty(amount *big.Int) *big.Int {
+	penalty := new(big.Int).Mul(amount, new(big.Int).SetUint64(s.config.SlashPercent))
+	return penalty.Div(penalty, big.NewInt(100))
+}
+
+//取抵押者已抵押的金额
+func (s *Snapshot) stakeOf(staker common.Address) *big.Int {
+	if amount, ok := s.Stakes[staker]; ok {
+		return amount
+	}
+	return new(big.Int)
+}
+
+/*
+在number高度解押的资金，要等到下一个epoch区块再加上UnbondingEpochs个epoch才退回
+
+因为Release是递增的，s.Unbondings自然地按Release排序
+*/
+func (s *Snapshot) releaseNumber(number uint64) uint64 {
+	return (number/s.config.EpochInterval + 1 + s.config.UnbondingEpochs) * s.config.EpochInterval
+}
+
+//取在epoch区块number到期的解押记录
+func (s *Snapshot) maturedUnbondings(number uint64) []*Unbonding {
+	matured := 0
+	for matured < len(s.Unbondings) && s.Unbondings[matured].Release <= number {
+		matured++
+	}
+	return s.Unbondings[:matured]
+}
+
+/*
+预选下一个epoch的签名者和委托人, 结果写入PreElectedSigners和PreElectedDelegators
+
+委托人的选票比重是已抵押的金额(Stakes), 而不是余额, 这样同一笔资金就不能在同一次选举里重复计算
+*/
+func (s *Snapshot) elect() {
+	
+	//新签名者在下一块(epoch区块)生效，所以按下一块的参数和刚选出的提案
+	rules := newRules(s.config, s.Number+1, decodeProposals(s.UnconfirmedProposals))
+	
+	candidateCnt := len(s.Candidates) - len(s.ElectedSigners)
+	
+	sorted := addressIntAscSorter(s.ElectedSigners)
+	
+	//错过的slot多过出块数(错过了一半以上轮到自己的slot)的签名者入狱, 但只在有足够候选人补上时才执行
+	jailedCnt := 0
+	candidateVotes := make(map[common.Address]*big.Int)
+	
+	for _, kv := range sorted {
+		
+		address := kv.Key
+		mintCnt := uint64(kv.Value)
+		missed := s.Missed[address]
+		
+		//有承诺却没有公开秘密的块不算出块, 算作错过
+		unrevealed := s.Unrevealed[address]
+		if unrevealed > mintCnt {
+			unrevealed = mintCnt
+		}
+		mintCnt, missed = mintCnt-unrevealed, missed+unrevealed
+		
+		if jailedCnt < candidateCnt && missed > mintCnt {
+			s.Jailed[address] = &Jail{
+				Reason:  jailDowntime,
+				Number:  s.Number,
+				Release: s.Number + 1 + s.config.JailEpochs*s.config.EpochInterval,
+				Minted:  uint16(kv.Value),
+				Missed:  s.Missed[address],
+				Unrevealed: s.Unrevealed[address],
+			}
+			jailedCnt++
+		} else if _, jailed := s.Jailed[address]; !jailed {
+			candidateVotes[ address ] = big.NewInt(0)
+		}
+	}
+	
+	//等待罚没的双签者不能参选, 但至少保留一名签名者, 否则链会停止
+	for _, offender := range s.offenders() {
+		if len(candidateVotes) > 1 {
+			delete(candidateVotes, offender)
+		}
+	}
+	
+	//如今 s.Candidates里不在狱中的都是合格的候选人， 开始竞争!
+	for delegator, candidate := range s.Delegators {
+		
+		if _, exist := s.Offenders[candidate]; exist {
+			continue
+		}
+		
+		if _, exist := s.Jailed[candidate]; exist {
+			continue
+		}
+		
+		if _, exist := candidateVotes[candidate]; !exist {
+			candidateVotes[candidate] = big.NewInt(0)
+		}
+		
+		//计算每个候选人的支持率
+		candidateVotes[candidate].Add(candidateVotes[candidate], s.stakeOf(delegator))
+	}
+	
+	//自己抵押不足的候选人不能参选
+	if rules.MinSelfStake.Sign() > 0 {
+		for candidate := range candidateVotes {
+			if s.stakeOf(candidate).Cmp(rules.MinSelfStake) < 0 {
+				delete(candidateVotes, candidate)
+			}
+		}
+	}
+	
+	newSigners := addressBigIntDescSorter(candidateVotes)
+	
+	//没有人可以参选时, 沿用当前的签名者, 否则链会停止
+	if len(newSigners) == 0 {
+		for _, signer := range s.electedSigners() {
+			newSigners = append(newSigners, addressBigIntDesc{signer, new(big.Int)})
+		}
+	}
+	
+	if uint64(len(newSigners)) > rules.MaxSigners {
+		newSigners = newSigners[:rules.MaxSigners]
+	}
+	
+	for _, newSigner := range newSigners {
+		preElectedSigner := newSigner.Key
+		s.PreElectedSigners[preElectedSigner] = struct{}{}
+		
+		//处理pre elected delegator, 没有抵押金的委托人不参与分红
+		s.PreElectedDelegators[preElectedSigner] = []ElectedDelegator{}
+		
+		delegators := make(map[common.Address]*big.Int)
+		sum := new(big.Int)
+		for delegator, candidate := range s.Delegators {
+			if amount := s.stakeOf(delegator); candidate == preElectedSigner && amount.Sign() > 0 {
+				delegators[delegator] = amount
+				sum.Add(sum, amount)
+			}
+		}
+		
+		//份额是定点整数，向下取整，加起来不超过portionBase
+		sortedDelegators := addressBigIntDescSorter(delegators)
+		for i := 0; i < len(sortedDelegators); i++ {
+			address := sortedDelegators[i].Key
+			portion := new(big.Int).Mul(sortedDelegators[i].Value, new(big.Int).SetUint64(portionBase))
+			portion.Div(portion, sum)
+			
+			s.PreElectedDelegators[preElectedSigner] = append(s.PreElectedDelegators[preElectedSigner], ElectedDelegator{address, uint32(portion.Uint64())})
+		}
+	}
 }
 
 
@@ -887,11 +1369,42 @@ func (s *Snapshot) confirmedProposals() []common.Hash {
 	return sortedProposals
 }
 
-// inturn returns if a signer at a given block height is in-turn or not.
-func (s *Snapshot) inturn(number uint64, signer common.Address) bool {
-	signers, offset := s.electedSigners(), 0
-	for offset < len(signers) && signers[offset] != signer {
-		offset++
+/*
+在快照的下一块生效的参数
+
+epoch块仍然属于上一个epoch(参考epochOfHeader(...))，所以一律用ConfirmedProposals，和epoch块extra里记录的提案相同
+*/
+func (s *Snapshot) rules() *Rules {
+	return newRules(s.config, s.Number+1, decodeProposals(s.ConfirmedProposals))
+}
+
+//取在slot轮到出块的签名者, 顺序参考schedule.go
+func (s *Snapshot) inturnSigner(slot uint64) common.Address {
+	return scheduledSigner(s.electedSigners(), s.Seed, slot)
+}
+
+// inturn returns if a signer at a given slot is in-turn or not.
+func (s *Snapshot) inturn(slot uint64, signer common.Address) bool {
+	return s.inturnSigner(slot) == signer
+}
+
+//快照的下一块时间截为time时所在的slot
+func (s *Snapshot) slot(time uint64) uint64 {
+	return slotOf(time, s.Number+1, slotIntervalAt(s.config, s.rules().SlotInterval, s.Number+1))
+}
+
+//快照所在块的slot, 和verifyHeader一样按下一块的出块间隔算
+func (s *Snapshot) lastSlot() uint64 {
+	return slotOf(s.Time, s.Number, slotIntervalAt(s.config, s.rules().SlotInterval, s.Number+1))
+}
+
+//签名者是否因为在signer limit个区块里出过块而不能在number高度出块, 和verifySeal的检查一样
+func (s *Snapshot) recentlySigned(number uint64, signer common.Address) bool {
+	limit := uint64(len(s.ElectedSigners)/2 + 1)
+	for seen, recent := range s.Recents {
+		if recent == signer && seen > number-limit {
+			return true
+		}
 	}
-	return (number % uint64(len(signers))) == uint64(offset)
+	return false
 }
@@ -0,0 +1,386 @@
+/*
+dpos的系统合约
+
+发送到系统地址(params.DposConfig.SystemAddress)的tx由这个原生合约执行，而不是ECRecover之类的预编译合约:
+ 1. 检查action的格式，格式不对的tx会revert, receipt.status为0, snapshot.apply(...)也会跳过它
+ 2. 按action收取gas
+ 3. 在父块快照上按顺序重放本块已接受的action, 再检查当前action, 记录接受log或拒绝log(带原因)
+    被拒绝的tx不会revert, 所以收据里能看到原因, 随tx转入的资金会退回
+ 4. snapshot.apply(...)只执行有接受log的action, 所以两边的结果一定相同
+
+epoch区块还会通过SystemReceipt(...)发出中选签名者和委托人的log, 它们在tx收据之后的系统收据里, 和tx的log一样被写入数据库和索引
+*/
+package dpos
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const (
+	actionGas uint64 = 20000 //每个action的基本gas, 不包括tx的intrinsic gas
+)
+
+const (
+	//拒绝原因的代码, 作为拒绝log的第4个topic, 方便按原因过滤
+	rejectUnknown uint8 = iota
+	rejectUnknownCandidate
+	rejectInsufficientStake
+	rejectInvalidEvidence
+	rejectDuplicateEvidence
+	rejectStaleEvidence
+	rejectJailed
+	rejectNotJailed
+	rejectInvalidStake
+	rejectNoVotingPower
+)
+
+var (
+	//log.Topics = [actionAcceptedTopic, sender, action id], log.Data = tx.value(32 bytes) + action的参数
+	actionAcceptedTopic = crypto.Keccak256Hash([]byte("DposActionAccepted(address,uint8)"))
+
+	//log.Topics = [actionRejectedTopic, sender, action id, 拒绝原因代码], log.Data = 拒绝原因
+	actionRejectedTopic = crypto.Keccak256Hash([]byte("DposActionRejected(address,uint8,uint8)"))
+
+	//epoch区块, log.Topics = [signerElectedTopic, signer], log.Data = epoch序号(32 bytes)
+	signerElectedTopic = crypto.Keccak256Hash([]byte("DposSignerElected(address,uint64)"))
+
+	//epoch区块, log.Topics = [delegatorElectedTopic, signer, delegator], log.Data = portion(4 bytes)
+	delegatorElectedTopic = crypto.Keccak256Hash([]byte("DposDelegatorElected(address,address,uint32)"))
+
+	rejectReasons = map[error]uint8{
+		errUnknownCandidate:  rejectUnknownCandidate,
+		errInsufficientStake: rejectInsufficientStake,
+		errInvalidEvidence:   rejectInvalidEvidence,
+		errInvalidPrecommit:  rejectInvalidEvidence,
+		errDuplicateEvidence: rejectDuplicateEvidence,
+		errStaleEvidence:     rejectStaleEvidence,
+		errJailed:            rejectJailed,
+		errNotJailed:         rejectNotJailed,
+		errInvalidStake:      rejectInvalidStake,
+		errNoVotingPower:     rejectNoVotingPower,
+	}
+
+	errNoSnapshot = errors.New("dpos snapshot unavailable")
+)
+
+type systemContract struct {
+	dpos   *Dpos
+	chain  consensus.ChainHeaderReader
+	header *types.Header
+}
+
+/*
+实现 consensus.SystemContractProvider 接口
+*/
+func (self *Dpos) SystemContracts(chain consensus.ChainHeaderReader, header *types.Header) map[common.Address]vm.SystemContract {
+	return map[common.Address]vm.SystemContract{
+		self.config.SystemAddress: &systemContract{dpos: self, chain: chain, header: header},
+	}
+}
+
+/*
+实现 vm.SystemContract 接口
+
+举报双签或重复的预提交投票需要做两次ecrecover
+*/
+func (self *systemContract) RequiredGas(input []byte) uint64 {
+	if len(input) > 0 && (input[0] == reportDoubleSign || input[0] == reportDoublePrecommit) {
+		return actionGas + 2*params.EcrecoverGas
+	}
+	return actionGas
+}
+
+/*
+实现 vm.SystemContract 接口
+*/
+func (self *systemContract) Run(evm *vm.EVM, caller common.Address, input []byte, value *big.Int) ([]byte, error) {
+
+	action := &Action{}
+	if err := self.validate(evm, caller, input, value, action); err != nil {
+		log.Debug("Reverted dpos action", "caller", caller, "err", err)
+		return nil, vm.ErrExecutionReverted
+	}
+
+	snap, err := self.pending(evm)
+	if err != nil {
+		log.Debug("Reverted dpos action", "caller", caller, "err", err)
+		return nil, vm.ErrExecutionReverted
+	}
+
+	id := common.BigToHash(new(big.Int).SetUint64(uint64(action.Id)))
+
+	if err := snap.applyAction(caller, action, value, evm.Context.BlockNumber.Uint64()); err != nil {
+		//被拒绝的action不扣留资金
+		if value.Sign() > 0 {
+			evm.Context.Transfer(evm.StateDB, self.dpos.config.SystemAddress, caller, value)
+		}
+		evm.StateDB.AddLog(&types.Log{
+			Address:     self.dpos.config.SystemAddress,
+			Topics:      []common.Hash{actionRejectedTopic, caller.Hash(), id, common.BigToHash(new(big.Int).SetUint64(uint64(rejectReasons[err])))},
+			Data:        []byte(err.Error()),
+			BlockNumber: evm.Context.BlockNumber.Uint64(),
+		})
+		return nil, nil
+	}
+
+	evm.StateDB.AddLog(&types.Log{
+		Address:     self.dpos.config.SystemAddress,
+		Topics:      []common.Hash{actionAcceptedTopic, caller.Hash(), id},
+		Data:        append(common.BigToHash(value).Bytes(), input[1:]...),
+		BlockNumber: evm.Context.BlockNumber.Uint64(),
+	})
+
+	return nil, nil
+}
+
+/*
+返回执行当前tx之前的快照
+*/
+func (self *systemContract) pending(evm *vm.EVM) (*Snapshot, error) {
+
+	if self.chain == nil || self.header == nil {
+		return nil, errNoSnapshot
+	}
+
+	//state.StateDB记录了本块到目前为止的log
+	var logs []*types.Log
+	if db, ok := evm.StateDB.(interface{ Logs() []*types.Log }); ok {
+		logs = db.Logs()
+	}
+
+	return self.dpos.pendingSnapshot(self.chain, self.header, logs)
+}
+
+/*
+返回执行了logs里已接受action的快照:
+取父块的快照, epoch区块先开始新的epoch, 再按log的顺序重放本块已接受的action, 和snapshot.apply(...)的顺序一致
+*/
+func (self *Dpos) pendingSnapshot(chain consensus.ChainHeaderReader, header *types.Header, logs []*types.Log) (*Snapshot, error) {
+
+	if header.Number.Sign() == 0 {
+		return nil, errNoSnapshot
+	}
+
+	number := header.Number.Uint64()
+
+	parent, err := self.snapshot(chain, number-1, header.ParentHash, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	//快照会被缓存, 必须在副本上修改
+	snap := parent.copy()
+	if number%self.config.EpochInterval == 0 {
+		//出块时extra在FinalizeAndAssemble才填好, 种子就是父块的mix, 和verifySeal检查的一样; schedule分叉之前没有种子
+		//从state组装的快照也有mix, 只有轻节点的快照没有, 不能拿空的mix当种子
+		var seed common.Hash
+		if self.config.IsSchedule(header.Number) {
+			if parent.Light {
+				return nil, errNoMix
+			}
+			seed = parent.Mix
+		}
+		snap.newEpoch(number, seed)
+	}
+
+	self.applyAcceptedActions(snap, logs, number)
+
+	return snap, nil
+}
+
+/*
+返回执行完整个块后的快照, 和snapshot.apply(...)重放这个块的结果相同: 块头由signer签名, logs是本块tx的log
+
+Finalize(...)把它写入state, 参考registry.go; 块头除了签名必须已经组装好
+*/
+func (self *Dpos) finalSnapshot(chain consensus.ChainHeaderReader, header *types.Header, signer common.Address, logs []*types.Log) (*Snapshot, error) {
+
+	if header.Number.Sign() == 0 {
+		return nil, errNoSnapshot
+	}
+
+	number := header.Number.Uint64()
+
+	parent, err := self.snapshot(chain, number-1, header.ParentHash, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	//快照会被缓存, 必须在副本上修改
+	snap := parent.copy()
+	if err := snap.applyHeader(header, signer); err != nil {
+		return nil, err
+	}
+	self.applyAcceptedActions(snap, logs, number)
+
+	if (number+1)%self.config.EpochInterval == 0 {
+		snap.closeEpoch()
+	}
+	return snap, nil
+}
+
+/*
+按log的顺序执行logs里已接受的action, 和snapshot.apply(...)按收据的顺序一致
+*/
+func (self *Dpos) applyAcceptedActions(snap *Snapshot, logs []*types.Log, number uint64) {
+	sorted := make([]*types.Log, len(logs))
+	copy(sorted, logs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Index < sorted[j].Index })
+
+	for _, l := range sorted {
+		if from, action, value, ok := acceptedAction(l, self.config.SystemAddress); ok {
+			snap.applyAction(from, action, value, number)
+		}
+	}
+}
+
+/*
+logs里是否有被系统合约接受的action
+*/
+func hasAcceptedAction(logs []*types.Log, systemAddress common.Address) bool {
+	for _, l := range logs {
+		if _, _, _, ok := acceptedAction(l, systemAddress); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+从接受log还原action
+*/
+func acceptedAction(l *types.Log, systemAddress common.Address) (common.Address, *Action, *big.Int, bool) {
+
+	if l.Address != systemAddress || len(l.Topics) != 3 || l.Topics[0] != actionAcceptedTopic || len(l.Data) < common.HashLength {
+		return common.Address{}, nil, nil, false
+	}
+
+	id := l.Topics[2].Big()
+	if !id.IsUint64() || id.Uint64() > 0xff {
+		return common.Address{}, nil, nil, false
+	}
+
+	action := &Action{}
+	if err := action.fromBytes(append([]byte{byte(id.Uint64())}, l.Data[common.HashLength:]...)); err != nil {
+		return common.Address{}, nil, nil, false
+	}
+
+	return common.BytesToAddress(l.Topics[1].Bytes()), action, new(big.Int).SetBytes(l.Data[:common.HashLength]), true
+}
+
+/*
+实现 consensus.ReceiptEmitter 接口
+
+epoch区块为每个中选的签名者和他的委托人各发出一条log, 这些log放在tx收据之后的系统收据里,
+和tx的收据一起计入收据根和bloom并写入数据库, 所以能被过滤器索引到
+
+系统收据不消耗gas, 它的TxHash是块的哈希, log的序号接在tx的log之后
+*/
+func (self *Dpos) SystemReceipt(header *types.Header, receipts types.Receipts) *types.Receipt {
+
+	number := header.Number.Uint64()
+	if number == 0 || number%self.config.EpochInterval != 0 {
+		return nil
+	}
+
+	extra, err := parseEpochExtra(header)
+	if err != nil {
+		return nil
+	}
+
+	var (
+		hash    = header.Hash()
+		epoch   = common.BigToHash(new(big.Int).SetUint64(number / self.config.EpochInterval))
+		receipt = &types.Receipt{
+			Status:           types.ReceiptStatusSuccessful,
+			TxHash:           hash,
+			BlockHash:        hash,
+			BlockNumber:      new(big.Int).Set(header.Number),
+			TransactionIndex: uint(len(receipts)),
+		}
+		logIndex uint
+	)
+	if len(receipts) > 0 {
+		receipt.CumulativeGasUsed = receipts[len(receipts)-1].CumulativeGasUsed
+	}
+	for _, r := range receipts {
+		logIndex += uint(len(r.Logs))
+	}
+
+	emit := func(topics []common.Hash, data []byte) {
+		receipt.Logs = append(receipt.Logs, &types.Log{
+			Address:     self.config.SystemAddress,
+			Topics:      topics,
+			Data:        data,
+			BlockNumber: number,
+			TxHash:      hash,
+			TxIndex:     receipt.TransactionIndex,
+			BlockHash:   hash,
+			Index:       logIndex,
+		})
+		logIndex++
+	}
+	for i, signer := range extra.Signers {
+		emit([]common.Hash{signerElectedTopic, signer.Hash()}, epoch.Bytes())
+
+		for _, delegator := range extra.Delegators[i] {
+			portion := make([]byte, portionLength)
+			binary.BigEndian.PutUint32(portion, delegator.Portion)
+
+			emit([]common.Hash{delegatorElectedTopic, signer.Hash(), delegator.Delegator.Hash()}, portion)
+		}
+	}
+	if len(receipt.Logs) == 0 {
+		return nil
+	}
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+
+	return receipt
+}
+
+/*
+只做不依赖快照的检查, 结果写入入参的action
+*/
+func (self *systemContract) validate(evm *vm.EVM, caller common.Address, input []byte, value *big.Int, action *Action) error {
+
+	//snapshot.apply(...)只看tx.To(), 所以合约转调的action是无效的
+	if caller != evm.Origin {
+		return errIndirectAction
+	}
+
+	if err := action.fromBytes(input); err != nil {
+		return errInvalidAction
+	}
+
+	if action.Id == stake {
+		if value.Sign() <= 0 {
+			return errInvalidStake
+		}
+	} else if value.Sign() != 0 {
+		return errUnexpectedValue
+	}
+
+	if action.Id == reportDoubleSign {
+		if _, _, err := verifyEvidence(action.Values[0].(*types.Header), action.Values[1].(*types.Header), self.dpos.signatures); err != nil {
+			return err
+		}
+	}
+	if action.Id == reportDoublePrecommit {
+		if _, _, err := verifyPrecommitEvidence(action.Values[0].(*Precommit), action.Values[1].(*Precommit)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
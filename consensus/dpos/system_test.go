@@ -0,0 +1,322 @@
+package dpos
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// 系统合约只通过engine.recents读取父块快照, 不会用到chain
+type testChainReader struct {
+	consensus.ChainHeaderReader
+}
+
+func newTestEVM(t *testing.T, engine *Dpos, origin common.Address) (*vm.EVM, *state.StateDB) {
+	statedb, err := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	statedb.AddBalance(origin, big.NewInt(1000))
+
+	parent := newSnapshot(engine.config, engine.signatures, 0, common.HexToHash("0x01"), []common.Address{origin}, nil, nil)
+	engine.recents.Add(parent.Hash, parent)
+
+	header := &types.Header{Number: big.NewInt(1), ParentHash: parent.Hash, Difficulty: big.NewInt(1)}
+	blockCtx := vm.BlockContext{
+		CanTransfer:     core.CanTransfer,
+		Transfer:        core.Transfer,
+		SystemContracts: engine.SystemContracts(testChainReader{}, header),
+		BlockNumber:     header.Number,
+		Time:            new(big.Int),
+		Difficulty:      header.Difficulty,
+	}
+	config := &params.ChainConfig{ChainID: big.NewInt(1), Dpos: engine.config}
+
+	return vm.NewEVM(blockCtx, vm.TxContext{Origin: origin, GasPrice: new(big.Int)}, statedb, config, vm.Config{}), statedb
+}
+
+func TestSystemContract(t *testing.T) {
+	var (
+		engine = New(&params.DposConfig{SlotInterval: 1, EpochInterval: 10}, rawdb.NewMemoryDatabase())
+		sender = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		system = engine.config.SystemAddress
+	)
+	if system != defaultSystemAddress {
+		t.Fatalf("system address mismatch: have %x, want %x", system, defaultSystemAddress)
+	}
+
+	tests := []struct {
+		input    []byte
+		value    int64
+		reverted bool
+	}{
+		{[]byte{becomeCandidate}, 0, false},
+		{[]byte{stake}, 100, false},
+		{[]byte{}, 0, true},                      //没有action
+		{[]byte{0xff}, 0, true},                  //action不存在
+		{[]byte{becomeCandidate, 0x01}, 0, true}, //格式不对
+		{[]byte{becomeCandidate}, 1, true},       //只有stake可以附带value
+		{[]byte{stake}, 0, true},                 //抵押金额必须大于0
+		{append([]byte{becomeDelegator}, sender.Bytes()...), 0, false},
+	}
+	for i, tt := range tests {
+		evm, statedb := newTestEVM(t, engine, sender)
+
+		_, leftOver, err := evm.Call(vm.AccountRef(sender), system, tt.input, 100000, big.NewInt(tt.value))
+		if tt.reverted {
+			if err != vm.ErrExecutionReverted {
+				t.Errorf("test %d: error mismatch: have %v, want %v", i, err, vm.ErrExecutionReverted)
+			}
+			if logs := statedb.Logs(); len(logs) != 0 {
+				t.Errorf("test %d: reverted action left logs: %v", i, logs)
+			}
+			if balance := statedb.GetBalance(system); balance.Sign() != 0 {
+				t.Errorf("test %d: reverted action kept value: %v", i, balance)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: action failed: %v", i, err)
+			continue
+		}
+		if used := 100000 - leftOver; used != actionGas {
+			t.Errorf("test %d: gas mismatch: have %d, want %d", i, used, actionGas)
+		}
+		logs := statedb.Logs()
+		if len(logs) != 1 || logs[0].Topics[0] != actionAcceptedTopic || logs[0].Topics[1] != sender.Hash() {
+			t.Errorf("test %d: action log mismatch: %v", i, logs)
+		}
+		if balance := statedb.GetBalance(system); balance.Cmp(big.NewInt(tt.value)) != 0 {
+			t.Errorf("test %d: escrow balance mismatch: have %v, want %v", i, balance, tt.value)
+		}
+	}
+}
+
+func TestSystemContractRejection(t *testing.T) {
+	var (
+		engine    = New(&params.DposConfig{SlotInterval: 1, EpochInterval: 10}, rawdb.NewMemoryDatabase())
+		sender    = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		candidate = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+		system    = engine.config.SystemAddress
+		unstake60 = append([]byte{unstake}, common.LeftPadBytes(big.NewInt(60).Bytes(), common.HashLength)...)
+	)
+	evm, statedb := newTestEVM(t, engine, sender)
+
+	//同一个块里的action按顺序检查, 后面的action能看到前面已接受的action
+	tests := []struct {
+		input  []byte
+		value  int64
+		reason uint8 //0表示接受
+	}{
+		{append([]byte{becomeDelegator}, candidate.Bytes()...), 0, rejectUnknownCandidate},
+		{[]byte{stake}, 100, 0},
+		{unstake60, 0, 0},
+		{unstake60, 0, rejectInsufficientStake},
+		{[]byte{unjail}, 0, rejectNotJailed},
+	}
+	for i, tt := range tests {
+		statedb.Prepare(common.BigToHash(big.NewInt(int64(i))), common.Hash{}, i)
+
+		if _, _, err := evm.Call(vm.AccountRef(sender), system, tt.input, 100000, big.NewInt(tt.value)); err != nil {
+			t.Fatalf("test %d: action reverted: %v", i, err)
+		}
+		logs := statedb.GetLogs(common.BigToHash(big.NewInt(int64(i))))
+		if len(logs) != 1 {
+			t.Fatalf("test %d: log count mismatch: have %d, want 1", i, len(logs))
+		}
+		if tt.reason == 0 {
+			if logs[0].Topics[0] != actionAcceptedTopic {
+				t.Errorf("test %d: action not accepted: %s", i, logs[0].Data)
+			}
+			continue
+		}
+		if logs[0].Topics[0] != actionRejectedTopic || logs[0].Topics[3] != common.BigToHash(big.NewInt(int64(tt.reason))) {
+			t.Errorf("test %d: rejection mismatch: have %v, want reason %d", i, logs[0].Topics, tt.reason)
+		}
+	}
+	if balance := statedb.GetBalance(system); balance.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("escrow balance mismatch: have %v, want 100", balance)
+	}
+
+	//snapshot.apply(...)从接受log还原的action必须和原来的一样
+	snap := newSnapshot(engine.config, engine.signatures, 0, common.Hash{}, []common.Address{sender}, nil, nil)
+	//statedb.Logs()不保证顺序, 按log的序号重放
+	logs := statedb.Logs()
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Index < logs[j].Index })
+
+	for _, l := range logs {
+		if from, action, value, ok := acceptedAction(l, system); ok {
+			if err := snap.applyAction(from, action, value, 1); err != nil {
+				t.Errorf("failed to replay accepted action %d: %v", action.Id, err)
+			}
+		}
+	}
+	if bonded := snap.stakeOf(sender); bonded.Cmp(big.NewInt(40)) != 0 {
+		t.Errorf("replayed stake mismatch: have %v, want 40", bonded)
+	}
+}
+
+func TestEpochLogs(t *testing.T) {
+	var (
+		engine    = New(&params.DposConfig{SlotInterval: 1, EpochInterval: 10}, rawdb.NewMemoryDatabase())
+		signer    = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		delegator = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+	)
+	extra, err := (&EpochExtra{
+		Epoch:      true,
+		Signers:    []common.Address{signer},
+		Delegators: [][]ElectedDelegator{{{Delegator: delegator, Portion: uint32(portionBase)}}},
+	}).Encode()
+	if err != nil {
+		t.Fatalf("failed to encode extra: %v", err)
+	}
+
+	if receipt := engine.SystemReceipt(&types.Header{Number: big.NewInt(9), Extra: extra}, nil); receipt != nil {
+		t.Errorf("non-epoch block emitted a system receipt: %v", receipt)
+	}
+	//系统收据接在tx的收据之后
+	txReceipts := types.Receipts{{CumulativeGasUsed: 21000, Logs: []*types.Log{{}, {}}}}
+	header := &types.Header{Number: big.NewInt(20), Extra: extra}
+
+	receipt := engine.SystemReceipt(header, txReceipts)
+	if receipt == nil {
+		t.Fatalf("missing system receipt")
+	}
+	if receipt.TxHash != header.Hash() || receipt.TransactionIndex != 1 || receipt.CumulativeGasUsed != 21000 || receipt.Status != types.ReceiptStatusSuccessful {
+		t.Errorf("system receipt mismatch: %+v", receipt)
+	}
+	logs := receipt.Logs
+	if len(logs) != 2 {
+		t.Fatalf("log count mismatch: have %d, want 2", len(logs))
+	}
+	if logs[0].Topics[0] != signerElectedTopic || logs[0].Topics[1] != signer.Hash() || new(big.Int).SetBytes(logs[0].Data).Uint64() != 2 {
+		t.Errorf("signer log mismatch: %v", logs[0])
+	}
+	if logs[1].Topics[0] != delegatorElectedTopic || logs[1].Topics[2] != delegator.Hash() || !bytes.Equal(logs[1].Data, []byte{0x3b, 0x9a, 0xca, 0x00}) {
+		t.Errorf("delegator log mismatch: %v", logs[1])
+	}
+	if logs[0].Index != 2 || logs[1].Index != 3 || logs[1].TxIndex != 1 {
+		t.Errorf("log position mismatch: have %d/%d", logs[0].Index, logs[1].Index)
+	}
+	if !types.BloomLookup(receipt.Bloom, delegator.Hash()) {
+		t.Errorf("delegator missing from the receipt bloom")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var (
+		config = &params.DposConfig{SlotInterval: 1, EpochInterval: 10, SystemAddress: defaultSystemAddress, ScheduleBlock: big.NewInt(0)}
+		system = config.SystemAddress
+		a      = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		b      = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+		c      = common.HexToAddress("0x00000000000000000000000000000000000000f3")
+		d      = common.HexToAddress("0x00000000000000000000000000000000000000f4")
+	)
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+
+	snap := newSnapshot(config, nil, 0, common.Hash{}, []common.Address{a}, nil, [][]ElectedDelegator{{{Delegator: d, Portion: uint32(portionBase)}}})
+	snap.Candidates[b] = struct{}{}
+	snap.Candidates[c] = struct{}{}
+
+	writeRegistry(statedb, system, snap, true)
+	if statedb.GetNonce(system) != 1 {
+		t.Errorf("system account nonce mismatch: have %d, want 1", statedb.GetNonce(system))
+	}
+
+	//没有变化时不改动state
+	root := statedb.IntermediateRoot(true)
+	writeRegistry(statedb, system, snap.copy(), true)
+	if statedb.IntermediateRoot(true) != root {
+		t.Errorf("unchanged registry modified the state")
+	}
+
+	//删除中间的候选人, 最后一位搬到它的位置
+	snap.applyAction(a, &Action{Id: quitCandidate}, new(big.Int), 1)
+	snap.Delegators[c] = b
+	writeRegistry(statedb, system, snap, true)
+
+	candidates, delegators := readRegistry(statedb, system)
+	if len(candidates) != 2 || len(delegators) != 1 || delegators[c] != b {
+		t.Fatalf("registry mismatch: %v %v", candidates, delegators)
+	}
+	for candidate := range snap.Candidates {
+		if _, ok := candidates[candidate]; !ok {
+			t.Errorf("candidate %x missing", candidate)
+		}
+	}
+	if have := (addressSet{system, candidatesSlot}).members(statedb); have[0] != c || have[1] != b {
+		t.Errorf("candidate order mismatch: %v", have)
+	}
+	if value := statedb.GetState(system, mappingSlot(d, delegationsSlot)); value != (common.Hash{}) {
+		t.Errorf("stale delegation left: %x", value)
+	}
+}
+
+// 父块没有区块体无法重放时, 快照从块的state里的registry组装, 和重放的结果相同
+func TestStateSnapshot(t *testing.T) {
+	keys := sortedTestKeys(2)
+	chain, engine := newTestChain(t, keys, nil, 100, nil)
+	defer chain.Stop()
+
+	var (
+		staker   = common.HexToAddress("0x00000000000000000000000000000000000000f1")
+		offender = common.HexToAddress("0x00000000000000000000000000000000000000f2")
+	)
+	order := scheduledTestKeys(keys, chain.Genesis().Hash())
+	for number := 1; number <= 4; number++ {
+		insertTestBlock(t, chain, engine, order[number%len(order)])
+
+		//只在区块体里的数据: 在缓存的快照上直接加入, 之后的块会把它们写入state
+		if number == 2 {
+			head := chain.CurrentHeader()
+			snap, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+			if err != nil {
+				t.Fatalf("failed to get snapshot: %v", err)
+			}
+			snap = snap.copy()
+			snap.Stakes[staker] = big.NewInt(100)
+			snap.Unbondings = append(snap.Unbondings, &Unbonding{Delegator: staker, Amount: big.NewInt(10), Release: 200})
+			snap.Evidences[common.HexToHash("0x01")] = 1
+			snap.Offenders[offender] = 2
+			snap.Jailed[offender] = &Jail{Reason: "double sign", Number: 2, Release: 300}
+			engine.recents.Add(head.Hash(), snap)
+		}
+	}
+	//像快速同步的pivot块之前一样去掉第2块的区块体和收据, 用没有缓存的引擎读取
+	block := chain.GetBlockByNumber(2)
+	rawdb.DeleteBody(engine.db, block.Hash(), 2)
+	rawdb.DeleteReceipts(engine.db, block.Hash(), 2)
+
+	fresh := New(engine.config, engine.db)
+	head := chain.CurrentHeader()
+	snap, err := fresh.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	if snap.Light || snap.Number != 4 || snap.Seed != chain.Genesis().Hash() {
+		t.Errorf("seeded snapshot mismatch: light %v, number %d, seed %x", snap.Light, snap.Number, snap.Seed)
+	}
+	replayed, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatalf("failed to get replayed snapshot: %v", err)
+	}
+	have, _ := json.Marshal(snap)
+	want, _ := json.Marshal(replayed)
+	if !bytes.Equal(have, want) {
+		t.Errorf("seeded snapshot mismatch:\nhave %s\nwant %s", have, want)
+	}
+	if snap.Stakes[staker].Cmp(big.NewInt(100)) != 0 || len(snap.Unbondings) != 1 || snap.Jailed[offender] == nil || len(snap.Commitments) != 2 {
+		t.Errorf("seeded snapshot lost body data: %s", have)
+	}
+}
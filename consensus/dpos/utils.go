@@ -5,8 +5,7 @@ import (
 	"io"
 	"bytes"
 	_"fmt"
-	"math"
-	"encoding/binary"
+	"math/big"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -16,53 +15,29 @@ import (
 )
 
 
-func parseEpochExtra(header *types.Header) ([]common.Address, []*Proposal, [][]ElectedDelegator) {
-	extras := unserialize(header.Extra)
-	
-	//extract signer
-	signers := make([]common.Address, len(extras[1])/common.AddressLength)
-	
-	for i := 0; i < len(signers); i++ {
-		copy(signers[i][:], extras[1][i*common.AddressLength:])
-	}
-	
-	//extract proposal
-	proposalCnt := len(extras[2])/common.HashLength
-	proposals := make([]*Proposal, 0)
-	
-	for i := 0; i < proposalCnt; i++ {
-		proposal := &Proposal{}
-		proposal.fromBytes(common.BytesToHash(extras[2][i*common.HashLength:(i+1)*common.HashLength]))
-		proposals = append(proposals, proposal)
-	}
+/*
+按份额把amount分给委托人，整数运算，返回每位委托人的奖励和除不尽的余数(归签名者)
+
+份额加起来超过portionBase时(例如旧格式的创世块)，超出的部分不会被分配，保证总数不超过amount
+*/
+func delegatorRewards(amount *big.Int, delegators []ElectedDelegator) ([]*big.Int, *big.Int) {
 	
-	//extract delegator
-	portionLen := 4
-	segments := unserialize(extras[3])
+	rewards := make([]*big.Int, len(delegators))
+	remainder := new(big.Int).Set(amount)
 	
-	delegatorss := make([][]ElectedDelegator,0)
-	for _, segment := range segments {
+	for i, delegator := range delegators {
+		reward := new(big.Int).Mul(amount, new(big.Int).SetUint64(uint64(delegator.Portion)))
+		reward.Div(reward, new(big.Int).SetUint64(portionBase))
 		
-		segmentLen := common.AddressLength+portionLen
-		delegatorCnt := len(segment)/segmentLen
-		delegators := make([]ElectedDelegator,0)
-		for i :=0; i < delegatorCnt; i++ {
-			
-			delegator := segment[i*segmentLen:(i+1)*segmentLen]
-			address := common.BytesToAddress(delegator[:common.AddressLength])
-			portion := math.Float32frombits(binary.BigEndian.Uint32(delegator[common.AddressLength:]))
-			
-			delegators = append(delegators, ElectedDelegator{address, portion})
+		if reward.Cmp(remainder) > 0 {
+			reward.Set(remainder)
 		}
-		
-		delegatorss = append(delegatorss, delegators)
-			
+		remainder.Sub(remainder, reward)
+		rewards[i] = reward
 	}
 	
-	return signers, proposals, delegatorss
-	
-}	
-
+	return rewards, remainder
+}
 
 func RLP(header *types.Header) []byte {
 	b := new(bytes.Buffer)
@@ -71,80 +46,9 @@ func RLP(header *types.Header) []byte {
 	return b.Bytes()
 }
 
-func unserialize(headerExtra []byte) [][]byte {
-
-	var result [][]byte
-	
-	extra := make([]byte, len(headerExtra))
-	copy(extra, headerExtra) //new slice
-	
-	start := uint64(0)
-	limit := uint64(0)
-	
-	processLen := true
-	for start < uint64(len(extra)) {
-		if processLen {
-			if extra[start] == 0xfd {
-				limit = uint64(binary.BigEndian.Uint16(extra[start + 1:start + 3]))
-				start += 3
-			} else {
-				limit = uint64(extra[start])
-				start += 1
-			}
-
-			processLen = false
-		} else {
-			result = append(result,extra[start:start+limit])
-			
-			start += limit
-			processLen = true
-		}
-	}
-
-	return result
-}
-
-
-func VarIntToBytes(item []byte) ([]byte) {
-	
-	buf := new(bytes.Buffer)
-	prefix := make([]byte,0)
-	
-	switch {
-		case len(item) <= 0xfc:
-			binary.Write(buf, binary.BigEndian, uint8(len(item)))
-		case len(item) <= 0xffff:
-			binary.Write(buf, binary.BigEndian, uint16(len(item)))
-			prefix = append(prefix,0xfd)
-		default:
-			return []byte{}
-	}
-	
-	result := buf.Bytes()
-	
-	if len(prefix) > 0 {
-		result = append(prefix, result...)
-	}
-	
-	return result
-}
-
-func BytesToVarInt() {
-	
-}
-
 func encodeSigHeader(w io.Writer, header *types.Header) {
 	//empty signature
-	
-	extras := unserialize(header.Extra)
-	
-	headerExtra := make([]byte,0)
-	copy(extras[0][:], bytes.Repeat([]byte{0x00}, crypto.SignatureLength))
-	
-	for _, extra := range extras {
-		headerExtra = append(headerExtra, VarIntToBytes(extra)...)
-		headerExtra = append(headerExtra, extra...)
-	}
+	headerExtra := unsealedExtra(header.Extra)
 	
 	toEncode := []interface{}{
 		header.ParentHash,
@@ -189,14 +93,11 @@ func ecrecover(header *types.Header, sigcache *lru.ARCCache) (common.Address, er
 	}
 	// Retrieve the signature from the header extra-data
 	
-	if len(header.Extra) < crypto.SignatureLength {
-		return common.Address{}, errMissingSignature
-	} else if header.Extra[0] != 0x41 {
-		return common.Address{}, errMissingSignature
+	signature, err := extraSignature(header.Extra)
+	if err != nil {
+		return common.Address{}, err
 	}
 	
-	signature := header.Extra[1:crypto.SignatureLength+1]
-	
 	// Recover the public key and the Ethereum address
 	pubkey, err := crypto.Ecrecover(SealHash(header).Bytes(), signature)
 	
@@ -208,4 +109,40 @@ func ecrecover(header *types.Header, sigcache *lru.ARCCache) (common.Address, er
 
 	sigcache.Add(hash, signer)
 	return signer, nil
-}
\ No newline at end of file
+}
+
+/*
+验证双签证据: 两个块头必须同高度、内容不同(SealHash不同)、且由同一个签名者签名
+
+返回双签者和证据哈希, 证据哈希与两个块头的先后次序无关, 用作防止重复举报
+*/
+func verifyEvidence(first, second *types.Header, sigcache *lru.ARCCache) (common.Address, common.Hash, error) {
+	
+	if first.Number == nil || second.Number == nil || first.Number.Cmp(second.Number) != 0 {
+		return common.Address{}, common.Hash{}, errInvalidEvidence
+	}
+	
+	firstHash, secondHash := SealHash(first), SealHash(second)
+	if firstHash == secondHash {
+		return common.Address{}, common.Hash{}, errInvalidEvidence
+	}
+	
+	firstSigner, err := ecrecover(first, sigcache)
+	if err != nil {
+		return common.Address{}, common.Hash{}, err
+	}
+	secondSigner, err := ecrecover(second, sigcache)
+	if err != nil {
+		return common.Address{}, common.Hash{}, err
+	}
+	
+	if firstSigner != secondSigner {
+		return common.Address{}, common.Hash{}, errInvalidEvidence
+	}
+	
+	if bytes.Compare(firstHash[:], secondHash[:]) > 0 {
+		firstHash, secondHash = secondHash, firstHash
+	}
+	
+	return firstSigner, crypto.Keccak256Hash(firstHash[:], secondHash[:]), nil
+}
@@ -188,6 +188,7 @@ type BlockChain struct {
 
 	currentBlock     atomic.Value // Current head of the block chain
 	currentFastBlock atomic.Value // Current head of the fast-sync chain (may be above the block chain!)
+	currentFinalized atomic.Value // Last irreversible header of the block chain, if the engine tracks finality
 
 	stateCache    state.Database // State database to reuse between imports (contains state cache)
 	bodyCache     *lru.Cache     // Cache for the most recent block bodies
@@ -442,6 +443,9 @@ func (bc *BlockChain) loadLastState() error {
 	bc.currentBlock.Store(currentBlock)
 	headBlockGauge.Update(int64(currentBlock.NumberU64()))
 
+	// Recompute the last irreversible block, it may be lower after a rewind
+	bc.currentFinalized.Store(bc.finalizedOf(currentBlock.Header()))
+
 	// Restore the last known head header
 	currentHeader := currentBlock.Header()
 	if head := rawdb.ReadHeadHeaderHash(bc.db); head != (common.Hash{}) {
@@ -674,6 +678,14 @@ func (bc *BlockChain) CurrentFastBlock() *types.Block {
 	return bc.currentFastBlock.Load().(*types.Block)
 }
 
+// CurrentFinalizedHeader retrieves the last irreversible header of the canonical
+// chain, or nil if the consensus engine doesn't track finality or no block is
+// irreversible yet.
+func (bc *BlockChain) CurrentFinalizedHeader() *types.Header {
+	header, _ := bc.currentFinalized.Load().(*types.Header)
+	return header
+}
+
 // Validator returns the current validator.
 func (bc *BlockChain) Validator() Validator {
 	return bc.validator
@@ -799,6 +811,22 @@ func (bc *BlockChain) writeHeadBlock(block *types.Block) {
 	}
 	bc.currentBlock.Store(block)
 	headBlockGauge.Update(int64(block.NumberU64()))
+
+	// Advance the last irreversible block, it never moves back on new heads
+	if finalized := bc.finalizedOf(block.Header()); finalized != nil {
+		if current := bc.CurrentFinalizedHeader(); current == nil || finalized.Number.Cmp(current.Number) > 0 {
+			bc.currentFinalized.Store(finalized)
+		}
+	}
+}
+
+// finalizedOf returns the last irreversible block of the chain ending at the
+// given head, or nil if the consensus engine doesn't track finality.
+func (bc *BlockChain) finalizedOf(head *types.Header) *types.Header {
+	if engine, ok := bc.engine.(consensus.Finality); ok {
+		return engine.Finalized(bc, head)
+	}
+	return nil
 }
 
 // Genesis retrieves the chain's genesis block.
@@ -1920,8 +1948,14 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		把VerifySeal从VerifyHeader分离，因为调用dpos.snapshot() > snapshot.apply() > chain.GetBlock()时会触发 errMissingBody。
 
 		解决方法是让全部区块都 writeBlockWithState后，再调用dpos.snapshot()时就不会触发 errMissingBody。
+		
+		签名者不合格(未中选或近期已出块)的区块必须拒绝，不能写入链
 		*/
-		bc.engine.VerifySeal(bc, block.Header())
+		if err := bc.engine.VerifySeal(bc, block.Header()); err != nil {
+			bc.reportBlock(block, receipts, err)
+			atomic.StoreUint32(&followupInterrupt, 1)
+			return it.index, err
+		}
 		
 		proctime := time.Since(start)
 
@@ -2225,6 +2259,12 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 			return fmt.Errorf("invalid new chain")
 		}
 	}
+	// Irreversible blocks must never be reorged out
+	if finalized := bc.CurrentFinalizedHeader(); finalized != nil && commonBlock.NumberU64() < finalized.Number.Uint64() {
+		log.Warn("Refusing reorg below finalized block", "number", commonBlock.Number(), "hash", commonBlock.Hash(),
+			"finalized", finalized.Number, "drop", len(oldChain), "add", len(newChain))
+		return ErrFinalizedReorg
+	}
 	// Ensure the user sees large reorgs
 	if len(oldChain) > 0 && len(newChain) > 0 {
 		logFn := log.Info
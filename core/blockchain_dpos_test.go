@@ -0,0 +1,266 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// The dpos engine imports core, so these tests live in an external package.
+package core_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// dposTester produces DPOS blocks on a chain that skips validation, so that
+// invalid blocks can be fed into a separate, validating chain.
+type dposTester struct {
+	t       *testing.T
+	genesis *core.Genesis
+	engine  *dpos.Dpos
+	chain   *core.BlockChain
+	blocks  []*types.Block
+}
+
+func newDposTester(t *testing.T, config *params.DposConfig, signers []common.Address) *dposTester {
+	extra, err := dpos.EncodeGenesisExtra(signers, nil)
+	if err != nil {
+		t.Fatalf("failed to encode genesis extra: %v", err)
+	}
+	chainConfig := *params.AllDposProtocolChanges
+	chainConfig.Dpos = config
+
+	genesis := &core.Genesis{Config: &chainConfig, ExtraData: extra, GasLimit: params.GenesisGasLimit, Difficulty: big.NewInt(1)}
+	tester := &dposTester{t: t, genesis: genesis}
+	tester.engine, tester.chain = tester.newChain()
+
+	return tester
+}
+
+func (tester *dposTester) newChain() (*dpos.Dpos, *core.BlockChain) {
+	db := rawdb.NewMemoryDatabase()
+	tester.genesis.MustCommit(db)
+
+	engine := dpos.New(tester.genesis.Config.Dpos, db)
+	chain, err := core.NewBlockChain(db, nil, tester.genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		tester.t.Fatalf("failed to create chain: %v", err)
+	}
+	return engine, chain
+}
+
+// mine seals the next block with key. The forge callback may alter the header
+// before it is signed, and difficulty overrides the one chosen by the engine.
+func (tester *dposTester) mine(key *ecdsa.PrivateKey, difficulty *big.Int, forge func(*types.Header)) {
+	parent := tester.chain.CurrentBlock()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	tester.engine.Authorize(signer, nil)
+
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     new(big.Int).Add(parent.Number(), common.Big1),
+		GasLimit:   parent.GasLimit(),
+	}
+	if err := tester.engine.Prepare(tester.chain, header); err != nil {
+		tester.t.Fatalf("failed to prepare block #%d: %v", header.Number, err)
+	}
+	// Seal in the next slot if it is the signer's turn, otherwise wait for the
+	// timeout slot after it like an out-of-turn signer has to
+	header.Time = parent.Time() + tester.genesis.Config.Dpos.SlotInterval
+	if tester.engine.CalcDifficulty(tester.chain, header.Time, parent.Header()).Cmp(big.NewInt(2)) != 0 {
+		header.Time += tester.genesis.Config.Dpos.SlotInterval
+	}
+	if difficulty != nil {
+		header.Difficulty = difficulty
+	}
+	statedb, err := tester.chain.StateAt(parent.Root())
+	if err != nil {
+		tester.t.Fatalf("failed to load state: %v", err)
+	}
+	block, err := tester.engine.FinalizeAndAssemble(tester.chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		tester.t.Fatalf("failed to assemble block #%d: %v", header.Number, err)
+	}
+	header = block.Header()
+	if forge != nil {
+		forge(header)
+	}
+	sig, err := crypto.Sign(dpos.SealHash(header).Bytes(), key)
+	if err != nil {
+		tester.t.Fatalf("failed to sign block #%d: %v", header.Number, err)
+	}
+	copy(header.Extra[1:], sig)
+
+	block = block.WithSeal(header)
+	if _, err := tester.chain.WriteBlockWithState(block, nil, nil, statedb, true); err != nil {
+		tester.t.Fatalf("failed to write block #%d: %v", header.Number, err)
+	}
+	tester.blocks = append(tester.blocks, block)
+}
+
+// Tests that a block whose seal is only rejected against the snapshot, rather
+// than against the epoch extra, is not imported.
+func TestDposInsertUnauthorizedSigner(t *testing.T) {
+	var (
+		key, _   = crypto.GenerateKey()
+		fake, _  = crypto.GenerateKey()
+		signer   = crypto.PubkeyToAddress(key.PublicKey)
+		outsider = crypto.PubkeyToAddress(fake.PublicKey)
+		config   = &params.DposConfig{SlotInterval: 1, EpochInterval: 3, MaxSigners: 2}
+	)
+	tester := newDposTester(t, config, []common.Address{signer})
+
+	tester.mine(key, nil, nil)
+	tester.mine(key, nil, nil)
+
+	// The epoch block announces a signer that never got elected, which then
+	// signs the next block.
+	tester.mine(key, nil, func(header *types.Header) {
+		header.Extra = bytes.Replace(header.Extra, signer[:], outsider[:], 1)
+	})
+	tester.mine(fake, big.NewInt(2), nil)
+
+	_, chain := tester.newChain()
+	defer chain.Stop()
+
+	n, err := chain.InsertChain(tester.blocks)
+	if err == nil {
+		t.Fatalf("unauthorized chain imported")
+	}
+	if n != 2 {
+		t.Errorf("failed block index mismatch: have %d, want %d: %v", n, 2, err)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 2 {
+		t.Errorf("head mismatch: have #%d, want #%d", head, 2)
+	}
+}
+
+// Tests that a signer sealing again before enough other signers did is rejected.
+func TestDposInsertRecentlySigned(t *testing.T) {
+	var (
+		key1, _ = crypto.GenerateKey()
+		key2, _ = crypto.GenerateKey()
+		config  = &params.DposConfig{SlotInterval: 1, EpochInterval: 30, MaxSigners: 2}
+	)
+	tester := newDposTester(t, config, []common.Address{crypto.PubkeyToAddress(key1.PublicKey), crypto.PubkeyToAddress(key2.PublicKey)})
+
+	tester.mine(key1, nil, nil)
+	tester.mine(key1, nil, nil)
+
+	_, chain := tester.newChain()
+	defer chain.Stop()
+
+	n, err := chain.InsertChain(tester.blocks)
+	if err == nil {
+		t.Fatalf("recently signed block imported")
+	}
+	if n != 1 {
+		t.Errorf("failed block index mismatch: have %d, want %d", n, 1)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 1 {
+		t.Errorf("head mismatch: have #%d, want #%d", head, 1)
+	}
+}
+
+// Tests that the candidate registry is committed into the storage of the system
+// account, so that it follows the state root and can be proven.
+func TestDposRegistryState(t *testing.T) {
+	var (
+		key, _ = crypto.GenerateKey()
+		signer = crypto.PubkeyToAddress(key.PublicKey)
+		system = common.HexToAddress("0x0000000000000000000000000000000000001000")
+		config = &params.DposConfig{SlotInterval: 1, EpochInterval: 3, MaxSigners: 2, SystemAddress: system}
+	)
+	tester := newDposTester(t, config, []common.Address{signer})
+
+	tester.mine(key, nil, nil)
+	tester.mine(key, nil, nil)
+
+	_, chain := tester.newChain()
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(tester.blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	statedb, err := chain.State()
+	if err != nil {
+		t.Fatalf("failed to load state: %v", err)
+	}
+	// The genesis signer is the only candidate, stored at index 1
+	slot := crypto.Keccak256Hash([]byte("dpos.registry.candidates"))
+	if count := statedb.GetState(system, slot); count != common.BigToHash(common.Big1) {
+		t.Errorf("candidate count mismatch: have %x, want 1", count)
+	}
+	index := crypto.Keccak256Hash(common.LeftPadBytes(signer[:], common.HashLength), slot[:])
+	if value := statedb.GetState(system, index); value != common.BigToHash(common.Big1) {
+		t.Errorf("candidate index mismatch: have %x, want 1", value)
+	}
+	if proof, err := statedb.GetStorageProof(system, index); err != nil || len(proof) == 0 {
+		t.Errorf("failed to prove candidate: %v", err)
+	}
+}
+
+// Tests that the election logs of an epoch block are stored in a system receipt
+// after the transaction receipts and are covered by the bloom of the block.
+func TestDposSystemReceipt(t *testing.T) {
+	var (
+		key, _ = crypto.GenerateKey()
+		signer = crypto.PubkeyToAddress(key.PublicKey)
+		system = common.HexToAddress("0x0000000000000000000000000000000000001000")
+		config = &params.DposConfig{SlotInterval: 1, EpochInterval: 3, MaxSigners: 2, SystemAddress: system}
+		topic  = crypto.Keccak256Hash([]byte("DposSignerElected(address,uint64)"))
+	)
+	tester := newDposTester(t, config, []common.Address{signer})
+	for i := 0; i < 3; i++ {
+		tester.mine(key, nil, nil)
+	}
+	_, chain := tester.newChain()
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(tester.blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if receipts := chain.GetReceiptsByHash(tester.blocks[1].Hash()); len(receipts) != 0 {
+		t.Errorf("non-epoch block has receipts: %v", receipts)
+	}
+	block := tester.blocks[2]
+	receipts := chain.GetReceiptsByHash(block.Hash())
+	if len(receipts) != 1 {
+		t.Fatalf("receipt count mismatch: have %d, want 1", len(receipts))
+	}
+	receipt := receipts[0]
+	if receipt.TxHash != block.Hash() || receipt.TransactionIndex != 0 || receipt.Status != types.ReceiptStatusSuccessful {
+		t.Errorf("system receipt mismatch: %+v", receipt)
+	}
+	if len(receipt.Logs) != 1 {
+		t.Fatalf("log count mismatch: have %d, want 1", len(receipt.Logs))
+	}
+	if l := receipt.Logs[0]; l.Address != system || l.Topics[0] != topic || l.Topics[1] != signer.Hash() || l.TxHash != block.Hash() || l.Index != 0 {
+		t.Errorf("election log mismatch: %+v", l)
+	}
+	if !types.BloomLookup(block.Bloom(), topic) {
+		t.Errorf("election log missing from the block bloom")
+	}
+}
@@ -474,6 +474,63 @@ func testBadHashes(t *testing.T, full bool) {
 	}
 }
 
+// finalityEngine is a consensus engine considering blocks irreversible once a
+// fixed number of blocks were built on top of them.
+type finalityEngine struct {
+	consensus.Engine
+	depth uint64
+}
+
+func (e *finalityEngine) Finalized(chain consensus.ChainHeaderReader, head *types.Header) *types.Header {
+	if head.Number.Uint64() < e.depth {
+		return chain.GetHeaderByNumber(0)
+	}
+	header := head
+	for i := uint64(0); i < e.depth && header != nil; i++ {
+		header = chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	}
+	return header
+}
+
+// Tests that the last irreversible block follows the head, and that reorgs below
+// it are refused even if the new chain is heavier.
+func TestReorgBelowFinalized(t *testing.T) {
+	engine := &finalityEngine{Engine: ethash.NewFaker(), depth: 2}
+	_, blockchain, err := newCanonical(engine, 0, true)
+	if err != nil {
+		t.Fatalf("failed to create pristine chain: %v", err)
+	}
+	defer blockchain.Stop()
+
+	blocks := makeBlockChain(blockchain.CurrentBlock(), 10, engine, blockchain.db, canonicalSeed)
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if finalized := blockchain.CurrentFinalizedHeader(); finalized == nil || finalized.Hash() != blocks[7].Hash() {
+		t.Fatalf("finalized mismatch: have %v, want #8", finalized)
+	}
+	// A heavier fork below the finalized block must be refused
+	head := blockchain.CurrentBlock()
+	fork := makeBlockChain(blocks[4], 10, engine, blockchain.db, forkSeed)
+	if _, err := blockchain.InsertChain(fork); !errors.Is(err, ErrFinalizedReorg) {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrFinalizedReorg)
+	}
+	if blockchain.CurrentBlock().Hash() != head.Hash() {
+		t.Errorf("head reorged below finalized block: have #%d", blockchain.CurrentBlock().NumberU64())
+	}
+	// A heavier fork above it is fine and moves the finalized block along
+	fork = makeBlockChain(blocks[8], 5, engine, blockchain.db, forkSeed)
+	if _, err := blockchain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork above finalized block: %v", err)
+	}
+	if blockchain.CurrentBlock().Hash() != fork[len(fork)-1].Hash() {
+		t.Errorf("head mismatch: have #%d, want fork head", blockchain.CurrentBlock().NumberU64())
+	}
+	if finalized := blockchain.CurrentFinalizedHeader(); finalized == nil || finalized.Hash() != fork[2].Hash() {
+		t.Errorf("finalized mismatch: have %v, want #12 of the fork", finalized)
+	}
+}
+
 // Tests that bad hashes are detected on boot, and the chain rolled back to a
 // good state prior to the bad hash.
 func TestReorgBadHeaderHashes(t *testing.T) { testReorgBadHashes(t, false) }
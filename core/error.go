@@ -27,6 +27,10 @@ var (
 
 	// ErrNoGenesis is returned when there is no Genesis Block.
 	ErrNoGenesis = errors.New("genesis not found in chain")
+
+	// ErrFinalizedReorg is returned if a block to import would reorg the chain
+	// below its last irreversible block.
+	ErrFinalizedReorg = errors.New("reorg below finalized block")
 )
 
 // List of evm-call-message pre-checking errors. All state transition messages will
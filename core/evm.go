@@ -35,8 +35,9 @@ type ChainContext interface {
 	GetHeader(common.Hash, uint64) *types.Header
 }
 
-// NewEVMBlockContext creates a new context for use in the EVM.
-func NewEVMBlockContext(header *types.Header, chain ChainContext, author *common.Address) vm.BlockContext {
+// NewEVMBlockContext creates a new context for use in the EVM. It fails if the
+// consensus engine replaces the difficulty with randomness it can't provide.
+func NewEVMBlockContext(header *types.Header, chain ChainContext, author *common.Address) (vm.BlockContext, error) {
 	// If we don't have an explicit author (i.e. not mining), extract from the header
 	var beneficiary common.Address
 	if author == nil {
@@ -44,16 +45,38 @@ func NewEVMBlockContext(header *types.Header, chain ChainContext, author *common
 	} else {
 		beneficiary = *author
 	}
-	return vm.BlockContext{
-		CanTransfer: CanTransfer,
-		Transfer:    Transfer,
-		GetHash:     GetHashFn(header, chain),
-		Coinbase:    beneficiary,
-		BlockNumber: new(big.Int).Set(header.Number),
-		Time:        new(big.Int).SetUint64(header.Time),
-		Difficulty:  new(big.Int).Set(header.Difficulty),
-		GasLimit:    header.GasLimit,
+	// Collect any native contracts the consensus engine serves, and replace the
+	// difficulty with the randomness of the engine if it provides any
+	var (
+		systemContracts map[common.Address]vm.SystemContract
+		difficulty      = new(big.Int).Set(header.Difficulty)
+	)
+	if chain != nil {
+		reader, _ := chain.(consensus.ChainHeaderReader)
+		if provider, ok := chain.Engine().(consensus.SystemContractProvider); ok {
+			systemContracts = provider.SystemContracts(reader, header)
+		}
+		if beacon, ok := chain.Engine().(consensus.RandomnessBeacon); ok && reader != nil {
+			random, err := beacon.Randomness(reader, header)
+			if err != nil {
+				return vm.BlockContext{}, err
+			}
+			if random != nil {
+				difficulty = random.Big()
+			}
+		}
 	}
+	return vm.BlockContext{
+		CanTransfer:     CanTransfer,
+		Transfer:        Transfer,
+		GetHash:         GetHashFn(header, chain),
+		SystemContracts: systemContracts,
+		Coinbase:        beneficiary,
+		BlockNumber:     new(big.Int).Set(header.Number),
+		Time:            new(big.Int).SetUint64(header.Time),
+		Difficulty:      difficulty,
+		GasLimit:        header.GasLimit,
+	}, nil
 }
 
 // NewEVMTxContext creates a new transaction context for a single transaction.
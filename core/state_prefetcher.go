@@ -86,7 +86,10 @@ func precacheTransaction(config *params.ChainConfig, bc ChainContext, author *co
 		return err
 	}
 	// Create the EVM and execute the transaction
-	context := NewEVMBlockContext(header, bc, author)
+	context, err := NewEVMBlockContext(header, bc, author)
+	if err != nil {
+		return err
+	}
 	txContext := NewEVMTxContext(msg)
 	vm := vm.NewEVM(context, txContext, statedb, config, cfg)
 
@@ -294,24 +294,30 @@ func (r Receipts) GetRlp(i int) []byte {
 
 // DeriveFields fills the receipts with their computed fields based on consensus
 // data and contextual infos like containing block and transactions.
+//
+// Receipts following the ones of the transactions are system receipts emitted
+// by the consensus engine, they report the block hash as transaction hash.
 func (r Receipts) DeriveFields(config *params.ChainConfig, hash common.Hash, number uint64, txs Transactions) error {
 	signer := MakeSigner(config, new(big.Int).SetUint64(number))
 
 	logIndex := uint(0)
-	if len(txs) != len(r) {
+	if len(txs) > len(r) {
 		return errors.New("transaction and receipt count mismatch")
 	}
 	for i := 0; i < len(r); i++ {
 		// The transaction hash can be retrieved from the transaction itself
-		r[i].TxHash = txs[i].Hash()
-
+		if i < len(txs) {
+			r[i].TxHash = txs[i].Hash()
+		} else {
+			r[i].TxHash = hash
+		}
 		// block location fields
 		r[i].BlockHash = hash
 		r[i].BlockNumber = new(big.Int).SetUint64(number)
 		r[i].TransactionIndex = uint(i)
 
 		// The contract address can be derived from the transaction itself
-		if txs[i].To() == nil {
+		if i < len(txs) && txs[i].To() == nil {
 			// Deriving the signer is expensive, only do if it's actually needed
 			from, _ := Sender(signer, txs[i])
 			r[i].ContractAddress = crypto.CreateAddress(from, txs[i].Nonce())
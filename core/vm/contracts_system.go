@@ -0,0 +1,47 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SystemContract is the basic interface for native contracts served by the
+// consensus engine at a chain-configured address. Unlike precompiled contracts
+// they may inspect the caller and the transferred value and modify the state,
+// e.g. to emit logs.
+type SystemContract interface {
+	RequiredGas(input []byte) uint64                                                   // RequiredGas calculates the contract gas use
+	Run(evm *EVM, caller common.Address, input []byte, value *big.Int) ([]byte, error) // Run runs the system contract
+}
+
+// RunSystemContract runs and evaluates the output of a system contract.
+// It returns
+// - the returned bytes,
+// - the _remaining_ gas,
+// - any error that occurred
+func RunSystemContract(evm *EVM, s SystemContract, caller common.Address, input []byte, suppliedGas uint64, value *big.Int) (ret []byte, remainingGas uint64, err error) {
+	gasCost := s.RequiredGas(input)
+	if suppliedGas < gasCost {
+		return nil, 0, ErrOutOfGas
+	}
+	suppliedGas -= gasCost
+	output, err := s.Run(evm, caller, input, value)
+	return output, suppliedGas, err
+}
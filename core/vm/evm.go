@@ -101,6 +101,8 @@ type BlockContext struct {
 	Transfer TransferFunc
 	// GetHash returns the hash corresponding to n
 	GetHash GetHashFunc
+	// SystemContracts are the native contracts served by the consensus engine
+	SystemContracts map[common.Address]SystemContract
 
 	// Block information
 	Coinbase    common.Address // Provides information for COINBASE
@@ -234,9 +236,10 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	}
 	snapshot := evm.StateDB.Snapshot()
 	p, isPrecompile := evm.precompile(addr)
+	s, isSystem := evm.Context.SystemContracts[addr]
 
 	if !evm.StateDB.Exist(addr) {
-		if !isPrecompile && evm.chainRules.IsEIP158 && value.Sign() == 0 {
+		if !isPrecompile && !isSystem && evm.chainRules.IsEIP158 && value.Sign() == 0 {
 			// Calling a non existing account, don't do anything, but ping the tracer
 			if evm.vmConfig.Debug && evm.depth == 0 {
 				evm.vmConfig.Tracer.CaptureStart(caller.Address(), addr, false, input, gas, value)
@@ -256,7 +259,9 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 		}(gas, time.Now())
 	}
 
-	if isPrecompile {
+	if isSystem {
+		ret, gas, err = RunSystemContract(evm, s, caller.Address(), input, gas, value)
+	} else if isPrecompile {
 		ret, gas, err = RunPrecompiledContract(p, input, gas)
 	} else {
 		// Initialise a new contract and set the code that is to be used by the EVM.
@@ -0,0 +1,222 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package dposclient provides a client for the DPOS RPC API.
+package dposclient
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Client defines typed wrappers for the DPOS RPC API.
+type Client struct {
+	c      *rpc.Client
+	eth    *ethclient.Client
+	system common.Address
+}
+
+// Dial connects a client to the given URL.
+func Dial(rawurl string) (*Client, error) {
+	return DialContext(context.Background(), rawurl)
+}
+
+func DialContext(ctx context.Context, rawurl string) (*Client, error) {
+	c, err := rpc.DialContext(ctx, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(c), nil
+}
+
+// NewClient creates a client that uses the given RPC client. Transactions are
+// sent to the default system address, see SetSystemAddress.
+func NewClient(c *rpc.Client) *Client {
+	return &Client{c: c, eth: ethclient.NewClient(c), system: dpos.DefaultSystemAddress}
+}
+
+func (dc *Client) Close() {
+	dc.c.Close()
+}
+
+// SetSystemAddress sets the system address the actions are sent to, for chains
+// configuring a non-default one.
+func (dc *Client) SetSystemAddress(address common.Address) {
+	dc.system = address
+}
+
+// Snapshots
+
+// Snapshot returns the DPOS snapshot at the given block. The latest block is
+// used if number is nil. Snapshots served by light clients are partial.
+func (dc *Client) Snapshot(ctx context.Context, number *big.Int) (*dpos.Snapshot, error) {
+	var snap *dpos.Snapshot
+	if err := dc.c.CallContext(ctx, &snap, "dpos_getSnapshot", toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// SnapshotAtHash returns the DPOS snapshot at the given block.
+func (dc *Client) SnapshotAtHash(ctx context.Context, hash common.Hash) (*dpos.Snapshot, error) {
+	var snap *dpos.Snapshot
+	if err := dc.c.CallContext(ctx, &snap, "dpos_getSnapshotAtHash", hash); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Signers returns the signers elected for the epoch of the given block, along
+// with the ones pre-elected for the next epoch.
+func (dc *Client) Signers(ctx context.Context, number *big.Int) (*dpos.Signers, error) {
+	var signers *dpos.Signers
+	if err := dc.c.CallContext(ctx, &signers, "dpos_getSigners", toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return signers, nil
+}
+
+// Schedule returns the order in which the signers elected for the epoch of the
+// given block seal its blocks.
+func (dc *Client) Schedule(ctx context.Context, number *big.Int) (*dpos.Schedule, error) {
+	var schedule *dpos.Schedule
+	if err := dc.c.CallContext(ctx, &schedule, "dpos_getSchedule", toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// Mix returns the RANDAO mix after the given block, which the transactions of
+// the next block read through the DIFFICULTY opcode.
+func (dc *Client) Mix(ctx context.Context, number *big.Int) (common.Hash, error) {
+	var mix common.Hash
+	err := dc.c.CallContext(ctx, &mix, "dpos_getMix", toBlockNumArg(number))
+	return mix, err
+}
+
+// Jailed returns the jailed candidates at the given block.
+func (dc *Client) Jailed(ctx context.Context, number *big.Int) (map[common.Address]*dpos.Jail, error) {
+	var jailed map[common.Address]*dpos.Jail
+	if err := dc.c.CallContext(ctx, &jailed, "dpos_getJailed", toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return jailed, nil
+}
+
+// PreviewElection returns the outcome of an election held on the current head.
+func (dc *Client) PreviewElection(ctx context.Context) (*dpos.ElectionPreview, error) {
+	var preview *dpos.ElectionPreview
+	if err := dc.c.CallContext(ctx, &preview, "dpos_previewElection"); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// Candidates and delegations
+
+// Candidates returns a page of the candidates at the given block, ordered by
+// the stake delegated to them. A zero limit returns the server's page size.
+func (dc *Client) Candidates(ctx context.Context, offset, limit uint64, number *big.Int) (*dpos.CandidatePage, error) {
+	var page *dpos.CandidatePage
+	if err := dc.c.CallContext(ctx, &page, "dpos_getCandidates", offset, limit, toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Delegators returns a page of the delegators of a candidate at the given
+// block, ordered by their stake.
+func (dc *Client) Delegators(ctx context.Context, candidate common.Address, offset, limit uint64, number *big.Int) (*dpos.DelegatorPage, error) {
+	var page *dpos.DelegatorPage
+	if err := dc.c.CallContext(ctx, &page, "dpos_getDelegators", candidate, offset, limit, toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Delegation returns the candidate the given address delegates to at the given
+// block, or nil if it doesn't delegate.
+func (dc *Client) Delegation(ctx context.Context, delegator common.Address, number *big.Int) (*common.Address, error) {
+	var candidate *common.Address
+	if err := dc.c.CallContext(ctx, &candidate, "dpos_getDelegation", delegator, toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return candidate, nil
+}
+
+// Proposals
+
+// Proposals returns the proposals the node votes on when sealing.
+func (dc *Client) Proposals(ctx context.Context) (map[common.Hash]bool, error) {
+	var proposals map[common.Hash]bool
+	if err := dc.c.CallContext(ctx, &proposals, "dpos_proposals"); err != nil {
+		return nil, err
+	}
+	return proposals, nil
+}
+
+// Propose adds a proposal for the node to vote on when sealing.
+func (dc *Client) Propose(ctx context.Context, proposal common.Hash, yes bool) error {
+	return dc.c.CallContext(ctx, nil, "dpos_propose", proposal, yes)
+}
+
+// Discard drops a proposal the node votes on.
+func (dc *Client) Discard(ctx context.Context, proposal common.Hash) error {
+	return dc.c.CallContext(ctx, nil, "dpos_discard", proposal)
+}
+
+// Tally returns the stake-weighted tally of the proposals voted on so far in
+// the epoch of the given block.
+func (dc *Client) Tally(ctx context.Context, number *big.Int) (map[common.Hash]*dpos.Tally, error) {
+	var tally map[common.Hash]*dpos.Tally
+	if err := dc.c.CallContext(ctx, &tally, "dpos_getTally", toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return tally, nil
+}
+
+// Rewards
+
+// Rewards returns the block reward paid out for sealing the given block, split
+// between the signer and its elected delegators.
+func (dc *Client) Rewards(ctx context.Context, number *big.Int) (*dpos.Rewards, error) {
+	var rewards *dpos.Rewards
+	if err := dc.c.CallContext(ctx, &rewards, "dpos_getRewards", toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return rewards, nil
+}
+
+func toBlockNumArg(number *big.Int) string {
+	if number == nil {
+		return "latest"
+	}
+	pending := big.NewInt(-1)
+	if number.Cmp(pending) == 0 {
+		return "pending"
+	}
+	finalized := big.NewInt(int64(rpc.FinalizedBlockNumber))
+	if number.Cmp(finalized) == 0 {
+		return "finalized"
+	}
+	return hexutil.EncodeBig(number)
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package dposclient
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	testKey, _    = crypto.GenerateKey()
+	testSigner    = crypto.PubkeyToAddress(testKey.PublicKey)
+	testDelegator = common.HexToAddress("0x0000000000000000000000000000000000000bad")
+)
+
+// newTestChain seals a short DPOS chain with a single signer, delegated to by
+// a single delegator entitled to all delegator rewards.
+func newTestChain(t *testing.T, blocks int) (*core.BlockChain, *dpos.Dpos) {
+	extra, err := dpos.EncodeGenesisExtra([]common.Address{testSigner}, map[common.Address][]dpos.ElectedDelegator{
+		testSigner: {{Delegator: testDelegator, Portion: uint32(dpos.PortionBase)}},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode genesis extra: %v", err)
+	}
+	config := *params.AllDposProtocolChanges
+	config.Dpos = &params.DposConfig{SlotInterval: 1, EpochInterval: 3, ScheduleBlock: big.NewInt(0)}
+	genesis := &core.Genesis{Config: &config, ExtraData: extra, GasLimit: params.GenesisGasLimit, Difficulty: big.NewInt(1)}
+
+	db := rawdb.NewMemoryDatabase()
+	genesis.MustCommit(db)
+	engine := dpos.New(config.Dpos, db)
+	engine.Authorize(testSigner, nil)
+
+	chain, err := core.NewBlockChain(db, nil, &config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	for i := 0; i < blocks; i++ {
+		parent := chain.CurrentBlock()
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number(), common.Big1), GasLimit: parent.GasLimit()}
+		if err := engine.Prepare(chain, header); err != nil {
+			t.Fatalf("failed to prepare block #%d: %v", header.Number, err)
+		}
+		header.Time = parent.Time() + config.Dpos.SlotInterval
+
+		statedb, _ := chain.StateAt(parent.Root())
+		block, err := engine.FinalizeAndAssemble(chain, header, statedb, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to assemble block #%d: %v", header.Number, err)
+		}
+		header = block.Header()
+		sig, _ := crypto.Sign(dpos.SealHash(header).Bytes(), testKey)
+		copy(header.Extra[1:], sig)
+
+		if _, err := chain.InsertChain(types.Blocks{block.WithSeal(header)}); err != nil {
+			t.Fatalf("failed to insert block #%d: %v", header.Number, err)
+		}
+	}
+	return chain, engine
+}
+
+// testEthAPI is the part of the eth namespace needed to send transactions,
+// recording the transactions sent instead of executing them.
+type testEthAPI struct {
+	sent []*types.Transaction
+}
+
+func (api *testEthAPI) GetTransactionCount(address common.Address, block string) hexutil.Uint64 {
+	return hexutil.Uint64(len(api.sent))
+}
+
+func (api *testEthAPI) GasPrice() *hexutil.Big {
+	return (*hexutil.Big)(big.NewInt(params.GWei))
+}
+
+func (api *testEthAPI) EstimateGas(args map[string]interface{}) hexutil.Uint64 {
+	return hexutil.Uint64(params.TxGas + 20000)
+}
+
+func (api *testEthAPI) SendRawTransaction(encoded hexutil.Bytes) (common.Hash, error) {
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(encoded, tx); err != nil {
+		return common.Hash{}, err
+	}
+	api.sent = append(api.sent, tx)
+	return tx.Hash(), nil
+}
+
+func newTestClient(t *testing.T, chain *core.BlockChain, engine *dpos.Dpos) (*Client, *testEthAPI) {
+	server := rpc.NewServer()
+	for _, api := range engine.APIs(chain) {
+		if err := server.RegisterName(api.Namespace, api.Service); err != nil {
+			t.Fatalf("failed to register %s API: %v", api.Namespace, err)
+		}
+	}
+	eth := new(testEthAPI)
+	if err := server.RegisterName("eth", eth); err != nil {
+		t.Fatalf("failed to register eth API: %v", err)
+	}
+	return NewClient(rpc.DialInProc(server)), eth
+}
+
+func TestQueries(t *testing.T) {
+	chain, engine := newTestChain(t, 4)
+	defer chain.Stop()
+
+	client, _ := newTestClient(t, chain, engine)
+	defer client.Close()
+
+	ctx := context.Background()
+
+	snap, err := client.Snapshot(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	if snap.Number != 4 || snap.Hash != chain.CurrentHeader().Hash() {
+		t.Errorf("snapshot mismatch: have #%d %x", snap.Number, snap.Hash)
+	}
+	if _, ok := snap.ElectedSigners[testSigner]; !ok {
+		t.Errorf("signer missing from snapshot: %v", snap.ElectedSigners)
+	}
+	if snap, err := client.SnapshotAtHash(ctx, chain.GetHeaderByNumber(2).Hash()); err != nil || snap.Number != 2 {
+		t.Errorf("snapshot at hash mismatch: %v", err)
+	}
+	signers, err := client.Signers(ctx, big.NewInt(3))
+	if err != nil {
+		t.Fatalf("failed to get signers: %v", err)
+	}
+	if len(signers.Elected) != 1 || signers.Elected[0] != testSigner {
+		t.Errorf("signers mismatch: have %v, want [%x]", signers.Elected, testSigner)
+	}
+	schedule, err := client.Schedule(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to get schedule: %v", err)
+	}
+	// Block 3 is the epoch block the signers of the latest block are shuffled
+	// with, seeded by the RANDAO mix before it
+	seed, err := client.Mix(ctx, big.NewInt(2))
+	if err != nil {
+		t.Fatalf("failed to get mix: %v", err)
+	}
+	if schedule.Epoch != 3 || schedule.Seed != seed || len(schedule.Signers) != 1 || schedule.NextSlot != chain.CurrentHeader().Time+1 || schedule.Next != testSigner {
+		t.Errorf("schedule mismatch: have epoch %d seed %x signers %v next %x", schedule.Epoch, schedule.Seed, schedule.Signers, schedule.Next)
+	}
+	// The first block has no earlier commitment to reveal, later ones do
+	if mix, err := client.Mix(ctx, big.NewInt(1)); err != nil || mix != chain.Genesis().Hash() {
+		t.Errorf("mix after block #1 mismatch: have %x, want genesis hash (%v)", mix, err)
+	}
+	if mix, err := client.Mix(ctx, nil); err != nil || mix == chain.Genesis().Hash() {
+		t.Errorf("mix not updated: have %x (%v)", mix, err)
+	}
+	page, err := client.Candidates(ctx, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to get candidates: %v", err)
+	}
+	if page.Total != 1 || page.Candidates[0].Address != testSigner || !page.Candidates[0].Elected {
+		t.Errorf("candidates mismatch: have %d", page.Total)
+	}
+	delegators, err := client.Delegators(ctx, testSigner, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to get delegators: %v", err)
+	}
+	if delegators.Total != 1 || delegators.Delegators[0].Address != testDelegator {
+		t.Errorf("delegators mismatch: have %d", delegators.Total)
+	}
+	if candidate, err := client.Delegation(ctx, testDelegator, nil); err != nil || candidate == nil || *candidate != testSigner {
+		t.Errorf("delegation mismatch: have %v, %v", candidate, err)
+	}
+	if candidate, err := client.Delegation(ctx, testSigner, nil); err != nil || candidate != nil {
+		t.Errorf("unexpected delegation: have %v, %v", candidate, err)
+	}
+	// The delegator gets all delegator rewards, the signer keeps the rest
+	rewards, err := client.Rewards(ctx, big.NewInt(2))
+	if err != nil {
+		t.Fatalf("failed to get rewards: %v", err)
+	}
+	total := new(big.Int).Add(rewards.SignerReward.ToInt(), rewards.Delegators[testDelegator].ToInt())
+	if rewards.Signer != testSigner || total.Cmp(dpos.ConstantinopleBlockReward) != 0 {
+		t.Errorf("rewards mismatch: have %x %v, want %x %v", rewards.Signer, total, testSigner, dpos.ConstantinopleBlockReward)
+	}
+	if _, err := client.Rewards(ctx, common.Big0); err == nil {
+		t.Errorf("genesis rewards returned")
+	}
+	// Proposals round trip through the node
+	proposal := common.Hash{0: 2, 31: 5} // MaxSignersProposal, 5 signers
+	if err := client.Propose(ctx, proposal, true); err != nil {
+		t.Fatalf("failed to propose: %v", err)
+	}
+	if proposals, err := client.Proposals(ctx); err != nil || len(proposals) != 1 || !proposals[proposal] {
+		t.Errorf("proposals mismatch: have %v, %v", proposals, err)
+	}
+	if err := client.Discard(ctx, proposal); err != nil {
+		t.Fatalf("failed to discard: %v", err)
+	}
+	if proposals, err := client.Proposals(ctx); err != nil || len(proposals) != 0 {
+		t.Errorf("proposal not discarded: have %v, %v", proposals, err)
+	}
+	if _, err := client.Tally(ctx, nil); err != nil {
+		t.Errorf("failed to get tally: %v", err)
+	}
+	if _, err := client.Jailed(ctx, nil); err != nil {
+		t.Errorf("failed to get jailed: %v", err)
+	}
+}
+
+func TestTransact(t *testing.T) {
+	chain, engine := newTestChain(t, 0)
+	defer chain.Stop()
+
+	client, eth := newTestClient(t, chain, engine)
+	defer client.Close()
+
+	chainID := big.NewInt(1)
+	opts, _ := bind.NewKeyedTransactorWithChainID(testKey, chainID)
+
+	candidate := common.HexToAddress("0x0000000000000000000000000000000000000c0c")
+	tests := []struct {
+		send func() (*types.Transaction, error)
+		data []byte
+	}{
+		{func() (*types.Transaction, error) { return client.BecomeCandidate(opts) }, []byte{dpos.ActionBecomeCandidate}},
+		{func() (*types.Transaction, error) { return client.BecomeDelegator(opts, candidate) }, append([]byte{dpos.ActionBecomeDelegator}, candidate.Bytes()...)},
+		{func() (*types.Transaction, error) { return client.QuitCandidate(opts) }, []byte{dpos.ActionQuitCandidate}},
+		{func() (*types.Transaction, error) { return client.QuitDelegator(opts) }, []byte{dpos.ActionQuitDelegator}},
+	}
+	for i, tt := range tests {
+		tx, err := tt.send()
+		if err != nil {
+			t.Fatalf("test %d: failed to send: %v", i, err)
+		}
+		sent := eth.sent[len(eth.sent)-1]
+		if sent.Hash() != tx.Hash() {
+			t.Errorf("test %d: sent transaction mismatch", i)
+		}
+		if *sent.To() != dpos.DefaultSystemAddress || sent.Nonce() != uint64(i) || sent.Gas() != params.TxGas+20000 {
+			t.Errorf("test %d: transaction mismatch: to %x, nonce %d, gas %d", i, sent.To(), sent.Nonce(), sent.Gas())
+		}
+		if !bytes.Equal(sent.Data(), tt.data) {
+			t.Errorf("test %d: data mismatch: have %x, want %x", i, sent.Data(), tt.data)
+		}
+		if from, err := types.Sender(types.NewEIP155Signer(chainID), sent); err != nil || from != testSigner {
+			t.Errorf("test %d: sender mismatch: have %x, %v", i, from, err)
+		}
+	}
+	// Actions are validated before anything is sent
+	if _, err := client.Transact(opts, dpos.ActionBecomeDelegator); err == nil {
+		t.Errorf("delegation without candidate sent")
+	}
+	if _, err := client.Transact(opts, 0xff); err == nil {
+		t.Errorf("unknown action sent")
+	}
+	if len(eth.sent) != len(tests) {
+		t.Errorf("sent transaction count mismatch: have %d, want %d", len(eth.sent), len(tests))
+	}
+}
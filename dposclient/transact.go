@@ -0,0 +1,105 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package dposclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// BecomeCandidate sends a transaction registering opts.From as a candidate.
+func (dc *Client) BecomeCandidate(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return dc.Transact(opts, dpos.ActionBecomeCandidate)
+}
+
+// BecomeDelegator sends a transaction delegating the stake of opts.From to the
+// given candidate.
+func (dc *Client) BecomeDelegator(opts *bind.TransactOpts, candidate common.Address) (*types.Transaction, error) {
+	return dc.Transact(opts, dpos.ActionBecomeDelegator, candidate)
+}
+
+// QuitCandidate sends a transaction withdrawing opts.From as a candidate.
+func (dc *Client) QuitCandidate(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return dc.Transact(opts, dpos.ActionQuitCandidate)
+}
+
+// QuitDelegator sends a transaction withdrawing the delegation of opts.From.
+func (dc *Client) QuitDelegator(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return dc.Transact(opts, dpos.ActionQuitDelegator)
+}
+
+// Transact encodes the given action, then builds, signs and sends a transaction
+// carrying it to the system address. Missing nonce, gas price and gas limit are
+// filled in the same way as for bound contracts.
+func (dc *Client) Transact(opts *bind.TransactOpts, action uint8, values ...interface{}) (*types.Transaction, error) {
+	data, err := dpos.EncodeAction(action, values...)
+	if err != nil {
+		return nil, err
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.TODO()
+	}
+	value := opts.Value
+	if value == nil {
+		value = new(big.Int)
+	}
+	var nonce uint64
+	if opts.Nonce == nil {
+		nonce, err = dc.eth.PendingNonceAt(ctx, opts.From)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve account nonce: %v", err)
+		}
+	} else {
+		nonce = opts.Nonce.Uint64()
+	}
+	gasPrice := opts.GasPrice
+	if gasPrice == nil {
+		gasPrice, err = dc.eth.SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to suggest gas price: %v", err)
+		}
+	}
+	// The system contract is native, so there is no code to check for
+	gasLimit := opts.GasLimit
+	if gasLimit == 0 {
+		msg := ethereum.CallMsg{From: opts.From, To: &dc.system, GasPrice: gasPrice, Value: value, Data: data}
+		gasLimit, err = dc.eth.EstimateGas(ctx, msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to estimate gas needed: %v", err)
+		}
+	}
+	if opts.Signer == nil {
+		return nil, errors.New("no signer to authorize the transaction with")
+	}
+	tx, err := opts.Signer(opts.From, types.NewTransaction(nonce, dc.system, value, gasLimit, gasPrice, data))
+	if err != nil {
+		return nil, err
+	}
+	if err := dc.eth.SendTransaction(ctx, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
@@ -203,9 +203,14 @@ func (api *PrivateDebugAPI) traceChain(ctx context.Context, start, end *types.Bl
 			// Fetch and execute the next block trace tasks
 			for task := range tasks {
 				signer := types.MakeSigner(api.eth.blockchain.Config(), task.block.Number())
-				blockCtx := core.NewEVMBlockContext(task.block.Header(), api.eth.blockchain, nil)
+				blockCtx, ctxErr := core.NewEVMBlockContext(task.block.Header(), api.eth.blockchain, nil)
 				// Trace all the transactions contained within
 				for i, tx := range task.block.Transactions() {
+					if ctxErr != nil {
+						task.results[i] = &txTraceResult{Error: ctxErr.Error()}
+						log.Warn("Tracing failed", "block", task.block.NumberU64(), "err", ctxErr)
+						break
+					}
 					msg, _ := tx.AsMessage(signer)
 					res, err := api.traceTx(ctx, msg, blockCtx, task.statedb, config)
 					if err != nil {
@@ -471,7 +476,10 @@ func (api *PrivateDebugAPI) traceBlock(ctx context.Context, block *types.Block,
 	if threads > len(txs) {
 		threads = len(txs)
 	}
-	blockCtx := core.NewEVMBlockContext(block.Header(), api.eth.blockchain, nil)
+	blockCtx, err := core.NewEVMBlockContext(block.Header(), api.eth.blockchain, nil)
+	if err != nil {
+		return nil, err
+	}
 	for th := 0; th < threads; th++ {
 		pend.Add(1)
 		go func() {
@@ -559,9 +567,12 @@ func (api *PrivateDebugAPI) standardTraceBlockToFile(ctx context.Context, block
 		signer      = types.MakeSigner(api.eth.blockchain.Config(), block.Number())
 		dumps       []string
 		chainConfig = api.eth.blockchain.Config()
-		vmctx       = core.NewEVMBlockContext(block.Header(), api.eth.blockchain, nil)
 		canon       = true
 	)
+	vmctx, err := core.NewEVMBlockContext(block.Header(), api.eth.blockchain, nil)
+	if err != nil {
+		return nil, err
+	}
 	// Check if there are any overrides: the caller may wish to enable a future
 	// fork when executing this block. Note, such overrides are only applicable to the
 	// actual specified block, not any preceding blocks that we have to go through
@@ -770,7 +781,10 @@ func (api *PrivateDebugAPI) TraceCall(ctx context.Context, args ethapi.CallArgs,
 
 	// Execute the trace
 	msg := args.ToMessage(api.eth.APIBackend.RPCGasCap())
-	vmctx := core.NewEVMBlockContext(header, api.eth.blockchain, nil)
+	vmctx, err := core.NewEVMBlockContext(header, api.eth.blockchain, nil)
+	if err != nil {
+		return nil, err
+	}
 	return api.traceTx(ctx, msg, vmctx, statedb, config)
 }
 
@@ -864,7 +878,10 @@ func (api *PrivateDebugAPI) computeTxEnv(block *types.Block, txIndex int, reexec
 		// Assemble the transaction call message and return if the requested offset
 		msg, _ := tx.AsMessage(signer)
 		txContext := core.NewEVMTxContext(msg)
-		context := core.NewEVMBlockContext(block.Header(), api.eth.blockchain, nil)
+		context, err := core.NewEVMBlockContext(block.Header(), api.eth.blockchain, nil)
+		if err != nil {
+			return nil, vm.BlockContext{}, nil, err
+		}
 		if idx == txIndex {
 			return msg, context, statedb, nil
 		}
@@ -63,6 +63,7 @@ type Ethereum struct {
 	blockchain      *core.BlockChain
 	protocolManager *ProtocolManager
 	dialCandidates  enode.Iterator
+	precommits      *dpos.PrecommitHandler // Precommit vote gossip, only on DPOS chains
 
 	// DB interfaces
 	chainDb ethdb.Database // Block chain database
@@ -177,6 +178,9 @@ func New(stack *node.Node, config *Config) (*Ethereum, error) {
 	if err != nil {
 		return nil, err
 	}
+	if engine, ok := eth.engine.(*dpos.Dpos); ok {
+		eth.precommits = dpos.NewPrecommitHandler(engine, eth.blockchain)
+	}
 	// Rewind the chain in case of an incompatible config upgrade.
 	if compat, ok := genesisErr.(*params.ConfigCompatError); ok {
 		log.Warn("Rewinding chain to upgrade configuration", "err", compat)
@@ -536,6 +540,9 @@ func (s *Ethereum) Protocols() []p2p.Protocol {
 		protos[i].Attributes = []enr.Entry{s.currentEthEntry()}
 		protos[i].DialCandidates = s.dialCandidates
 	}
+	if s.precommits != nil {
+		protos = append(protos, s.precommits.Protocols()...)
+	}
 	return protos
 }
 
@@ -557,6 +564,9 @@ func (s *Ethereum) Start() error {
 	}
 	// Start the networking layer and the light server if requested
 	s.protocolManager.Start(maxPeers)
+	if s.precommits != nil {
+		s.precommits.Start()
+	}
 	return nil
 }
 
@@ -565,6 +575,9 @@ func (s *Ethereum) Start() error {
 func (s *Ethereum) Stop() error {
 	// Stop all the peer-related stuff first.
 	s.protocolManager.Stop()
+	if s.precommits != nil {
+		s.precommits.Stop()
+	}
 
 	// Then stop everything else.
 	s.bloomIndexer.Close()
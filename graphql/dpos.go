@@ -0,0 +1,340 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package graphql
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/internal/ethapi"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var errNotDpos = errors.New("chain is not using the DPOS engine")
+
+// chainReader adapts the backend to the chain reader needed by the DPOS API.
+// Snapshots missing from the engine's cache are rebuilt from the block bodies.
+type chainReader struct {
+	backend ethapi.Backend
+}
+
+func (c *chainReader) Config() *params.ChainConfig {
+	return c.backend.ChainConfig()
+}
+
+func (c *chainReader) CurrentHeader() *types.Header {
+	return c.backend.CurrentHeader()
+}
+
+func (c *chainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	header, _ := c.backend.HeaderByHash(context.Background(), hash)
+	if header == nil || header.Number.Uint64() != number {
+		return nil
+	}
+	return header
+}
+
+func (c *chainReader) GetHeaderByNumber(number uint64) *types.Header {
+	header, _ := c.backend.HeaderByNumber(context.Background(), rpc.BlockNumber(number))
+	return header
+}
+
+func (c *chainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	header, _ := c.backend.HeaderByHash(context.Background(), hash)
+	return header
+}
+
+func (c *chainReader) GetBlock(hash common.Hash, number uint64) *types.Block {
+	block, _ := c.backend.BlockByHash(context.Background(), hash)
+	if block == nil || block.NumberU64() != number {
+		return nil
+	}
+	return block
+}
+
+// dposAPI returns the DPOS API over the backend's chain, or an error if the
+// chain runs another consensus engine.
+func dposAPI(backend ethapi.Backend) (*dpos.API, error) {
+	engine, ok := backend.Engine().(*dpos.Dpos)
+	if !ok {
+		return nil, errNotDpos
+	}
+	return dpos.NewAPI(&chainReader{backend}, engine), nil
+}
+
+// DposBlock is the DPOS consensus data of a block.
+type DposBlock struct {
+	backend ethapi.Backend
+	info    *dpos.BlockInfo
+}
+
+// Dpos returns the DPOS consensus data of the block, or nil on chains running
+// another consensus engine.
+func (b *Block) Dpos(ctx context.Context) (*DposBlock, error) {
+	engine, ok := b.backend.Engine().(*dpos.Dpos)
+	if !ok {
+		return nil, nil
+	}
+	header, err := b.resolveHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := engine.BlockInfo(header)
+	if err != nil {
+		return nil, err
+	}
+	return &DposBlock{backend: b.backend, info: info}, nil
+}
+
+func (b *DposBlock) Signer(ctx context.Context, args BlockNumberArgs) *Account {
+	return &Account{
+		backend:       b.backend,
+		address:       b.info.Signer,
+		blockNrOrHash: args.NumberOrLatest(),
+	}
+}
+
+func (b *DposBlock) InTurn(ctx context.Context) bool {
+	return b.info.InTurn
+}
+
+func (b *DposBlock) Vote(ctx context.Context) *DposVote {
+	if b.info.Proposal == (common.Hash{}) {
+		return nil
+	}
+	return &DposVote{proposal: b.info.Proposal, yes: b.info.Yes}
+}
+
+func (b *DposBlock) Epoch(ctx context.Context) *DposEpoch {
+	if b.info.Epoch == nil {
+		return nil
+	}
+	return &DposEpoch{extra: b.info.Epoch}
+}
+
+// DposVote is a proposal vote cast by the signer of a block.
+type DposVote struct {
+	proposal common.Hash
+	yes      bool
+}
+
+func (v *DposVote) Proposal(ctx context.Context) common.Hash {
+	return v.proposal
+}
+
+func (v *DposVote) Yes(ctx context.Context) bool {
+	return v.yes
+}
+
+// DposEpoch is the election result recorded in an epoch block.
+type DposEpoch struct {
+	extra *dpos.EpochExtra
+}
+
+func (e *DposEpoch) Signers(ctx context.Context) []common.Address {
+	return e.extra.Signers
+}
+
+func (e *DposEpoch) Delegators(ctx context.Context) []*DposElectedDelegator {
+	delegators := []*DposElectedDelegator{}
+	for i, list := range e.extra.Delegators {
+		for _, delegator := range list {
+			delegators = append(delegators, &DposElectedDelegator{signer: e.extra.Signers[i], delegator: delegator})
+		}
+	}
+	return delegators
+}
+
+func (e *DposEpoch) Proposals(ctx context.Context) []common.Hash {
+	return e.extra.ProposalHashes()
+}
+
+// DposElectedDelegator is a delegator elected for a signer.
+type DposElectedDelegator struct {
+	signer    common.Address
+	delegator dpos.ElectedDelegator
+}
+
+func (d *DposElectedDelegator) Signer(ctx context.Context) common.Address {
+	return d.signer
+}
+
+func (d *DposElectedDelegator) Delegator(ctx context.Context) common.Address {
+	return d.delegator.Delegator
+}
+
+func (d *DposElectedDelegator) Portion(ctx context.Context) hexutil.Uint64 {
+	return hexutil.Uint64(d.delegator.Portion)
+}
+
+// DposCandidatePage is a page of candidates out of the total number.
+type DposCandidatePage struct {
+	page *dpos.CandidatePage
+}
+
+func (p *DposCandidatePage) Total(ctx context.Context) hexutil.Uint64 {
+	return hexutil.Uint64(p.page.Total)
+}
+
+func (p *DposCandidatePage) Candidates(ctx context.Context) []*DposCandidate {
+	candidates := make([]*DposCandidate, len(p.page.Candidates))
+	for i, candidate := range p.page.Candidates {
+		candidates[i] = &DposCandidate{candidate}
+	}
+	return candidates
+}
+
+// DposCandidate is a candidate along with the stake delegated to it.
+type DposCandidate struct {
+	info *dpos.CandidateInfo
+}
+
+func (c *DposCandidate) Address(ctx context.Context) common.Address {
+	return c.info.Address
+}
+
+func (c *DposCandidate) SelfStake(ctx context.Context) hexutil.Big {
+	return *c.info.SelfStake
+}
+
+func (c *DposCandidate) Weight(ctx context.Context) hexutil.Big {
+	return *c.info.Weight
+}
+
+func (c *DposCandidate) Delegators(ctx context.Context) hexutil.Uint64 {
+	return hexutil.Uint64(c.info.Delegators)
+}
+
+func (c *DposCandidate) Elected(ctx context.Context) bool {
+	return c.info.Elected
+}
+
+func (c *DposCandidate) Jailed(ctx context.Context) bool {
+	return c.info.Jailed
+}
+
+// DposDelegatorPage is a page of delegators out of the total number.
+type DposDelegatorPage struct {
+	page *dpos.DelegatorPage
+}
+
+func (p *DposDelegatorPage) Total(ctx context.Context) hexutil.Uint64 {
+	return hexutil.Uint64(p.page.Total)
+}
+
+func (p *DposDelegatorPage) Delegators(ctx context.Context) []*DposDelegator {
+	delegators := make([]*DposDelegator, len(p.page.Delegators))
+	for i, delegator := range p.page.Delegators {
+		delegators[i] = &DposDelegator{delegator}
+	}
+	return delegators
+}
+
+// DposDelegator is a delegator along with its stake.
+type DposDelegator struct {
+	info *dpos.DelegatorInfo
+}
+
+func (d *DposDelegator) Address(ctx context.Context) common.Address {
+	return d.info.Address
+}
+
+func (d *DposDelegator) Stake(ctx context.Context) hexutil.Big {
+	return *d.info.Stake
+}
+
+// dposBlockNumber converts an optional block argument to the block number
+// taken by the DPOS API, the latest block if none was provided.
+func dposBlockNumber(block *hexutil.Uint64) *rpc.BlockNumber {
+	number := rpc.LatestBlockNumber
+	if block != nil {
+		number = rpc.BlockNumber(*block)
+	}
+	return &number
+}
+
+func (r *Resolver) Candidates(ctx context.Context, args struct {
+	Block  *hexutil.Uint64
+	Offset *hexutil.Uint64
+	Limit  *hexutil.Uint64
+}) (*DposCandidatePage, error) {
+	api, err := dposAPI(r.backend)
+	if err != nil {
+		return nil, err
+	}
+	var offset, limit uint64
+	if args.Offset != nil {
+		offset = uint64(*args.Offset)
+	}
+	if args.Limit != nil {
+		limit = uint64(*args.Limit)
+	}
+	page, err := api.GetCandidates(ctx, offset, limit, dposBlockNumber(args.Block))
+	if err != nil {
+		return nil, err
+	}
+	return &DposCandidatePage{page}, nil
+}
+
+func (r *Resolver) Delegators(ctx context.Context, args struct {
+	Candidate common.Address
+	Block     *hexutil.Uint64
+	Offset    *hexutil.Uint64
+	Limit     *hexutil.Uint64
+}) (*DposDelegatorPage, error) {
+	api, err := dposAPI(r.backend)
+	if err != nil {
+		return nil, err
+	}
+	var offset, limit uint64
+	if args.Offset != nil {
+		offset = uint64(*args.Offset)
+	}
+	if args.Limit != nil {
+		limit = uint64(*args.Limit)
+	}
+	page, err := api.GetDelegators(ctx, args.Candidate, offset, limit, dposBlockNumber(args.Block))
+	if err != nil {
+		return nil, err
+	}
+	return &DposDelegatorPage{page}, nil
+}
+
+func (r *Resolver) Delegation(ctx context.Context, args struct {
+	Delegator common.Address
+	Block     *hexutil.Uint64
+}) (*Account, error) {
+	api, err := dposAPI(r.backend)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := api.GetDelegation(ctx, args.Delegator, dposBlockNumber(args.Block))
+	if err != nil || candidate == nil {
+		return nil, err
+	}
+	blockNrOrHash := rpc.BlockNumberOrHashWithNumber(*dposBlockNumber(args.Block))
+	return &Account{
+		backend:       r.backend,
+		address:       *candidate,
+		blockNrOrHash: blockNrOrHash,
+	}, nil
+}
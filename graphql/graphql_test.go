@@ -17,19 +17,25 @@
 package graphql
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/miner"
 	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -122,6 +128,117 @@ func TestGraphQL_BadRequest(t *testing.T) {
 	assert.Equal(t, 400, resp.StatusCode)
 }
 
+// Tests that the DPOS consensus data of blocks and the candidate registry can
+// be queried on a DPOS chain.
+func TestGraphQLDpos(t *testing.T) {
+	stack := createNode(t, false)
+	defer stack.Close()
+
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	delegator := common.HexToAddress("0x0000000000000000000000000000000000000bad")
+
+	extra, err := dpos.EncodeGenesisExtra([]common.Address{signer}, map[common.Address][]dpos.ElectedDelegator{
+		signer: {{Delegator: delegator, Portion: uint32(dpos.PortionBase)}},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode genesis extra: %v", err)
+	}
+	config := *params.AllDposProtocolChanges
+	config.Dpos = &params.DposConfig{SlotInterval: 1, EpochInterval: 3, ScheduleBlock: big.NewInt(0)}
+
+	ethBackend, err := eth.New(stack, &eth.Config{
+		Genesis:        &core.Genesis{Config: &config, ExtraData: extra, GasLimit: params.GenesisGasLimit, Difficulty: big.NewInt(1)},
+		NetworkId:      1337,
+		TrieCleanCache: 5,
+		TrieDirtyCache: 5,
+		TrieTimeout:    60 * time.Minute,
+		SnapshotCache:  5,
+	})
+	if err != nil {
+		t.Fatalf("could not create eth backend: %v", err)
+	}
+	if err := New(stack, ethBackend.APIBackend, []string{}, []string{}); err != nil {
+		t.Fatalf("could not create graphql service: %v", err)
+	}
+	// Seal a few blocks, the third one opening the next epoch
+	var (
+		chain  = ethBackend.BlockChain()
+		engine = ethBackend.Engine().(*dpos.Dpos)
+	)
+	engine.Authorize(signer, nil)
+	for i := 0; i < 3; i++ {
+		parent := chain.CurrentBlock()
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number(), common.Big1), GasLimit: parent.GasLimit()}
+		if err := engine.Prepare(chain, header); err != nil {
+			t.Fatalf("failed to prepare block #%d: %v", header.Number, err)
+		}
+		header.Time = parent.Time() + config.Dpos.SlotInterval
+
+		statedb, _ := chain.StateAt(parent.Root())
+		block, err := engine.FinalizeAndAssemble(chain, header, statedb, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to assemble block #%d: %v", header.Number, err)
+		}
+		header = block.Header()
+		sig, _ := crypto.Sign(dpos.SealHash(header).Bytes(), key)
+		copy(header.Extra[1:], sig)
+
+		if _, err := chain.InsertChain(types.Blocks{block.WithSeal(header)}); err != nil {
+			t.Fatalf("failed to insert block #%d: %v", header.Number, err)
+		}
+	}
+	if err := stack.Start(); err != nil {
+		t.Fatalf("could not start node: %v", err)
+	}
+	query := func(q string) string {
+		body := strings.NewReader(fmt.Sprintf(`{"query": %q,"variables": null}`, q))
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/graphql", "127.0.0.1:9393"), body)
+		if err != nil {
+			t.Fatal("could not issue new http request ", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := doHTTPRequest(t, req)
+		defer resp.Body.Close()
+
+		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read from response body: %v", err)
+		}
+		return string(bodyBytes)
+	}
+	signerHex, delegatorHex := strings.ToLower(signer.Hex()), strings.ToLower(delegator.Hex())
+
+	// A plain block carries the signer only, the epoch block the election
+	have := query("{block(number: 2){miner{address} dpos{signer{address} inTurn vote{yes} epoch{signers}}}}")
+	want := fmt.Sprintf(`{"data":{"block":{"miner":{"address":"0x0000000000000000000000000000000000000000"},"dpos":{"signer":{"address":"%s"},"inTurn":true,"vote":null,"epoch":null}}}}`, signerHex)
+	assert.Equal(t, want, have)
+
+	have = query("{block(number: 3){dpos{signer{address} epoch{signers delegators{signer delegator portion} proposals}}}}")
+	want = fmt.Sprintf(`{"data":{"block":{"dpos":{"signer":{"address":"%s"},"epoch":{"signers":["%s"],"delegators":[],"proposals":[]}}}}}`, signerHex, signerHex)
+	assert.Equal(t, want, have)
+
+	have = query("{block(number: 0){dpos{signer{address} epoch{delegators{signer delegator portion}}}}}")
+	want = fmt.Sprintf(`{"data":{"block":{"dpos":{"signer":{"address":"0x0000000000000000000000000000000000000000"},"epoch":{"delegators":[{"signer":"%s","delegator":"%s","portion":"0x3b9aca00"}]}}}}}`, signerHex, delegatorHex)
+	assert.Equal(t, want, have)
+
+	// The registry is queried at the latest block by default
+	have = query("{candidates{total candidates{address elected}}}")
+	want = fmt.Sprintf(`{"data":{"candidates":{"total":"0x1","candidates":[{"address":"%s","elected":true}]}}}`, signerHex)
+	assert.Equal(t, want, have)
+
+	have = query(fmt.Sprintf(`{delegators(candidate: "%s", block: 2){total delegators{address}} delegation(delegator: "%s"){address}}`, signerHex, delegatorHex))
+	want = fmt.Sprintf(`{"data":{"delegators":{"total":"0x1","delegators":[{"address":"%s"}]},"delegation":{"address":"%s"}}}`, delegatorHex, signerHex)
+	assert.Equal(t, want, have)
+
+	// A reopened engine has no cached snapshots and replays the blocks through the backend
+	reopened := dpos.NewAPI(&chainReader{ethBackend.APIBackend}, dpos.New(config.Dpos, ethBackend.ChainDb()))
+	if page, err := reopened.GetCandidates(context.Background(), 0, 10, nil); err != nil || page.Total != 1 {
+		t.Errorf("reopened engine candidates mismatch: have %v, %v", page, err)
+	}
+}
+
 func createNode(t *testing.T, gqlEnabled bool) *node.Node {
 	stack, err := node.New(&node.Config{
 		HTTPHost: "127.0.0.1",
@@ -172,7 +289,8 @@ func createGQLService(t *testing.T, stack *node.Node, endpoint string) {
 }
 
 func doHTTPRequest(t *testing.T, req *http.Request) *http.Response {
-	client := &http.Client{}
+	// Every test restarts the server on the same port, don't reuse connections
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
 	resp, err := client.Do(req)
 	if err != nil {
 		t.Fatal("could not issue a GET request to the given endpoint", err)
@@ -209,6 +209,84 @@ const schema string = `
         # EstimateGas estimates the amount of gas that will be required for
         # successful execution of a transaction at the current block's state.
         estimateGas(data: CallData!): Long!
+        # Dpos is the DPOS consensus data of this block. Miner is always the
+        # zero address on DPOS chains, the signer is recovered from the seal
+        # instead. This field is null on chains running another engine.
+        dpos: DposBlock
+    }
+
+    # DposBlock is the DPOS consensus data carried by a block header.
+    type DposBlock {
+        # Signer is the account that sealed this block, recovered from its
+        # signature. It is the zero address for the genesis block.
+        signer(block: Long): Account!
+        # InTurn is true if the block was sealed by the signer whose turn it was.
+        inTurn: Boolean!
+        # Vote is the proposal vote cast by the signer in MixHash and Nonce,
+        # null if the signer didn't vote.
+        vote: DposVote
+        # Epoch is the election result recorded in the extra-data of epoch
+        # blocks and the genesis block, null for other blocks.
+        epoch: DposEpoch
+    }
+
+    # DposVote is a proposal vote cast by the signer of a block.
+    type DposVote {
+        # Proposal is the 32 byte proposal, its first byte is the proposal ID.
+        proposal: Bytes32!
+        # Yes is true for a vote in favour, false for withdrawing one.
+        yes: Boolean!
+    }
+
+    # DposEpoch is the election result recorded in an epoch block.
+    type DposEpoch {
+        # Signers are the signers elected for the epoch, in address order.
+        signers: [Address!]!
+        # Delegators are the delegators elected for each signer.
+        delegators: [DposElectedDelegator!]!
+        # Proposals are the proposals confirmed so far, in force from this epoch.
+        proposals: [Bytes32!]!
+    }
+
+    # DposElectedDelegator is a delegator elected for a signer.
+    type DposElectedDelegator {
+        signer: Address!
+        delegator: Address!
+        # Portion is the share of the signer's delegator rewards, in billionths.
+        portion: Long!
+    }
+
+    # DposCandidate is a candidate along with the stake delegated to it.
+    type DposCandidate {
+        address: Address!
+        # SelfStake is the stake bonded by the candidate itself, in wei.
+        selfStake: BigInt!
+        # Weight is the total stake of the candidate's delegators, in wei.
+        weight: BigInt!
+        # Delegators is the number of delegators of the candidate.
+        delegators: Long!
+        # Elected is true if the candidate is a signer of the current epoch.
+        elected: Boolean!
+        jailed: Boolean!
+    }
+
+    # DposCandidatePage is a page of candidates out of the total number.
+    type DposCandidatePage {
+        total: Long!
+        candidates: [DposCandidate!]!
+    }
+
+    # DposDelegator is a delegator along with its stake.
+    type DposDelegator {
+        address: Address!
+        # Stake is the stake bonded by the delegator, in wei.
+        stake: BigInt!
+    }
+
+    # DposDelegatorPage is a page of delegators out of the total number.
+    type DposDelegatorPage {
+        total: Long!
+        delegators: [DposDelegator!]!
     }
 
     # CallData represents the data associated with a local contract call.
@@ -316,6 +394,16 @@ const schema string = `
         syncing: SyncState
         # ChainID returns the current chain ID for transaction replay protection.
         chainID: BigInt!
+        # Candidates returns a page of the DPOS candidates at a block, ordered
+        # by the stake delegated to them. If block is not supplied, it defaults
+        # to the most recent known block. Pages hold at most 100 candidates.
+        candidates(block: Long, offset: Long, limit: Long): DposCandidatePage!
+        # Delegators returns a page of the delegators of a DPOS candidate at a
+        # block, ordered by their stake.
+        delegators(candidate: Address!, block: Long, offset: Long, limit: Long): DposDelegatorPage!
+        # Delegation returns the DPOS candidate an account delegates to at a
+        # block, or null if it doesn't delegate.
+        delegation(delegator: Address!, block: Long): Account
     }
 
     type Mutation {
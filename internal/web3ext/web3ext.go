@@ -94,6 +94,64 @@ web3._extend({
 			call: 'dpos_getSignersAtHash',
 			params: 1
 		}),
+		new web3._extend.Method({
+			name: 'getSchedule',
+			call: 'dpos_getSchedule',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getMix',
+			call: 'dpos_getMix',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getCandidates',
+			call: 'dpos_getCandidates',
+			params: 3,
+			inputFormatter: [null, null, web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getDelegators',
+			call: 'dpos_getDelegators',
+			params: 4,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, null, null, web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getDelegation',
+			call: 'dpos_getDelegation',
+			params: 2,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'previewElection',
+			call: 'dpos_previewElection',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'getPrecommitEvidences',
+			call: 'dpos_getPrecommitEvidences',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'getJailed',
+			call: 'dpos_getJailed',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getRewards',
+			call: 'dpos_getRewards',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getTally',
+			call: 'dpos_getTally',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
 		new web3._extend.Method({
 			name: 'propose',
 			call: 'dpos_propose',
@@ -114,11 +172,6 @@ web3._extend({
 			call: 'dpos_version',
 			params: 0
 		}),
-		new web3._extend.Method({
-			name: 'test',
-			call: 'dpos_test',
-			params: 1
-		}),
 	],
 	properties: [
 		new web3._extend.Property({
@@ -62,6 +62,13 @@ func (b *LesApiBackend) HeaderByNumber(ctx context.Context, number rpc.BlockNumb
 	if number == rpc.LatestBlockNumber || number == rpc.PendingBlockNumber {
 		return b.eth.blockchain.CurrentHeader(), nil
 	}
+	if number == rpc.FinalizedBlockNumber {
+		// Light clients don't track finality, derive it from the current head
+		if engine, ok := b.eth.engine.(consensus.Finality); ok {
+			return engine.Finalized(b.eth.blockchain, b.eth.blockchain.CurrentHeader()), nil
+		}
+		return nil, nil
+	}
 	return b.eth.blockchain.GetHeaderByNumberOdr(ctx, uint64(number))
 }
 
@@ -172,7 +179,10 @@ func (b *LesApiBackend) GetTd(ctx context.Context, hash common.Hash) *big.Int {
 
 func (b *LesApiBackend) GetEVM(ctx context.Context, msg core.Message, state *state.StateDB, header *types.Header) (*vm.EVM, func() error, error) {
 	txContext := core.NewEVMTxContext(msg)
-	context := core.NewEVMBlockContext(header, b.eth.blockchain, nil)
+	context, err := core.NewEVMBlockContext(header, b.eth.blockchain, nil)
+	if err != nil {
+		return nil, state.Error, err
+	}
 	return vm.NewEVM(context, txContext, state, b.eth.chainConfig, vm.Config{}), state.Error, nil
 }
 
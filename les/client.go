@@ -18,6 +18,7 @@
 package les
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -26,6 +27,7 @@ import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/bloombits"
 	"github.com/ethereum/go-ethereum/core/rawdb"
@@ -128,6 +130,13 @@ func New(stack *node.Node, config *eth.Config) (*LightEthereum, error) {
 	leth.bloomTrieIndexer = light.NewBloomTrieIndexer(chainDb, leth.odr, params.BloomBitsBlocksClient, params.BloomTrieFrequency, config.LightNoPrune)
 	leth.odr.SetIndexers(leth.chtIndexer, leth.bloomTrieIndexer, leth.bloomIndexer)
 
+	// DPOS snapshots can't be rebuilt without block bodies, retrieve them instead
+	if engine, ok := leth.engine.(*dpos.Dpos); ok {
+		engine.SetEpochRetriever(func(ctx context.Context, header *types.Header, epoch uint64, account common.Address, keys []common.Hash) (*types.Header, []common.Hash, error) {
+			return light.GetDposEpoch(ctx, leth.odr, header, epoch, account, keys)
+		})
+	}
+
 	checkpoint := config.Checkpoint
 	if checkpoint == nil {
 		checkpoint = params.TrustedCheckpoints[genesisHash]
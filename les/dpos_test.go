@@ -0,0 +1,173 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/light"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// newDposTestChain seals a short DPOS chain with a single signer, delegated to
+// by a single delegator.
+func newDposTestChain(t *testing.T, blocks int) (*core.BlockChain, *dpos.Dpos) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	extra, err := dpos.EncodeGenesisExtra([]common.Address{signer}, map[common.Address][]dpos.ElectedDelegator{
+		signer: {{Delegator: bankAddr, Portion: uint32(dpos.PortionBase)}},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode genesis extra: %v", err)
+	}
+	config := *params.AllDposProtocolChanges
+	config.Dpos = &params.DposConfig{SlotInterval: 1, EpochInterval: 3}
+	genesis := &core.Genesis{Config: &config, ExtraData: extra, GasLimit: params.GenesisGasLimit, Difficulty: big.NewInt(1)}
+
+	db := rawdb.NewMemoryDatabase()
+	genesis.MustCommit(db)
+	engine := dpos.New(config.Dpos, db)
+	engine.Authorize(signer, nil)
+
+	chain, err := core.NewBlockChain(db, nil, &config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	for i := 0; i < blocks; i++ {
+		parent := chain.CurrentBlock()
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number(), common.Big1), GasLimit: parent.GasLimit()}
+		if err := engine.Prepare(chain, header); err != nil {
+			t.Fatalf("failed to prepare block #%d: %v", header.Number, err)
+		}
+		header.Time = parent.Time() + config.Dpos.SlotInterval
+
+		statedb, _ := chain.StateAt(parent.Root())
+		block, err := engine.FinalizeAndAssemble(chain, header, statedb, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to assemble block #%d: %v", header.Number, err)
+		}
+		header = block.Header()
+		sig, _ := crypto.Sign(dpos.SealHash(header).Bytes(), key)
+		copy(header.Extra[1:], sig)
+
+		if _, err := chain.InsertChain(types.Blocks{block.WithSeal(header)}); err != nil {
+			t.Fatalf("failed to insert block #%d: %v", header.Number, err)
+		}
+	}
+	return chain, engine
+}
+
+// Tests that DPOS epoch proofs served by a LES server pass the client side
+// validation, and that tampered responses are rejected.
+func TestDposProofs(t *testing.T) {
+	chain, engine := newDposTestChain(t, 5)
+	defer chain.Stop()
+
+	var (
+		h    = &serverHandler{blockchain: chain, server: &LesServer{}}
+		head = chain.CurrentHeader()
+		keys = []common.Hash{
+			crypto.Keccak256Hash([]byte("dpos.registry.candidates")),
+			crypto.Keccak256Hash([]byte("dpos.registry.delegators")),
+			common.HexToHash("0xdeadbeef"), // unset slot
+		}
+		epoch = chain.GetHeaderByNumber(3)
+	)
+	newRequest := func() *DposRequest {
+		return &DposRequest{Id: light.StateTrieID(head), Account: engine.SystemAddress(), Keys: keys, Epoch: 3, EpochHash: epoch.Hash()}
+	}
+	prove := func(req DposReq) DposResps {
+		nodes := light.NewNodeSet()
+		header, err := h.proveDposEpoch(req, nodes)
+		if err != nil {
+			t.Fatalf("failed to prove: %v", err)
+		}
+		return DposResps{Headers: []*types.Header{header}, Proofs: nodes.NodeList()}
+	}
+	resps := prove(DposReq{BHash: head.Hash(), Epoch: 3, Keys: keys})
+
+	// A valid response yields the epoch block and the slot values
+	r := newRequest()
+	if err := r.Validate(nil, &Msg{MsgType: MsgDposProofs, Obj: resps}); err != nil {
+		t.Fatalf("failed to validate proof: %v", err)
+	}
+	if r.Header.Hash() != epoch.Hash() {
+		t.Errorf("epoch block mismatch: have %x, want %x", r.Header.Hash(), epoch.Hash())
+	}
+	want := []common.Hash{common.BigToHash(common.Big1), common.BigToHash(common.Big1), {}}
+	for i := range want {
+		if r.Values[i] != want[i] {
+			t.Errorf("value %d mismatch: have %x, want %x", i, r.Values[i], want[i])
+		}
+	}
+	// Responses not matching the request are rejected
+	if err := newRequest().Validate(nil, &Msg{MsgType: MsgProofsV2, Obj: resps.Proofs}); err != errInvalidMessageType {
+		t.Errorf("wrong message type: have %v, want %v", err, errInvalidMessageType)
+	}
+	if err := newRequest().Validate(nil, &Msg{MsgType: MsgDposProofs, Obj: DposResps{Proofs: resps.Proofs}}); err != errInvalidEntryCount {
+		t.Errorf("missing epoch block: have %v, want %v", err, errInvalidEntryCount)
+	}
+	wrong := prove(DposReq{BHash: head.Hash(), Epoch: 0, Keys: keys})
+	if err := newRequest().Validate(nil, &Msg{MsgType: MsgDposProofs, Obj: DposResps{Headers: wrong.Headers, Proofs: resps.Proofs}}); err != errEpochHashMismatch {
+		t.Errorf("wrong epoch block: have %v, want %v", err, errEpochHashMismatch)
+	}
+	// Missing or superfluous proof nodes are rejected
+	if err := newRequest().Validate(nil, &Msg{MsgType: MsgDposProofs, Obj: DposResps{Headers: resps.Headers, Proofs: resps.Proofs[1:]}}); err == nil {
+		t.Errorf("incomplete proof accepted")
+	}
+	extra := prove(DposReq{BHash: chain.GetHeaderByNumber(4).Hash(), Epoch: 3, Keys: keys})
+	proofs := append(append(light.NodeList{}, resps.Proofs...), extra.Proofs...)
+	if err := newRequest().Validate(nil, &Msg{MsgType: MsgDposProofs, Obj: DposResps{Headers: resps.Headers, Proofs: proofs}}); err != errUselessNodes {
+		t.Errorf("superfluous proof: have %v, want %v", err, errUselessNodes)
+	}
+	// Invalid requests are refused by the server
+	for i, req := range []DposReq{
+		{BHash: common.HexToHash("0x01"), Epoch: 3},
+		{BHash: head.Hash(), Epoch: head.Number.Uint64() + 1},
+		{BHash: head.Hash(), Epoch: 3, Keys: make([]common.Hash, MaxDposProofKeys+1)},
+	} {
+		if _, err := h.proveDposEpoch(req, light.NewNodeSet()); err == nil {
+			t.Errorf("request %d: invalid request served", i)
+		}
+	}
+}
+
+// Tests that the DPOS proof messages live in their own protocol version, leaving
+// lpv4 as defined upstream.
+func TestDposProofsVersion(t *testing.T) {
+	if ProtocolLengths[lpv4] != 24 {
+		t.Errorf("lpv4 message count mismatch: have %d, want 24", ProtocolLengths[lpv4])
+	}
+	if GetDposProofsMsg < ProtocolLengths[lpv4] || DposProofsMsg >= ProtocolLengths[lpv5] {
+		t.Errorf("DPOS proof messages outside lpv5: %d, %d", GetDposProofsMsg, DposProofsMsg)
+	}
+	req := &DposRequest{Id: &light.TrieID{}}
+	if peer := newServerPeer(lpv4, NetworkId, false, p2p.NewPeer(enode.ID{}, "lpv4", nil), nil); req.CanSend(peer) {
+		t.Errorf("DPOS proofs requested from an lpv4 server")
+	}
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -43,6 +44,7 @@ var (
 	errCHTHashMismatch     = errors.New("cht hash mismatch")
 	errCHTNumberMismatch   = errors.New("cht number mismatch")
 	errUselessNodes        = errors.New("useless nodes in merkle proof nodeset")
+	errEpochHashMismatch   = errors.New("dpos epoch hash mismatch")
 )
 
 type LesOdrRequest interface {
@@ -68,6 +70,8 @@ func LesRequest(req light.OdrRequest) LesOdrRequest {
 		return (*BloomRequest)(r)
 	case *light.TxStatusRequest:
 		return (*TxStatusRequest)(r)
+	case *light.DposRequest:
+		return (*DposRequest)(r)
 	default:
 		return nil
 	}
@@ -515,6 +519,100 @@ func (r *TxStatusRequest) Validate(db ethdb.Database, msg *Msg) error {
 	return nil
 }
 
+type DposReq struct {
+	BHash common.Hash
+	Epoch uint64
+	Keys  []common.Hash
+}
+
+type DposResps struct { // describes all responses, not just a single one
+	Headers []*types.Header
+	Proofs  light.NodeList
+}
+
+// ODR request type for DPOS epoch blocks and system account storage, see LesOdrRequest interface
+type DposRequest light.DposRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *DposRequest) GetCost(peer *serverPeer) uint64 {
+	return peer.getRequestCost(GetDposProofsMsg, 1)
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *DposRequest) CanSend(peer *serverPeer) bool {
+	return peer.version >= lpv5 && peer.HasBlock(r.Id.BlockHash, r.Id.BlockNumber, true)
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *DposRequest) Request(reqID uint64, peer *serverPeer) error {
+	peer.Log().Debug("Requesting DPOS proof", "root", r.Id.Root, "epoch", r.Epoch, "keys", len(r.Keys))
+	req := DposReq{
+		BHash: r.Id.BlockHash,
+		Epoch: r.Epoch,
+		Keys:  r.Keys,
+	}
+	return peer.requestDposProofs(reqID, []DposReq{req})
+}
+
+// Valid processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+func (r *DposRequest) Validate(db ethdb.Database, msg *Msg) error {
+	log.Debug("Validating DPOS proof", "root", r.Id.Root, "epoch", r.Epoch, "keys", len(r.Keys))
+
+	if msg.MsgType != MsgDposProofs {
+		return errInvalidMessageType
+	}
+	resps := msg.Obj.(DposResps)
+	if len(resps.Headers) != 1 {
+		return errInvalidEntryCount
+	}
+	// The epoch block must be the one of the locally known header chain
+	header := resps.Headers[0]
+	if header == nil || header.Hash() != r.EpochHash || header.Number.Uint64() != r.Epoch {
+		return errEpochHashMismatch
+	}
+	// Verify the system account, then every requested storage slot
+	nodeSet := resps.Proofs.NodeSet()
+	reads := &readTraceDB{db: nodeSet}
+
+	blob, err := trie.VerifyProof(r.Id.Root, crypto.Keccak256(r.Account[:]), reads)
+	if err != nil {
+		return fmt.Errorf("merkle proof verification failed: %v", err)
+	}
+	values := make([]common.Hash, len(r.Keys))
+	if blob != nil {
+		var account state.Account
+		if err := rlp.DecodeBytes(blob, &account); err != nil {
+			return err
+		}
+		if account.Root != types.EmptyRootHash {
+			for i, key := range r.Keys {
+				value, err := trie.VerifyProof(account.Root, crypto.Keccak256(key[:]), reads)
+				if err != nil {
+					return fmt.Errorf("merkle proof verification failed: %v", err)
+				}
+				if value != nil {
+					_, content, _, err := rlp.Split(value)
+					if err != nil {
+						return err
+					}
+					values[i] = common.BytesToHash(content)
+				}
+			}
+		}
+	}
+	// check if all nodes have been read by VerifyProof
+	if len(reads.reads) != nodeSet.KeyCount() {
+		return errUselessNodes
+	}
+	r.Header = header
+	r.Values = values
+	r.Proof = nodeSet
+	return nil
+}
+
 // readTraceDB stores the keys of database reads. We use this to check that received node
 // sets contain only the trie nodes necessary to make proofs pass.
 type readTraceDB struct {
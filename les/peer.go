@@ -460,6 +460,13 @@ func (p *serverPeer) requestProofs(reqID uint64, reqs []ProofReq) error {
 	return p.sendRequest(GetProofsV2Msg, reqID, reqs, len(reqs))
 }
 
+// requestDposProofs fetches a batch of DPOS epoch blocks and system account
+// storage proofs from a remote node.
+func (p *serverPeer) requestDposProofs(reqID uint64, reqs []DposReq) error {
+	p.Log().Debug("Fetching batch of DPOS proofs", "count", len(reqs))
+	return p.sendRequest(GetDposProofsMsg, reqID, reqs, len(reqs))
+}
+
 // requestHelperTrieProofs fetches a batch of HelperTrie merkle proofs from a remote node.
 func (p *serverPeer) requestHelperTrieProofs(reqID uint64, reqs []HelperTrieReq) error {
 	p.Log().Debug("Fetching batch of HelperTrie proofs", "count", len(reqs))
@@ -645,6 +652,10 @@ func (p *serverPeer) Handshake(genesis common.Hash, forkid forkid.ID, forkFilter
 
 		if !p.onlyAnnounce {
 			for msgCode := range reqAvgTimeCost {
+				// Requests introduced by later protocol versions are not expected
+				if msgCode >= ProtocolLengths[uint(p.version)] {
+					continue
+				}
 				if p.fcCosts[msgCode] == nil {
 					return errResp(ErrUselessPeer, "peer does not support message %d", msgCode)
 				}
@@ -886,6 +897,12 @@ func (p *clientPeer) replyProofsV2(reqID uint64, proofs light.NodeList) *reply {
 	return &reply{p.rw, ProofsV2Msg, reqID, data}
 }
 
+// replyDposProofs creates a reply with a batch of DPOS epoch blocks and proofs, corresponding to the ones requested.
+func (p *clientPeer) replyDposProofs(reqID uint64, resp DposResps) *reply {
+	data, _ := rlp.EncodeToBytes(resp)
+	return &reply{p.rw, DposProofsMsg, reqID, data}
+}
+
 // replyHelperTrieProofs creates a reply with a batch of HelperTrie proofs, corresponding to the ones requested.
 func (p *clientPeer) replyHelperTrieProofs(reqID uint64, resp HelperTrieResps) *reply {
 	data, _ := rlp.EncodeToBytes(resp)
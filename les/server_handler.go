@@ -21,17 +21,20 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/forkid"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	lps "github.com/ethereum/go-ethereum/les/lespay/server"
 	"github.com/ethereum/go-ethereum/light"
@@ -57,6 +60,8 @@ const (
 	MaxHelperTrieProofsFetch = 64  // Amount of helper tries to be fetched per retrieval request
 	MaxTxSend                = 64  // Amount of transactions to be send per request
 	MaxTxStatus              = 256 // Amount of transactions to queried per request
+	MaxDposProofsFetch       = 16  // Amount of DPOS epoch proofs to be fetched per retrieval request
+	MaxDposProofKeys         = 256 // Amount of DPOS storage slots to be proven per epoch proof
 )
 
 var (
@@ -697,6 +702,55 @@ func (h *serverHandler) handleMsg(p *clientPeer, wg *sync.WaitGroup) error {
 			}()
 		}
 
+	case GetDposProofsMsg:
+		p.Log().Trace("Received DPOS proofs request")
+		if metrics.EnabledExpensive {
+			miscInDposProofPacketsMeter.Mark(1)
+			miscInDposProofTrafficMeter.Mark(int64(msg.Size))
+		}
+		var req struct {
+			ReqID uint64
+			Reqs  []DposReq
+		}
+		if err := msg.Decode(&req); err != nil {
+			clientErrorMeter.Mark(1)
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		reqCnt := len(req.Reqs)
+		if accept(req.ReqID, uint64(reqCnt), MaxDposProofsFetch) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var (
+					nodes   = light.NewNodeSet()
+					headers []*types.Header
+				)
+				for i, request := range req.Reqs {
+					if i != 0 && !task.waitOrStop() {
+						sendResponse(req.ReqID, 0, nil, task.servingTime)
+						return
+					}
+					header, err := h.proveDposEpoch(request, nodes)
+					if err != nil {
+						p.Log().Debug("Failed to prove DPOS epoch", "hash", request.BHash, "epoch", request.Epoch, "err", err)
+						p.bumpInvalid()
+						continue
+					}
+					headers = append(headers, header)
+					if nodes.DataSize() >= softResponseLimit {
+						break
+					}
+				}
+				reply := p.replyDposProofs(req.ReqID, DposResps{Headers: headers, Proofs: nodes.NodeList()})
+				sendResponse(req.ReqID, uint64(reqCnt), reply, task.done())
+				if metrics.EnabledExpensive {
+					miscOutDposProofPacketsMeter.Mark(1)
+					miscOutDposProofTrafficMeter.Mark(int64(reply.size()))
+					miscServingTimeDposProofTimer.Update(time.Duration(task.servingTime))
+				}
+			}()
+		}
+
 	case GetHelperTrieProofsMsg:
 		p.Log().Trace("Received helper trie proof request")
 		if metrics.EnabledExpensive {
@@ -889,6 +943,67 @@ func (h *serverHandler) getAccount(triedb *trie.Database, root, hash common.Hash
 	return account, nil
 }
 
+// proveDposEpoch retrieves the DPOS epoch block requested and proves the
+// requested storage slots of the DPOS system account against the state of
+// the trusted block.
+func (h *serverHandler) proveDposEpoch(req DposReq, nodes *light.NodeSet) (*types.Header, error) {
+	engine, ok := h.blockchain.Engine().(*dpos.Dpos)
+	if !ok {
+		return nil, errors.New("not a dpos chain")
+	}
+	if len(req.Keys) > MaxDposProofKeys {
+		return nil, fmt.Errorf("too many keys: %d", len(req.Keys))
+	}
+	header := h.blockchain.GetHeaderByHash(req.BHash)
+	if header == nil {
+		return nil, errors.New("unknown block")
+	}
+	number := header.Number.Uint64()
+	if req.Epoch > number {
+		return nil, fmt.Errorf("epoch %d after block %d", req.Epoch, number)
+	}
+	// Refuse to search stale state data in the database since looking for
+	// a non-exist key is kind of expensive.
+	local := h.blockchain.CurrentHeader().Number.Uint64()
+	if !h.server.archiveMode && number+core.TriesInMemory <= local {
+		return nil, fmt.Errorf("stale state of block %d, head %d", number, local)
+	}
+	// The epoch block is looked up along the requested block, which might
+	// not be canonical on this server
+	maxNonCanonical := uint64(100)
+	hash, _ := h.blockchain.GetAncestor(req.BHash, number, number-req.Epoch, &maxNonCanonical)
+	epoch := h.blockchain.GetHeader(hash, req.Epoch)
+	if epoch == nil {
+		return nil, fmt.Errorf("unknown epoch block %d", req.Epoch)
+	}
+	// Prove the system account, then the slots from its storage trie
+	var (
+		statedb = h.blockchain.StateCache()
+		accKey  = crypto.Keccak256Hash(engine.SystemAddress().Bytes())
+	)
+	accTrie, err := statedb.OpenTrie(header.Root)
+	if err != nil {
+		return nil, err
+	}
+	if err := accTrie.Prove(accKey[:], 0, nodes); err != nil {
+		return nil, err
+	}
+	account, err := h.getAccount(statedb.TrieDB(), header.Root, accKey)
+	if err != nil {
+		return nil, err
+	}
+	storageTrie, err := statedb.OpenStorageTrie(accKey, account.Root)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range req.Keys {
+		if err := storageTrie.Prove(crypto.Keccak256(key[:]), 0, nodes); err != nil {
+			return nil, err
+		}
+	}
+	return epoch, nil
+}
+
 // getHelperTrie returns the post-processed trie root for the given trie ID and section index
 func (h *serverHandler) getHelperTrie(typ uint, index uint64) (common.Hash, string) {
 	switch typ {
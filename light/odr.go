@@ -190,3 +190,22 @@ type TxStatusRequest struct {
 
 // StoreResult stores the retrieved data in local database
 func (req *TxStatusRequest) StoreResult(db ethdb.Database) {}
+
+// DposRequest is the ODR request type for retrieving the DPOS epoch block of a
+// header along with storage slots of the DPOS system account, proven against
+// the state of the header
+type DposRequest struct {
+	Id        *TrieID        // state trie of the trusted header
+	Account   common.Address // DPOS system account
+	Keys      []common.Hash  // storage slots of the system account
+	Epoch     uint64         // number of the epoch block
+	EpochHash common.Hash    // hash of the epoch block, known from the header chain
+	Header    *types.Header  // retrieved epoch block
+	Values    []common.Hash  // retrieved storage values, zero if unset
+	Proof     *NodeSet
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *DposRequest) StoreResult(db ethdb.Database) {
+	req.Proof.Store(db)
+}
@@ -287,3 +287,22 @@ func GetTransaction(ctx context.Context, odr OdrBackend, txHash common.Hash) (*t
 	}
 	return body.Transactions[pos.Index], pos.BlockHash, pos.BlockIndex, pos.Index, nil
 }
+
+// GetDposEpoch retrieves the canonical DPOS epoch block numbered epoch and the
+// given storage slots of the DPOS system account in the state of header.
+func GetDposEpoch(ctx context.Context, odr OdrBackend, header *types.Header, epoch uint64, account common.Address, keys []common.Hash) (*types.Header, []common.Hash, error) {
+	if epoch > header.Number.Uint64() {
+		return nil, nil, errNonCanonicalHash
+	}
+	// The epoch block is verified against the canonical hash, which is either
+	// stored locally or proven by the CHT
+	hash, err := GetCanonicalHash(ctx, odr, epoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &DposRequest{Id: StateTrieID(header), Account: account, Keys: keys, Epoch: epoch, EpochHash: hash}
+	if err := odr.Retrieve(ctx, r); err != nil {
+		return nil, nil, err
+	}
+	return r.Header, r.Values, nil
+}
@@ -300,6 +300,15 @@ func (w *worker) isRunning() bool {
 	return atomic.LoadInt32(&w.running) == 1
 }
 
+// isInstantSealing returns whether the engine only seals blocks when new
+// transactions arrive, i.e. a zero period clique or zero slot dpos chain.
+func (w *worker) isInstantSealing() bool {
+	if engine, ok := w.engine.(consensus.InstantSealer); ok {
+		return engine.InstantSealing(w.chain, w.chain.CurrentHeader())
+	}
+	return w.chainConfig.Clique != nil && w.chainConfig.Clique.Period == 0
+}
+
 // close terminates all background threads maintained by the worker.
 // Note the worker does not support being closed multiple times.
 func (w *worker) close() {
@@ -382,10 +391,10 @@ func (w *worker) newWorkLoop(recommit time.Duration) {
 			if w.isRunning() {
 				
 				/*
-				如果不是clique引擎或clique.period > 0 (不是dev模式） 和发现新tx,那就调用commit
+				如果不是即时出块(clique.period或dpos.slotInterval为0的dev模式） 和发现新tx,那就调用commit
 				注意, period >0 clique是可以接受空tx
 				*/
-				if w.chainConfig.Clique == nil || w.chainConfig.Clique.Period > 0 {
+				if !w.isInstantSealing() {
 					// Short circuit if no new transaction arrives.
 					if atomic.LoadInt32(&w.newTxs) == 0 {
 						timer.Reset(recommit)
@@ -518,11 +527,11 @@ func (w *worker) mainLoop() {
 				// by clique. Of course the advance sealing(empty submission) is disabled.
 				
 				/*
-				当通道<-w.txsCh收到新tx, 当下共识设置又是0 period clique (dev模式)，那么调用w.commitNewWork(...)开启挖矿。
+				当通道<-w.txsCh收到新tx, 当下共识设置又是0 period clique或0 slot dpos (dev模式)，那么调用w.commitNewWork(...)开启挖矿。
 				
-				注意, period 0 clique是不接受空tx, clique.Seal() @ consensus/clique/clique.go里会做检查
+				注意, 即时出块是不接受空tx, clique.Seal() @ consensus/clique/clique.go和dpos.Seal() @ consensus/dpos/dpos.go里会做检查
 				*/
-				if w.chainConfig.Clique != nil && w.chainConfig.Clique.Period == 0 {
+				if w.isInstantSealing() {
 					w.commitNewWork(nil, true, time.Now().Unix())
 				}
 			}
@@ -633,6 +642,12 @@ func (w *worker) resultLoop() {
 				}
 				logs = append(logs, receipt.Logs...)
 			}
+			if emitter, ok := w.engine.(consensus.ReceiptEmitter); ok {
+				if receipt := emitter.SystemReceipt(block.Header(), receipts); receipt != nil {
+					receipts = append(receipts, receipt)
+					logs = append(logs, receipt.Logs...)
+				}
+			}
 			// Commit block and state to database.
 			_, err := w.chain.WriteBlockWithState(block, receipts, logs, task.state, true)
 			if err != nil {
@@ -20,6 +20,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math/big"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -262,7 +263,7 @@ var (
 	
 	
 	//测试用途
-	AllDposProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, nil, nil, nil, nil, &DposConfig{SlotInterval: 10, EpochInterval: 86400}}
+	AllDposProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, nil, nil, nil, nil, &DposConfig{SlotInterval: 10, EpochInterval: 86400, RandaoBlock: big.NewInt(0), ScheduleBlock: big.NewInt(0)}}
 	
 	TestChainConfig = &ChainConfig{big.NewInt(1), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, nil, nil, new(EthashConfig), nil,nil}
 	TestRules       = TestChainConfig.Rules(new(big.Int))
@@ -370,7 +371,137 @@ func (c *CliqueConfig) String() string {
 // DposConfig is the consensus engine configs for DPOS based sealing.
 type DposConfig struct {
 	SlotInterval uint64 `json:"slotInterval"`   //也叫slot,是区块与区块之间的时间差
+	SystemAddress common.Address `json:"systemAddress,omitempty"` //dpos系统合约地址，action tx发送到这里，也是抵押金的托管账户
 	EpochInterval  uint64 `json:"epochInterval"`  //Epoch是时代差，一个时代等于默认86400秒，每个新时代将重选出块人组合
+	UnbondingEpochs uint64 `json:"unbondingEpochs,omitempty"` //解押等待期，unstake后要等多少个epoch才退回抵押金
+	SlashPercent uint64 `json:"slashPercent,omitempty"` //双签被举报后，罚没抵押金的百分比
+	JailEpochs uint64 `json:"jailEpochs,omitempty"` //出块不达标的签名者被关多少个epoch后才可以unjail
+	SignerReward uint64 `json:"signerReward,omitempty"` //签名者分得的区块奖励%, 余下的分给委托人
+	MaxSigners uint64 `json:"maxSigners,omitempty"` //每个epoch最多选出多少个签名者
+	WiggleTime uint64 `json:"wiggleTime,omitempty"` //轮不到出块时多等待的时间单位(毫秒)
+	BlockReward *big.Int `json:"blockReward,omitempty"` //每块的奖励, 没有设置则按Frontier/Byzantium/Constantinople的奖励
+	Forks []DposFork `json:"forks,omitempty"` //按块高度排定的参数变更，像ChainConfig的硬分叉
+	RandaoBlock *big.Int `json:"randaoBlock,omitempty"` //从这个块高度起EVM的DIFFICULTY指令返回RANDAO mix, 没有设置则仍是难度
+	ScheduleBlock *big.Int `json:"scheduleBlock,omitempty"` //从这个块高度起时间截对齐slot, 按slot轮流出块, 签名者按epoch区块记录的种子洗牌; 没有设置则按块高度轮流, 签名者按地址排序
+}
+
+// IsRandao returns whether num is either equal to the RANDAO fork block or greater,
+// from which on the DIFFICULTY opcode returns the RANDAO mix.
+func (c *DposConfig) IsRandao(num *big.Int) bool {
+	return isForked(c.RandaoBlock, num)
+}
+
+// IsSchedule returns whether num is either equal to the schedule fork block or
+// greater, from which on blocks are sealed in turn by slot.
+func (c *DposConfig) IsSchedule(num *big.Int) bool {
+	return isForked(c.ScheduleBlock, num)
+}
+
+// DposFork schedules a change of the DPOS economic parameters from the given
+// block on. Unset fields keep their previous values.
+type DposFork struct {
+	Block        *big.Int `json:"block"`
+	SignerReward *uint64  `json:"signerReward,omitempty"`
+	MaxSigners   *uint64  `json:"maxSigners,omitempty"`
+	WiggleTime   *uint64  `json:"wiggleTime,omitempty"`
+	BlockReward  *big.Int `json:"blockReward,omitempty"`
+}
+
+// DposRules are the DPOS economic parameters in effect at a given block.
+type DposRules struct {
+	SignerReward uint64   // Percentage of the block reward paid to the signer
+	MaxSigners   uint64   // Maximum number of signers elected for an epoch
+	WiggleTime   uint64   // Out-of-turn sealing delay unit in milliseconds
+	BlockReward  *big.Int // Block reward, nil means the default reward schedule
+}
+
+// Rules returns the DPOS economic parameters in effect at the given block,
+// applying every fork scheduled at or before it.
+func (c *DposConfig) Rules(num uint64) DposRules {
+	rules := DposRules{
+		SignerReward: c.SignerReward,
+		MaxSigners:   c.MaxSigners,
+		WiggleTime:   c.WiggleTime,
+		BlockReward:  c.BlockReward,
+	}
+	for _, fork := range c.Forks {
+		if !isForked(fork.Block, new(big.Int).SetUint64(num)) {
+			break
+		}
+		if fork.SignerReward != nil {
+			rules.SignerReward = *fork.SignerReward
+		}
+		if fork.MaxSigners != nil {
+			rules.MaxSigners = *fork.MaxSigners
+		}
+		if fork.WiggleTime != nil {
+			rules.WiggleTime = *fork.WiggleTime
+		}
+		if fork.BlockReward != nil {
+			rules.BlockReward = fork.BlockReward
+		}
+	}
+	return rules
+}
+
+// CheckForkOrder checks that the DPOS forks are scheduled in strictly ascending
+// block order and that every scheduled value is usable.
+func (c *DposConfig) CheckForkOrder() error {
+	if c.SignerReward > 100 {
+		return fmt.Errorf("invalid dpos signerReward %d, must be at most 100", c.SignerReward)
+	}
+	for i, fork := range c.Forks {
+		if fork.Block == nil {
+			return fmt.Errorf("dpos fork %d has no block number", i)
+		}
+		if i > 0 && c.Forks[i-1].Block.Cmp(fork.Block) >= 0 {
+			return fmt.Errorf("unsupported dpos fork ordering: fork at %v scheduled after fork at %v", fork.Block, c.Forks[i-1].Block)
+		}
+		if fork.SignerReward != nil && *fork.SignerReward > 100 {
+			return fmt.Errorf("invalid dpos signerReward %d at block %v, must be at most 100", *fork.SignerReward, fork.Block)
+		}
+		if fork.MaxSigners != nil && *fork.MaxSigners == 0 {
+			return fmt.Errorf("invalid dpos maxSigners 0 at block %v", fork.Block)
+		}
+		if fork.BlockReward != nil && fork.BlockReward.Sign() < 0 {
+			return fmt.Errorf("invalid dpos blockReward %v at block %v", fork.BlockReward, fork.Block)
+		}
+	}
+	return nil
+}
+
+// checkCompatible returns an error if the DPOS parameters in effect up to the
+// given head differ between the two configs.
+func (c *DposConfig) checkCompatible(newcfg *DposConfig, head *big.Int) *ConfigCompatError {
+	if isForkIncompatible(c.RandaoBlock, newcfg.RandaoBlock, head) {
+		return newCompatError("DPOS RANDAO fork block", c.RandaoBlock, newcfg.RandaoBlock)
+	}
+	if isForkIncompatible(c.ScheduleBlock, newcfg.ScheduleBlock, head) {
+		return newCompatError("DPOS schedule fork block", c.ScheduleBlock, newcfg.ScheduleBlock)
+	}
+	blocks := []*big.Int{common.Big0}
+	for _, fork := range c.Forks {
+		blocks = append(blocks, fork.Block)
+	}
+	for _, fork := range newcfg.Forks {
+		blocks = append(blocks, fork.Block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Cmp(blocks[j]) < 0 })
+
+	for _, block := range blocks {
+		if !isForked(block, head) {
+			break
+		}
+		if !c.Rules(block.Uint64()).equal(newcfg.Rules(block.Uint64())) {
+			return newCompatError("DPOS parameters", block, block)
+		}
+	}
+	return nil
+}
+
+func (r DposRules) equal(other DposRules) bool {
+	return r.SignerReward == other.SignerReward && r.MaxSigners == other.MaxSigners &&
+		r.WiggleTime == other.WiggleTime && configNumEqual(r.BlockReward, other.BlockReward)
 }
 
 // String implements the stringer interface, returning the consensus engine details.
@@ -530,6 +661,9 @@ func (c *ChainConfig) CheckConfigForkOrder() error {
 			lastFork = cur
 		}
 	}
+	if c.Dpos != nil {
+		return c.Dpos.CheckForkOrder()
+	}
 	return nil
 }
 
@@ -580,6 +714,11 @@ func (c *ChainConfig) checkCompatible(newcfg *ChainConfig, head *big.Int) *Confi
 	if isForkIncompatible(c.EWASMBlock, newcfg.EWASMBlock, head) {
 		return newCompatError("ewasm fork block", c.EWASMBlock, newcfg.EWASMBlock)
 	}
+	if c.Dpos != nil && newcfg.Dpos != nil {
+		if err := c.Dpos.checkCompatible(newcfg.Dpos, head); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
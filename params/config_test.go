@@ -96,3 +96,71 @@ func TestCheckCompatible(t *testing.T) {
 		}
 	}
 }
+
+func TestDposRules(t *testing.T) {
+	var (
+		ten   = uint64(10)
+		three = uint64(3)
+	)
+	config := &DposConfig{
+		SignerReward: 50,
+		MaxSigners:   21,
+		WiggleTime:   500,
+		Forks: []DposFork{
+			{Block: big.NewInt(100), SignerReward: &ten},
+			{Block: big.NewInt(200), MaxSigners: &three, BlockReward: big.NewInt(1)},
+		},
+	}
+	if err := config.CheckForkOrder(); err != nil {
+		t.Fatalf("valid forks rejected: %v", err)
+	}
+	tests := []struct {
+		num  uint64
+		want DposRules
+	}{
+		{0, DposRules{SignerReward: 50, MaxSigners: 21, WiggleTime: 500}},
+		{99, DposRules{SignerReward: 50, MaxSigners: 21, WiggleTime: 500}},
+		{100, DposRules{SignerReward: 10, MaxSigners: 21, WiggleTime: 500}},
+		{200, DposRules{SignerReward: 10, MaxSigners: 3, WiggleTime: 500, BlockReward: big.NewInt(1)}},
+	}
+	for _, test := range tests {
+		if have := config.Rules(test.num); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("block %d: rules mismatch: have %+v, want %+v", test.num, have, test.want)
+		}
+	}
+
+	unordered := &DposConfig{Forks: []DposFork{{Block: big.NewInt(200)}, {Block: big.NewInt(100)}}}
+	if err := unordered.CheckForkOrder(); err == nil {
+		t.Errorf("unordered forks accepted")
+	}
+
+	// Rescheduling a fork which already passed needs a rewind
+	moved := &DposConfig{SignerReward: 50, MaxSigners: 21, WiggleTime: 500, Forks: []DposFork{{Block: big.NewInt(150), SignerReward: &ten}}}
+	stored := &ChainConfig{Dpos: config}
+	if err := stored.CheckCompatible(&ChainConfig{Dpos: moved}, 120); err == nil || err.RewindTo != 99 {
+		t.Errorf("moved fork compatibility mismatch: %v", err)
+	}
+	if err := stored.CheckCompatible(&ChainConfig{Dpos: moved}, 99); err != nil {
+		t.Errorf("future fork change rejected: %v", err)
+	}
+
+	// Scheduling the RANDAO fork below the head needs a rewind as well
+	randao := *config
+	randao.RandaoBlock = big.NewInt(50)
+	if !randao.IsRandao(big.NewInt(50)) || randao.IsRandao(big.NewInt(49)) || config.IsRandao(big.NewInt(1000)) {
+		t.Errorf("randao fork activation mismatch")
+	}
+	if err := stored.CheckCompatible(&ChainConfig{Dpos: &randao}, 120); err == nil || err.RewindTo != 49 {
+		t.Errorf("randao fork compatibility mismatch: %v", err)
+	}
+
+	// So does scheduling the slot fork below the head
+	scheduled := *config
+	scheduled.ScheduleBlock = big.NewInt(60)
+	if !scheduled.IsSchedule(big.NewInt(60)) || scheduled.IsSchedule(big.NewInt(59)) || config.IsSchedule(big.NewInt(1000)) {
+		t.Errorf("schedule fork activation mismatch")
+	}
+	if err := stored.CheckCompatible(&ChainConfig{Dpos: &scheduled}, 120); err == nil || err.RewindTo != 59 {
+		t.Errorf("schedule fork compatibility mismatch: %v", err)
+	}
+}
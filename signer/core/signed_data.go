@@ -63,6 +63,10 @@ var (
 		accounts.MimetypeDpos,
 		0x03,
 	}
+	ApplicationDposPrecommit = SigFormat{
+		accounts.MimetypeDposPrecommit,
+		0x04,
+	}
 	TextPlain = SigFormat{
 		accounts.MimetypeTextPlain,
 		0x45,
@@ -263,6 +267,58 @@ func (api *SignerAPI) determineSignatureFormat(ctx context.Context, contentType
 		// Clique uses V on the form 0 or 1
 		useEthereumV = false
 		req = &SignDataRequest{ContentType: mediaType, Rawdata: cliqueRlp, Messages: messages, Hash: sighash}
+	case ApplicationDpos.Mime:
+		// Dpos headers are sent with the complete extradata and an empty signature
+		stringData, ok := data.(string)
+		if !ok {
+			return nil, useEthereumV, fmt.Errorf("input for %v must be an hex-encoded string", ApplicationDpos.Mime)
+		}
+		dposData, err := hexutil.Decode(stringData)
+		if err != nil {
+			return nil, useEthereumV, err
+		}
+		header := &types.Header{}
+		if err := rlp.DecodeBytes(dposData, header); err != nil {
+			return nil, useEthereumV, err
+		}
+		sighash, dposRlp, err := dposHeaderHashAndRlp(header)
+		if err != nil {
+			return nil, useEthereumV, err
+		}
+		messages := []*NameValueType{
+			{
+				Name:  "Dpos header",
+				Typ:   "dpos",
+				Value: fmt.Sprintf("dpos header %d [0x%x]", header.Number, header.Hash()),
+			},
+		}
+		// Dpos uses V on the form 0 or 1
+		useEthereumV = false
+		req = &SignDataRequest{ContentType: mediaType, Rawdata: dposRlp, Messages: messages, Hash: sighash}
+	case ApplicationDposPrecommit.Mime:
+		// Dpos precommit votes are sent as the exact data to sign
+		stringData, ok := data.(string)
+		if !ok {
+			return nil, useEthereumV, fmt.Errorf("input for %v must be an hex-encoded string", ApplicationDposPrecommit.Mime)
+		}
+		voteData, err := hexutil.Decode(stringData)
+		if err != nil {
+			return nil, useEthereumV, err
+		}
+		number, hash, err := dpos.DecodePrecommitData(voteData)
+		if err != nil {
+			return nil, useEthereumV, err
+		}
+		messages := []*NameValueType{
+			{
+				Name:  "Dpos precommit vote",
+				Typ:   "dpos",
+				Value: fmt.Sprintf("dpos precommit vote for block %d [0x%x]", number, hash),
+			},
+		}
+		// Dpos uses V on the form 0 or 1
+		useEthereumV = false
+		req = &SignDataRequest{ContentType: mediaType, Rawdata: voteData, Messages: messages, Hash: crypto.Keccak256(voteData)}
 	default: // also case TextPlain.Mime:
 		// Calculates an Ethereum ECDSA signature for:
 		// hash = keccak256("\x19${byteVersion}Ethereum Signed Message:\n${message length}${message}")
@@ -315,9 +371,12 @@ func cliqueHeaderHashAndRlp(header *types.Header) (hash, rlp []byte, err error)
 	return hash, rlp, err
 }
 
+// dposHeaderHashAndRlp returns the hash which is used as input for the dpos
+// signing. The extradata is validated first, so a malformed header is refused
+// instead of being signed.
 func dposHeaderHashAndRlp(header *types.Header) (hash, rlp []byte, err error) {
-	if len(header.Extra) < 65 {
-		err = fmt.Errorf("dpos header extradata too short, %d < 65", len(header.Extra))
+	if err = new(dpos.EpochExtra).Decode(header.Extra); err != nil {
+		err = fmt.Errorf("invalid dpos header extradata: %v", err)
 		return
 	}
 	rlp = dpos.RLP(header)
@@ -22,6 +22,8 @@ import (
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 func TestBytesPadding(t *testing.T) {
@@ -143,3 +145,25 @@ func TestParseInteger(t *testing.T) {
 		}
 	}
 }
+
+func TestDposHeaderHashAndRlp(t *testing.T) {
+	extra, err := new(dpos.EpochExtra).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(1), Extra: extra}
+	hash, _, err := dposHeaderHashAndRlp(header)
+	if err != nil {
+		t.Fatalf("valid header refused: %v", err)
+	}
+	if !bytes.Equal(hash, dpos.SealHash(header).Bytes()) {
+		t.Errorf("hash mismatch: have %x, want %x", hash, dpos.SealHash(header))
+	}
+	// Truncated or unversioned extradata must be refused, not signed
+	for _, extra := range [][]byte{nil, extra[:len(extra)-1], append([]byte{0x00}, extra[1:]...), append(extra, 0x01)} {
+		header.Extra = extra
+		if _, _, err := dposHeaderHashAndRlp(header); err == nil {
+			t.Errorf("malformed extradata %x accepted", extra)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package dpos
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/consensus/dpos"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Fuzz feeds arbitrary extra-data into the DPOS header codec. Decoding must
+// never panic, and anything that decodes must encode back to the same bytes.
+func Fuzz(input []byte) int {
+	// Sealing hashes are computed over headers straight off the network
+	dpos.SealHash(&types.Header{Number: big.NewInt(1), Extra: input})
+
+	extra := new(dpos.EpochExtra)
+	if err := extra.Decode(input); err != nil {
+		return 0
+	}
+	output, err := extra.Encode()
+	if err != nil {
+		panic(fmt.Sprintf("decoded extra-data failed to encode: %v", err))
+	}
+	if !bytes.Equal(input, output) {
+		panic(fmt.Sprintf("decode-encode is not equal, \ninput : %x\noutput: %x", input, output))
+	}
+	return 1
+}